@@ -0,0 +1,355 @@
+// Package bench drives concurrent streams through a socks5 local to an
+// in-process sink and reports throughput, latency percentiles and the
+// runtime metrics of the local, it backs `detour bench`.
+package bench
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/observerss/detour2/common"
+	"github.com/observerss/detour2/detourtest"
+	"github.com/observerss/detour2/local"
+)
+
+const (
+	IN_PROCESS   = "in-process"
+	DIAL_TIMEOUT = 5 * time.Second
+	IO_TIMEOUT   = 30 * time.Second
+	MAX_ERRORS   = 20 // distinct error messages kept in a report
+)
+
+type Config struct {
+	Proxy      string // socks5 address of a running local, empty builds an in-process chain
+	Relays     int    // relays of the in-process chain
+	Compress   string // codecs of the in-process chain
+	MetricsURL string // base url of the metrics of Proxy, e.g. http://127.0.0.1:3910
+	SinkListen string // address the sink listens on
+	SinkAddr   string // address the exit dials to reach the sink, defaults to the listen address
+	Streams    int
+	Upload     int // bytes sent per round trip
+	Download   int // bytes answered per round trip
+	RoundTrips int // per stream before it is reopened, 0 keeps streams open till the end
+	Duration   time.Duration
+}
+
+// Latency percentiles are in milliseconds.
+type Latency struct {
+	Count int     `json:"count"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P99   float64 `json:"p99"`
+	Max   float64 `json:"max"`
+}
+
+// RuntimeDelta is how much counters of the local RuntimeMetrics grew during
+// the run.
+type RuntimeDelta struct {
+	ConnectFailuresTotal   int64 `json:"connectFailuresTotal"`
+	QueueFullTotal         int64 `json:"queueFullTotal"`
+	QueueTimeoutsTotal     int64 `json:"queueTimeoutsTotal"`
+	WebSocketConnectsTotal int64 `json:"webSocketConnectsTotal"`
+	WebSocketReadErrors    int64 `json:"webSocketReadErrors"`
+	WebSocketWriteErrors   int64 `json:"webSocketWriteErrors"`
+}
+
+type Report struct {
+	StartedAt        time.Time        `json:"startedAt"`
+	Proxy            string           `json:"proxy"`
+	Relays           int              `json:"relays,omitempty"`
+	Streams          int              `json:"streams"`
+	Upload           int              `json:"upload"`
+	Download         int              `json:"download"`
+	RoundTrips       int              `json:"roundTrips"`
+	DurationSeconds  float64          `json:"durationSeconds"`
+	StreamsOpened    int64            `json:"streamsOpened"`
+	ConnectFailures  int64            `json:"connectFailures"`
+	StreamErrors     int64            `json:"streamErrors"`
+	RoundTripsTotal  int64            `json:"roundTripsTotal"`
+	BytesUp          int64            `json:"bytesUp"`
+	BytesDown        int64            `json:"bytesDown"`
+	UpBytesPerSec    float64          `json:"upBytesPerSec"`
+	DownBytesPerSec  float64          `json:"downBytesPerSec"`
+	ConnectLatency   Latency          `json:"connectLatency"`
+	RoundTripLatency Latency          `json:"roundTripLatency"`
+	Errors           map[string]int64 `json:"errors,omitempty"`
+	Runtime          *RuntimeDelta    `json:"runtime,omitempty"` // missing without metrics
+}
+
+type run struct {
+	conf      Config
+	proxy     string
+	target    string
+	deadline  time.Time
+	opened    atomic.Int64
+	failures  atomic.Int64
+	broken    atomic.Int64
+	trips     atomic.Int64
+	bytesUp   atomic.Int64
+	bytesDown atomic.Int64
+	lock      sync.Mutex
+	connects  []time.Duration
+	rtts      []time.Duration
+	errors    map[string]int64
+}
+
+// Run benches for conf.Duration, or until ctx is done.
+func Run(ctx context.Context, conf Config) (*Report, error) {
+	if conf.Streams < 1 {
+		conf.Streams = 1
+	}
+	if conf.Duration <= 0 {
+		conf.Duration = 10 * time.Second
+	}
+	if conf.SinkListen == "" {
+		conf.SinkListen = "127.0.0.1:0"
+	}
+	sink, err := StartSink(conf.SinkListen)
+	if err != nil {
+		return nil, err
+	}
+	defer sink.Close()
+
+	r := &run{conf: conf, proxy: conf.Proxy, target: conf.SinkAddr, errors: map[string]int64{}}
+	if r.target == "" {
+		r.target = sink.Addr()
+	}
+	report := &Report{
+		Proxy:      conf.Proxy,
+		Streams:    conf.Streams,
+		Upload:     conf.Upload,
+		Download:   conf.Download,
+		RoundTrips: conf.RoundTrips,
+	}
+	var metrics func() (common.RuntimeMetricsSnapshot, error)
+	if conf.Proxy == "" {
+		chain, err := detourtest.NewChain(detourtest.ChainConfig{Relays: conf.Relays, Compress: conf.Compress})
+		if err != nil {
+			return nil, err
+		}
+		defer chain.Close()
+		r.proxy = chain.ProxyAddr
+		report.Proxy, report.Relays = IN_PROCESS, conf.Relays
+		metrics = func() (common.RuntimeMetricsSnapshot, error) { return chain.Local.Metrics.Snapshot(), nil }
+	} else if conf.MetricsURL != "" {
+		metrics = func() (common.RuntimeMetricsSnapshot, error) { return fetchRuntime(ctx, conf.MetricsURL) }
+	}
+
+	var before common.RuntimeMetricsSnapshot
+	if metrics != nil {
+		if before, err = metrics(); err != nil {
+			return nil, fmt.Errorf("metrics: %w", err)
+		}
+	}
+	report.StartedAt = time.Now()
+	r.deadline = report.StartedAt.Add(conf.Duration)
+	ctx, cancel := context.WithDeadline(ctx, r.deadline)
+	defer cancel()
+	wg := sync.WaitGroup{}
+	for i := 0; i < conf.Streams; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.worker(ctx)
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(report.StartedAt)
+
+	if metrics != nil {
+		after, err := metrics()
+		if err != nil {
+			return nil, fmt.Errorf("metrics: %w", err)
+		}
+		report.Runtime = &RuntimeDelta{
+			ConnectFailuresTotal:   after.ConnectFailuresTotal - before.ConnectFailuresTotal,
+			QueueFullTotal:         after.QueueFullTotal - before.QueueFullTotal,
+			QueueTimeoutsTotal:     after.QueueTimeoutsTotal - before.QueueTimeoutsTotal,
+			WebSocketConnectsTotal: after.WebSocketConnectsTotal - before.WebSocketConnectsTotal,
+			WebSocketReadErrors:    after.WebSocketReadErrors - before.WebSocketReadErrors,
+			WebSocketWriteErrors:   after.WebSocketWriteErrors - before.WebSocketWriteErrors,
+		}
+	}
+
+	report.DurationSeconds = elapsed.Seconds()
+	report.StreamsOpened = r.opened.Load()
+	report.ConnectFailures = r.failures.Load()
+	report.StreamErrors = r.broken.Load()
+	report.RoundTripsTotal = r.trips.Load()
+	report.BytesUp = r.bytesUp.Load()
+	report.BytesDown = r.bytesDown.Load()
+	report.UpBytesPerSec = float64(report.BytesUp) / elapsed.Seconds()
+	report.DownBytesPerSec = float64(report.BytesDown) / elapsed.Seconds()
+	report.ConnectLatency = percentiles(r.connects)
+	report.RoundTripLatency = percentiles(r.rtts)
+	if len(r.errors) > 0 {
+		report.Errors = r.errors
+	}
+	return report, nil
+}
+
+func (r *run) worker(ctx context.Context) {
+	for ctx.Err() == nil {
+		start := time.Now()
+		conn, err := r.open(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			r.failures.Add(1)
+			r.fail(err)
+			// do not spin on a broken chain
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		r.opened.Add(1)
+		connect := time.Since(start)
+		rtts := []time.Duration{}
+		err = r.exchange(ctx, conn, &rtts)
+		conn.Close()
+		if err != nil && ctx.Err() == nil {
+			r.broken.Add(1)
+			r.fail(err)
+		}
+		r.lock.Lock()
+		r.connects = append(r.connects, connect)
+		r.rtts = append(r.rtts, rtts...)
+		r.lock.Unlock()
+	}
+}
+
+func (r *run) open(ctx context.Context) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: DIAL_TIMEOUT}
+	conn, err := dialer.DialContext(ctx, "tcp", r.proxy)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(DIAL_TIMEOUT))
+	if err := detourtest.Socks5Connect(conn, r.target); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// exchange does round trips on conn until the deadline or RoundTrips.
+func (r *run) exchange(ctx context.Context, conn net.Conn, rtts *[]time.Duration) error {
+	header := make([]byte, HEADER_SIZE)
+	binary.BigEndian.PutUint32(header[:4], uint32(r.conf.Upload))
+	binary.BigEndian.PutUint32(header[4:], uint32(r.conf.Download))
+	// unblock reads and writes when the run ends
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+	for i := 0; r.conf.RoundTrips == 0 || i < r.conf.RoundTrips; i++ {
+		if ctx.Err() != nil {
+			return nil
+		}
+		conn.SetDeadline(time.Now().Add(IO_TIMEOUT))
+		start := time.Now()
+		if _, err := conn.Write(header); err != nil {
+			return err
+		}
+		if err := writePayload(conn, r.conf.Upload); err != nil {
+			return err
+		}
+		r.bytesUp.Add(int64(r.conf.Upload))
+		n, err := io.CopyN(io.Discard, conn, int64(r.conf.Download))
+		r.bytesDown.Add(n)
+		if err != nil {
+			return err
+		}
+		*rtts = append(*rtts, time.Since(start))
+		r.trips.Add(1)
+	}
+	return nil
+}
+
+func (r *run) fail(err error) {
+	message := err.Error()
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Err != nil {
+		// drop the addresses, they differ for every stream
+		message = opErr.Op + ": " + opErr.Err.Error()
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.errors[message]; !ok && len(r.errors) >= MAX_ERRORS {
+		message = "other"
+	}
+	r.errors[message]++
+}
+
+func percentiles(samples []time.Duration) Latency {
+	if len(samples) == 0 {
+		return Latency{}
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	at := func(q float64) float64 {
+		return common.ElapsedMillis(samples[int(q*float64(len(samples)-1))])
+	}
+	return Latency{Count: len(samples), P50: at(0.5), P90: at(0.9), P99: at(0.99), Max: at(1)}
+}
+
+func fetchRuntime(ctx context.Context, base string) (common.RuntimeMetricsSnapshot, error) {
+	snapshot := local.LocalMetricsSnapshot{}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(base, "/")+"/debug/metrics", nil)
+	if err != nil {
+		return snapshot.Runtime, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return snapshot.Runtime, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return snapshot.Runtime, fmt.Errorf("%s: %s", req.URL, resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&snapshot)
+	return snapshot.Runtime, err
+}
+
+// WriteReport prints a summary of report for humans.
+func WriteReport(w io.Writer, report *Report) error {
+	proxy := report.Proxy
+	if report.Proxy == IN_PROCESS {
+		proxy = fmt.Sprintf("%s chain with %d relays", IN_PROCESS, report.Relays)
+	}
+	fmt.Fprintf(w, "%s, %d streams, %d bytes up / %d bytes down per round trip, %.1fs\n",
+		proxy, report.Streams, report.Upload, report.Download, report.DurationSeconds)
+	fmt.Fprintf(w, "streams:     %d opened, %d connect failures, %d broken\n", report.StreamsOpened, report.ConnectFailures, report.StreamErrors)
+	fmt.Fprintf(w, "throughput:  up %.2f MiB/s, down %.2f MiB/s, %d round trips\n",
+		report.UpBytesPerSec/(1<<20), report.DownBytesPerSec/(1<<20), report.RoundTripsTotal)
+	for _, item := range []struct {
+		name    string
+		latency Latency
+	}{{"connect:", report.ConnectLatency}, {"round trip:", report.RoundTripLatency}} {
+		fmt.Fprintf(w, "%-12s p50 %.1fms, p90 %.1fms, p99 %.1fms, max %.1fms\n",
+			item.name, item.latency.P50, item.latency.P90, item.latency.P99, item.latency.Max)
+	}
+	if runtime := report.Runtime; runtime != nil {
+		fmt.Fprintf(w, "local:       %d connect failures, %d queue full, %d queue timeouts, %d websocket connects\n",
+			runtime.ConnectFailuresTotal, runtime.QueueFullTotal, runtime.QueueTimeoutsTotal, runtime.WebSocketConnectsTotal)
+	}
+	messages := make([]string, 0, len(report.Errors))
+	for message := range report.Errors {
+		messages = append(messages, message)
+	}
+	sort.Slice(messages, func(i, j int) bool { return report.Errors[messages[i]] > report.Errors[messages[j]] })
+	for _, message := range messages {
+		if _, err := fmt.Fprintf(w, "error:       %d x %s\n", report.Errors[message], message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package bench_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/observerss/detour2/bench"
+	"github.com/observerss/detour2/detourtest"
+)
+
+func TestBenchThroughInProcessChain(t *testing.T) {
+	detourtest.SilenceLogs(t)
+
+	report, err := bench.Run(context.Background(), bench.Config{
+		Relays:     1,
+		Streams:    4,
+		Upload:     4096,
+		Download:   16384,
+		RoundTrips: 3,
+		Duration:   300 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.ConnectFailures != 0 || report.StreamErrors != 0 || len(report.Errors) != 0 {
+		t.Fatalf("unexpected failures: %+v", report)
+	}
+	if report.StreamsOpened < 4 || report.BytesUp < report.RoundTripsTotal*4096 || report.BytesDown < report.RoundTripsTotal*16384 {
+		t.Fatalf("unexpected counts: %+v", report)
+	}
+	if report.ConnectLatency.Count == 0 || report.RoundTripLatency.P50 <= 0 || report.RoundTripLatency.Max < report.RoundTripLatency.P99 {
+		t.Fatalf("unexpected latencies: %+v %+v", report.ConnectLatency, report.RoundTripLatency)
+	}
+	if report.Runtime == nil || report.Runtime.ConnectFailuresTotal != 0 || report.Runtime.WebSocketConnectsTotal == 0 {
+		t.Fatalf("unexpected runtime delta: %+v", report.Runtime)
+	}
+
+	out := bytes.Buffer{}
+	if err := bench.WriteReport(&out, report); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "in-process chain with 1 relays") || !strings.Contains(out.String(), "round trip:") {
+		t.Fatalf("unexpected text report:\n%s", out.String())
+	}
+}
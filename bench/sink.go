@@ -0,0 +1,97 @@
+package bench
+
+import (
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+)
+
+const HEADER_SIZE = 8 // upload and download sizes, big endian uint32s
+
+// payload is sent in both directions, random so compression does not
+// flatter the numbers.
+var payload = func() []byte {
+	data := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	return data
+}()
+
+// Sink is the target of a bench, every request is a header followed by
+// the upload bytes, answered with the download bytes.
+type Sink struct {
+	Listener net.Listener
+	wg       sync.WaitGroup
+	conns    sync.Map // net.Conn => struct{}
+}
+
+func StartSink(listen string) (*Sink, error) {
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+	sink := &Sink{Listener: listener}
+	sink.wg.Add(1)
+	go sink.serve()
+	return sink, nil
+}
+
+func (s *Sink) Addr() string {
+	return s.Listener.Addr().String()
+}
+
+func (s *Sink) Close() {
+	s.Listener.Close()
+	s.conns.Range(func(key, _ any) bool {
+		key.(net.Conn).Close()
+		return true
+	})
+	s.wg.Wait()
+}
+
+func (s *Sink) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.Listener.Accept()
+		if err != nil {
+			return
+		}
+		s.conns.Store(conn, struct{}{})
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.conns.Delete(conn)
+			defer conn.Close()
+			s.handle(conn)
+		}()
+	}
+}
+
+func (s *Sink) handle(conn net.Conn) {
+	header := make([]byte, HEADER_SIZE)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		upload := int64(binary.BigEndian.Uint32(header[:4]))
+		download := int(binary.BigEndian.Uint32(header[4:]))
+		if _, err := io.CopyN(io.Discard, conn, upload); err != nil {
+			return
+		}
+		if err := writePayload(conn, download); err != nil {
+			return
+		}
+	}
+}
+
+func writePayload(w io.Writer, n int) error {
+	for n > 0 {
+		chunk := min(n, len(payload))
+		if _, err := w.Write(payload[:chunk]); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
@@ -0,0 +1,280 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ACCESS_FORMAT_JSON   = "json"
+	ACCESS_FORMAT_COMMON = "common"
+
+	// ACCESS_COMMON_TEMPLATE is used for the common format, after the
+	// NCSA common log format.
+	ACCESS_COMMON_TEMPLATE = `{client} - {user} [{start}] "CONNECT {target}" "{result}" {bytesUp} {bytesDown} {duration} "{path}"`
+
+	DEFAULT_ACCESS_MAX_SIZE = 100 // MB
+	DEFAULT_ACCESS_MAX_AGE  = "24h"
+	DEFAULT_ACCESS_BACKUPS  = 7
+
+	accessBackupLayout = "20060102-150405.000000"
+	commonTimeLayout   = "02/Jan/2006:15:04:05 -0700"
+)
+
+var accessPlaceholder = regexp.MustCompile(`\{(\w+)\}`)
+
+// AccessLogConfig is shared by LocalConfig and ServerConfig.
+type AccessLogConfig struct {
+	AccessLog        string `json:"accessLog" example:"access.log"`
+	AccessLogFormat  string `json:"accessLogFormat" example:"json"` // json, common or a {field} template
+	AccessLogMaxSize int    `json:"accessLogMaxSize" example:"100"` // MB
+	AccessLogMaxAge  string `json:"accessLogMaxAge" example:"24h"`
+	AccessLogBackups int    `json:"accessLogBackups" example:"7"`
+}
+
+// AccessRecord describes one finished stream.
+type AccessRecord struct {
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Side      string    `json:"side"` // local, relay or exit
+	Cid       string    `json:"cid"`
+	Client    string    `json:"client"`
+	User      string    `json:"user,omitempty"`
+	Listener  string    `json:"listener,omitempty"`
+	Target    string    `json:"target"`
+	Resolved  string    `json:"resolved,omitempty"` // address the exit dialed
+	BytesUp   int64     `json:"bytesUp"`
+	BytesDown int64     `json:"bytesDown"`
+	Result    string    `json:"result"`
+	Path      []string  `json:"path,omitempty"` // websocket urls of the hops
+}
+
+// CloseReason keeps the first reason a stream ended for, it is safe for
+// concurrent use.
+type CloseReason struct {
+	reason atomic.Pointer[string]
+}
+
+func (c *CloseReason) Set(reason string) {
+	c.reason.CompareAndSwap(nil, &reason)
+}
+
+// Get returns the reason, or fallback when none was set.
+func (c *CloseReason) Get(fallback string) string {
+	if reason := c.reason.Load(); reason != nil {
+		return *reason
+	}
+	return fallback
+}
+
+// AccessLog appends AccessRecords to a file, rotating it when it grows past
+// MaxSize or was opened longer than MaxAge ago. A nil AccessLog drops them.
+type AccessLog struct {
+	lock     sync.Mutex
+	path     string
+	template string // empty for json
+	maxSize  int64
+	maxAge   time.Duration
+	backups  int
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+// NewAccessLog returns nil when conf.AccessLog is empty.
+func NewAccessLog(conf AccessLogConfig) (*AccessLog, error) {
+	path := strings.TrimSpace(conf.AccessLog)
+	if path == "" {
+		return nil, nil
+	}
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	a := &AccessLog{
+		path:    path,
+		maxSize: int64(DEFAULT_ACCESS_MAX_SIZE) << 20,
+		backups: DEFAULT_ACCESS_BACKUPS,
+	}
+	switch conf.AccessLogFormat {
+	case "", ACCESS_FORMAT_JSON:
+	case ACCESS_FORMAT_COMMON:
+		a.template = ACCESS_COMMON_TEMPLATE
+	default:
+		a.template = conf.AccessLogFormat
+	}
+	if conf.AccessLogMaxSize > 0 {
+		a.maxSize = int64(conf.AccessLogMaxSize) << 20
+	}
+	maxAge := conf.AccessLogMaxAge
+	if maxAge == "" {
+		maxAge = DEFAULT_ACCESS_MAX_AGE
+	}
+	a.maxAge, _ = time.ParseDuration(maxAge)
+	if conf.AccessLogBackups > 0 {
+		a.backups = conf.AccessLogBackups
+	}
+	return a, nil
+}
+
+// Validate checks the access log fields, it is called by the config
+// validation of both sides.
+func (conf AccessLogConfig) Validate() error {
+	errs := []error{}
+	switch conf.AccessLogFormat {
+	case "", ACCESS_FORMAT_JSON, ACCESS_FORMAT_COMMON:
+	default:
+		matches := accessPlaceholder.FindAllStringSubmatch(conf.AccessLogFormat, -1)
+		if len(matches) == 0 {
+			errs = append(errs, fmt.Errorf("accessLogFormat: %q should be json, common or a template with {field}s", conf.AccessLogFormat))
+		}
+		for _, match := range matches {
+			if _, ok := accessFields(AccessRecord{})[match[1]]; !ok {
+				errs = append(errs, fmt.Errorf("accessLogFormat: unknown field {%s}", match[1]))
+			}
+		}
+	}
+	if conf.AccessLogMaxSize < 0 {
+		errs = append(errs, fmt.Errorf("accessLogMaxSize: %d is negative", conf.AccessLogMaxSize))
+	}
+	if conf.AccessLogMaxAge != "" {
+		if age, err := time.ParseDuration(conf.AccessLogMaxAge); err != nil || age < 0 {
+			errs = append(errs, fmt.Errorf("accessLogMaxAge: %q is not a positive duration like 24h", conf.AccessLogMaxAge))
+		}
+	}
+	if conf.AccessLogBackups < 0 {
+		errs = append(errs, fmt.Errorf("accessLogBackups: %d is negative", conf.AccessLogBackups))
+	}
+	return errors.Join(errs...)
+}
+
+// Path returns the file written to.
+func (a *AccessLog) Path() string {
+	if a == nil {
+		return ""
+	}
+	return a.path
+}
+
+// Write appends one record, rotating the file first when due.
+func (a *AccessLog) Write(record AccessRecord) error {
+	if a == nil {
+		return nil
+	}
+	line, err := a.format(record)
+	if err != nil {
+		return err
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.file != nil && (a.size+int64(len(line)) > a.maxSize || a.maxAge > 0 && time.Since(a.openedAt) > a.maxAge) {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+	if a.file == nil {
+		if err := a.open(); err != nil {
+			return err
+		}
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	return err
+}
+
+func (a *AccessLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+	return err
+}
+
+func (a *AccessLog) open() error {
+	file, err := os.OpenFile(a.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	a.file, a.size, a.openedAt = file, info.Size(), time.Now()
+	return nil
+}
+
+// rotate renames the current file to path.<time> and removes the oldest
+// backups beyond the limit.
+func (a *AccessLog) rotate() error {
+	a.file.Close()
+	a.file = nil
+	backup := a.path + "." + time.Now().Format(accessBackupLayout)
+	if err := os.Rename(a.path, backup); err != nil {
+		return err
+	}
+	backups, err := filepath.Glob(a.path + ".*")
+	if err != nil {
+		return err
+	}
+	sort.Strings(backups)
+	for len(backups) > a.backups {
+		os.Remove(backups[0])
+		backups = backups[1:]
+	}
+	return nil
+}
+
+func (a *AccessLog) format(record AccessRecord) ([]byte, error) {
+	if a.template == "" {
+		line, err := json.Marshal(record)
+		return append(line, '\n'), err
+	}
+	fields := accessFields(record)
+	line := accessPlaceholder.ReplaceAllStringFunc(a.template, func(placeholder string) string {
+		value, ok := fields[placeholder[1:len(placeholder)-1]]
+		if !ok {
+			return placeholder
+		}
+		if value == "" {
+			return "-"
+		}
+		return value
+	})
+	return []byte(line + "\n"), nil
+}
+
+func accessFields(record AccessRecord) map[string]string {
+	return map[string]string{
+		"start":     record.Start.Format(commonTimeLayout),
+		"end":       record.End.Format(commonTimeLayout),
+		"duration":  strconv.FormatFloat(record.End.Sub(record.Start).Seconds(), 'f', 3, 64),
+		"side":      record.Side,
+		"cid":       record.Cid,
+		"client":    record.Client,
+		"user":      record.User,
+		"listener":  record.Listener,
+		"target":    record.Target,
+		"resolved":  record.Resolved,
+		"bytesUp":   strconv.FormatInt(record.BytesUp, 10),
+		"bytesDown": strconv.FormatInt(record.BytesDown, 10),
+		"result":    record.Result,
+		"path":      strings.Join(record.Path, ","),
+	}
+}
@@ -0,0 +1,68 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLogFormats(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	record := AccessRecord{
+		Start:     start,
+		End:       start.Add(1500 * time.Millisecond),
+		Side:      "local",
+		Client:    "127.0.0.1:5000",
+		Target:    "example.com:443",
+		BytesUp:   10,
+		BytesDown: 20,
+		Result:    "client closed",
+		Path:      []string{"ws://a/ws", "ws://b/ws"},
+	}
+	for format, want := range map[string]string{
+		ACCESS_FORMAT_COMMON:         `127.0.0.1:5000 - - [01/May/2024:12:00:00 +0000] "CONNECT example.com:443" "client closed" 10 20 1.500 "ws://a/ws,ws://b/ws"`,
+		"{side} {target} {resolved}": "local example.com:443 -",
+	} {
+		path := filepath.Join(t.TempDir(), "access.log")
+		access, err := NewAccessLog(AccessLogConfig{AccessLog: path, AccessLogFormat: format})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := access.Write(record); err != nil {
+			t.Fatal(err)
+		}
+		access.Close()
+		data, _ := os.ReadFile(path)
+		if got := strings.TrimSpace(string(data)); got != want {
+			t.Fatalf("%s: got %q, want %q", format, got, want)
+		}
+	}
+
+	if err := (AccessLogConfig{AccessLogFormat: "{target} {bogus}"}).Validate(); err == nil {
+		t.Fatal("unknown template field accepted")
+	}
+}
+
+func TestAccessLogRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	access, err := NewAccessLog(AccessLogConfig{AccessLog: path, AccessLogBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer access.Close()
+	access.maxSize = 1 // every record goes to a fresh file
+	for i := 0; i < 5; i++ {
+		if err := access.Write(AccessRecord{Target: "example.com:443"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 2 {
+		t.Fatalf("want 2 backups, got %v", backups)
+	}
+	if data, _ := os.ReadFile(path); strings.Count(string(data), "\n") != 1 {
+		t.Fatalf("current file should hold the last record: %q", data)
+	}
+}
@@ -0,0 +1,224 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ACLConfig limits the destinations an exit server dials. Rules are comma
+// separated, each is an ip or CIDR ("10.0.0.0/8"), a domain ("example.com",
+// "*.example.com" for its subdomains) or "*", optionally followed by ":port"
+// or ":low-high", ipv6 goes in brackets when a port follows. Deny wins over
+// allow, and a non empty allow list denies everything else.
+type ACLConfig struct {
+	AllowDestinations string `json:"allowDestinations" example:"*.example.com:443,203.0.113.0/24"`
+	DenyDestinations  string `json:"denyDestinations" example:"*:25,10.1.0.0/16"`
+	// loopback, link-local, private and shared addresses are denied unless
+	// this is set or an ip rule of the allow list covers them
+	AllowPrivateDestinations bool `json:"allowPrivateDestinations" example:"false"`
+}
+
+func (c ACLConfig) Validate() error {
+	_, err := NewACL(c)
+	return err
+}
+
+// privatePrefixes are denied by default on top of what netip reports as
+// loopback, link-local, private, multicast or unspecified.
+var privatePrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"), // shared address space, home of some cloud metadata services
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+}
+
+// IsPrivateAddr reports whether ip should not be reachable from an exit
+// server by default.
+func IsPrivateAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() || ip.IsPrivate() || ip.IsUnspecified() {
+		return true
+	}
+	for _, prefix := range privatePrefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type aclRule struct {
+	text      string
+	prefix    netip.Prefix // ip rules
+	domain    string       // domain rules, lower case
+	subdomain bool         // "*.example.com"
+	low, high uint16       // 0, 0 is any port
+}
+
+func parseACLRule(text string) (aclRule, error) {
+	rule := aclRule{text: text}
+	host, ports := text, ""
+	if strings.HasPrefix(text, "[") {
+		end := strings.Index(text, "]")
+		if end < 0 {
+			return rule, fmt.Errorf("%q: missing ]", text)
+		}
+		host, ports = text[1:end], strings.TrimPrefix(text[end+1:], ":")
+		if end+1 < len(text) && text[end+1] != ':' {
+			return rule, fmt.Errorf("%q: expected : after ]", text)
+		}
+	} else if strings.Count(text, ":") == 1 {
+		host, ports, _ = strings.Cut(text, ":")
+	}
+	if ports != "" {
+		low, high, isRange := strings.Cut(ports, "-")
+		if !isRange {
+			high = low
+		}
+		l, err1 := strconv.ParseUint(low, 10, 16)
+		h, err2 := strconv.ParseUint(high, 10, 16)
+		if err1 != nil || err2 != nil || l == 0 || l > h {
+			return rule, fmt.Errorf("%q: bad port %q", text, ports)
+		}
+		rule.low, rule.high = uint16(l), uint16(h)
+	}
+	switch {
+	case host == "*":
+	case strings.Contains(host, "/"):
+		prefix, err := netip.ParsePrefix(host)
+		if err != nil {
+			return rule, fmt.Errorf("%q: %w", text, err)
+		}
+		rule.prefix = prefix.Masked()
+	default:
+		if ip, err := netip.ParseAddr(host); err == nil {
+			rule.prefix = netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen())
+			break
+		}
+		domain, subdomain := strings.CutPrefix(strings.ToLower(host), "*.")
+		if domain == "" || strings.ContainsAny(domain, "*/:[] ") {
+			return rule, fmt.Errorf("%q: not an ip, CIDR or domain", text)
+		}
+		rule.domain, rule.subdomain = strings.TrimSuffix(domain, "."), subdomain
+	}
+	return rule, nil
+}
+
+func (r aclRule) matches(host string, ip netip.Addr, port uint16) bool {
+	if r.low != 0 && (port < r.low || port > r.high) {
+		return false
+	}
+	switch {
+	case r.prefix.IsValid():
+		return r.prefix.Contains(ip)
+	case r.domain != "":
+		if r.subdomain {
+			return strings.HasSuffix(host, "."+r.domain)
+		}
+		return host == r.domain
+	}
+	return true
+}
+
+// ACL decides which destinations may be dialed, a nil ACL allows all.
+type ACL struct {
+	allow        []aclRule
+	deny         []aclRule
+	allowPrivate bool
+}
+
+func NewACL(conf ACLConfig) (*ACL, error) {
+	acl := &ACL{allowPrivate: conf.AllowPrivateDestinations}
+	errs := []error{}
+	for _, list := range []struct {
+		name  string
+		value string
+		rules *[]aclRule
+	}{
+		{"allowDestinations", conf.AllowDestinations, &acl.allow},
+		{"denyDestinations", conf.DenyDestinations, &acl.deny},
+	} {
+		for _, text := range strings.Split(list.value, ",") {
+			if text = strings.TrimSpace(text); text == "" {
+				continue
+			}
+			rule, err := parseACLRule(text)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", list.name, err))
+				continue
+			}
+			*list.rules = append(*list.rules, rule)
+		}
+	}
+	return acl, errors.Join(errs...)
+}
+
+// DeniedError is returned for a destination the ACL refuses.
+type DeniedError struct {
+	Host    string // the name asked for, empty for an ip
+	Address netip.AddrPort
+	Reason  string
+}
+
+func (e *DeniedError) Error() string {
+	target := e.Address.String()
+	if e.Host != "" {
+		target = net.JoinHostPort(e.Host, strconv.Itoa(int(e.Address.Port()))) + " (" + e.Address.Addr().String() + ")"
+	}
+	return "destination " + target + " denied: " + e.Reason
+}
+
+// Check decides on dialing address, host is the name the client asked for or
+// empty when it gave an ip.
+func (a *ACL) Check(host string, address netip.AddrPort) error {
+	if a == nil {
+		return nil
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	ip, port := address.Addr().Unmap(), address.Port()
+	for _, rule := range a.deny {
+		if rule.matches(host, ip, port) {
+			return &DeniedError{Host: host, Address: address, Reason: "matches deny rule " + rule.text}
+		}
+	}
+	allowed, coversIP := len(a.allow) == 0, false
+	for _, rule := range a.allow {
+		if rule.matches(host, ip, port) {
+			allowed = true
+			// names can resolve anywhere, only ip rules open private ranges
+			coversIP = coversIP || rule.prefix.IsValid()
+		}
+	}
+	if !allowed {
+		return &DeniedError{Host: host, Address: address, Reason: "not in the allow list"}
+	}
+	if !a.allowPrivate && !coversIP && IsPrivateAddr(ip) {
+		return &DeniedError{Host: host, Address: address, Reason: "private address"}
+	}
+	return nil
+}
+
+// Control returns a net.Dialer Control checking every address a dial to host
+// resolved to, so names resolving to denied addresses cannot slip through.
+func (a *ACL) Control(host string) func(network string, address string, c syscall.RawConn) error {
+	if a == nil {
+		return nil
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		host = ""
+	}
+	return func(network string, address string, c syscall.RawConn) error {
+		addrPort, err := netip.ParseAddrPort(address)
+		if err != nil {
+			return err
+		}
+		return a.Check(host, addrPort)
+	}
+}
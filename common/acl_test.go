@@ -0,0 +1,67 @@
+package common
+
+import (
+	"errors"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestACLCheck(t *testing.T) {
+	acl, err := NewACL(ACLConfig{
+		AllowDestinations: "*.example.com:443,example.com,10.1.0.0/16:8000-9000,[fd00::1]:22",
+		DenyDestinations:  "*:25,bad.example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		host    string
+		address string
+		reason  string // empty when allowed
+	}{
+		{"www.example.com", "93.184.215.14:443", ""},
+		{"WWW.Example.com.", "93.184.215.14:443", ""},
+		{"www.example.com", "93.184.215.14:80", "not in the allow list"},
+		{"example.com", "93.184.215.14:80", ""},
+		{"example.com", "93.184.215.14:25", "matches deny rule *:25"},
+		{"bad.example.com", "93.184.215.14:443", "matches deny rule bad.example.com"},
+		{"", "10.1.2.3:8080", ""},
+		{"", "10.1.2.3:22", "not in the allow list"},
+		{"", "[fd00::1]:22", ""},
+		{"www.example.com", "127.0.0.1:443", "private address"},
+		{"www.example.com", "[::ffff:169.254.169.254]:443", "private address"},
+		{"www.example.com", "100.100.100.200:443", "private address"},
+	} {
+		err := acl.Check(tc.host, netip.MustParseAddrPort(tc.address))
+		var denied *DeniedError
+		if tc.reason == "" && err != nil || tc.reason != "" && (!errors.As(err, &denied) || denied.Reason != tc.reason) {
+			t.Fatalf("%s %s: got %v want %q", tc.host, tc.address, err, tc.reason)
+		}
+	}
+
+	open, _ := NewACL(ACLConfig{AllowPrivateDestinations: true})
+	if err := open.Check("", netip.MustParseAddrPort("127.0.0.1:22")); err != nil {
+		t.Fatalf("private should be allowed: %v", err)
+	}
+	if err := (*ACL)(nil).Check("", netip.MustParseAddrPort("127.0.0.1:22")); err != nil {
+		t.Fatalf("nil acl should allow all: %v", err)
+	}
+	closed, _ := NewACL(ACLConfig{})
+	err = closed.Check("localhost", netip.MustParseAddrPort("127.0.0.1:22"))
+	if err == nil || err.Error() != "destination localhost:22 (127.0.0.1) denied: private address" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestACLRejectsBadRules(t *testing.T) {
+	err := ACLConfig{AllowDestinations: "10.0.0.0/33,example.com:0", DenyDestinations: "[::1:22,*.:80"}.Validate()
+	if err == nil {
+		t.Fatal("expected errors")
+	}
+	for _, want := range []string{"allowDestinations: \"10.0.0.0/33\"", "allowDestinations: \"example.com:0\"", "denyDestinations: \"[::1:22\"", "denyDestinations: \"*.:80\""} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("missing %s in %v", want, err)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package common
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/observerss/detour2/logger"
+)
+
+// ADMIN_TOKEN_ENV is used as the default admin token, like PASSWORD_ENV.
+const ADMIN_TOKEN_ENV = "DETOUR_ADMIN_TOKEN"
+
+// AdminConn describes one active stream in the admin API.
+type AdminConn struct {
+	Cid          string  `json:"cid"`
+	Wid          string  `json:"wid"`
+	Network      string  `json:"network"`
+	Address      string  `json:"address"`
+	User         string  `json:"user,omitempty"`
+	Listener     string  `json:"listener,omitempty"`
+	Via          string  `json:"via"` // websocket or next relay the stream rides on
+	BytesUp      int64   `json:"bytesUp"`
+	BytesDown    int64   `json:"bytesDown"`
+	StartedAt    string  `json:"startedAt"`
+	AgeSeconds   float64 `json:"ageSeconds"`
+	LastActiveAt string  `json:"lastActiveAt"`
+	IdleSeconds  float64 `json:"idleSeconds"`
+}
+
+// AdminBackend is implemented by local.Local and server.Server.
+type AdminBackend interface {
+	AdminConns() []AdminConn
+	// CloseConn closes the stream cid on both sides, it reports false when
+	// there is no such stream.
+	CloseConn(cid string) bool
+	// Spans returns the recorded trace spans of cid.
+	Spans(cid string) []Span
+	// RateLimits returns the rate limits in effect, SetRateLimits swaps them
+	// for live streams too.
+	RateLimits() RateLimitConfig
+	SetRateLimits(conf RateLimitConfig) error
+}
+
+// UsageBackend is implemented by server.Server, admin handlers of such a
+// backend also serve /admin/usage.
+type UsageBackend interface {
+	UsageSnapshot() UsageSnapshot
+	// ResetUsage clears the usage of user, or of everyone when user is empty.
+	ResetUsage(user string)
+}
+
+// BanBackend is implemented by server.Server, admin handlers of such a
+// backend also serve /admin/bans.
+type BanBackend interface {
+	Bans() []Ban
+	// Unban lifts the ban of ip, it reports false when ip is not banned.
+	Unban(ip string) bool
+}
+
+// NewAdminConn fills the time fields of an AdminConn relative to now.
+func NewAdminConn(conn AdminConn, startedAt time.Time, lastActive time.Time) AdminConn {
+	now := time.Now()
+	conn.StartedAt = startedAt.Format(time.RFC3339)
+	conn.AgeSeconds = now.Sub(startedAt).Seconds()
+	conn.LastActiveAt = lastActive.Format(time.RFC3339)
+	conn.IdleSeconds = now.Sub(lastActive).Seconds()
+	return conn
+}
+
+// AdminLog is the logging state served at /admin/log.
+type AdminLog struct {
+	Format string            `json:"format"`
+	Levels map[string]string `json:"levels"` // subsystem => level
+}
+
+// NewAdminHandler serves GET /admin/conns, DELETE /admin/conns/{cid},
+// GET /admin/trace/{cid}, GET/PUT /admin/log?level=info,wsconn=debug and
+// GET/PUT /admin/ratelimit with a RateLimitConfig body, a UsageBackend also
+// gets GET /admin/usage, DELETE /admin/usage and DELETE /admin/usage/{user},
+// a BanBackend GET /admin/bans and DELETE /admin/bans/{ip}.
+// Every request needs "Authorization: Bearer <token>".
+func NewAdminHandler(token string, backend AdminBackend) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/conns", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(backend.AdminConns())
+	})
+	mux.HandleFunc("DELETE /admin/conns/{cid}", func(w http.ResponseWriter, r *http.Request) {
+		if !backend.CloseConn(r.PathValue("cid")) {
+			http.Error(w, "connection not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /admin/trace/{cid}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(backend.Spans(r.PathValue("cid")))
+	})
+	mux.HandleFunc("GET /admin/log", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(AdminLog{Format: logger.Format(), Levels: logger.Levels()})
+	})
+	mux.HandleFunc("PUT /admin/log", func(w http.ResponseWriter, r *http.Request) {
+		if err := logger.SetLevels(r.URL.Query().Get("level")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logger.Main.Info("admin, log levels changed", "levels", logger.LevelsSpec())
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(AdminLog{Format: logger.Format(), Levels: logger.Levels()})
+	})
+	mux.HandleFunc("GET /admin/ratelimit", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(backend.RateLimits())
+	})
+	mux.HandleFunc("PUT /admin/ratelimit", func(w http.ResponseWriter, r *http.Request) {
+		conf := RateLimitConfig{}
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&conf); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := backend.SetRateLimits(conf); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logger.Main.Info("admin, rate limits changed", "rateLimit", conf.RateLimit, "userRateLimit", conf.UserRateLimit, "streamRateLimit", conf.StreamRateLimit)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(backend.RateLimits())
+	})
+	if usage, ok := backend.(UsageBackend); ok {
+		mux.HandleFunc("GET /admin/usage", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(usage.UsageSnapshot())
+		})
+		reset := func(w http.ResponseWriter, r *http.Request) {
+			usage.ResetUsage(r.PathValue("user"))
+			logger.Main.Info("admin, usage reset", logger.USER, r.PathValue("user"))
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(usage.UsageSnapshot())
+		}
+		mux.HandleFunc("DELETE /admin/usage", reset)
+		mux.HandleFunc("DELETE /admin/usage/{user}", reset)
+	}
+	if bans, ok := backend.(BanBackend); ok {
+		mux.HandleFunc("GET /admin/bans", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(bans.Bans())
+		})
+		mux.HandleFunc("DELETE /admin/bans/{ip}", func(w http.ResponseWriter, r *http.Request) {
+			if !bans.Unban(r.PathValue("ip")) {
+				http.Error(w, "ban not found", http.StatusNotFound)
+				return
+			}
+			logger.Main.Info("admin, unbanned", "client", r.PathValue("ip"))
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scheme, given, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		if token == "" || !strings.EqualFold(scheme, "bearer") || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
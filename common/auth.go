@@ -0,0 +1,86 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// AUTH_HEADER carries the token of a websocket upgrade, servers with a
+	// decoy hand requests without a valid one to the decoy.
+	AUTH_HEADER = "X-Detour-Auth"
+	// AUTH_WINDOW is how far the clock of a client may be off.
+	AUTH_WINDOW = 5 * time.Minute
+)
+
+func authMAC(password string, payload string) string {
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write([]byte("detour2-auth " + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// NewAuthToken returns a single-use token "unix.nonce.mac" signed with
+// password.
+func NewAuthToken(password string, now time.Time) string {
+	nonce, _ := GenerateRandomStringURLSafe(12)
+	payload := strconv.FormatInt(now.Unix(), 10) + "." + nonce
+	return payload + "." + authMAC(password, payload)
+}
+
+// SetAuthHeader signs a websocket upgrade request with password.
+func SetAuthHeader(header http.Header, password string) {
+	header.Set(AUTH_HEADER, NewAuthToken(password, time.Now()))
+}
+
+// AuthVerifier checks tokens of NewAuthToken and refuses replays of one
+// within AUTH_WINDOW. It is safe for concurrent use.
+type AuthVerifier struct {
+	lock sync.Mutex
+	seen map[string]time.Time // token => when it expires
+}
+
+func (v *AuthVerifier) Verify(password string, token string, now time.Time) bool {
+	payload, mac, ok := cutLast(token, ".")
+	if !ok || !hmac.Equal([]byte(mac), []byte(authMAC(password, payload))) {
+		return false
+	}
+	unix, _, _ := strings.Cut(payload, ".")
+	seconds, err := strconv.ParseInt(unix, 10, 64)
+	if err != nil {
+		return false
+	}
+	issued := time.Unix(seconds, 0)
+	if issued.Before(now.Add(-AUTH_WINDOW)) || issued.After(now.Add(AUTH_WINDOW)) {
+		return false
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if v.seen == nil {
+		v.seen = map[string]time.Time{}
+	}
+	for seen, expires := range v.seen {
+		if now.After(expires) {
+			delete(v.seen, seen)
+		}
+	}
+	if _, ok := v.seen[token]; ok {
+		return false
+	}
+	v.seen[token] = issued.Add(AUTH_WINDOW)
+	return true
+}
+
+func cutLast(s string, sep string) (string, string, bool) {
+	i := strings.LastIndex(s, sep)
+	if i < 0 {
+		return s, "", false
+	}
+	return s[:i], s[i+len(sep):], true
+}
@@ -0,0 +1,29 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAuthVerifier(t *testing.T) {
+	now := time.Now()
+	verifier := AuthVerifier{}
+	token := NewAuthToken("pass123", now)
+	if !verifier.Verify("pass123", token, now.Add(time.Minute)) {
+		t.Fatal("valid token refused")
+	}
+	if verifier.Verify("pass123", token, now.Add(time.Minute)) {
+		t.Fatal("replayed token accepted")
+	}
+	for name, token := range map[string]string{
+		"wrong password": NewAuthToken("other", now),
+		"expired":        NewAuthToken("pass123", now.Add(-AUTH_WINDOW-time.Second)),
+		"from future":    NewAuthToken("pass123", now.Add(AUTH_WINDOW+time.Second)),
+		"empty":          "",
+		"garbage":        "1.2.3",
+	} {
+		if verifier.Verify("pass123", token, now) {
+			t.Fatalf("%s: token accepted", name)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	BAN_FAILURE_WINDOW       = 10 * time.Minute // failures older than this are forgotten
+	DEFAULT_BAN_DURATION     = 10 * time.Minute
+	DEFAULT_BAN_MAX_DURATION = 24 * time.Hour
+	FORWARDED_FOR_HEADER     = "X-Forwarded-For"
+)
+
+// BanConfig bans client IPs that fail authentication or send frames that do
+// not unpack, a BanThreshold of 0 turns banning off. Every ban of an IP lasts
+// twice as long as the one before, up to BanMaxDuration.
+type BanConfig struct {
+	BanThreshold   int    `json:"banThreshold" example:"5"` // failures within BAN_FAILURE_WINDOW that ban
+	BanDuration    string `json:"banDuration" example:"10m"`
+	BanMaxDuration string `json:"banMaxDuration" example:"24h"`
+	BanFile        string `json:"banFile" example:"bans.json"`                   // keeps bans across restarts
+	TrustedProxies string `json:"trustedProxies" example:"127.0.0.1,10.0.0.0/8"` // X-Forwarded-For is read from these only
+}
+
+func (c BanConfig) Validate() error {
+	_, err := parseBanConfig(c)
+	return err
+}
+
+type banRules struct {
+	threshold   int
+	duration    time.Duration
+	maxDuration time.Duration
+	trusted     []netip.Prefix
+}
+
+func parseBanConfig(conf BanConfig) (banRules, error) {
+	rules := banRules{threshold: conf.BanThreshold, duration: DEFAULT_BAN_DURATION, maxDuration: DEFAULT_BAN_MAX_DURATION}
+	errs := []error{}
+	if conf.BanThreshold < 0 {
+		errs = append(errs, fmt.Errorf("banThreshold: %d is negative", conf.BanThreshold))
+	}
+	for _, field := range []struct {
+		name  string
+		value string
+		into  *time.Duration
+	}{
+		{"banDuration", conf.BanDuration, &rules.duration},
+		{"banMaxDuration", conf.BanMaxDuration, &rules.maxDuration},
+	} {
+		if strings.TrimSpace(field.value) == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(strings.TrimSpace(field.value))
+		if err != nil || duration <= 0 {
+			errs = append(errs, fmt.Errorf("%s: %q should be a duration like 10m", field.name, field.value))
+			continue
+		}
+		*field.into = duration
+	}
+	rules.maxDuration = max(rules.maxDuration, rules.duration)
+	for _, value := range strings.Split(conf.TrustedProxies, ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(value)
+			if addrErr != nil {
+				errs = append(errs, fmt.Errorf("trustedProxies: %q is not an ip or cidr", value))
+				continue
+			}
+			prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		rules.trusted = append(rules.trusted, prefix.Masked())
+	}
+	return rules, errors.Join(errs...)
+}
+
+// Ban is one client IP in the ban list.
+type Ban struct {
+	IP      string    `json:"ip"`
+	Until   time.Time `json:"until"`
+	Strikes int       `json:"strikes"` // bans so far, the next one lasts twice as long
+}
+
+type banEntry struct {
+	failures []time.Time
+	strikes  int
+	until    time.Time
+}
+
+// BanList counts failures per client IP and bans the ones crossing the
+// threshold. It is safe for concurrent use, a nil BanList bans nobody.
+type BanList struct {
+	Path    string
+	lock    sync.Mutex
+	saving  sync.Mutex // keeps writes of the file in order
+	rules   banRules
+	entries map[netip.Addr]*banEntry
+}
+
+// NewBanList loads the bans of conf.BanFile, a missing file starts empty.
+func NewBanList(conf BanConfig) (*BanList, error) {
+	b := &BanList{Path: strings.TrimSpace(conf.BanFile), entries: map[netip.Addr]*banEntry{}}
+	if err := b.Update(conf); err != nil {
+		return nil, err
+	}
+	if b.Path == "" {
+		return b, nil
+	}
+	data, err := os.ReadFile(b.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	bans := []Ban{}
+	if err := json.Unmarshal(data, &bans); err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Path, err)
+	}
+	for _, ban := range bans {
+		if addr, err := netip.ParseAddr(ban.IP); err == nil {
+			b.entries[addr] = &banEntry{strikes: ban.Strikes, until: ban.Until}
+		}
+	}
+	return b, nil
+}
+
+// Update swaps the threshold, durations and trusted proxies, an invalid conf
+// leaves them alone. The ban file needs a restart.
+func (b *BanList) Update(conf BanConfig) error {
+	rules, err := parseBanConfig(conf)
+	if err != nil {
+		return err
+	}
+	b.lock.Lock()
+	b.rules = rules
+	b.lock.Unlock()
+	return nil
+}
+
+func (b *BanList) trusts(addr netip.Addr) bool {
+	for _, prefix := range b.rules.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address r came from. X-Forwarded-For is walked from
+// the right while the hops are trusted proxies, so a client cannot pick the
+// address it is banned by.
+func (b *BanList) ClientIP(r *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, _ := netip.ParseAddr(host)
+	addr = addr.Unmap()
+	if b == nil {
+		return addr
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !b.trusts(addr) {
+		return addr
+	}
+	hops := strings.Split(strings.Join(r.Header.Values(FORWARDED_FOR_HEADER), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		addr = hop.Unmap()
+		if !b.trusts(addr) {
+			break
+		}
+	}
+	return addr
+}
+
+// Banned reports whether addr is banned now.
+func (b *BanList) Banned(addr netip.Addr) bool {
+	if b == nil {
+		return false
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	entry, ok := b.entries[addr]
+	return ok && b.rules.threshold > 0 && time.Now().Before(entry.until)
+}
+
+// Fail counts a failure of addr and returns how long it is banned for when
+// this failure crossed the threshold, 0 otherwise.
+func (b *BanList) Fail(addr netip.Addr) time.Duration {
+	if b == nil || !addr.IsValid() {
+		return 0
+	}
+	now := time.Now()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.rules.threshold <= 0 {
+		return 0
+	}
+	b.prune(now)
+	entry, ok := b.entries[addr]
+	if !ok {
+		entry = &banEntry{}
+		b.entries[addr] = entry
+	}
+	entry.failures = append(entry.failures, now)
+	if len(entry.failures) < b.rules.threshold || now.Before(entry.until) {
+		return 0
+	}
+	duration := b.rules.duration
+	for i := 0; i < entry.strikes && duration < b.rules.maxDuration; i++ {
+		duration *= 2
+	}
+	duration = min(duration, b.rules.maxDuration)
+	entry.strikes++
+	entry.until = now.Add(duration)
+	entry.failures = nil
+	return duration
+}
+
+// prune forgets failures older than BAN_FAILURE_WINDOW, and IPs that stayed
+// clean for BanMaxDuration after their last ban.
+func (b *BanList) prune(now time.Time) {
+	since := now.Add(-BAN_FAILURE_WINDOW)
+	for addr, entry := range b.entries {
+		kept := entry.failures[:0]
+		for _, failed := range entry.failures {
+			if failed.After(since) {
+				kept = append(kept, failed)
+			}
+		}
+		entry.failures = kept
+		if len(kept) == 0 && now.After(entry.until.Add(b.rules.maxDuration)) {
+			delete(b.entries, addr)
+		}
+	}
+}
+
+// Bans returns the IPs banned now, the latest to expire first.
+func (b *BanList) Bans() []Ban {
+	bans := []Ban{}
+	if b == nil {
+		return bans
+	}
+	now := time.Now()
+	b.lock.Lock()
+	for addr, entry := range b.entries {
+		if now.Before(entry.until) {
+			bans = append(bans, Ban{IP: addr.String(), Until: entry.until, Strikes: entry.strikes})
+		}
+	}
+	b.lock.Unlock()
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Until.After(bans[j].Until)
+	})
+	return bans
+}
+
+// Unban lifts the ban of ip and forgets its strikes, it reports false when
+// ip was not banned.
+func (b *BanList) Unban(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if b == nil || err != nil {
+		return false
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	entry, ok := b.entries[addr.Unmap()]
+	if !ok || !time.Now().Before(entry.until) {
+		return false
+	}
+	delete(b.entries, addr.Unmap())
+	return true
+}
+
+// Save writes the IPs with strikes to Path, so bans and their escalation
+// survive a restart.
+func (b *BanList) Save() error {
+	if b == nil || b.Path == "" {
+		return nil
+	}
+	b.saving.Lock()
+	defer b.saving.Unlock()
+	bans := []Ban{}
+	b.lock.Lock()
+	for addr, entry := range b.entries {
+		if entry.strikes > 0 {
+			bans = append(bans, Ban{IP: addr.String(), Until: entry.until, Strikes: entry.strikes})
+		}
+	}
+	b.lock.Unlock()
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].IP < bans[j].IP
+	})
+	data, err := json.MarshalIndent(bans, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(b.Path, data)
+}
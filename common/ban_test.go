@@ -0,0 +1,75 @@
+package common
+
+import (
+	"net/http"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBanListEscalates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.json")
+	conf := BanConfig{BanThreshold: 2, BanDuration: "1m", BanMaxDuration: "3m", BanFile: path}
+	bans, err := NewBanList(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := netip.MustParseAddr("203.0.113.7")
+	if bans.Fail(addr) != 0 || bans.Banned(addr) {
+		t.Fatal("banned below the threshold")
+	}
+	for i, want := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute} {
+		if got := bans.Fail(addr); got != want {
+			t.Fatalf("ban %d: got %v want %v", i, got, want)
+		}
+		if !bans.Banned(addr) || bans.Fail(addr) != 0 {
+			t.Fatalf("ban %d: not banned", i)
+		}
+		// let the ban expire
+		bans.entries[addr].until = time.Now().Add(-time.Second)
+		bans.entries[addr].failures = nil
+		bans.Fail(addr)
+	}
+	bans.entries[addr].until = time.Now().Add(time.Minute)
+	if err := bans.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := NewBanList(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := reloaded.Bans(); len(list) != 1 || list[0].IP != "203.0.113.7" || list[0].Strikes != 3 {
+		t.Fatalf("unexpected bans after reload: %+v", list)
+	}
+	if !reloaded.Unban("203.0.113.7") || reloaded.Banned(addr) || reloaded.Unban("203.0.113.7") {
+		t.Fatal("unban failed")
+	}
+}
+
+func TestBanListClientIP(t *testing.T) {
+	bans, err := NewBanList(BanConfig{TrustedProxies: "127.0.0.1,10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		remote string
+		xff    []string
+		want   string
+	}{
+		{"198.51.100.1:4000", []string{"203.0.113.7"}, "198.51.100.1"},
+		{"127.0.0.1:4000", nil, "127.0.0.1"},
+		{"127.0.0.1:4000", []string{"1.2.3.4, 203.0.113.7"}, "203.0.113.7"},
+		{"127.0.0.1:4000", []string{"203.0.113.7", "10.1.2.3"}, "203.0.113.7"},
+		{"127.0.0.1:4000", []string{"10.1.2.3, bogus"}, "127.0.0.1"},
+	} {
+		r := &http.Request{RemoteAddr: tc.remote, Header: http.Header{FORWARDED_FOR_HEADER: tc.xff}}
+		if got := bans.ClientIP(r); got.String() != tc.want {
+			t.Fatalf("%s %v: got %s want %s", tc.remote, tc.xff, got, tc.want)
+		}
+	}
+	if err := (BanConfig{TrustedProxies: "proxy"}).Validate(); err == nil {
+		t.Fatal("expected a bad trusted proxy to be refused")
+	}
+}
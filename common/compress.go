@@ -0,0 +1,199 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+type Codec byte
+
+const (
+	CODEC_NONE Codec = iota
+	CODEC_ZSTD
+	CODEC_SNAPPY
+)
+
+const (
+	DEFAULT_COMPRESS_THRESHOLD = 256
+	MAX_DECOMPRESSED_LENGTH    = 4 << 20
+)
+
+// SupportedCodecs is the preference order used when a peer accepts any codec.
+var SupportedCodecs = []Codec{CODEC_ZSTD, CODEC_SNAPPY}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+func (c Codec) String() string {
+	switch c {
+	case CODEC_NONE:
+		return "none"
+	case CODEC_ZSTD:
+		return "zstd"
+	case CODEC_SNAPPY:
+		return "snappy"
+	default:
+		return fmt.Sprintf("codec(%d)", byte(c))
+	}
+}
+
+func ParseCodec(name string) (Codec, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "none":
+		return CODEC_NONE, nil
+	case "zstd":
+		return CODEC_ZSTD, nil
+	case "snappy":
+		return CODEC_SNAPPY, nil
+	default:
+		return CODEC_NONE, fmt.Errorf("unsupported compression codec %q", name)
+	}
+}
+
+// ParseCodecs parses a comma-separated preference list, "none" entries are dropped.
+func ParseCodecs(value string) ([]Codec, error) {
+	codecs := []Codec{}
+	for _, name := range strings.Split(value, ",") {
+		codec, err := ParseCodec(name)
+		if err != nil {
+			return nil, err
+		}
+		if codec != CODEC_NONE {
+			codecs = append(codecs, codec)
+		}
+	}
+	return codecs, nil
+}
+
+func FormatCodecs(codecs []Codec) string {
+	names := make([]string, 0, len(codecs))
+	for _, codec := range codecs {
+		names = append(names, codec.String())
+	}
+	return strings.Join(names, ",")
+}
+
+// AtomicCodec is the codec a websocket compresses with. It starts as none and
+// is agreed on inside the encrypted CONNECT and its ack, so the handshake
+// tells nothing. Every message names its codec, which keeps a change safe
+// while others are in flight.
+type AtomicCodec struct {
+	value atomic.Uint32
+}
+
+// Load returns the codec, a nil AtomicCodec is none.
+func (c *AtomicCodec) Load() Codec {
+	if c == nil {
+		return CODEC_NONE
+	}
+	return Codec(c.value.Load())
+}
+
+func (c *AtomicCodec) Store(codec Codec) {
+	c.value.Store(uint32(codec))
+}
+
+// NegotiateCodec picks the first codec offered by the peer that is also accepted locally.
+func NegotiateCodec(offer string, accepted []Codec) Codec {
+	for _, name := range strings.Split(offer, ",") {
+		codec, err := ParseCodec(name)
+		if err != nil || codec == CODEC_NONE {
+			continue
+		}
+		for _, candidate := range accepted {
+			if candidate == codec {
+				return codec
+			}
+		}
+	}
+	return CODEC_NONE
+}
+
+// IsCompressed sniffs payloads that will not shrink any further, e.g. TLS
+// records, media and archive formats.
+func IsCompressed(data []byte) bool {
+	if len(data) >= 3 && data[0] >= 0x14 && data[0] <= 0x17 && data[1] == 0x03 && data[2] <= 0x04 {
+		return true
+	}
+	for _, magic := range compressedMagics {
+		if bytes.HasPrefix(data, magic) {
+			return true
+		}
+	}
+	return false
+}
+
+var compressedMagics = [][]byte{
+	{0x1f, 0x8b},             // gzip
+	{0x28, 0xb5, 0x2f, 0xfd}, // zstd
+	{0xff, 0x06, 0x00, 0x00}, // snappy framed
+	{0x42, 0x5a, 0x68},       // bzip2
+	{0xfd, '7', 'z', 'X', 'Z'},
+	{'P', 'K', 0x03, 0x04},
+	{0x89, 'P', 'N', 'G'},
+	{0xff, 0xd8, 0xff},
+	{'G', 'I', 'F', '8'},
+	{'R', 'I', 'F', 'F'},
+	{'w', 'O', 'F', '2'},
+	{'O', 'g', 'g', 'S'},
+	{0x1a, 0x45, 0xdf, 0xa3}, // matroska/webm
+}
+
+func initZstd() error {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+		if zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(MAX_DECOMPRESSED_LENGTH))
+	})
+	return zstdErr
+}
+
+func compressData(codec Codec, data []byte) ([]byte, error) {
+	switch codec {
+	case CODEC_ZSTD:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		return zstdEncoder.EncodeAll(data, nil), nil
+	case CODEC_SNAPPY:
+		return s2.EncodeSnappy(nil, data), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression codec %d", byte(codec))
+	}
+}
+
+func decompressData(codec Codec, data []byte) ([]byte, error) {
+	switch codec {
+	case CODEC_NONE:
+		return data, nil
+	case CODEC_ZSTD:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		return zstdDecoder.DecodeAll(data, nil)
+	case CODEC_SNAPPY:
+		size, err := s2.DecodedLen(data)
+		if err != nil {
+			return nil, err
+		}
+		if size > MAX_DECOMPRESSED_LENGTH {
+			return nil, errors.New("decompressed data is too long")
+		}
+		return s2.Decode(nil, data)
+	default:
+		return nil, fmt.Errorf("unsupported compression codec %d", byte(codec))
+	}
+}
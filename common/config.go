@@ -0,0 +1,454 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/observerss/detour2/logger"
+
+	"gopkg.in/yaml.v3"
+)
+
+// PASSWORD_ENV is used as the default password so it does not have to be
+// passed on the command line, where it shows up in ps.
+const PASSWORD_ENV = "DETOUR_PASSWORD"
+
+var envPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// LoadConfig decodes a json or yaml file into conf. Unknown keys are errors,
+// and ${VAR} / ${VAR:-default} in strings are replaced from the environment
+// after parsing, so values need no quoting. An unquoted yaml value that is
+// only a ${VAR} takes the type of its value, e.g. poolSize: ${POOL}.
+func LoadConfig(path string, conf any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var value any
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		node := yaml.Node{}
+		if err := yaml.Unmarshal(data, &node); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if err := expandNode(&node); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if err := node.Decode(&value); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	default:
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		if err := decoder.Decode(&value); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if value, err = expandValue(value); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if value == nil {
+		return nil
+	}
+	data, err = json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(conf); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// WriteFileAtomic replaces path with data through a temporary file in the
+// same directory, so a crash never leaves half a file behind.
+func WriteFileAtomic(path string, data []byte) error {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	err = errors.Join(err, file.Close())
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+// ExpandEnv substitutes ${VAR} and ${VAR:-default}, a bare $ is left alone
+// so passwords may still contain it.
+func ExpandEnv(text string) (string, error) {
+	errs := []error{}
+	text = envPattern.ReplaceAllStringFunc(text, func(match string) string {
+		groups := envPattern.FindStringSubmatch(match)
+		value, ok := os.LookupEnv(groups[1])
+		if ok && value != "" {
+			return value
+		}
+		if groups[2] != "" {
+			return groups[3]
+		}
+		if !ok {
+			errs = append(errs, fmt.Errorf("environment variable %s is not set", groups[1]))
+		}
+		return ""
+	})
+	return text, errors.Join(errs...)
+}
+
+// expandValue runs ExpandEnv on the keys and strings of decoded json.
+func expandValue(value any) (any, error) {
+	switch value := value.(type) {
+	case string:
+		return ExpandEnv(value)
+	case []any:
+		errs := []error{}
+		for i, item := range value {
+			var err error
+			value[i], err = expandValue(item)
+			errs = append(errs, err)
+		}
+		return value, errors.Join(errs...)
+	case map[string]any:
+		errs := []error{}
+		expanded := make(map[string]any, len(value))
+		for key, item := range value {
+			key, err := ExpandEnv(key)
+			errs = append(errs, err)
+			expanded[key], err = expandValue(item)
+			errs = append(errs, err)
+		}
+		return expanded, errors.Join(errs...)
+	}
+	return value, nil
+}
+
+// expandNode runs ExpandEnv on the scalars of a yaml document. A plain
+// scalar that is a single reference is typed again from its new value,
+// anything else stays a string.
+func expandNode(node *yaml.Node) error {
+	errs := []error{}
+	if node.Kind == yaml.ScalarNode && envPattern.MatchString(node.Value) {
+		whole := envPattern.FindString(node.Value) == node.Value
+		value, err := ExpandEnv(node.Value)
+		errs = append(errs, err)
+		node.Value = value
+		if whole && node.Style == 0 {
+			node.Tag = ""
+		} else {
+			node.Tag, node.Style = "!!str", yaml.DoubleQuotedStyle
+		}
+	}
+	for _, child := range node.Content {
+		errs = append(errs, expandNode(child))
+	}
+	return errors.Join(errs...)
+}
+
+// PoolKeys maps every pool key ("url#i") to its remote url.
+func PoolKeys(remotes string, poolSize int) map[string]string {
+	if poolSize < 1 {
+		poolSize = 1
+	}
+	keys := map[string]string{}
+	for _, url := range strings.Split(remotes, ",") {
+		url = strings.TrimSpace(url)
+		if url == "" {
+			continue
+		}
+		for i := 0; i < poolSize; i++ {
+			keys[fmt.Sprintf("%s#%d", url, i)] = url
+		}
+	}
+	return keys
+}
+
+// InboundListeners returns the listeners to serve, Listen and Proto are used
+// when Listeners is empty. Names default to the proto.
+func (c *LocalConfig) InboundListeners() []ListenerConfig {
+	listeners := c.Listeners
+	if len(listeners) == 0 {
+		if c.Proto == "" {
+			return nil
+		}
+		listeners = []ListenerConfig{{Listen: c.Listen, Proto: c.Proto}}
+	}
+	inbounds := make([]ListenerConfig, 0, len(listeners))
+	for _, listener := range listeners {
+		if listener.Name == "" {
+			listener.Name = listener.Proto
+		}
+		inbounds = append(inbounds, listener)
+	}
+	return inbounds
+}
+
+func (c *LocalConfig) Validate() error {
+	errs := []error{}
+	if len(c.Listeners) == 0 {
+		errs = append(errs, validateListen("listen", c.Listen))
+	}
+	if strings.TrimSpace(c.Remotes) == "" {
+		errs = append(errs, errors.New("remotes: at least one remote is required"))
+	}
+	errs = append(errs, validateRemotes(c.Remotes))
+	if c.Password == "" {
+		errs = append(errs, errors.New("password: cannot be empty"))
+	}
+	switch c.Proto {
+	case "socks5", "http", "":
+	default:
+		errs = append(errs, fmt.Errorf("proto: %q is not supported, use socks5 or http", c.Proto))
+	}
+	names := map[string]bool{}
+	for i, listener := range c.Listeners {
+		if listener.Name == "" {
+			listener.Name = listener.Proto
+		}
+		name := fmt.Sprintf("listeners[%d]", i)
+		errs = append(errs, validateListen(name+".listen", listener.Listen))
+		switch listener.Proto {
+		case "socks5", "http":
+		default:
+			errs = append(errs, fmt.Errorf("%s.proto: %q is not supported, use socks5 or http", name, listener.Proto))
+		}
+		if names[listener.Name] {
+			errs = append(errs, fmt.Errorf("%s.name: %q is used twice", name, listener.Name))
+		}
+		names[listener.Name] = true
+		for user, password := range listener.Users {
+			if user == "" || password == "" {
+				errs = append(errs, fmt.Errorf("%s.users: username and password cannot be empty", name))
+			} else if len(user) > 255 || len(password) > 255 {
+				errs = append(errs, fmt.Errorf("%s.users: %q is longer than 255 bytes", name, user))
+			}
+		}
+	}
+	if c.PoolSize < 0 {
+		errs = append(errs, fmt.Errorf("poolSize: %d is negative", c.PoolSize))
+	}
+	errs = append(errs, validateAddress("metricsListen", c.MetricsListen))
+	errs = append(errs, validateAdmin(c.AdminListen, c.AdminToken))
+	errs = append(errs, validateCompress(c.Compress, c.CompressThreshold))
+	errs = append(errs, c.AccessLogConfig.Validate())
+	errs = append(errs, c.RateLimitConfig.Validate())
+	errs = append(errs, c.RemoteOptions.Validate())
+	errs = append(errs, validateTraceEndpoint(c.TraceEndpoint))
+	errs = append(errs, validateLog(c.LogFormat, c.LogLevel))
+	return errors.Join(errs...)
+}
+
+func (c *ServerConfig) Validate() error {
+	errs := []error{}
+	errs = append(errs, validateListen("listen", c.Listen))
+	errs = append(errs, validateRemotes(c.Remotes))
+	if c.Password == "" {
+		errs = append(errs, errors.New("password: cannot be empty"))
+	}
+	if c.RelayPoolSize < 0 {
+		errs = append(errs, fmt.Errorf("relayPoolSize: %d is negative", c.RelayPoolSize))
+	}
+	for _, server := range strings.Split(c.DNSServers, ",") {
+		server = strings.TrimSpace(server)
+		if server == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(server); err != nil && net.ParseIP(server) == nil {
+			errs = append(errs, fmt.Errorf("dnsServers: %q is not an ip or ip:port", server))
+		}
+	}
+	errs = append(errs, validateAddress("metricsListen", c.MetricsListen))
+	errs = append(errs, validateAdmin(c.AdminListen, c.AdminToken))
+	errs = append(errs, validateCompress(c.Compress, c.CompressThreshold))
+	errs = append(errs, c.AccessLogConfig.Validate())
+	errs = append(errs, c.ACLConfig.Validate())
+	errs = append(errs, c.QuotaConfig.Validate())
+	errs = append(errs, c.RateLimitConfig.Validate())
+	errs = append(errs, c.UsageConfig.Validate())
+	errs = append(errs, c.DecoyConfig.Validate())
+	errs = append(errs, c.BanConfig.Validate())
+	errs = append(errs, c.TLSConfig.Validate())
+	errs = append(errs, c.RemoteOptions.Validate())
+	errs = append(errs, validateTraceEndpoint(c.TraceEndpoint))
+	errs = append(errs, validateLog(c.LogFormat, c.LogLevel))
+	return errors.Join(errs...)
+}
+
+func (c QuotaConfig) Validate() error {
+	errs := []error{}
+	for _, field := range []struct {
+		name  string
+		value float64
+	}{
+		{"maxStreams", float64(c.MaxStreams)},
+		{"maxStreamsPerWebsocket", float64(c.MaxStreamsPerWebsocket)},
+		{"maxStreamsPerUser", float64(c.MaxStreamsPerUser)},
+		{"connectRate", c.ConnectRate},
+	} {
+		if field.value < 0 {
+			errs = append(errs, fmt.Errorf("%s: %v is negative", field.name, field.value))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c *DeployConfig) Validate() error {
+	errs := []error{}
+	if c.Mode != "server" && c.Mode != "local" {
+		errs = append(errs, fmt.Errorf("mode: %q should be either server or local", c.Mode))
+	}
+	for _, field := range []struct{ name, value string }{
+		{"accessKeyId", c.AccessKeyId},
+		{"accessKeySecret", c.AccessKeySecret},
+		{"accountId", c.AccountId},
+		{"region", c.Region},
+		{"serviceName", c.ServiceName},
+		{"functionName", c.FunctionName},
+		{"triggerName", c.TriggerName},
+		{"image", c.Image},
+	} {
+		if field.value == "" {
+			errs = append(errs, fmt.Errorf("%s: cannot be empty", field.name))
+		}
+	}
+	if c.Password == "" && !c.Remove {
+		errs = append(errs, errors.New("password: cannot be empty"))
+	}
+	if c.PublicPort < 1 || c.PublicPort > 65535 {
+		errs = append(errs, fmt.Errorf("publicPort: %d is not a valid port", c.PublicPort))
+	}
+	return errors.Join(errs...)
+}
+
+func (c DecoyConfig) Validate() error {
+	errs := []error{}
+	if path := strings.TrimSpace(c.WSPath); path != "" && !strings.HasPrefix(path, "/") {
+		errs = append(errs, fmt.Errorf("wsPath: %q should start with /", path))
+	}
+	if value := strings.TrimSpace(c.DecoyURL); value != "" {
+		u, err := url.Parse(value)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("decoyURL: %q should look like https://www.example.com", value))
+		}
+		if strings.TrimSpace(c.DecoyDir) != "" {
+			errs = append(errs, errors.New("decoyDir: cannot be set together with decoyURL"))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c TLSConfig) Validate() error {
+	errs := []error{}
+	cert, key := strings.TrimSpace(c.TLSCert) != "", strings.TrimSpace(c.TLSKey) != ""
+	if cert != key {
+		errs = append(errs, errors.New("tlsCert: tlsCert and tlsKey go together"))
+	}
+	if cert && c.TLSSelfSigned {
+		errs = append(errs, errors.New("tlsSelfSigned: cannot be set together with tlsCert"))
+	}
+	if strings.TrimSpace(c.TLSClientCA) != "" && !cert && !c.TLSSelfSigned {
+		errs = append(errs, errors.New("tlsClientCA: needs tlsCert or tlsSelfSigned"))
+	}
+	return errors.Join(errs...)
+}
+
+// Enabled reports whether the server terminates TLS.
+func (c TLSConfig) Enabled() bool {
+	return strings.TrimSpace(c.TLSCert) != "" || c.TLSSelfSigned
+}
+
+func validateListen(name string, value string) error {
+	network, address, ok := strings.Cut(value, "://")
+	if !ok || network != "tcp" {
+		return fmt.Errorf("%s: %q should look like tcp://host:port", name, value)
+	}
+	return validateAddress(name, address)
+}
+
+func validateAddress(name string, value string) error {
+	if strings.TrimSpace(value) == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(strings.TrimSpace(value)); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+func validateAdmin(listen string, token string) error {
+	if strings.TrimSpace(listen) == "" {
+		return nil
+	}
+	if token == "" {
+		return errors.New("adminToken: cannot be empty when adminListen is set")
+	}
+	return validateAddress("adminListen", listen)
+}
+
+func validateTraceEndpoint(value string) error {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil
+	}
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("traceEndpoint: %q should look like http://host:4318/v1/traces", value)
+	}
+	return nil
+}
+
+func validateLog(format string, level string) error {
+	errs := []error{}
+	switch format {
+	case "", logger.FORMAT_TEXT, logger.FORMAT_JSON:
+	default:
+		errs = append(errs, fmt.Errorf("logFormat: %q should be text or json", format))
+	}
+	if _, err := logger.ParseLevels(level); err != nil {
+		errs = append(errs, fmt.Errorf("logLevel: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+func validateRemotes(value string) error {
+	errs := []error{}
+	for _, remote := range strings.Split(value, ",") {
+		remote = strings.TrimSpace(remote)
+		if remote == "" {
+			continue
+		}
+		u, err := url.Parse(remote)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("remotes: %w", err))
+			continue
+		}
+		if (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("remotes: %q should look like ws://host:port/ws", remote))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func validateCompress(value string, threshold int) error {
+	errs := []error{}
+	if _, err := ParseCodecs(value); err != nil {
+		errs = append(errs, fmt.Errorf("compress: %w", err))
+	}
+	if threshold < 0 {
+		errs = append(errs, fmt.Errorf("compressThreshold: %d is negative", threshold))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,115 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigYAMLWithEnv(t *testing.T) {
+	t.Setenv("DETOUR_TEST_SECRET", "s3cr$t")
+	path := writeConfig(t, "local.yaml", `
+listen: tcp://127.0.0.1:3810
+remotes: ws://127.0.0.1:3811/ws
+password: ${DETOUR_TEST_SECRET}
+proto: ${DETOUR_TEST_PROTO:-http}
+poolSize: 2
+`)
+	conf := &LocalConfig{PoolSize: 64, CompressThreshold: DEFAULT_COMPRESS_THRESHOLD}
+	if err := LoadConfig(path, conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.Password != "s3cr$t" || conf.Proto != "http" || conf.PoolSize != 2 || conf.CompressThreshold != DEFAULT_COMPRESS_THRESHOLD {
+		t.Fatalf("unexpected config %+v", conf)
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadConfigEnvValuesAreNotParsed(t *testing.T) {
+	secret := "&a *b \"c\" \\d\n# e: f"
+	t.Setenv("DETOUR_TEST_SECRET", secret)
+	t.Setenv("DETOUR_TEST_POOL", "3")
+	for _, path := range []string{
+		writeConfig(t, "local.yaml", "password: ${DETOUR_TEST_SECRET}\nadminToken: \"t-${DETOUR_TEST_SECRET}\"\npoolSize: ${DETOUR_TEST_POOL}\n"),
+		writeConfig(t, "local.json", `{"password": "${DETOUR_TEST_SECRET}", "adminToken": "t-${DETOUR_TEST_SECRET}", "poolSize": 3}`),
+	} {
+		conf := &LocalConfig{}
+		if err := LoadConfig(path, conf); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if conf.Password != secret || !strings.HasSuffix(conf.AdminToken, secret) || conf.PoolSize != 3 {
+			t.Fatalf("%s: unexpected config %+v", path, conf)
+		}
+	}
+}
+
+func TestLoadConfigRejectsUnknownKeysAndMissingEnv(t *testing.T) {
+	path := writeConfig(t, "server.json", `{"listen": "tcp://0.0.0.0:3811", "pasword": "x"}`)
+	if err := LoadConfig(path, &ServerConfig{}); err == nil || !strings.Contains(err.Error(), "pasword") {
+		t.Fatalf("expected unknown field error, got %v", err)
+	}
+
+	path = writeConfig(t, "server.yml", "password: ${DETOUR_TEST_UNSET}\n")
+	if err := LoadConfig(path, &ServerConfig{}); err == nil || !strings.Contains(err.Error(), "DETOUR_TEST_UNSET") {
+		t.Fatalf("expected missing env error, got %v", err)
+	}
+}
+
+func TestValidateReportsAllErrors(t *testing.T) {
+	conf := &LocalConfig{
+		Listen:   "0.0.0.0:3810",
+		Remotes:  "http://127.0.0.1:3811/ws",
+		Proto:    "socks4",
+		Compress: "gzip",
+	}
+	err := conf.Validate()
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, field := range []string{"listen", "remotes", "password", "proto", "compress"} {
+		if !strings.Contains(err.Error(), field+":") {
+			t.Errorf("missing %s error in %q", field, err)
+		}
+	}
+}
+
+func TestValidateListeners(t *testing.T) {
+	conf := &LocalConfig{
+		Remotes:  "ws://127.0.0.1:3811/ws",
+		Password: "pass123",
+		Listeners: []ListenerConfig{
+			{Listen: "tcp://0.0.0.0:7777", Proto: "http"},
+			{Listen: "tcp://0.0.0.0:7778", Proto: "http", Users: map[string]string{"alice": ""}},
+			{Name: "socks", Listen: "0.0.0.0:7776", Proto: "socks4"},
+		},
+	}
+	err := conf.Validate()
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, field := range []string{"listeners[1].name", "listeners[1].users", "listeners[2].listen", "listeners[2].proto"} {
+		if !strings.Contains(err.Error(), field+":") {
+			t.Errorf("missing %s error in %q", field, err)
+		}
+	}
+
+	conf.Listeners = conf.Listeners[:1]
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if listeners := conf.InboundListeners(); len(listeners) != 1 || listeners[0].Name != "http" {
+		t.Fatalf("unexpected inbound listeners: %+v", listeners)
+	}
+}
@@ -0,0 +1,193 @@
+package common
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// PIN_PREFIX may lead a pin, as in the pin-sha256 of HPKP.
+const PIN_PREFIX = "sha256/"
+
+// reservedHeaders are set by the websocket handshake or detour itself.
+var reservedHeaders = []string{"Upgrade", "Connection", "Sec-Websocket-Key", "Sec-Websocket-Version",
+	"Sec-Websocket-Extensions", "Sec-Websocket-Protocol", AUTH_HEADER}
+
+// RemoteConfig tunes dialing one remote. Address, SNI and Host can differ
+// from the host of the url, so a websocket may reach a relay through the
+// edge of a CDN.
+type RemoteConfig struct {
+	CA          string            `json:"ca" example:"/etc/detour2/ca.pem"` // PEM bundle trusted instead of the system roots
+	Pins        []string          `json:"pins"`                             // base64 SHA-256 of an SPKI, one certificate of the verified chain (the leaf when insecure) has to match
+	SNI         string            `json:"sni" example:"cdn.example.com"`
+	Insecure    bool              `json:"insecure"`                                     // skip certificate verification, pins still apply
+	ClientCert  string            `json:"clientCert" example:"/etc/detour2/client.pem"` // presented to a server with tlsClientCA
+	ClientKey   string            `json:"clientKey" example:"/etc/detour2/client-key.pem"`
+	Address     string            `json:"address" example:"203.0.113.7:443"` // host:port the TCP connection goes to
+	Host        string            `json:"host" example:"relay.example.com"`  // HTTP Host header
+	Headers     map[string]string `json:"headers"`                           // extra handshake headers, e.g. User-Agent
+	Subprotocol string            `json:"subprotocol" example:"chat"`
+}
+
+func (c RemoteConfig) Equal(other RemoteConfig) bool {
+	return c.CA == other.CA && c.SNI == other.SNI && c.Insecure == other.Insecure && slices.Equal(c.Pins, other.Pins) &&
+		c.ClientCert == other.ClientCert && c.ClientKey == other.ClientKey &&
+		c.Address == other.Address && c.Host == other.Host && maps.Equal(c.Headers, other.Headers) && c.Subprotocol == other.Subprotocol
+}
+
+// RemoteOptions maps remote urls to their RemoteConfig, "*" applies to the
+// remotes not listed.
+type RemoteOptions map[string]RemoteConfig
+
+// For returns the RemoteConfig of url.
+func (o RemoteOptions) For(url string) RemoteConfig {
+	if conf, ok := o[strings.TrimSpace(url)]; ok {
+		return conf
+	}
+	return o["*"]
+}
+
+func (o RemoteOptions) Validate() error {
+	errs := []error{}
+	for url, conf := range o {
+		if url != "*" && (strings.TrimSpace(url) == "" || validateRemotes(url) != nil) {
+			errs = append(errs, fmt.Errorf("remoteOptions: %q should be a remote url or *", url))
+		}
+		if err := conf.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("remoteOptions.%s: %w", url, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c RemoteConfig) Validate() error {
+	errs := []error{}
+	if _, err := c.TLSConfig(); err != nil {
+		errs = append(errs, err)
+	}
+	if address := strings.TrimSpace(c.Address); address != "" {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			errs = append(errs, fmt.Errorf("address: %q is not host:port", c.Address))
+		}
+	}
+	if strings.ContainsAny(c.Host, " /\t\r\n") {
+		errs = append(errs, fmt.Errorf("host: %q is not a host", c.Host))
+	}
+	for name, value := range c.Headers {
+		if name == "" || strings.ContainsAny(name, " :\t\r\n") || strings.ContainsAny(value, "\r\n") {
+			errs = append(errs, fmt.Errorf("headers: %q is not a valid header", name))
+		} else if slices.Contains(reservedHeaders, http.CanonicalHeaderKey(name)) || http.CanonicalHeaderKey(name) == "Host" {
+			errs = append(errs, fmt.Errorf("headers: %s is set by the handshake, use host or subprotocol", name))
+		}
+	}
+	if strings.ContainsAny(c.Subprotocol, " ,\t") {
+		errs = append(errs, fmt.Errorf("subprotocol: %q is not a token", c.Subprotocol))
+	}
+	return errors.Join(errs...)
+}
+
+// SetHeaders adds Host and the extra headers of c to the handshake header.
+func (c RemoteConfig) SetHeaders(header http.Header) {
+	for name, value := range c.Headers {
+		header.Set(name, value)
+	}
+	if host := strings.TrimSpace(c.Host); host != "" {
+		header.Set("Host", host)
+	}
+}
+
+// CertPin returns the pin of cert, the base64 SHA-256 of its SPKI.
+func CertPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// TLSConfig returns the client config of c, nil when c changes nothing.
+func (c RemoteConfig) TLSConfig() (*tls.Config, error) {
+	if c.CA == "" && len(c.Pins) == 0 && c.SNI == "" && !c.Insecure && c.ClientCert == "" && c.ClientKey == "" {
+		return nil, nil
+	}
+	config := &tls.Config{ServerName: strings.TrimSpace(c.SNI), InsecureSkipVerify: c.Insecure}
+	certFile, keyFile := strings.TrimSpace(c.ClientCert), strings.TrimSpace(c.ClientKey)
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("clientCert: clientCert and clientKey go together")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("clientCert: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if path := strings.TrimSpace(c.CA); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("ca: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("ca: no certificates in %s", path)
+		}
+	}
+	if len(c.Pins) > 0 {
+		pins := map[string]bool{}
+		for _, pin := range c.Pins {
+			pin = strings.TrimPrefix(strings.TrimSpace(pin), PIN_PREFIX)
+			if sum, err := base64.StdEncoding.DecodeString(pin); err != nil || len(sum) != sha256.Size {
+				return nil, fmt.Errorf("pins: %q is not a base64 SHA-256", pin)
+			}
+			pins[pin] = true
+		}
+		insecure := c.Insecure
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			// anyone may append a pinned certificate to what they send, so
+			// only the verified chains count, or the leaf when not verifying
+			certs := state.PeerCertificates[:min(1, len(state.PeerCertificates))]
+			if !insecure {
+				certs = nil
+				for _, chain := range state.VerifiedChains {
+					certs = append(certs, chain...)
+				}
+			}
+			for _, cert := range certs {
+				if pins[CertPin(cert)] {
+					return nil
+				}
+			}
+			return errors.New("tls: no certificate of the remote matches the pins")
+		}
+	}
+	return config, nil
+}
+
+// NewWebsocketDialer returns a dialer of remotes configured by conf, the
+// handshake header needs conf.SetHeaders too.
+func NewWebsocketDialer(conf RemoteConfig, timeout time.Duration) (*websocket.Dialer, error) {
+	config, err := conf.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	dialer := &websocket.Dialer{HandshakeTimeout: timeout, TLSClientConfig: config}
+	if address := strings.TrimSpace(conf.Address); address != "" {
+		dialer.NetDialContext = func(ctx context.Context, network string, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, address)
+		}
+	}
+	if protocol := strings.TrimSpace(conf.Subprotocol); protocol != "" {
+		dialer.Subprotocols = []string{protocol}
+	}
+	return dialer, nil
+}
@@ -0,0 +1,163 @@
+package common
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRemoteConfigVerifiesRemote(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.NotFoundHandler())
+	ts.Config.ErrorLog = log.New(io.Discard, "", 0)
+	ts.StartTLS()
+	defer ts.Close()
+	address := ts.Listener.Addr().String()
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	pin := CertPin(ts.Certificate())
+	other := "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="
+
+	for _, tc := range []struct {
+		name string
+		conf RemoteConfig
+		ok   bool
+	}{
+		{"system roots", RemoteConfig{}, false},
+		{"ca", RemoteConfig{CA: ca}, true},
+		{"ca and sni", RemoteConfig{CA: ca, SNI: "example.com"}, true},
+		{"ca and wrong sni", RemoteConfig{CA: ca, SNI: "wrong.test"}, false},
+		{"insecure", RemoteConfig{Insecure: true}, true},
+		{"pin", RemoteConfig{Insecure: true, Pins: []string{other, PIN_PREFIX + pin}}, true},
+		{"wrong pin", RemoteConfig{Insecure: true, Pins: []string{other}}, false},
+		{"ca and wrong pin", RemoteConfig{CA: ca, Pins: []string{other}}, false},
+	} {
+		config, err := tc.conf.TLSConfig()
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if config == nil {
+			config = &tls.Config{}
+		}
+		conn, err := tls.Dial("tcp", address, config)
+		if err == nil {
+			conn.Close()
+		}
+		if (err == nil) != tc.ok {
+			t.Fatalf("%s: dial error %v, want ok %v", tc.name, err, tc.ok)
+		}
+	}
+}
+
+func TestRemoteOptionsValidate(t *testing.T) {
+	options := RemoteOptions{
+		"*":                      {Insecure: true},
+		"wss://a.example.com/ws": {Pins: []string{"sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="}},
+	}
+	if err := options.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if conf := options.For("wss://b.example.com/ws"); !conf.Insecure {
+		t.Fatalf("remote without an entry did not get *: %+v", conf)
+	}
+	for _, bad := range []RemoteOptions{
+		{"a.example.com": {}},
+		{"*": {Pins: []string{"short"}}},
+		{"*": {CA: filepath.Join(t.TempDir(), "missing.pem")}},
+		{"*": {Address: "203.0.113.7"}},
+		{"*": {ClientCert: "client.pem"}},
+		{"*": {Headers: map[string]string{"sec-websocket-key": "x"}}},
+		{"*": {Headers: map[string]string{"Host": "relay.example.com"}}},
+		{"*": {Headers: map[string]string{"X-Token": "a\r\nb"}}},
+	} {
+		if err := bad.Validate(); err == nil {
+			t.Fatalf("%+v accepted", bad)
+		}
+	}
+}
+
+func selfSigned(t *testing.T, name string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestRemoteConfigPinIgnoresAppendedCert(t *testing.T) {
+	pinned, foreign := selfSigned(t, "pinned"), selfSigned(t, "interceptor")
+	// an interceptor serves its own leaf with the pinned certificate appended
+	served := foreign
+	served.Certificate = [][]byte{foreign.Certificate[0], pinned.Certificate[0]}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{served}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: foreign.Certificate[0]}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, conf := range []RemoteConfig{
+		{Insecure: true, Pins: []string{CertPin(pinned.Leaf)}},
+		{CA: ca, Pins: []string{CertPin(pinned.Leaf)}},
+	} {
+		config, err := conf.TLSConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn, err := tls.Dial("tcp", listener.Addr().String(), config); err == nil {
+			conn.Close()
+			t.Fatalf("%+v: appended pinned certificate accepted", conf)
+		}
+	}
+	config, _ := RemoteConfig{CA: ca, Pins: []string{CertPin(foreign.Leaf)}}.TLSConfig()
+	conn, err := tls.Dial("tcp", listener.Addr().String(), config)
+	if err != nil {
+		t.Fatalf("verified leaf rejected: %v", err)
+	}
+	conn.Close()
+}
@@ -3,6 +3,7 @@ package common
 import (
 	"errors"
 	"sync"
+	"time"
 )
 
 const DefaultMessageQueueLimit = 64
@@ -25,6 +26,8 @@ type FairMessageWriter struct {
 	maxQueue int
 	done     chan struct{}
 	once     sync.Once
+
+	QueueWait *Histogram // optional, set before the first Write
 }
 
 type FairMessageWriterSnapshot struct {
@@ -35,8 +38,10 @@ type FairMessageWriterSnapshot struct {
 }
 
 type queuedMessage struct {
-	msg    *Message
-	result chan error
+	msg        *Message
+	result     chan error
+	queuedAt   time.Time
+	dequeuedAt time.Time
 }
 
 func NewFairMessageWriter(write MessageWriteFunc, maxQueuePerCID int) *FairMessageWriter {
@@ -59,8 +64,9 @@ func (w *FairMessageWriter) Write(msg *Message) error {
 		return ErrMessageWriterClosed
 	}
 	item := &queuedMessage{
-		msg:    CloneMessage(msg),
-		result: make(chan error, 1),
+		msg:      CloneMessage(msg),
+		result:   make(chan error, 1),
+		queuedAt: time.Now(),
 	}
 	key := messageQueueKey(msg)
 
@@ -82,7 +88,11 @@ func (w *FairMessageWriter) Write(msg *Message) error {
 	w.cond.Signal()
 	w.mu.Unlock()
 
-	return <-item.result
+	err := <-item.result
+	if !item.dequeuedAt.IsZero() {
+		w.QueueWait.Observe(item.dequeuedAt.Sub(item.queuedAt))
+	}
+	return err
 }
 
 func (w *FairMessageWriter) Close() {
@@ -144,6 +154,7 @@ func (w *FairMessageWriter) next() (*queuedMessage, bool) {
 	key := w.order[0]
 	queue := w.queues[key]
 	item := queue[0]
+	item.dequeuedAt = time.Now()
 	queue = queue[1:]
 	if len(queue) == 0 {
 		delete(w.queues, key)
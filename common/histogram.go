@@ -0,0 +1,100 @@
+package common
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// DURATION_BUCKETS are the upper bounds in seconds shared by every duration
+// histogram, wide enough for both round-trips and stream lifetimes.
+var DURATION_BUCKETS = [...]float64{
+	0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5,
+	1, 2.5, 5, 10, 30, 60, 300, 900, 3600,
+}
+
+// Histogram counts durations into DURATION_BUCKETS, it is safe for
+// concurrent use and the zero value is ready.
+type Histogram struct {
+	buckets  [len(DURATION_BUCKETS) + 1]atomic.Int64 // the last one is +Inf
+	sumNanos atomic.Int64
+}
+
+type HistogramSnapshot struct {
+	Count      int64             `json:"count"`
+	SumSeconds float64           `json:"sumSeconds"`
+	P50        float64           `json:"p50"`
+	P90        float64           `json:"p90"`
+	P99        float64           `json:"p99"`
+	Buckets    []HistogramBucket `json:"buckets"`
+}
+
+// HistogramBucket is cumulative like a Prometheus bucket, the +Inf bucket is
+// left out as it always equals Count.
+type HistogramBucket struct {
+	Le    float64 `json:"le"`
+	Count int64   `json:"count"`
+}
+
+func (h *Histogram) Observe(d time.Duration) {
+	if h == nil {
+		return
+	}
+	seconds := d.Seconds()
+	i := 0
+	for i < len(DURATION_BUCKETS) && seconds > DURATION_BUCKETS[i] {
+		i++
+	}
+	h.buckets[i].Add(1)
+	h.sumNanos.Add(int64(d))
+}
+
+// Since observes the time elapsed since start.
+func (h *Histogram) Since(start time.Time) {
+	h.Observe(time.Since(start))
+}
+
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	snapshot := HistogramSnapshot{Buckets: make([]HistogramBucket, len(DURATION_BUCKETS))}
+	if h == nil {
+		for i, le := range DURATION_BUCKETS {
+			snapshot.Buckets[i].Le = le
+		}
+		return snapshot
+	}
+	counts := make([]int64, len(h.buckets))
+	for i := range h.buckets {
+		counts[i] = h.buckets[i].Load()
+		snapshot.Count += counts[i]
+	}
+	snapshot.SumSeconds = float64(h.sumNanos.Load()) / float64(time.Second)
+	cumulative := int64(0)
+	for i, le := range DURATION_BUCKETS {
+		cumulative += counts[i]
+		snapshot.Buckets[i] = HistogramBucket{Le: le, Count: cumulative}
+	}
+	snapshot.P50 = snapshot.Quantile(0.5)
+	snapshot.P90 = snapshot.Quantile(0.9)
+	snapshot.P99 = snapshot.Quantile(0.99)
+	return snapshot
+}
+
+// Quantile estimates the q-quantile in seconds by interpolating inside the
+// bucket it falls in, values past the last bound report the last bound.
+func (s HistogramSnapshot) Quantile(q float64) float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	rank := q * float64(s.Count)
+	lower, below := 0.0, int64(0)
+	for _, bucket := range s.Buckets {
+		if float64(bucket.Count) >= rank {
+			inBucket := bucket.Count - below
+			if inBucket == 0 {
+				return bucket.Le
+			}
+			return lower + (bucket.Le-lower)*(rank-float64(below))/float64(inBucket)
+		}
+		lower, below = bucket.Le, bucket.Count
+	}
+	return lower
+}
@@ -0,0 +1,47 @@
+package common
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogramSnapshot(t *testing.T) {
+	h := &Histogram{}
+	for i := 0; i < 90; i++ {
+		h.Observe(3 * time.Millisecond)
+	}
+	for i := 0; i < 10; i++ {
+		h.Observe(2 * time.Hour)
+	}
+
+	snapshot := h.Snapshot()
+	if snapshot.Count != 100 || math.Abs(snapshot.SumSeconds-(0.27+72000)) > 1e-6 {
+		t.Fatalf("unexpected count or sum: %+v", snapshot)
+	}
+	if snapshot.Buckets[1].Count != 0 || snapshot.Buckets[2].Count != 90 || snapshot.Buckets[len(snapshot.Buckets)-1].Count != 90 {
+		t.Fatalf("unexpected buckets: %+v", snapshot.Buckets)
+	}
+	if snapshot.P50 <= 0.0025 || snapshot.P50 > 0.005 {
+		t.Fatalf("p50 should fall in the 5ms bucket: %v", snapshot.P50)
+	}
+	if snapshot.P99 != 3600 {
+		t.Fatalf("p99 past the last bound should report it: %v", snapshot.P99)
+	}
+
+	p := NewPromWriter()
+	p.Histogram("detour_test_seconds", "Test.", snapshot, "pool", "x")
+	var out strings.Builder
+	p.WriteTo(&out)
+	for _, line := range []string{
+		"# TYPE detour_test_seconds histogram",
+		`detour_test_seconds_bucket{pool="x",le="0.005"} 90`,
+		`detour_test_seconds_bucket{pool="x",le="+Inf"} 100`,
+		`detour_test_seconds_count{pool="x"} 100`,
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, out.String())
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package common
 
 import (
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -34,8 +35,11 @@ type RuntimeMetrics struct {
 	WebSocketActive         Counter
 	WebSocketReadErrors     Counter
 	WebSocketWriteErrors    Counter
+	AuthFailuresTotal       Counter // upgrades failing AUTH_HEADER and websockets sending frames that do not unpack
+	BannedRequestsTotal     Counter // requests refused because the client IP is banned
 	ConnectAttemptsTotal    Counter
 	ConnectFailuresTotal    Counter
+	ConnectDeniedTotal      Counter // CONNECTs refused by the destination ACL
 	RelayConnectFailures    Counter
 	QueueTimeoutsTotal      Counter
 	QueueFullTotal          Counter
@@ -43,6 +47,29 @@ type RuntimeMetrics struct {
 	MessagesOutTotal        Counter
 	PayloadBytesInTotal     Counter
 	PayloadBytesOutTotal    Counter
+
+	CompressedMessagesTotal   Counter
+	CompressSkippedTotal      Counter
+	CompressBytesInTotal      Counter
+	CompressBytesOutTotal     Counter
+	CompressNanosTotal        Counter
+	DecompressedMessagesTotal Counter
+	DecompressNanosTotal      Counter
+
+	ThrottledNanosTotal Counter // time streams waited for rate limits
+
+	ConfigReloadsTotal   Counter
+	ConfigReloadFailures Counter
+
+	ConnectRTT        Histogram // local CONNECT sent until its ack
+	DialDuration      Histogram // target dials on the exit server
+	HandshakeDuration Histogram // websocket dials to the next hop
+	QueueWait         Histogram // messages waiting in a FairMessageWriter
+	StreamLifetime    Histogram // streams from ack to close
+
+	reloadLock      sync.Mutex
+	lastReloadAt    time.Time
+	lastReloadError string
 }
 
 type RuntimeMetricsSnapshot struct {
@@ -54,8 +81,11 @@ type RuntimeMetricsSnapshot struct {
 	WebSocketActive         int64  `json:"webSocketActive"`
 	WebSocketReadErrors     int64  `json:"webSocketReadErrors"`
 	WebSocketWriteErrors    int64  `json:"webSocketWriteErrors"`
+	AuthFailuresTotal       int64  `json:"authFailuresTotal"`
+	BannedRequestsTotal     int64  `json:"bannedRequestsTotal"`
 	ConnectAttemptsTotal    int64  `json:"connectAttemptsTotal"`
 	ConnectFailuresTotal    int64  `json:"connectFailuresTotal"`
+	ConnectDeniedTotal      int64  `json:"connectDeniedTotal"`
 	RelayConnectFailures    int64  `json:"relayConnectFailures"`
 	QueueTimeoutsTotal      int64  `json:"queueTimeoutsTotal"`
 	QueueFullTotal          int64  `json:"queueFullTotal"`
@@ -63,16 +93,67 @@ type RuntimeMetricsSnapshot struct {
 	MessagesOutTotal        int64  `json:"messagesOutTotal"`
 	PayloadBytesInTotal     int64  `json:"payloadBytesInTotal"`
 	PayloadBytesOutTotal    int64  `json:"payloadBytesOutTotal"`
+
+	CompressedMessagesTotal   int64   `json:"compressedMessagesTotal"`
+	CompressSkippedTotal      int64   `json:"compressSkippedTotal"`
+	CompressBytesInTotal      int64   `json:"compressBytesInTotal"`
+	CompressBytesOutTotal     int64   `json:"compressBytesOutTotal"`
+	CompressionRatio          float64 `json:"compressionRatio"`
+	CompressNanosTotal        int64   `json:"compressNanosTotal"`
+	DecompressedMessagesTotal int64   `json:"decompressedMessagesTotal"`
+	DecompressNanosTotal      int64   `json:"decompressNanosTotal"`
+
+	ThrottledNanosTotal int64 `json:"throttledNanosTotal"`
+
+	ConfigReloadsTotal   int64  `json:"configReloadsTotal"`
+	ConfigReloadFailures int64  `json:"configReloadFailures"`
+	LastReloadAt         string `json:"lastReloadAt,omitempty"`
+	LastReloadError      string `json:"lastReloadError,omitempty"`
+
+	ConnectRTT        HistogramSnapshot `json:"connectRttSeconds"`
+	DialDuration      HistogramSnapshot `json:"dialSeconds"`
+	HandshakeDuration HistogramSnapshot `json:"handshakeSeconds"`
+	QueueWait         HistogramSnapshot `json:"queueWaitSeconds"`
+	StreamLifetime    HistogramSnapshot `json:"streamLifetimeSeconds"`
 }
 
 func NewRuntimeMetrics() *RuntimeMetrics {
 	return &RuntimeMetrics{StartedAt: time.Now()}
 }
 
+// RecordReload counts a config reload, err is kept until the next reload.
+func (m *RuntimeMetrics) RecordReload(err error) {
+	if m == nil {
+		return
+	}
+	m.ConfigReloadsTotal.Inc()
+	m.reloadLock.Lock()
+	defer m.reloadLock.Unlock()
+	m.lastReloadAt = time.Now()
+	m.lastReloadError = ""
+	if err != nil {
+		m.ConfigReloadFailures.Inc()
+		m.lastReloadError = err.Error()
+	}
+}
+
 func (m *RuntimeMetrics) Snapshot() RuntimeMetricsSnapshot {
 	if m == nil {
 		return RuntimeMetricsSnapshot{}
 	}
+	m.reloadLock.Lock()
+	lastReloadAt := ""
+	if !m.lastReloadAt.IsZero() {
+		lastReloadAt = m.lastReloadAt.Format(time.RFC3339)
+	}
+	lastReloadError := m.lastReloadError
+	m.reloadLock.Unlock()
+	compressIn := m.CompressBytesInTotal.Load()
+	compressOut := m.CompressBytesOutTotal.Load()
+	ratio := 0.0
+	if compressOut > 0 {
+		ratio = float64(compressIn) / float64(compressOut)
+	}
 	return RuntimeMetricsSnapshot{
 		StartedAt:               m.StartedAt.Format(time.RFC3339),
 		UptimeSeconds:           int64(time.Since(m.StartedAt).Seconds()),
@@ -82,8 +163,11 @@ func (m *RuntimeMetrics) Snapshot() RuntimeMetricsSnapshot {
 		WebSocketActive:         m.WebSocketActive.Load(),
 		WebSocketReadErrors:     m.WebSocketReadErrors.Load(),
 		WebSocketWriteErrors:    m.WebSocketWriteErrors.Load(),
+		AuthFailuresTotal:       m.AuthFailuresTotal.Load(),
+		BannedRequestsTotal:     m.BannedRequestsTotal.Load(),
 		ConnectAttemptsTotal:    m.ConnectAttemptsTotal.Load(),
 		ConnectFailuresTotal:    m.ConnectFailuresTotal.Load(),
+		ConnectDeniedTotal:      m.ConnectDeniedTotal.Load(),
 		RelayConnectFailures:    m.RelayConnectFailures.Load(),
 		QueueTimeoutsTotal:      m.QueueTimeoutsTotal.Load(),
 		QueueFullTotal:          m.QueueFullTotal.Load(),
@@ -91,5 +175,27 @@ func (m *RuntimeMetrics) Snapshot() RuntimeMetricsSnapshot {
 		MessagesOutTotal:        m.MessagesOutTotal.Load(),
 		PayloadBytesInTotal:     m.PayloadBytesInTotal.Load(),
 		PayloadBytesOutTotal:    m.PayloadBytesOutTotal.Load(),
+
+		CompressedMessagesTotal:   m.CompressedMessagesTotal.Load(),
+		CompressSkippedTotal:      m.CompressSkippedTotal.Load(),
+		CompressBytesInTotal:      compressIn,
+		CompressBytesOutTotal:     compressOut,
+		CompressionRatio:          ratio,
+		CompressNanosTotal:        m.CompressNanosTotal.Load(),
+		DecompressedMessagesTotal: m.DecompressedMessagesTotal.Load(),
+		DecompressNanosTotal:      m.DecompressNanosTotal.Load(),
+
+		ThrottledNanosTotal: m.ThrottledNanosTotal.Load(),
+
+		ConfigReloadsTotal:   m.ConfigReloadsTotal.Load(),
+		ConfigReloadFailures: m.ConfigReloadFailures.Load(),
+		LastReloadAt:         lastReloadAt,
+		LastReloadError:      lastReloadError,
+
+		ConnectRTT:        m.ConnectRTT.Snapshot(),
+		DialDuration:      m.DialDuration.Snapshot(),
+		HandshakeDuration: m.HandshakeDuration.Snapshot(),
+		QueueWait:         m.QueueWait.Snapshot(),
+		StreamLifetime:    m.StreamLifetime.Snapshot(),
 	}
 }
@@ -0,0 +1,217 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/observerss/detour2/logger"
+)
+
+const (
+	OTLP_BATCH_SIZE     = 256
+	OTLP_QUEUE_SIZE     = 4096
+	OTLP_FLUSH_INTERVAL = 2 * time.Second
+	OTLP_TIMEOUT        = 5 * time.Second
+
+	otlpKindInternal = 1
+	otlpKindServer   = 2
+	otlpKindClient   = 3
+	otlpStatusError  = 2
+)
+
+// OTLPExporter posts spans in batches to an OTLP/HTTP JSON endpoint such as
+// http://127.0.0.1:4318/v1/traces, spans are dropped when the queue is full.
+type OTLPExporter struct {
+	Endpoint string
+	Service  string
+	Client   *http.Client
+	Log      *slog.Logger
+	queue    chan Span
+	done     chan struct{}
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+func NewOTLPExporter(endpoint string, service string, log *slog.Logger) *OTLPExporter {
+	e := &OTLPExporter{
+		Endpoint: endpoint,
+		Service:  service,
+		Client:   &http.Client{Timeout: OTLP_TIMEOUT},
+		Log:      log,
+		queue:    make(chan Span, OTLP_QUEUE_SIZE),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+func (e *OTLPExporter) Export(span Span) {
+	select {
+	case e.queue <- span:
+	default:
+		e.Log.Debug("otlp, queue full, span dropped", logger.CID, span.Cid)
+	}
+}
+
+// Close sends the queued spans and stops the exporter.
+func (e *OTLPExporter) Close() {
+	e.stopOnce.Do(func() { close(e.done) })
+	<-e.stopped
+}
+
+func (e *OTLPExporter) run() {
+	defer close(e.stopped)
+	ticker := time.NewTicker(OTLP_FLUSH_INTERVAL)
+	defer ticker.Stop()
+	batch := []Span{}
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.post(batch); err != nil {
+			e.Log.Warn("otlp, export error", "spans", len(batch), logger.ERR, err)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case span := <-e.queue:
+			batch = append(batch, span)
+			if len(batch) >= OTLP_BATCH_SIZE {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-e.done:
+			for {
+				select {
+				case span := <-e.queue:
+					batch = append(batch, span)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (e *OTLPExporter) post(spans []Span) error {
+	body, err := json.Marshal(OTLPRequest(e.Service, spans))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), OTLP_TIMEOUT)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+// OTLPRequest builds the ExportTraceServiceRequest of spans, every phase
+// becomes a child span.
+func OTLPRequest(service string, spans []Span) map[string]any {
+	converted := make([]otlpSpan, 0, len(spans))
+	for _, span := range spans {
+		kind := otlpKindServer
+		if span.Hop == HOP_LOCAL {
+			kind = otlpKindClient
+		}
+		attributes := []otlpAttribute{
+			{Key: "detour.cid", Value: otlpValue{span.Cid}},
+			{Key: "detour.target", Value: otlpValue{span.Target}},
+			{Key: "detour.hop", Value: otlpValue{span.Hop}},
+		}
+		if span.Next != "" {
+			attributes = append(attributes, otlpAttribute{Key: "detour.next", Value: otlpValue{span.Next}})
+		}
+		status := otlpStatus{}
+		if span.Error != "" {
+			status = otlpStatus{Code: otlpStatusError, Message: span.Error}
+		}
+		converted = append(converted, otlpSpan{
+			TraceID:           span.TraceID,
+			SpanID:            span.SpanID,
+			ParentSpanID:      span.ParentID,
+			Name:              span.Hop + " connect",
+			Kind:              kind,
+			StartTimeUnixNano: unixNano(span.Start),
+			EndTimeUnixNano:   unixNano(span.End),
+			Attributes:        attributes,
+			Status:            status,
+		})
+		for _, phase := range span.Phases {
+			converted = append(converted, otlpSpan{
+				TraceID:           span.TraceID,
+				SpanID:            randomHex(8),
+				ParentSpanID:      span.SpanID,
+				Name:              phase.Name,
+				Kind:              otlpKindInternal,
+				StartTimeUnixNano: unixNano(phase.Start),
+				EndTimeUnixNano:   unixNano(phase.End),
+			})
+		}
+	}
+	return map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": []otlpAttribute{{Key: "service.name", Value: otlpValue{service}}},
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "github.com/observerss/detour2"},
+				"spans": converted,
+			}},
+		}},
+	}
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
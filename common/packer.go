@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"math/rand"
+	"time"
 
 	"github.com/observerss/detour2/crypto/shuffle"
 	"github.com/observerss/detour2/crypto/xxtea"
@@ -19,16 +20,25 @@ const (
 	MIN_INPUT_LENGTH  = 96
 	MAX_TARGET_LENGTH = 192
 	MESSAGE_VERSION   = 1
+	MESSAGE_VERSION_2 = 2 // adds a codec byte after the ok flag
 	MAX_STRING_LENGTH = 1<<16 - 1
 	MAX_DATA_LENGTH   = 1<<32 - 1
 )
 
 type Packer struct {
-	Password string
+	Password          string
+	CompressThreshold int
+	Metrics           *RuntimeMetrics
 }
 
 func (p *Packer) Pack(msg *Message) ([]byte, error) {
-	buf, err := EncodeMessage(msg)
+	return p.PackWith(msg, CODEC_NONE)
+}
+
+// PackWith packs msg compressing its Data with codec, the codec must have been
+// negotiated with the peer since older peers only understand MESSAGE_VERSION.
+func (p *Packer) PackWith(msg *Message, codec Codec) ([]byte, error) {
+	buf, err := p.encode(msg, codec)
 	if err != nil {
 		return nil, err
 	}
@@ -45,18 +55,62 @@ func (p *Packer) Unpack(data []byte) (*Message, error) {
 		return nil, err
 	}
 	buf := p.Decrypt(data)
-	return DecodeMessage(buf)
+	return decodeMessage(buf, p.Metrics)
+}
+
+func (p *Packer) encode(msg *Message, codec Codec) ([]byte, error) {
+	threshold := p.CompressThreshold
+	if threshold < 1 {
+		threshold = DEFAULT_COMPRESS_THRESHOLD
+	}
+	if codec == CODEC_NONE || len(msg.Data) < threshold {
+		return EncodeMessage(msg)
+	}
+	if IsCompressed(msg.Data) {
+		if p.Metrics != nil {
+			p.Metrics.CompressSkippedTotal.Inc()
+		}
+		return EncodeMessage(msg)
+	}
+
+	start := time.Now()
+	data, err := compressData(codec, msg.Data)
+	if err != nil {
+		return nil, err
+	}
+	if p.Metrics != nil {
+		p.Metrics.CompressNanosTotal.Add(int64(time.Since(start)))
+	}
+	if len(data) >= len(msg.Data) {
+		if p.Metrics != nil {
+			p.Metrics.CompressSkippedTotal.Inc()
+		}
+		return EncodeMessage(msg)
+	}
+	if p.Metrics != nil {
+		p.Metrics.CompressedMessagesTotal.Inc()
+		p.Metrics.CompressBytesInTotal.Add(int64(len(msg.Data)))
+		p.Metrics.CompressBytesOutTotal.Add(int64(len(data)))
+	}
+	return encodeMessage(msg, MESSAGE_VERSION_2, codec, data)
 }
 
 func EncodeMessage(msg *Message) ([]byte, error) {
+	return encodeMessage(msg, MESSAGE_VERSION, CODEC_NONE, msg.Data)
+}
+
+func encodeMessage(msg *Message, version byte, codec Codec, data []byte) ([]byte, error) {
 	buf := bytes.Buffer{}
-	buf.WriteByte(MESSAGE_VERSION)
+	buf.WriteByte(version)
 	buf.WriteByte(byte(msg.Cmd))
 	if msg.Ok {
 		buf.WriteByte(1)
 	} else {
 		buf.WriteByte(0)
 	}
+	if version >= MESSAGE_VERSION_2 {
+		buf.WriteByte(byte(codec))
+	}
 	if err := writeString(&buf, msg.Wid); err != nil {
 		return nil, err
 	}
@@ -72,15 +126,19 @@ func EncodeMessage(msg *Message) ([]byte, error) {
 	if err := writeString(&buf, msg.Address); err != nil {
 		return nil, err
 	}
-	if err := writeBytes(&buf, msg.Data); err != nil {
+	if err := writeBytes(&buf, data); err != nil {
 		return nil, err
 	}
 	return buf.Bytes(), nil
 }
 
 func DecodeMessage(input []byte) (*Message, error) {
-	if len(input) > 0 && input[0] == MESSAGE_VERSION {
-		msg, err := decodeBinaryMessage(input)
+	return decodeMessage(input, nil)
+}
+
+func decodeMessage(input []byte, metrics *RuntimeMetrics) (*Message, error) {
+	if len(input) > 0 && (input[0] == MESSAGE_VERSION || input[0] == MESSAGE_VERSION_2) {
+		msg, err := decodeBinaryMessage(input, metrics)
 		if err == nil {
 			return msg, nil
 		}
@@ -93,13 +151,13 @@ func DecodeMessage(input []byte) (*Message, error) {
 	return decodeGobMessage(input)
 }
 
-func decodeBinaryMessage(input []byte) (*Message, error) {
+func decodeBinaryMessage(input []byte, metrics *RuntimeMetrics) (*Message, error) {
 	reader := bytes.NewReader(input)
 	version, err := reader.ReadByte()
 	if err != nil {
 		return nil, err
 	}
-	if version != MESSAGE_VERSION {
+	if version != MESSAGE_VERSION && version != MESSAGE_VERSION_2 {
 		return nil, fmt.Errorf("unsupported message version %d", version)
 	}
 	cmd, err := reader.ReadByte()
@@ -110,6 +168,14 @@ func decodeBinaryMessage(input []byte) (*Message, error) {
 	if err != nil {
 		return nil, err
 	}
+	codec := CODEC_NONE
+	if version >= MESSAGE_VERSION_2 {
+		value, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		codec = Codec(value)
+	}
 	wid, err := readString(reader)
 	if err != nil {
 		return nil, err
@@ -137,6 +203,17 @@ func decodeBinaryMessage(input []byte) (*Message, error) {
 	if reader.Len() != 0 {
 		return nil, errors.New("message has trailing data")
 	}
+	if codec != CODEC_NONE {
+		start := time.Now()
+		data, err = decompressData(codec, data)
+		if err != nil {
+			return nil, err
+		}
+		if metrics != nil {
+			metrics.DecompressedMessagesTotal.Inc()
+			metrics.DecompressNanosTotal.Add(int64(time.Since(start)))
+		}
+	}
 	return &Message{
 		Cmd:     CMD(cmd),
 		Wid:     wid,
@@ -69,3 +69,58 @@ func TestPackerUnpackLegacyGobPayload(t *testing.T) {
 		t.Fatalf("msg and msg2 do not match: %+v %+v", msg, msg2)
 	}
 }
+
+func TestPackerCompressedRoundTrip(t *testing.T) {
+	metrics := NewRuntimeMetrics()
+	p := Packer{Password: "pass123", Metrics: metrics}
+	payload := bytes.Repeat([]byte("GET /api/v1/items HTTP/1.1\r\nHost: example.com\r\n"), 64)
+	for _, codec := range SupportedCodecs {
+		msg := Message{Cmd: DATA, Cid: "cid", Wid: "wid", Data: payload}
+		data, err := p.PackWith(&msg, codec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) >= len(payload) {
+			t.Fatalf("%s: payload was not compressed: %d >= %d", codec, len(data), len(payload))
+		}
+		msg2, err := p.Unpack(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg2.Cid != msg.Cid || !bytes.Equal(msg2.Data, payload) {
+			t.Fatalf("%s: msg and msg2 do not match: %+v", codec, msg2)
+		}
+	}
+	snapshot := metrics.Snapshot()
+	if snapshot.CompressedMessagesTotal != 2 || snapshot.DecompressedMessagesTotal != 2 || snapshot.CompressionRatio <= 1 {
+		t.Fatalf("unexpected compression metrics: %+v", snapshot)
+	}
+}
+
+func TestPackerSkipsCompressedPayloads(t *testing.T) {
+	metrics := NewRuntimeMetrics()
+	p := Packer{Password: "pass123", Metrics: metrics}
+	tlsRecord := append([]byte{0x17, 0x03, 0x03, 0x04, 0x00}, bytes.Repeat([]byte{'a'}, 1024)...)
+	buf, err := p.encode(&Message{Cmd: DATA, Data: tlsRecord}, CODEC_ZSTD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf[0] != MESSAGE_VERSION {
+		t.Fatalf("compressed payload should be sent as version %d, got %d", MESSAGE_VERSION, buf[0])
+	}
+	if got := metrics.CompressSkippedTotal.Load(); got != 1 {
+		t.Fatalf("unexpected skipped count: %d", got)
+	}
+}
+
+func TestNegotiateCodec(t *testing.T) {
+	if got := NegotiateCodec("snappy, zstd", SupportedCodecs); got != CODEC_SNAPPY {
+		t.Fatalf("expected first offered codec, got %s", got)
+	}
+	if got := NegotiateCodec("brotli,zstd", []Codec{CODEC_SNAPPY}); got != CODEC_NONE {
+		t.Fatalf("expected no codec, got %s", got)
+	}
+	if got := NegotiateCodec("", SupportedCodecs); got != CODEC_NONE {
+		t.Fatalf("expected no codec for legacy peers, got %s", got)
+	}
+}
@@ -0,0 +1,164 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const PROMETHEUS_CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+// PromWriter collects samples and writes them in the Prometheus text format.
+// Samples of a metric are grouped under one HELP/TYPE header no matter in
+// which order they are added.
+type PromWriter struct {
+	families []*promFamily
+	byName   map[string]*promFamily
+}
+
+type promFamily struct {
+	name    string
+	help    string
+	kind    string
+	samples []string
+}
+
+func NewPromWriter() *PromWriter {
+	return &PromWriter{byName: map[string]*promFamily{}}
+}
+
+// Counter adds a sample of a monotonically increasing metric, labels are
+// name, value pairs.
+func (p *PromWriter) Counter(name string, help string, value float64, labels ...string) {
+	p.add("counter", name, help, value, labels)
+}
+
+func (p *PromWriter) Gauge(name string, help string, value float64, labels ...string) {
+	p.add("gauge", name, help, value, labels)
+}
+
+func (p *PromWriter) add(kind string, name string, help string, value float64, labels []string) {
+	p.addSample(kind, name, help, name, value, labels)
+}
+
+func (p *PromWriter) addSample(kind string, name string, help string, sampleName string, value float64, labels []string) {
+	family, ok := p.byName[name]
+	if !ok {
+		family = &promFamily{name: name, help: help, kind: kind}
+		p.byName[name] = family
+		p.families = append(p.families, family)
+	}
+	var sample strings.Builder
+	sample.WriteString(sampleName)
+	if len(labels) > 0 {
+		sample.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				sample.WriteByte(',')
+			}
+			sample.WriteString(labels[i])
+			sample.WriteString(`="`)
+			sample.WriteString(promEscaper.Replace(labels[i+1]))
+			sample.WriteByte('"')
+		}
+		sample.WriteByte('}')
+	}
+	sample.WriteByte(' ')
+	sample.WriteString(formatPromValue(value))
+	family.samples = append(family.samples, sample.String())
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatPromValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func (p *PromWriter) WriteTo(w io.Writer) (int64, error) {
+	var out strings.Builder
+	for _, family := range p.families {
+		fmt.Fprintf(&out, "# HELP %s %s\n# TYPE %s %s\n", family.name, family.help, family.name, family.kind)
+		for _, sample := range family.samples {
+			out.WriteString(sample)
+			out.WriteByte('\n')
+		}
+	}
+	n, err := io.WriteString(w, out.String())
+	return int64(n), err
+}
+
+// Runtime adds every RuntimeMetrics counter as detour_* metrics.
+func (p *PromWriter) Runtime(s RuntimeMetricsSnapshot) {
+	if startedAt, err := time.Parse(time.RFC3339, s.StartedAt); err == nil {
+		p.Gauge("detour_start_time_seconds", "Unix time the process started.", float64(startedAt.Unix()))
+	}
+	p.Gauge("detour_uptime_seconds", "Seconds since the process started.", float64(s.UptimeSeconds))
+	p.Counter("detour_client_connections_total", "Client streams opened.", float64(s.ClientConnectionsTotal))
+	p.Counter("detour_client_connections_closed_total", "Client streams closed.", float64(s.ClientConnectionsClosed))
+	p.Counter("detour_websocket_connects_total", "Websocket connections established.", float64(s.WebSocketConnectsTotal))
+	p.Gauge("detour_websocket_active", "Websocket connections currently open.", float64(s.WebSocketActive))
+	p.Counter("detour_websocket_read_errors_total", "Websocket read errors.", float64(s.WebSocketReadErrors))
+	p.Counter("detour_websocket_write_errors_total", "Websocket write errors.", float64(s.WebSocketWriteErrors))
+	p.Counter("detour_auth_failures_total", "Websocket upgrades failing authentication and websockets sending frames that do not unpack.", float64(s.AuthFailuresTotal))
+	p.Counter("detour_banned_requests_total", "Requests refused because the client IP is banned.", float64(s.BannedRequestsTotal))
+	p.Counter("detour_connect_attempts_total", "CONNECT requests handled.", float64(s.ConnectAttemptsTotal))
+	p.Counter("detour_connect_failures_total", "CONNECT requests that failed.", float64(s.ConnectFailuresTotal))
+	p.Counter("detour_connect_denied_total", "CONNECT requests refused by the destination ACL.", float64(s.ConnectDeniedTotal))
+	p.Counter("detour_relay_connect_failures_total", "CONNECT requests the next relay failed.", float64(s.RelayConnectFailures))
+	p.Counter("detour_queue_timeouts_total", "Messages dropped after waiting for a stream queue.", float64(s.QueueTimeoutsTotal))
+	p.Counter("detour_queue_full_total", "Messages rejected by a full writer queue.", float64(s.QueueFullTotal))
+	p.Counter("detour_messages_in_total", "Messages read from websockets.", float64(s.MessagesInTotal))
+	p.Counter("detour_messages_out_total", "Messages written to websockets.", float64(s.MessagesOutTotal))
+	p.Counter("detour_payload_in_bytes_total", "Payload bytes read from websockets.", float64(s.PayloadBytesInTotal))
+	p.Counter("detour_payload_out_bytes_total", "Payload bytes written to websockets.", float64(s.PayloadBytesOutTotal))
+	p.Counter("detour_compressed_messages_total", "Messages sent compressed.", float64(s.CompressedMessagesTotal))
+	p.Counter("detour_compress_skipped_total", "Messages sent uncompressed because compression did not help.", float64(s.CompressSkippedTotal))
+	p.Counter("detour_compress_in_bytes_total", "Bytes before compression.", float64(s.CompressBytesInTotal))
+	p.Counter("detour_compress_out_bytes_total", "Bytes after compression.", float64(s.CompressBytesOutTotal))
+	p.Counter("detour_compress_seconds_total", "Time spent compressing.", float64(s.CompressNanosTotal)/float64(time.Second))
+	p.Counter("detour_decompressed_messages_total", "Compressed messages received.", float64(s.DecompressedMessagesTotal))
+	p.Counter("detour_decompress_seconds_total", "Time spent decompressing.", float64(s.DecompressNanosTotal)/float64(time.Second))
+	p.Counter("detour_throttled_seconds_total", "Time streams waited for rate limits.", float64(s.ThrottledNanosTotal)/float64(time.Second))
+	p.Counter("detour_config_reloads_total", "Configuration reloads attempted.", float64(s.ConfigReloadsTotal))
+	p.Counter("detour_config_reload_failures_total", "Configuration reloads that failed.", float64(s.ConfigReloadFailures))
+	if lastReloadAt, err := time.Parse(time.RFC3339, s.LastReloadAt); err == nil {
+		p.Gauge("detour_config_last_reload_timestamp_seconds", "Unix time of the last configuration reload.", float64(lastReloadAt.Unix()))
+	}
+	p.Histogram("detour_connect_rtt_seconds", "Time from sending CONNECT to its ack on the local.", s.ConnectRTT)
+	p.Histogram("detour_dial_seconds", "Time to dial targets on the exit server.", s.DialDuration)
+	p.Histogram("detour_handshake_seconds", "Time to dial the websocket of the next hop.", s.HandshakeDuration)
+	p.Histogram("detour_queue_wait_seconds", "Time messages wait in a websocket writer queue.", s.QueueWait)
+	p.Histogram("detour_stream_lifetime_seconds", "Time streams stay open after their ack.", s.StreamLifetime)
+}
+
+// Histogram adds the _bucket, _sum and _count samples of a histogram.
+func (p *PromWriter) Histogram(name string, help string, s HistogramSnapshot, labels ...string) {
+	for _, bucket := range s.Buckets {
+		p.addSample("histogram", name, help, name+"_bucket", float64(bucket.Count), append(labels[:len(labels):len(labels)], "le", formatPromValue(bucket.Le)))
+	}
+	p.addSample("histogram", name, help, name+"_bucket", float64(s.Count), append(labels[:len(labels):len(labels)], "le", "+Inf"))
+	p.addSample("histogram", name, help, name+"_sum", s.SumSeconds, labels)
+	p.addSample("histogram", name, help, name+"_count", float64(s.Count), labels)
+}
+
+// Writer adds the queue snapshot of a websocket writer, labels identify it.
+func (p *PromWriter) Writer(s FairMessageWriterSnapshot, labels ...string) {
+	closed := 0.0
+	if s.Closed {
+		closed = 1
+	}
+	p.Gauge("detour_writer_closed", "Whether the websocket writer is closed.", closed, labels...)
+	p.Gauge("detour_writer_queue_streams", "Streams with messages queued in the websocket writer.", float64(s.QueueKeys), labels...)
+	p.Gauge("detour_writer_queue_messages", "Messages queued in the websocket writer.", float64(s.QueueMessages), labels...)
+}
@@ -0,0 +1,29 @@
+package common
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPromWriterGroupsFamilies(t *testing.T) {
+	p := NewPromWriter()
+	p.Gauge("detour_a", "A.", 1, "remote", `ws://x/"y"`)
+	p.Counter("detour_b_total", "B.", 2)
+	p.Gauge("detour_a", "A.", 0.5, "remote", "ws://z")
+
+	var out strings.Builder
+	if _, err := p.WriteTo(&out); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP detour_a A.
+# TYPE detour_a gauge
+detour_a{remote="ws://x/\"y\""} 1
+detour_a{remote="ws://z"} 0.5
+# HELP detour_b_total B.
+# TYPE detour_b_total counter
+detour_b_total 2
+`
+	if out.String() != want {
+		t.Fatalf("unexpected exposition:\n%s", out.String())
+	}
+}
@@ -0,0 +1,236 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// THROTTLE_PRUNE_INTERVAL is how often user buckets that refilled are
+// dropped, so user names clients make up do not pile up.
+const THROTTLE_PRUNE_INTERVAL = time.Minute
+
+// RateLimitConfig caps bandwidth in bytes per second, written like "512K",
+// "10M" or "1G" (powers of 1024), "" or "0" means unlimited. Every limit
+// applies to each direction on its own.
+type RateLimitConfig struct {
+	RateLimit       string            `json:"rateLimit" example:"100M"`    // the whole process
+	UserRateLimit   string            `json:"userRateLimit" example:"10M"` // every user
+	StreamRateLimit string            `json:"streamRateLimit" example:"2M"`
+	UserRateLimits  map[string]string `json:"userRateLimits"` // username => limit, overrides userRateLimit
+}
+
+func (c RateLimitConfig) Validate() error {
+	_, err := parseRates(c)
+	return err
+}
+
+// ParseBytes parses a byte size like "1500", "512K", "1.5M", "10MB" or
+// "1GiB", an empty value is 0.
+func ParseBytes(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	number := strings.TrimRight(strings.ToUpper(value), "IB")
+	scale := 1.0
+	if number != "" {
+		if i := strings.IndexByte("KMGT", number[len(number)-1]); i >= 0 {
+			scale = math.Pow(1024, float64(i+1))
+			number = number[:len(number)-1]
+		}
+	}
+	size, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+	if err != nil || size < 0 || math.IsInf(size, 0) || math.IsNaN(size) {
+		return 0, fmt.Errorf("%q is not a size like 512K or 10M", value)
+	}
+	return int64(size * scale), nil
+}
+
+type throttleRates struct {
+	global int64
+	user   int64
+	stream int64
+	users  map[string]int64
+}
+
+func (r throttleRates) forUser(user string) int64 {
+	if rate, ok := r.users[user]; ok {
+		return rate
+	}
+	return r.user
+}
+
+func parseRates(conf RateLimitConfig) (throttleRates, error) {
+	rates := throttleRates{users: map[string]int64{}}
+	errs := []error{}
+	var err error
+	if rates.global, err = ParseBytes(conf.RateLimit); err != nil {
+		errs = append(errs, fmt.Errorf("rateLimit: %w", err))
+	}
+	if rates.user, err = ParseBytes(conf.UserRateLimit); err != nil {
+		errs = append(errs, fmt.Errorf("userRateLimit: %w", err))
+	}
+	if rates.stream, err = ParseBytes(conf.StreamRateLimit); err != nil {
+		errs = append(errs, fmt.Errorf("streamRateLimit: %w", err))
+	}
+	for user, value := range conf.UserRateLimits {
+		if rates.users[user], err = ParseBytes(value); err != nil {
+			errs = append(errs, fmt.Errorf("userRateLimits.%s: %w", user, err))
+		}
+	}
+	return rates, errors.Join(errs...)
+}
+
+// tokenBucket holds up to one second of tokens.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take removes n tokens at rate and returns how long the caller has to wait
+// for the ones it borrowed.
+func (b *tokenBucket) take(n int, rate int64, now time.Time) time.Duration {
+	if rate <= 0 {
+		// starts full once a limit is set again
+		b.last = time.Time{}
+		return 0
+	}
+	if b.last.IsZero() {
+		b.tokens = float64(rate)
+	} else {
+		b.tokens = min(float64(rate), b.tokens+now.Sub(b.last).Seconds()*float64(rate))
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(rate) * float64(time.Second))
+}
+
+// full reports whether the bucket refilled since it was last taken from,
+// then it is no different from a new one.
+func (b *tokenBucket) full(rate int64, now time.Time) bool {
+	return b.last.IsZero() || rate <= 0 || b.tokens+now.Sub(b.last).Seconds()*float64(rate) >= float64(rate)
+}
+
+// bucketPair is one bucket per direction, up is towards the target.
+type bucketPair [2]tokenBucket
+
+func (p *bucketPair) take(up bool, n int, rate int64, now time.Time) time.Duration {
+	if up {
+		return p[0].take(n, rate, now)
+	}
+	return p[1].take(n, rate, now)
+}
+
+// Throttle paces streams with a global, a per-user and a per-stream token
+// bucket in each direction, limits can change while streams run.
+type Throttle struct {
+	Metrics *RuntimeMetrics
+	lock    sync.Mutex
+	conf    RateLimitConfig
+	rates   throttleRates
+	global  bucketPair
+	users   map[string]*bucketPair // only users with a limit, pruned once refilled
+	pruned  time.Time
+}
+
+func NewThrottle(conf RateLimitConfig, metrics *RuntimeMetrics) (*Throttle, error) {
+	t := &Throttle{Metrics: metrics, users: map[string]*bucketPair{}}
+	return t, t.Update(conf)
+}
+
+// Update swaps the limits, an invalid conf leaves them alone.
+func (t *Throttle) Update(conf RateLimitConfig) error {
+	rates, err := parseRates(conf)
+	if err != nil {
+		return err
+	}
+	conf.UserRateLimits = maps.Clone(conf.UserRateLimits)
+	t.lock.Lock()
+	t.conf, t.rates = conf, rates
+	t.lock.Unlock()
+	return nil
+}
+
+// Config returns the limits in effect.
+func (t *Throttle) Config() RateLimitConfig {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	conf := t.conf
+	conf.UserRateLimits = maps.Clone(conf.UserRateLimits)
+	return conf
+}
+
+// Stream returns the throttle of a new stream of user, nil when t is nil.
+func (t *Throttle) Stream(user string) *StreamThrottle {
+	if t == nil {
+		return nil
+	}
+	return &StreamThrottle{throttle: t, user: user}
+}
+
+// StreamThrottle paces one stream, a nil StreamThrottle never waits.
+type StreamThrottle struct {
+	throttle *Throttle
+	user     string
+	own      bucketPair
+}
+
+// Wait blocks until n more bytes may pass in direction up, or done is
+// closed, and returns how long it waited.
+func (s *StreamThrottle) Wait(up bool, n int, done <-chan struct{}) time.Duration {
+	if s == nil || n <= 0 {
+		return 0
+	}
+	t := s.throttle
+	now := time.Now()
+	t.lock.Lock()
+	delay := t.global.take(up, n, t.rates.global, now)
+	if rate := t.rates.forUser(s.user); s.user != "" && rate > 0 {
+		users, ok := t.users[s.user]
+		if !ok {
+			users = &bucketPair{}
+			t.users[s.user] = users
+		}
+		delay = max(delay, users.take(up, n, rate, now))
+	}
+	if now.Sub(t.pruned) >= THROTTLE_PRUNE_INTERVAL {
+		t.prune(now)
+	}
+	delay = max(delay, s.own.take(up, n, t.rates.stream, now))
+	t.lock.Unlock()
+	if delay <= 0 {
+		return 0
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-done:
+	}
+	waited := time.Since(now)
+	if t.Metrics != nil {
+		t.Metrics.ThrottledNanosTotal.Add(int64(waited))
+	}
+	return waited
+}
+
+// prune drops the user buckets that are full again, t.lock must be held.
+func (t *Throttle) prune(now time.Time) {
+	t.pruned = now
+	for user, users := range t.users {
+		rate := t.rates.forUser(user)
+		if users[0].full(rate, now) && users[1].full(rate, now) {
+			delete(t.users, user)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package common
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParseBytes(t *testing.T) {
+	for value, want := range map[string]int64{"": 0, "0": 0, "1500": 1500, "512K": 512 << 10, "1.5m": 3 << 19, "10MB": 10 << 20, "1GiB": 1 << 30} {
+		if got, err := ParseBytes(value); err != nil || got != want {
+			t.Fatalf("%q: got %d, %v want %d", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"fast", "-1K", "10X"} {
+		if _, err := ParseBytes(value); err == nil {
+			t.Fatalf("%q: expected an error", value)
+		}
+	}
+}
+
+func TestTokenBucketPaces(t *testing.T) {
+	now := time.Now()
+	bucket := tokenBucket{}
+	if wait := bucket.take(1000, 1000, now); wait != 0 {
+		t.Fatalf("a full bucket should not wait: %v", wait)
+	}
+	if wait := bucket.take(500, 1000, now); wait != 500*time.Millisecond {
+		t.Fatalf("unexpected wait: %v", wait)
+	}
+	// the borrowed tokens are paid back first
+	if wait := bucket.take(500, 1000, now.Add(time.Second)); wait != 0 {
+		t.Fatalf("unexpected wait after refill: %v", wait)
+	}
+	if wait := bucket.take(10_000, 0, now); wait != 0 {
+		t.Fatalf("unlimited should not wait: %v", wait)
+	}
+}
+
+func TestThrottleLimitsUsersAndStreams(t *testing.T) {
+	metrics := NewRuntimeMetrics()
+	throttle, err := NewThrottle(RateLimitConfig{StreamRateLimit: "1M", UserRateLimits: map[string]string{"alice": "10K"}}, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, bob := throttle.Stream("alice"), throttle.Stream("bob")
+	if alice.Wait(true, 10<<10, nil) != 0 || bob.Wait(true, 10<<10, nil) != 0 {
+		t.Fatal("first bytes should pass at once")
+	}
+	start := time.Now()
+	if waited := alice.Wait(true, 1<<10, nil); waited < 50*time.Millisecond || time.Since(start) < 50*time.Millisecond {
+		t.Fatalf("alice should wait about 100ms, waited %v", waited)
+	}
+	if bob.Wait(true, 1<<10, nil) != 0 || alice.Wait(false, 1<<10, nil) != 0 {
+		t.Fatal("other users and directions have their own buckets")
+	}
+	if metrics.ThrottledNanosTotal.Load() == 0 {
+		t.Fatal("throttled time was not counted")
+	}
+
+	if err := throttle.Update(RateLimitConfig{RateLimit: "slow"}); err == nil {
+		t.Fatal("expected an invalid limit")
+	}
+	if err := throttle.Update(RateLimitConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if alice.Wait(true, 1<<20, nil) != 0 {
+		t.Fatal("live streams should pick up removed limits")
+	}
+	done := make(chan struct{})
+	close(done)
+	throttle.Update(RateLimitConfig{StreamRateLimit: "1K"})
+	alice.Wait(true, 1<<10, done)
+	if waited := alice.Wait(true, 1<<20, done); waited > time.Second {
+		t.Fatalf("done should stop the wait, waited %v", waited)
+	}
+	if (*StreamThrottle)(nil).Wait(true, 1, nil) != 0 || (*Throttle)(nil).Stream("alice") != nil {
+		t.Fatal("nil throttles should not wait")
+	}
+}
+
+func TestThrottleKeepsOnlyBusyUserBuckets(t *testing.T) {
+	throttle, err := NewThrottle(RateLimitConfig{UserRateLimit: "1K"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 100 {
+		throttle.Stream(fmt.Sprint("user", i)).Wait(true, 512, nil)
+	}
+	done := make(chan struct{})
+	close(done)
+	throttle.Stream("alice").Wait(false, 4<<10, done)
+	if len(throttle.users) != 101 {
+		t.Fatalf("expected a bucket per limited user, got %d", len(throttle.users))
+	}
+	throttle.prune(time.Now().Add(2 * time.Second))
+	if _, ok := throttle.users["alice"]; !ok || len(throttle.users) != 1 {
+		t.Fatalf("only alice is still paying back, kept %d buckets", len(throttle.users))
+	}
+
+	unlimited, _ := NewThrottle(RateLimitConfig{StreamRateLimit: "1K"}, nil)
+	unlimited.Stream("bob").Wait(true, 512, nil)
+	if len(unlimited.users) != 0 {
+		t.Fatal("users without a limit should get no bucket")
+	}
+}
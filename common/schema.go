@@ -1,5 +1,12 @@
 package common
 
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
 type CMD int
 
 const (
@@ -9,6 +16,20 @@ const (
 	SWITCH
 )
 
+func (c CMD) String() string {
+	switch c {
+	case CONNECT:
+		return "connect"
+	case DATA:
+		return "data"
+	case CLOSE:
+		return "close"
+	case SWITCH:
+		return "switch"
+	}
+	return "cmd(" + strconv.Itoa(int(c)) + ")"
+}
+
 type Message struct {
 	Cmd     CMD
 	Wid     string
@@ -20,6 +41,60 @@ type Message struct {
 	Data    []byte
 }
 
+// ConnectRequest rides in Message.Msg of a CONNECT. Without a user or codecs it is a
+// bare W3C traceparent, which is all older locals send.
+type ConnectRequest struct {
+	TraceParent string `json:"traceparent,omitempty"`
+	User        string `json:"user,omitempty"`     // authenticated by the local inbound
+	Compress    string `json:"compress,omitempty"` // codecs the sender accepts, e.g. "zstd,snappy"
+}
+
+func ParseConnectRequest(msg string) ConnectRequest {
+	var req ConnectRequest
+	if strings.HasPrefix(msg, "{") {
+		json.Unmarshal([]byte(msg), &req)
+	} else {
+		req.TraceParent = msg
+	}
+	return req
+}
+
+func (r ConnectRequest) String() string {
+	if r.User == "" && r.Compress == "" {
+		return r.TraceParent
+	}
+	data, _ := json.Marshal(r)
+	return string(data)
+}
+
+// ConnectInfo rides in Message.Msg of a successful CONNECT ack, a refusal
+// keeps its plain reason there. Older servers leave it empty.
+type ConnectInfo struct {
+	Resolved string    `json:"resolved,omitempty"` // target address the exit dialed
+	Path     []string  `json:"path,omitempty"`     // urls of the hops after the one answering
+	Elapsed  []float64 `json:"elapsed,omitempty"`  // ms each hop from the one answering took to ack
+	Codec    string    `json:"codec,omitempty"`    // picked from the offer of the CONNECT for this websocket
+}
+
+// ParseConnectInfo decodes the Msg of an ack, anything else gives a zero info.
+func ParseConnectInfo(msg string) ConnectInfo {
+	var info ConnectInfo
+	if strings.HasPrefix(msg, "{") {
+		json.Unmarshal([]byte(msg), &info)
+	}
+	return info
+}
+
+// ElapsedMillis converts d for ConnectInfo.Elapsed.
+func ElapsedMillis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func (i ConnectInfo) String() string {
+	data, _ := json.Marshal(i)
+	return string(data)
+}
+
 type Package struct {
 	Key     []byte
 	Padding int
@@ -27,24 +102,94 @@ type Package struct {
 }
 
 type LocalConfig struct {
-	Listen        string `json:"listen" example:"tcp://0.0.0.0:3810"`
-	Remotes       string `json:"remotes" example:"ws://127.0.0.1:3811/ws,ws://127.0.0.1:3811/ws"`
-	Password      string `json:"password" example:"pass123"`
-	Proto         string `json:"proto" example:"socks5"`
-	PoolSize      int    `json:"poolSize" example:"4"`
-	MetricsListen string `json:"metricsListen" example:"127.0.0.1:3819"`
+	Listen            string `json:"listen" example:"tcp://0.0.0.0:3810"`
+	Remotes           string `json:"remotes" example:"ws://127.0.0.1:3811/ws,ws://127.0.0.1:3811/ws"`
+	Password          string `json:"password" example:"pass123"`
+	Proto             string `json:"proto" example:"socks5"`
+	PoolSize          int    `json:"poolSize" example:"4"`
+	MetricsListen     string `json:"metricsListen" example:"127.0.0.1:3819"`
+	Compress          string `json:"compress" example:"zstd,snappy"`
+	CompressThreshold int    `json:"compressThreshold" example:"256"`
+	AdminListen       string `json:"adminListen" example:"127.0.0.1:3920"`
+	AdminToken        string `json:"adminToken"`
+	TrafficLog        string `json:"trafficLog" example:"traffic.jsonl"`
+	TraceEndpoint     string `json:"traceEndpoint" example:"http://127.0.0.1:4318/v1/traces"`
+	LogFormat         string `json:"logFormat" example:"json"`
+	LogLevel          string `json:"logLevel" example:"info,wsconn=debug"`
+
+	AccessLogConfig
+	RateLimitConfig
+	Listeners     []ListenerConfig `json:"listeners"`
+	RemoteOptions RemoteOptions    `json:"remoteOptions"` // remote url or "*" => RemoteConfig
+}
+
+// ListenerConfig is one inbound proxy port of a local, when LocalConfig.Listeners
+// is empty Listen and Proto make the only one.
+type ListenerConfig struct {
+	Name   string            `json:"name" example:"http"`
+	Listen string            `json:"listen" example:"tcp://0.0.0.0:7777"`
+	Proto  string            `json:"proto" example:"http"`
+	Users  map[string]string `json:"users"` // username => password, empty means no auth
 }
 
 type ServerConfig struct {
-	Listen        string `json:"listen" example:"tcp://0.0.0.0:3811"`
-	Remotes       string `json:"remotes" example:"ws://127.0.0.1:3812/ws"`
-	Password      string `json:"password" example:"pass123"`
-	RelayPoolSize int    `json:"relayPoolSize" example:"4"`
-	DNSServers    string `json:"dnsServers" example:"8.8.8.8:53,1.1.1.1:53"`
-	MetricsListen string `json:"metricsListen" example:"127.0.0.1:3819"`
+	Listen            string `json:"listen" example:"tcp://0.0.0.0:3811"`
+	Remotes           string `json:"remotes" example:"ws://127.0.0.1:3812/ws"`
+	Password          string `json:"password" example:"pass123"`
+	RelayPoolSize     int    `json:"relayPoolSize" example:"4"`
+	DNSServers        string `json:"dnsServers" example:"8.8.8.8:53,1.1.1.1:53"`
+	MetricsListen     string `json:"metricsListen" example:"127.0.0.1:3819"`
+	Compress          string `json:"compress" example:"zstd,snappy"`
+	CompressThreshold int    `json:"compressThreshold" example:"256"`
+	Pprof             bool   `json:"pprof" example:"false"`
+	AdminListen       string `json:"adminListen" example:"127.0.0.1:3921"`
+	AdminToken        string `json:"adminToken"`
+	TrafficLog        string `json:"trafficLog" example:"traffic.jsonl"`
+	TraceEndpoint     string `json:"traceEndpoint" example:"http://127.0.0.1:4318/v1/traces"`
+	LogFormat         string `json:"logFormat" example:"json"`
+	LogLevel          string `json:"logLevel" example:"info,relay=debug"`
+
+	AccessLogConfig
+	ACLConfig
+	RateLimitConfig
+	QuotaConfig
+	UsageConfig
+	DecoyConfig
+	BanConfig
+	TLSConfig
+	RemoteOptions RemoteOptions `json:"remoteOptions"` // next relay url or "*" => RemoteConfig
+}
+
+// TLSConfig makes a server terminate TLS itself so locals can dial wss://,
+// cert and key files are loaded again when they change.
+type TLSConfig struct {
+	TLSCert       string `json:"tlsCert" example:"/etc/detour2/cert.pem"`
+	TLSKey        string `json:"tlsKey" example:"/etc/detour2/key.pem"`
+	TLSClientCA   string `json:"tlsClientCA" example:"/etc/detour2/clients.pem"` // websockets need a client certificate signed by it
+	TLSSelfSigned bool   `json:"tlsSelfSigned" example:"false"`                  // a throwaway certificate for testing
+}
+
+// DecoyConfig makes a server look like an ordinary web site: requests off
+// WSPath and upgrades without a valid AUTH_HEADER are answered by the decoy.
+// Without a decoy anyone may upgrade at WSPath and / shows the time.
+type DecoyConfig struct {
+	WSPath   string `json:"wsPath" example:"/ws"`
+	DecoyURL string `json:"decoyURL" example:"https://www.example.com"` // site the requests are proxied to
+	DecoyDir string `json:"decoyDir" example:"/var/www/html"`           // or a directory of static files
+}
+
+// QuotaConfig caps the streams upstream peers may open on a server, 0 is
+// unlimited. A websocket is counted by the wid of the local pool entry, so
+// streams moved by a SWITCH keep counting against it.
+type QuotaConfig struct {
+	MaxStreams             int     `json:"maxStreams" example:"16384"`
+	MaxStreamsPerWebsocket int     `json:"maxStreamsPerWebsocket" example:"4096"`
+	MaxStreamsPerUser      int     `json:"maxStreamsPerUser" example:"1024"`
+	ConnectRate            float64 `json:"connectRate" example:"200"` // CONNECTs per second, bursting up to one second
 }
 
 type DeployConfig struct {
+	Mode            string `json:"mode" example:"server"`
 	AccessKeyId     string `json:"accessKeyId"`
 	AccessKeySecret string `json:"accessKeySecret"`
 	AccountId       string `json:"accountId"`
@@ -0,0 +1,330 @@
+package common
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	TRACE_BUFFER_SIZE = 4096 // spans kept in memory for /admin/trace
+
+	HOP_LOCAL = "local"
+	HOP_RELAY = "relay"
+	HOP_EXIT  = "exit"
+)
+
+// TraceContext identifies a span across hops, it rides in Message.Msg of a
+// CONNECT request as a W3C traceparent. Older peers ignore it.
+type TraceContext struct {
+	TraceID string // 32 hex digits
+	SpanID  string // 16 hex digits
+}
+
+// NewTraceContext starts a new trace.
+func NewTraceContext() TraceContext {
+	return TraceContext{TraceID: randomHex(16), SpanID: randomHex(8)}
+}
+
+// ParseTraceParent parses "00-<trace id>-<span id>-<flags>".
+func ParseTraceParent(value string) (TraceContext, bool) {
+	parts := strings.Split(value, "-")
+	if len(parts) != 4 || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return TraceContext{}, false
+	}
+	for _, part := range parts {
+		if _, err := hex.DecodeString(part); err != nil {
+			return TraceContext{}, false
+		}
+	}
+	return TraceContext{TraceID: parts[1], SpanID: parts[2]}, true
+}
+
+func (t TraceContext) TraceParent() string {
+	return "00-" + t.TraceID + "-" + t.SpanID + "-01"
+}
+
+// Child returns a new span of the same trace.
+func (t TraceContext) Child() TraceContext {
+	return TraceContext{TraceID: t.TraceID, SpanID: randomHex(8)}
+}
+
+func (t TraceContext) IsZero() bool {
+	return t.TraceID == ""
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Span is how long one hop took to open a stream, from the CONNECT arriving
+// to the ack going back, split into phases.
+type Span struct {
+	TraceID  string      `json:"traceId"`
+	SpanID   string      `json:"spanId"`
+	ParentID string      `json:"parentId,omitempty"`
+	Hop      string      `json:"hop"` // local, relay or exit
+	Cid      string      `json:"cid"`
+	Target   string      `json:"target"`
+	Next     string      `json:"next,omitempty"` // url of the next hop
+	Start    time.Time   `json:"start"`
+	End      time.Time   `json:"end"`
+	Phases   []SpanPhase `json:"phases,omitempty"`
+	Error    string      `json:"error,omitempty"`
+}
+
+type SpanPhase struct {
+	Name  string    `json:"name"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// ActiveSpan is a Span being recorded, it is safe for concurrent use and
+// a nil ActiveSpan records nothing.
+type ActiveSpan struct {
+	lock   sync.Mutex
+	span   Span
+	mark   time.Time
+	tracer *Tracer
+	ended  bool
+}
+
+// Context returns the context to hand to the next hop.
+func (a *ActiveSpan) Context() TraceContext {
+	if a == nil {
+		return TraceContext{}
+	}
+	return TraceContext{TraceID: a.span.TraceID, SpanID: a.span.SpanID}
+}
+
+// Mark ends the phase name, it started at the previous mark.
+func (a *ActiveSpan) Mark(name string) {
+	if a == nil {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.ended {
+		return
+	}
+	now := time.Now()
+	a.span.Phases = append(a.span.Phases, SpanPhase{Name: name, Start: a.mark, End: now})
+	a.mark = now
+}
+
+func (a *ActiveSpan) SetNext(url string) {
+	if a == nil {
+		return
+	}
+	a.lock.Lock()
+	a.span.Next = url
+	a.lock.Unlock()
+}
+
+// Finish records the span with the tracer, only the first call counts.
+func (a *ActiveSpan) Finish(errMsg string) {
+	if a == nil {
+		return
+	}
+	a.lock.Lock()
+	if a.ended {
+		a.lock.Unlock()
+		return
+	}
+	a.ended = true
+	a.span.End = time.Now()
+	a.span.Error = errMsg
+	span := a.span
+	span.Phases = slices.Clone(span.Phases)
+	a.lock.Unlock()
+	a.tracer.record(span)
+}
+
+// Tracer keeps the last TRACE_BUFFER_SIZE spans and exports them to an OTLP
+// endpoint when one is given.
+type Tracer struct {
+	Endpoint string
+	lock     sync.Mutex
+	spans    []Span
+	next     int
+	exporter *OTLPExporter
+}
+
+func NewTracer(service string, endpoint string, log *slog.Logger) *Tracer {
+	t := &Tracer{Endpoint: strings.TrimSpace(endpoint)}
+	if t.Endpoint != "" {
+		t.exporter = NewOTLPExporter(t.Endpoint, service, log)
+	}
+	return t
+}
+
+// Start opens a span of hop, a child of parent or the root of a new trace
+// when parent is zero.
+func (t *Tracer) Start(parent TraceContext, hop string, cid string, target string) *ActiveSpan {
+	tc := NewTraceContext()
+	if !parent.IsZero() {
+		tc = parent.Child()
+	}
+	now := time.Now()
+	return &ActiveSpan{
+		span: Span{
+			TraceID:  tc.TraceID,
+			SpanID:   tc.SpanID,
+			ParentID: parent.SpanID,
+			Hop:      hop,
+			Cid:      cid,
+			Target:   target,
+			Start:    now,
+		},
+		mark:   now,
+		tracer: t,
+	}
+}
+
+func (t *Tracer) record(span Span) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	if len(t.spans) < TRACE_BUFFER_SIZE {
+		t.spans = append(t.spans, span)
+	} else {
+		t.spans[t.next] = span
+		t.next = (t.next + 1) % TRACE_BUFFER_SIZE
+	}
+	t.lock.Unlock()
+	if t.exporter != nil {
+		t.exporter.Export(span)
+	}
+}
+
+// Spans returns the kept spans of cid, oldest first.
+func (t *Tracer) Spans(cid string) []Span {
+	if t == nil {
+		return nil
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	found := []Span{}
+	for i := range t.spans {
+		span := t.spans[(t.next+i)%len(t.spans)]
+		if span.Cid == cid {
+			found = append(found, span)
+		}
+	}
+	return found
+}
+
+// Close flushes the exporter.
+func (t *Tracer) Close() {
+	if t != nil && t.exporter != nil {
+		t.exporter.Close()
+	}
+}
+
+// FetchSpans gets the spans of cid from an admin api, admin is an address
+// or a base url.
+func FetchSpans(ctx context.Context, admin string, token string, cid string) ([]Span, error) {
+	base := strings.TrimSuffix(admin, "/")
+	if !strings.Contains(base, "://") {
+		base = "http://" + base
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/admin/trace/"+cid, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("%s: %s: %s", admin, resp.Status, strings.TrimSpace(string(body)))
+	}
+	spans := []Span{}
+	return spans, json.NewDecoder(resp.Body).Decode(&spans)
+}
+
+// OrderSpans sorts spans hop by hop, following parent ids from the local to
+// the exit, spans whose parent is missing go by start time.
+func OrderSpans(spans []Span) []Span {
+	sort.SliceStable(spans, func(i, j int) bool { return spans[i].Start.Before(spans[j].Start) })
+	children := map[string][]Span{}
+	ids := map[string]bool{}
+	for _, span := range spans {
+		ids[span.SpanID] = true
+	}
+	roots := []Span{}
+	for _, span := range spans {
+		if span.ParentID != "" && ids[span.ParentID] {
+			children[span.ParentID] = append(children[span.ParentID], span)
+		} else {
+			roots = append(roots, span)
+		}
+	}
+	ordered := make([]Span, 0, len(spans))
+	var walk func(span Span)
+	walk = func(span Span) {
+		ordered = append(ordered, span)
+		for _, child := range children[span.SpanID] {
+			walk(child)
+		}
+	}
+	for _, root := range roots {
+		walk(root)
+	}
+	return ordered
+}
+
+// WriteTimeline prints ordered spans as a table, offsets are relative to the
+// first span and mix the clocks of every hop.
+func WriteTimeline(w io.Writer, spans []Span) error {
+	if len(spans) == 0 {
+		_, err := fmt.Fprintln(w, "no spans found")
+		return err
+	}
+	first := spans[0].Start
+	for _, span := range spans {
+		if span.Start.Before(first) {
+			first = span.Start
+		}
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TRACE\tHOP\tTARGET\tSTART\tTOTAL\tPHASES\tNEXT\tERROR")
+	for _, span := range spans {
+		phases := make([]string, 0, len(span.Phases))
+		for _, phase := range span.Phases {
+			phases = append(phases, phase.Name+"="+formatMillis(phase.End.Sub(phase.Start)))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t+%s\t%s\t%s\t%s\t%s\n",
+			span.TraceID, span.Hop, span.Target, formatMillis(span.Start.Sub(first)), formatMillis(span.End.Sub(span.Start)),
+			strings.Join(phases, " "), dashIfEmpty(span.Next), dashIfEmpty(span.Error))
+	}
+	return tw.Flush()
+}
+
+func formatMillis(d time.Duration) string {
+	return fmt.Sprintf("%.1fms", float64(d)/float64(time.Millisecond))
+}
+
+func dashIfEmpty(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
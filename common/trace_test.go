@@ -0,0 +1,48 @@
+package common
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTraceParentRoundTrip(t *testing.T) {
+	tc := NewTraceContext()
+	parsed, ok := ParseTraceParent(tc.TraceParent())
+	if !ok || parsed != tc {
+		t.Fatalf("round trip failed: %+v %+v", tc, parsed)
+	}
+	for _, value := range []string{"", "connection refused", "00-xyz-abc-01", `{"resolved":"1.2.3.4:80"}`} {
+		if _, ok := ParseTraceParent(value); ok {
+			t.Fatalf("%q parsed as a traceparent", value)
+		}
+	}
+}
+
+func TestOrderSpansFollowsParents(t *testing.T) {
+	tracer := NewTracer("test", "", nil)
+	local := tracer.Start(TraceContext{}, HOP_LOCAL, "cid", "example.com:443")
+	relay := tracer.Start(local.Context(), HOP_RELAY, "cid", "example.com:443")
+	exit := tracer.Start(relay.Context(), HOP_EXIT, "cid", "example.com:443")
+	exit.Mark("dial")
+	// another host with a clock running behind
+	exit.span.Start = exit.span.Start.Add(-time.Second)
+	exit.Finish("dial failed")
+	relay.Finish("refused")
+	local.Finish("refused")
+	tracer.Start(TraceContext{}, HOP_LOCAL, "other", "example.com:443").Finish("")
+
+	spans := OrderSpans(tracer.Spans("cid"))
+	if len(spans) != 3 || spans[0].Hop != HOP_LOCAL || spans[1].Hop != HOP_RELAY || spans[2].Hop != HOP_EXIT {
+		t.Fatalf("unexpected order: %+v", spans)
+	}
+
+	var out bytes.Buffer
+	if err := WriteTimeline(&out, spans); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != 4 || !strings.Contains(lines[3], "dial=") || !strings.Contains(lines[3], "dial failed") {
+		t.Fatalf("unexpected timeline:\n%s", out.String())
+	}
+}
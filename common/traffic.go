@@ -0,0 +1,221 @@
+package common
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	TRAFFIC_FLUSH_INTERVAL = time.Minute
+	TRAFFIC_RETENTION      = 24 * time.Hour
+	TRAFFIC_DEFAULT_WINDOW = time.Hour
+	TRAFFIC_DEFAULT_TOP    = 20
+)
+
+// TrafficTable aggregates stream bytes by destination host and user in one
+// minute buckets, kept for TRAFFIC_RETENTION. It is safe for concurrent use.
+type TrafficTable struct {
+	lock    sync.Mutex
+	minutes map[int64]map[trafficKey]*TrafficRecord // unix minute => totals
+	pending map[trafficKey]*TrafficRecord           // not yet written to the log
+	Log     string                                  // optional JSON-lines file
+}
+
+type trafficKey struct {
+	host string
+	user string
+}
+
+// TrafficRecord is one line of the traffic log, and one row of a top table
+// where Host or User may be left empty.
+type TrafficRecord struct {
+	Time      string `json:"time,omitempty"`
+	Host      string `json:"host,omitempty"`
+	User      string `json:"user,omitempty"`
+	BytesUp   int64  `json:"bytesUp"`
+	BytesDown int64  `json:"bytesDown"`
+	Streams   int64  `json:"streams"`
+}
+
+type TrafficSnapshot struct {
+	Window string          `json:"window"`
+	ByHost []TrafficRecord `json:"byHost"`
+	ByUser []TrafficRecord `json:"byUser"`
+}
+
+// TrafficCursor remembers how many bytes of a stream were accounted, so live
+// streams can be sampled and finished ones topped up without counting twice.
+type TrafficCursor struct {
+	up   atomic.Int64
+	down atomic.Int64
+}
+
+// Advance returns the bytes added since the last call.
+func (c *TrafficCursor) Advance(up int64, down int64) (int64, int64) {
+	return up - c.up.Swap(up), down - c.down.Swap(down)
+}
+
+func NewTrafficTable(log string) *TrafficTable {
+	return &TrafficTable{
+		minutes: map[int64]map[trafficKey]*TrafficRecord{},
+		pending: map[trafficKey]*TrafficRecord{},
+		Log:     log,
+	}
+}
+
+// Add accounts bytes of a stream to address, finished counts the stream.
+func (t *TrafficTable) Add(address string, user string, up int64, down int64, finished bool) {
+	if t == nil || up == 0 && down == 0 && !finished {
+		return
+	}
+	key := trafficKey{host: address, user: user}
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		key.host = host
+	}
+	streams := int64(0)
+	if finished {
+		streams = 1
+	}
+	minute := time.Now().Unix() / 60
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	bucket, ok := t.minutes[minute]
+	if !ok {
+		bucket = map[trafficKey]*TrafficRecord{}
+		t.minutes[minute] = bucket
+		for old := range t.minutes {
+			if old <= minute-int64(TRAFFIC_RETENTION/time.Minute) {
+				delete(t.minutes, old)
+			}
+		}
+	}
+	add := TrafficRecord{BytesUp: up, BytesDown: down, Streams: streams}
+	addTraffic(bucket, key, TrafficRecord{Host: key.host, User: key.user}, add)
+	if t.Log != "" {
+		addTraffic(t.pending, key, TrafficRecord{Host: key.host, User: key.user}, add)
+	}
+}
+
+func addTraffic[K comparable](totals map[K]*TrafficRecord, key K, row TrafficRecord, add TrafficRecord) {
+	total, ok := totals[key]
+	if !ok {
+		total = &row
+		totals[key] = total
+	}
+	total.BytesUp += add.BytesUp
+	total.BytesDown += add.BytesDown
+	total.Streams += add.Streams
+}
+
+// Top sums the last window and returns the n biggest hosts and users by
+// total bytes.
+func (t *TrafficTable) Top(window time.Duration, n int) TrafficSnapshot {
+	snapshot := TrafficSnapshot{Window: window.String(), ByHost: []TrafficRecord{}, ByUser: []TrafficRecord{}}
+	if t == nil {
+		return snapshot
+	}
+	since := time.Now().Add(-window).Unix() / 60
+	byHost := map[string]*TrafficRecord{}
+	byUser := map[string]*TrafficRecord{}
+	t.lock.Lock()
+	for minute, bucket := range t.minutes {
+		if minute < since {
+			continue
+		}
+		for key, record := range bucket {
+			addTraffic(byHost, key.host, TrafficRecord{Host: key.host}, *record)
+			if key.user != "" {
+				addTraffic(byUser, key.user, TrafficRecord{User: key.user}, *record)
+			}
+		}
+	}
+	t.lock.Unlock()
+	snapshot.ByHost = topTraffic(byHost, n)
+	snapshot.ByUser = topTraffic(byUser, n)
+	return snapshot
+}
+
+func topTraffic(totals map[string]*TrafficRecord, n int) []TrafficRecord {
+	records := make([]TrafficRecord, 0, len(totals))
+	for _, record := range totals {
+		records = append(records, *record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		a, b := records[i].BytesUp+records[i].BytesDown, records[j].BytesUp+records[j].BytesDown
+		if a != b {
+			return a > b
+		}
+		return records[i].Host+records[i].User < records[j].Host+records[j].User
+	})
+	if n > 0 && len(records) > n {
+		records = records[:n]
+	}
+	return records
+}
+
+// Flush appends the records added since the last flush to Log.
+func (t *TrafficTable) Flush() error {
+	if t == nil || t.Log == "" {
+		return nil
+	}
+	t.lock.Lock()
+	pending := t.pending
+	t.pending = map[trafficKey]*TrafficRecord{}
+	t.lock.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	file, err := os.OpenFile(t.Log, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	now := time.Now().Format(time.RFC3339)
+	encoder := json.NewEncoder(file)
+	for _, record := range pending {
+		record.Time = now
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TrafficHandler serves Top as JSON, ?window=15m&top=10 pick the window and
+// the number of rows.
+func TrafficHandler(t *TrafficTable) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		window, top := TRAFFIC_DEFAULT_WINDOW, TRAFFIC_DEFAULT_TOP
+		if value := r.URL.Query().Get("window"); value != "" {
+			parsed, err := time.ParseDuration(value)
+			if err != nil || parsed <= 0 || parsed > TRAFFIC_RETENTION {
+				http.Error(w, "window should be a duration up to "+TRAFFIC_RETENTION.String(), http.StatusBadRequest)
+				return
+			}
+			window = parsed
+		}
+		if value := r.URL.Query().Get("top"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 1 {
+				http.Error(w, "top should be a positive number", http.StatusBadRequest)
+				return
+			}
+			top = parsed
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(t.Top(window, top))
+	}
+}
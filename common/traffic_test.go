@@ -0,0 +1,64 @@
+package common
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTrafficTop(t *testing.T) {
+	table := NewTrafficTable("")
+	var cursor TrafficCursor
+	up, down := cursor.Advance(100, 10)
+	table.Add("example.com:443", "alice", up, down, false)
+	up, down = cursor.Advance(150, 10)
+	table.Add("example.com:443", "alice", up, down, true)
+	table.Add("example.com:80", "bob", 1, 1, true)
+	table.Add("1.2.3.4:53", "", 10, 10, true)
+	table.Add("idle:1", "", 0, 0, false)
+
+	top := table.Top(time.Hour, 2)
+	if len(top.ByHost) != 2 || top.ByHost[0] != (TrafficRecord{Host: "example.com", BytesUp: 151, BytesDown: 11, Streams: 2}) || top.ByHost[1].Host != "1.2.3.4" {
+		t.Fatalf("unexpected hosts: %+v", top.ByHost)
+	}
+	if len(top.ByUser) != 2 || top.ByUser[0] != (TrafficRecord{User: "alice", BytesUp: 150, BytesDown: 10, Streams: 1}) || top.ByUser[1].User != "bob" {
+		t.Fatalf("unexpected users: %+v", top.ByUser)
+	}
+}
+
+func TestTrafficFlush(t *testing.T) {
+	log := filepath.Join(t.TempDir(), "traffic.jsonl")
+	table := NewTrafficTable(log)
+	table.Add("example.com:443", "alice", 5, 7, true)
+	if err := table.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	table.Add("example.com:443", "alice", 1, 0, false)
+	if err := table.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := table.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var records []TrafficRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record TrafficRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 2 || records[0].Time == "" || records[0].BytesUp != 5 || records[0].Streams != 1 || records[1].BytesUp != 1 || records[1].Streams != 0 {
+		t.Fatalf("unexpected log records: %+v", records)
+	}
+}
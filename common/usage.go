@@ -0,0 +1,288 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// USAGE_SAVE_INTERVAL is how often live streams are sampled into the
+	// ledger, users over quota are closed and the usage file is written.
+	USAGE_SAVE_INTERVAL = 10 * time.Second
+	// ANONYMOUS_USER is who streams without a user are accounted to.
+	ANONYMOUS_USER = "-"
+)
+
+// UsageConfig caps the traffic of every user per billing cycle, up and down
+// together, sizes are written like RateLimitConfig and "" or "0" means
+// unlimited. Streams without a user share the quota of ANONYMOUS_USER, so a
+// local leaving the user out is capped too. Users are named by the locals,
+// which are trusted as they hold the password.
+type UsageConfig struct {
+	UsageFile         string            `json:"usageFile" example:"usage.json"` // keeps usage across restarts
+	UserQuota         string            `json:"userQuota" example:"100G"`
+	UserQuotas        map[string]string `json:"userQuotas"`                // username => quota, overrides userQuota
+	QuotaResetDay     int               `json:"quotaResetDay" example:"1"` // day of the month a cycle starts at local midnight, 1-28
+	QuotaCloseStreams bool              `json:"quotaCloseStreams"`         // also close live streams of users over quota
+}
+
+func (c UsageConfig) Validate() error {
+	_, _, err := parseUsageQuotas(c)
+	if c.QuotaResetDay < 0 || c.QuotaResetDay > 28 {
+		err = errors.Join(err, fmt.Errorf("quotaResetDay: %d is not a day from 1 to 28", c.QuotaResetDay))
+	}
+	return err
+}
+
+func parseUsageQuotas(conf UsageConfig) (int64, map[string]int64, error) {
+	errs := []error{}
+	quota, err := ParseBytes(conf.UserQuota)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("userQuota: %w", err))
+	}
+	quotas := map[string]int64{}
+	for user, value := range conf.UserQuotas {
+		if quotas[user], err = ParseBytes(value); err != nil {
+			errs = append(errs, fmt.Errorf("userQuotas.%s: %w", user, err))
+		}
+	}
+	return quota, quotas, errors.Join(errs...)
+}
+
+// CycleStart returns the start of the billing cycle holding now, day 0 is
+// the first of the month.
+func CycleStart(now time.Time, day int) time.Time {
+	day = max(day, 1)
+	start := time.Date(now.Year(), now.Month(), day, 0, 0, 0, 0, now.Location())
+	if now.Before(start) {
+		start = start.AddDate(0, -1, 0)
+	}
+	return start
+}
+
+// UsageRecord is the usage of one user in the current cycle.
+type UsageRecord struct {
+	User      string `json:"user"`
+	BytesUp   int64  `json:"bytesUp"`
+	BytesDown int64  `json:"bytesDown"`
+	Quota     int64  `json:"quota"` // 0 is unlimited
+	Exceeded  bool   `json:"exceeded"`
+}
+
+type UsageSnapshot struct {
+	CycleStart string        `json:"cycleStart"`
+	NextReset  string        `json:"nextReset"`
+	Users      []UsageRecord `json:"users"`
+}
+
+// usageState is the content of the usage file.
+type usageState struct {
+	CycleStart time.Time               `json:"cycleStart"`
+	Users      map[string]*UsageRecord `json:"users"`
+}
+
+// UsageLedger counts the bytes of every user in the current billing cycle
+// and persists them to Path. It is safe for concurrent use.
+type UsageLedger struct {
+	Path   string
+	lock   sync.Mutex
+	saving sync.Mutex // keeps writes of the file in order
+	conf   UsageConfig
+	quota  int64
+	quotas map[string]int64
+	state  usageState
+	dirty  bool
+}
+
+// NewUsageLedger loads the usage of the current cycle from conf.UsageFile,
+// a missing file or one of an earlier cycle starts from zero.
+func NewUsageLedger(conf UsageConfig) (*UsageLedger, error) {
+	l := &UsageLedger{Path: strings.TrimSpace(conf.UsageFile)}
+	if err := l.Update(conf); err != nil {
+		return nil, err
+	}
+	l.state = usageState{CycleStart: CycleStart(time.Now(), conf.QuotaResetDay), Users: map[string]*UsageRecord{}}
+	if l.Path == "" {
+		return l, nil
+	}
+	data, err := os.ReadFile(l.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	saved := usageState{}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("%s: %w", l.Path, err)
+	}
+	if !saved.CycleStart.Before(l.state.CycleStart) && saved.Users != nil {
+		l.state = saved
+	}
+	return l, nil
+}
+
+// Update swaps the quotas, the reset day and the close setting, an invalid
+// conf leaves them alone. The usage file needs a restart.
+func (l *UsageLedger) Update(conf UsageConfig) error {
+	if err := conf.Validate(); err != nil {
+		return err
+	}
+	quota, quotas, _ := parseUsageQuotas(conf)
+	conf.UsageFile = l.Path
+	conf.UserQuotas = maps.Clone(conf.UserQuotas)
+	l.lock.Lock()
+	l.conf, l.quota, l.quotas = conf, quota, quotas
+	l.lock.Unlock()
+	return nil
+}
+
+// CloseStreams reports whether live streams of users over quota are closed.
+func (l *UsageLedger) CloseStreams() bool {
+	if l == nil {
+		return false
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.conf.QuotaCloseStreams
+}
+
+// rollover starts a new cycle once now is past the current one, moving the
+// reset day to one already passed starts it at once.
+func (l *UsageLedger) rollover(now time.Time) {
+	start := CycleStart(now, l.conf.QuotaResetDay)
+	if start.After(l.state.CycleStart) {
+		l.state.Users = map[string]*UsageRecord{}
+		l.dirty = true
+	}
+	l.state.CycleStart = start
+}
+
+func (l *UsageLedger) quotaOf(user string) int64 {
+	if quota, ok := l.quotas[user]; ok {
+		return quota
+	}
+	return l.quota
+}
+
+func (l *UsageLedger) exceeded(record *UsageRecord) bool {
+	quota := l.quotaOf(record.User)
+	return quota > 0 && record.BytesUp+record.BytesDown >= quota
+}
+
+func usageUser(user string) string {
+	if user == "" {
+		return ANONYMOUS_USER
+	}
+	return user
+}
+
+// Add accounts bytes of user, streams without one to ANONYMOUS_USER.
+func (l *UsageLedger) Add(user string, up int64, down int64) {
+	if l == nil || up == 0 && down == 0 {
+		return
+	}
+	user = usageUser(user)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.rollover(time.Now())
+	record, ok := l.state.Users[user]
+	if !ok {
+		record = &UsageRecord{User: user}
+		l.state.Users[user] = record
+	}
+	record.BytesUp += up
+	record.BytesDown += down
+	l.dirty = true
+}
+
+// Exceeded reports whether user used up the quota of this cycle.
+func (l *UsageLedger) Exceeded(user string) bool {
+	if l == nil {
+		return false
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.rollover(time.Now())
+	record, ok := l.state.Users[usageUser(user)]
+	return ok && l.exceeded(record)
+}
+
+// Reset clears the usage of user, or of everyone when user is empty.
+func (l *UsageLedger) Reset(user string) {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if user == "" {
+		l.state.Users = map[string]*UsageRecord{}
+	} else {
+		delete(l.state.Users, user)
+	}
+	l.dirty = true
+}
+
+// Save writes the usage to Path when it changed since the last save.
+func (l *UsageLedger) Save() error {
+	if l == nil || l.Path == "" {
+		return nil
+	}
+	l.saving.Lock()
+	defer l.saving.Unlock()
+	l.lock.Lock()
+	if !l.dirty {
+		l.lock.Unlock()
+		return nil
+	}
+	data, err := json.MarshalIndent(l.state, "", "  ")
+	l.dirty = false
+	l.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := WriteFileAtomic(l.Path, data); err != nil {
+		l.lock.Lock()
+		l.dirty = true
+		l.lock.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Snapshot returns the usage of every user, the biggest first.
+func (l *UsageLedger) Snapshot() UsageSnapshot {
+	if l == nil {
+		return UsageSnapshot{Users: []UsageRecord{}}
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.rollover(time.Now())
+	snapshot := UsageSnapshot{
+		CycleStart: l.state.CycleStart.Format(time.RFC3339),
+		NextReset:  l.state.CycleStart.AddDate(0, 1, 0).Format(time.RFC3339),
+		Users:      make([]UsageRecord, 0, len(l.state.Users)),
+	}
+	for _, record := range l.state.Users {
+		row := *record
+		row.Quota = l.quotaOf(row.User)
+		row.Exceeded = l.exceeded(record)
+		snapshot.Users = append(snapshot.Users, row)
+	}
+	sort.Slice(snapshot.Users, func(i, j int) bool {
+		a, b := snapshot.Users[i], snapshot.Users[j]
+		if a.BytesUp+a.BytesDown != b.BytesUp+b.BytesDown {
+			return a.BytesUp+a.BytesDown > b.BytesUp+b.BytesDown
+		}
+		return a.User < b.User
+	})
+	return snapshot
+}
@@ -0,0 +1,86 @@
+package common
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCycleStart(t *testing.T) {
+	for _, tc := range []struct {
+		now  time.Time
+		day  int
+		want time.Time
+	}{
+		{time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC), 0, time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC), 15, time.Date(2026, 10, 15, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2026, 10, 14, 23, 0, 0, 0, time.UTC), 15, time.Date(2026, 9, 15, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2026, 1, 3, 0, 0, 0, 0, time.UTC), 28, time.Date(2025, 12, 28, 0, 0, 0, 0, time.UTC)},
+	} {
+		if got := CycleStart(tc.now, tc.day); !got.Equal(tc.want) {
+			t.Fatalf("%v day %d: got %v want %v", tc.now, tc.day, got, tc.want)
+		}
+	}
+}
+
+func TestUsageLedgerEnforcesAndPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	conf := UsageConfig{UsageFile: path, UserQuota: "1K", UserQuotas: map[string]string{"bob": "0"}}
+	ledger, err := NewUsageLedger(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ledger.Add("alice", 600, 300)
+	ledger.Add("bob", 1<<20, 0)
+	ledger.Add("", 1000, 0)
+	if ledger.Exceeded("alice") || ledger.Exceeded("bob") || ledger.Exceeded("") {
+		t.Fatalf("nobody should be over quota: %+v", ledger.Snapshot())
+	}
+	ledger.Add("", 100, 0)
+	if !ledger.Exceeded("") || !ledger.Exceeded(ANONYMOUS_USER) {
+		t.Fatalf("streams without a user should share a capped quota: %+v", ledger.Snapshot())
+	}
+	ledger.Add("alice", 0, 124)
+	if !ledger.Exceeded("alice") {
+		t.Fatalf("alice should be over quota: %+v", ledger.Snapshot())
+	}
+	if err := ledger.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := NewUsageLedger(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := reloaded.Snapshot()
+	if len(snapshot.Users) != 3 || snapshot.Users[0].User != "bob" || snapshot.Users[1].User != ANONYMOUS_USER || snapshot.Users[2] != (UsageRecord{User: "alice", BytesUp: 600, BytesDown: 424, Quota: 1024, Exceeded: true}) {
+		t.Fatalf("unexpected usage after reload: %+v", snapshot)
+	}
+	reloaded.Reset("alice")
+	if reloaded.Exceeded("alice") {
+		t.Fatal("alice should be reset")
+	}
+	if err := reloaded.Update(UsageConfig{UserQuota: "fast"}); err == nil {
+		t.Fatal("expected an invalid quota to be refused")
+	}
+}
+
+func TestUsageLedgerDropsEarlierCycle(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	data, _ := json.Marshal(usageState{
+		CycleStart: CycleStart(time.Now(), 1).AddDate(0, -1, 0),
+		Users:      map[string]*UsageRecord{"alice": {User: "alice", BytesUp: 1 << 30}},
+	})
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ledger, err := NewUsageLedger(UsageConfig{UsageFile: path, UserQuota: "1G"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ledger.Exceeded("alice") || len(ledger.Snapshot().Users) != 0 {
+		t.Fatalf("usage of the last cycle was kept: %+v", ledger.Snapshot())
+	}
+}
@@ -78,6 +78,7 @@ join_systemd_args() {
 render_unit() {
     local role="$1"
     local args="$2"
+    local env_file="$3"
     local template="deploy/systemd/detour2.service.template"
     [[ -f "$template" ]] || fail "missing template: $template"
 
@@ -87,6 +88,7 @@ render_unit() {
     unit="${unit//\{\{RUN_USER\}\}/${DETOUR2_USER:-root}}"
     unit="${unit//\{\{RUN_GROUP\}\}/${DETOUR2_GROUP:-root}}"
     unit="${unit//\{\{ARGS\}\}/$args}"
+    unit="${unit//\{\{ENV_FILE\}\}/$env_file}"
     printf '%s\n' "$unit"
 }
 
@@ -156,7 +158,7 @@ args=()
 case "$deploy_role" in
     server)
         [[ "$listen" == tcp://* ]] || fail "server LISTEN must be tcp://host:port"
-        args=(server -l "$listen" -p "$password")
+        args=(server -l "$listen")
         if [[ -n "$dns" ]]; then
             args+=(-dns "$dns")
         fi
@@ -167,7 +169,7 @@ case "$deploy_role" in
     relay)
         [[ "$listen" == tcp://* ]] || fail "relay LISTEN must be tcp://host:port"
         [[ -n "$upstream" ]] || fail "relay requires UPSTREAM"
-        args=(relay -l "$listen" -p "$password" -r "$(to_ws_url "$upstream")" -pool "$pool")
+        args=(relay -l "$listen" -r "$(to_ws_url "$upstream")" -pool "$pool")
         if [[ -n "$dns" ]]; then
             args+=(-dns "$dns")
         fi
@@ -192,7 +194,7 @@ case "$deploy_role" in
             tcp://*) ;;
             *) fail "local LISTEN must be tcp://, http://, or socks5://" ;;
         esac
-        args=(local -l "$listen" -p "$password" -r "$(to_ws_url "$upstream")" -t "$proto" -pool "$pool")
+        args=(local -l "$listen" -r "$(to_ws_url "$upstream")" -t "$proto" -pool "$pool")
         if [[ -n "$metrics" ]]; then
             args+=(-metrics "$metrics")
         fi
@@ -204,13 +206,17 @@ case "$deploy_role" in
 esac
 
 unit_args="$(join_systemd_args "${args[@]}")"
-unit="$(render_unit "$unit_role" "$unit_args")"
+# the password goes to the environment so it does not show up in ps, and to
+# a root-only file as the unit itself is world-readable
+env_file="/etc/detour2/$service.env"
+unit="$(render_unit "$unit_role" "$unit_args" "$env_file")"
 binary="$(build_binary)"
 
 echo "host:    $host"
 echo "service: $service"
 echo "binary:  $binary"
 echo "args:    $unit_args"
+echo "env:     $env_file (DETOUR_PASSWORD, mode 0600)"
 
 if [[ "${DRY_RUN:-0}" == "1" ]]; then
     echo
@@ -219,20 +225,25 @@ if [[ "${DRY_RUN:-0}" == "1" ]]; then
 fi
 
 tmp_unit="$(mktemp)"
-trap 'rm -f "$tmp_unit"' EXIT
+tmp_env="$(mktemp)"
+trap 'rm -f "$tmp_unit" "$tmp_env"' EXIT
 printf '%s\n' "$unit" >"$tmp_unit"
+printf 'DETOUR_PASSWORD=%s\n' "$(systemd_quote "$password")" >"$tmp_env"
 
 ssh_opts="${SSH_OPTS:--o BatchMode=yes}"
 scp_opts="${SCP_OPTS:--o BatchMode=yes}"
 remote_bin="/tmp/detour2-${role}-$$"
 remote_unit="/tmp/${service}.service.$$"
+remote_env="/tmp/${service}.env.$$"
 
 scp $scp_opts "$binary" "$host:$remote_bin"
 scp $scp_opts "$tmp_unit" "$host:$remote_unit"
+scp $scp_opts "$tmp_env" "$host:$remote_env"
 ssh $ssh_opts "$host" \
     "sudo install -D -m 0755 '$remote_bin' /opt/detour2/detour && \
+     sudo install -D -m 0600 -o root -g root '$remote_env' '$env_file' && \
      sudo install -D -m 0644 '$remote_unit' /etc/systemd/system/$service.service && \
-     rm -f '$remote_bin' '$remote_unit' && \
+     rm -f '$remote_bin' '$remote_unit' '$remote_env' && \
      sudo systemctl daemon-reload && \
      sudo systemctl enable '$service.service' && \
      sudo systemctl restart '$service.service' && \
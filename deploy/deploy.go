@@ -32,6 +32,14 @@ func NewClient(conf *common.DeployConfig) (_result *Client, _err error) {
 	return client, nil
 }
 
+// EnvironmentVariables carries the password so it is not visible in the function command.
+func (c *Client) EnvironmentVariables() map[string]*string {
+	return map[string]*string{
+		"TZ":                tea.String("Asia/Shanghai"),
+		common.PASSWORD_ENV: tea.String(c.Conf.Password),
+	}
+}
+
 func (c *Client) DeleteFunction() error {
 	_, err := c.Client.DeleteFunction(&c.Conf.ServiceName, &c.Conf.FunctionName)
 	return err
@@ -53,13 +61,13 @@ func (c *Client) CreateFunction() error {
 		CustomContainerConfig: &fc_open20210406.CustomContainerConfig{
 			AccelerationType: tea.String("Default"),
 			Args:             tea.String(""),
-			Command:          tea.String(fmt.Sprintf(`["./detour","server","-p","%s"]`, c.Conf.Password)),
+			Command:          tea.String(`["./detour","server"]`),
 			Image:            tea.String(c.Conf.Image),
 			WebServerMode:    tea.Bool(true),
 		},
 		Description:           tea.String(""),
 		DiskSize:              tea.Int32(512),
-		EnvironmentVariables:  map[string]*string{"TZ": tea.String("Asia/Shanghai")},
+		EnvironmentVariables:  c.EnvironmentVariables(),
 		FunctionName:          &c.Conf.FunctionName,
 		Handler:               tea.String("index.handler"),
 		InitializationTimeout: tea.Int32(3),
@@ -84,13 +92,13 @@ func (c *Client) UpdateFunction() error {
 		CustomContainerConfig: &fc_open20210406.CustomContainerConfig{
 			AccelerationType: tea.String("Default"),
 			Args:             tea.String(""),
-			Command:          tea.String(fmt.Sprintf(`["./detour","server","-p","%s"]`, c.Conf.Password)),
+			Command:          tea.String(`["./detour","server"]`),
 			Image:            tea.String(c.Conf.Image),
 			WebServerMode:    tea.Bool(true),
 		},
 		Description:           tea.String(""),
 		DiskSize:              tea.Int32(512),
-		EnvironmentVariables:  map[string]*string{"TZ": tea.String("Asia/Shanghai")},
+		EnvironmentVariables:  c.EnvironmentVariables(),
 		Handler:               tea.String("index.handler"),
 		InitializationTimeout: tea.Int32(3),
 		Initializer:           tea.String(""),
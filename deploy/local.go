@@ -4,7 +4,6 @@ import (
 	"bufio"
 	"context"
 	"fmt"
-	"log"
 	"os/exec"
 	"strconv"
 	"strings"
@@ -21,7 +20,7 @@ import (
 const CONTAINER_NAME = "detour2-deploy-local"
 
 func DeployLocal(conf *common.DeployConfig) error {
-	logger.Info.Println("deploy on local...")
+	logger.Deploy.Info("deploy on local...")
 
 	cli, err := client.NewClientWithOpts(client.FromEnv)
 	if err != nil {
@@ -37,7 +36,7 @@ func DeployLocal(conf *common.DeployConfig) error {
 	if err != nil {
 		return err
 	}
-	log.Println("remote wsurl", wsurl)
+	logger.Deploy.Info("deploy, remote websocket", "url", wsurl)
 
 	// cmd := exec.Command("docker", "rm", "-f", CONTAINER_NAME)
 	// err = RunCommand(cmd)
@@ -55,7 +54,8 @@ func DeployLocal(conf *common.DeployConfig) error {
 			ExposedPorts: nat.PortSet{
 				nat.Port("3810/tcp"): {},
 			},
-			Cmd: []string{"./detour", "local", "-p", conf.Password, "-r", wsurl, "-l", "tcp://0.0.0.0:3810"},
+			Cmd: []string{"./detour", "local", "-r", wsurl, "-l", "tcp://0.0.0.0:3810"},
+			Env: []string{common.PASSWORD_ENV + "=" + conf.Password},
 		},
 		&container.HostConfig{
 			RestartPolicy: container.RestartPolicy{Name: "always"},
@@ -75,7 +75,7 @@ func DeployLocal(conf *common.DeployConfig) error {
 		return err
 	}
 
-	logger.Info.Println("deploy ok.")
+	logger.Deploy.Info("deploy ok.")
 	return nil
 }
 
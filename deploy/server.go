@@ -10,7 +10,7 @@ func DeployServer(conf *common.DeployConfig) error {
 		return RemoveServer(conf)
 	}
 
-	logger.Info.Println("deploy on aliyun...")
+	logger.Deploy.Info("deploy on aliyun...")
 	fc, err := NewClient(conf)
 	if err != nil {
 		return err
@@ -18,7 +18,7 @@ func DeployServer(conf *common.DeployConfig) error {
 
 	err = fc.FindService()
 	if err != nil {
-		logger.Info.Println("create service...")
+		logger.Deploy.Info("create service...")
 		err = fc.CreateService()
 		if err != nil {
 			return err
@@ -27,10 +27,10 @@ func DeployServer(conf *common.DeployConfig) error {
 
 	err = fc.FindFunction()
 	if err != nil {
-		logger.Info.Println("create function...")
+		logger.Deploy.Info("create function...")
 		err = fc.CreateFunction()
 	} else {
-		logger.Info.Println("update function...")
+		logger.Deploy.Info("update function...")
 		err = fc.UpdateFunction()
 	}
 
@@ -40,7 +40,7 @@ func DeployServer(conf *common.DeployConfig) error {
 
 	_, err = fc.GetTrigger()
 	if err != nil {
-		logger.Info.Println("create trigger...")
+		logger.Deploy.Info("create trigger...")
 		err = fc.CreateTrigger()
 		if err != nil {
 			return err
@@ -48,35 +48,35 @@ func DeployServer(conf *common.DeployConfig) error {
 	}
 	url, _ := fc.GetHTTPURL()
 	ws, _ := fc.GetWebsocketURL()
-	logger.Info.Printf("deploy ok.\n    url = %s\n    ws = %s", url, ws)
+	logger.Deploy.Info("deploy ok.", "url", url, "ws", ws)
 	return nil
 }
 
 func RemoveServer(conf *common.DeployConfig) error {
-	logger.Info.Println("remove on aliyun...")
+	logger.Deploy.Info("remove on aliyun...")
 	fc, err := NewClient(conf)
 	if err != nil {
-		logger.Error.Fatal(err)
+		logger.Fatal(logger.Deploy, "remove, client error", logger.ERR, err)
 	}
 
-	logger.Info.Println("remove trigger...")
+	logger.Deploy.Info("remove trigger...")
 	err = fc.DeleteTrigger()
 	if err != nil {
 		return err
 	}
 
-	logger.Info.Println("remove function...")
+	logger.Deploy.Info("remove function...")
 	err = fc.DeleteFunction()
 	if err != nil {
 		return err
 	}
 
-	logger.Info.Println("remove service...")
+	logger.Deploy.Info("remove service...")
 	err = fc.DeleteService()
 	if err != nil {
 		return err
 	}
 
-	logger.Info.Println("remove ok.")
+	logger.Deploy.Info("remove ok.")
 	return nil
 }
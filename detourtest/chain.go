@@ -0,0 +1,216 @@
+// Package detourtest spins up in-process detour2 chains on loopback for
+// integration tests: local -> relay... -> exit, with fault injection between
+// hops and fake targets.
+package detourtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/observerss/detour2/common"
+	"github.com/observerss/detour2/local"
+	"github.com/observerss/detour2/server"
+)
+
+const DefaultPassword = "detourtest"
+
+type ChainConfig struct {
+	Password string
+	Proto    string // local inbound proto, defaults to socks5
+	Relays   int    // middle relays between local and the exit server
+	PoolSize int
+	Compress string
+
+	// optional hooks to adjust each hop before it is built
+	LocalConfig  func(*common.LocalConfig)
+	ServerConfig func(hop int, conf *common.ServerConfig)
+}
+
+// Chain is a running local -> relay... -> exit stack. Servers[0] is the first
+// hop after the local and the last one is the exit, Links[i] is the
+// FaultProxy every upstream connection to Servers[i] passes through.
+type Chain struct {
+	Local      *local.Local
+	Servers    []*server.Server
+	Links      []*FaultProxy
+	ProxyAddr  string            // address of the first listener
+	ProxyAddrs map[string]string // listener name => address
+
+	cancel context.CancelFunc
+}
+
+func NewChain(conf ChainConfig) (*Chain, error) {
+	if conf.Password == "" {
+		conf.Password = DefaultPassword
+	}
+	if conf.Proto == "" {
+		conf.Proto = local.PROTO_SOCKS5
+	}
+	if conf.PoolSize < 1 {
+		conf.PoolSize = 1
+	}
+
+	chain := &Chain{}
+	hops := conf.Relays + 1
+	chain.Servers = make([]*server.Server, hops)
+	chain.Links = make([]*FaultProxy, hops)
+	next := ""
+	for hop := hops - 1; hop >= 0; hop-- {
+		sconf := &common.ServerConfig{
+			Listen:        "tcp://127.0.0.1:0",
+			Remotes:       next,
+			Password:      conf.Password,
+			RelayPoolSize: conf.PoolSize,
+			Compress:      conf.Compress,
+			// test targets listen on loopback
+			ACLConfig: common.ACLConfig{AllowPrivateDestinations: true},
+		}
+		if conf.ServerConfig != nil {
+			conf.ServerConfig(hop, sconf)
+		}
+		s, err := server.NewServer(sconf)
+		if err != nil {
+			chain.Close()
+			return nil, err
+		}
+		if err := s.Start(); err != nil {
+			chain.Close()
+			return nil, err
+		}
+		chain.Servers[hop] = s
+		link, err := NewFaultProxy(s.Addr().String())
+		if err != nil {
+			chain.Close()
+			return nil, err
+		}
+		chain.Links[hop] = link
+		next = "ws://" + link.Addr() + "/ws"
+	}
+
+	lconf := &common.LocalConfig{
+		Listen:   "tcp://127.0.0.1:0",
+		Remotes:  next,
+		Password: conf.Password,
+		Proto:    conf.Proto,
+		PoolSize: conf.PoolSize,
+		Compress: conf.Compress,
+	}
+	if conf.LocalConfig != nil {
+		conf.LocalConfig(lconf)
+	}
+	l, err := local.NewLocal(lconf)
+	if err != nil {
+		chain.Close()
+		return nil, err
+	}
+	chain.Local = l
+	ctx, cancel := context.WithCancel(context.Background())
+	chain.cancel = cancel
+	// started here too, so DialContext works before the listeners run
+	chain.Local.Start(ctx)
+	chain.ProxyAddrs = map[string]string{}
+	for _, inbound := range chain.Local.Inbounds {
+		// the configured addresses are ignored, every listener gets a free port
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			chain.Close()
+			return nil, err
+		}
+		if chain.ProxyAddr == "" {
+			chain.ProxyAddr = listener.Addr().String()
+		}
+		chain.ProxyAddrs[inbound.Name] = listener.Addr().String()
+		go chain.Local.ServeInbound(ctx, inbound, listener)
+	}
+	return chain, nil
+}
+
+// StartChain builds a chain torn down at the end of the test.
+func StartChain(t testing.TB, conf ChainConfig) *Chain {
+	t.Helper()
+	chain, err := NewChain(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(chain.Close)
+	return chain
+}
+
+// Exit returns the last hop, the one dialing targets.
+func (c *Chain) Exit() *server.Server {
+	return c.Servers[len(c.Servers)-1]
+}
+
+// RemoteURL returns the websocket URL the local connects to.
+func (c *Chain) RemoteURL() string {
+	return "ws://" + c.Links[0].Addr() + "/ws"
+}
+
+// DialContext opens a stream through the chain using the embedded local.
+func (c *Chain) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	return c.Local.DialContext(ctx, network, address)
+}
+
+// DialSOCKS5 connects to address through the local's socks5 listener.
+func (c *Chain) DialSOCKS5(address string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", c.ProxyAddr, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	if err := Socks5Connect(conn, address); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// WaitIdle waits until no hop tracks any stream.
+func (c *Chain) WaitIdle(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		busy := ""
+		if active := c.Local.MetricsSnapshot().Connections.Active; active > 0 {
+			busy = fmt.Sprintf("local has %d active streams", active)
+		}
+		for hop, s := range c.Servers {
+			snapshot := s.MetricsSnapshot()
+			if snapshot.Connections.Active > 0 || snapshot.RelayPool.ActiveTotal > 0 {
+				busy = fmt.Sprintf("hop %d: connections=%+v relayPool=%+v", hop, snapshot.Connections, snapshot.RelayPool)
+			}
+		}
+		if busy == "" {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.New("chain did not become idle: " + busy)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (c *Chain) Close() {
+	if c.cancel != nil {
+		c.cancel()
+	}
+	if c.Local != nil {
+		c.Local.StopLocal()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for _, s := range c.Servers {
+		if s != nil {
+			s.Shutdown(ctx)
+		}
+	}
+	for _, link := range c.Links {
+		if link != nil {
+			link.Close()
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package detourtest
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestChainRecoversFromDroppedWebsocket(t *testing.T) {
+	SilenceLogs(t)
+
+	targetAddr := StartEchoServer(t)
+	chain := StartChain(t, ChainConfig{Relays: 1})
+
+	assertChainEcho(t, chain, targetAddr, []byte("before drop"))
+	for _, link := range chain.Links {
+		link.DropAll()
+	}
+	assertChainEcho(t, chain, targetAddr, []byte("after drop"))
+}
+
+func TestChainSurvivesDelayedFrames(t *testing.T) {
+	SilenceLogs(t)
+
+	targetAddr := StartEchoServer(t)
+	chain := StartChain(t, ChainConfig{})
+	chain.Links[0].SetDelay(20 * time.Millisecond)
+
+	start := time.Now()
+	assertChainEcho(t, chain, targetAddr, []byte("delayed"))
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Fatalf("delay was not applied: %s", elapsed)
+	}
+}
+
+func TestChainRecoversFromCorruptedFrame(t *testing.T) {
+	SilenceLogs(t)
+
+	targetAddr := StartEchoServer(t)
+	chain := StartChain(t, ChainConfig{})
+	assertChainEcho(t, chain, targetAddr, []byte("before corruption"))
+
+	chain.Links[0].CorruptNext(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	conn, err := chain.DialContext(ctx, "tcp", targetAddr)
+	if err == nil {
+		conn.Close()
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		conn, err := chain.DialSOCKS5(targetAddr)
+		if err == nil {
+			conn.SetDeadline(time.Now().Add(3 * time.Second))
+			AssertEcho(t, conn, []byte("after corruption"))
+			conn.Close()
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("chain did not recover from corrupted frame: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func assertChainEcho(t *testing.T, chain *Chain, targetAddr string, payload []byte) {
+	t.Helper()
+
+	conn, err := chain.DialSOCKS5(targetAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	AssertEcho(t, conn, payload)
+}
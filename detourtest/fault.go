@@ -0,0 +1,150 @@
+package detourtest
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FaultProxy is a TCP forwarder placed in front of a hop, it can delay,
+// corrupt or drop the websocket traffic passing through it.
+type FaultProxy struct {
+	Target   string
+	Listener net.Listener
+
+	delay   atomic.Int64
+	corrupt atomic.Int64
+	mu      sync.Mutex
+	conns   map[net.Conn]struct{}
+	closed  bool
+}
+
+func NewFaultProxy(target string) (*FaultProxy, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	proxy := &FaultProxy{
+		Target:   target,
+		Listener: listener,
+		conns:    make(map[net.Conn]struct{}),
+	}
+	go proxy.serve()
+	return proxy, nil
+}
+
+func (p *FaultProxy) Addr() string {
+	return p.Listener.Addr().String()
+}
+
+// SetDelay holds every forwarded chunk for d before passing it on.
+func (p *FaultProxy) SetDelay(d time.Duration) {
+	p.delay.Store(int64(d))
+}
+
+// CorruptNext flips a byte in each of the next n forwarded chunks.
+func (p *FaultProxy) CorruptNext(n int) {
+	p.corrupt.Store(int64(n))
+}
+
+// DropAll closes every connection currently passing through the proxy,
+// new connections are still accepted.
+func (p *FaultProxy) DropAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for conn := range p.conns {
+		conn.Close()
+		delete(p.conns, conn)
+	}
+}
+
+// Active returns the number of open connections, counting both sides.
+func (p *FaultProxy) Active() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.conns)
+}
+
+func (p *FaultProxy) Close() {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	p.Listener.Close()
+	p.DropAll()
+}
+
+func (p *FaultProxy) serve() {
+	for {
+		client, err := p.Listener.Accept()
+		if err != nil {
+			return
+		}
+		go p.handle(client)
+	}
+}
+
+func (p *FaultProxy) handle(client net.Conn) {
+	upstream, err := net.DialTimeout("tcp", p.Target, time.Second)
+	if err != nil {
+		client.Close()
+		return
+	}
+	if !p.track(client, upstream) {
+		client.Close()
+		upstream.Close()
+		return
+	}
+	done := make(chan struct{}, 2)
+	go p.pipe(upstream, client, done)
+	go p.pipe(client, upstream, done)
+	<-done
+	p.untrack(client, upstream)
+}
+
+func (p *FaultProxy) track(conns ...net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return false
+	}
+	for _, conn := range conns {
+		p.conns[conn] = struct{}{}
+	}
+	return true
+}
+
+func (p *FaultProxy) untrack(conns ...net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+		delete(p.conns, conn)
+	}
+}
+
+func (p *FaultProxy) pipe(dst net.Conn, src net.Conn, done chan<- struct{}) {
+	defer func() {
+		dst.Close()
+		src.Close()
+		done <- struct{}{}
+	}()
+	buf := make([]byte, 32*1024)
+	for {
+		nr, err := src.Read(buf)
+		if nr > 0 {
+			if delay := time.Duration(p.delay.Load()); delay > 0 {
+				time.Sleep(delay)
+			}
+			if p.corrupt.Load() > 0 && p.corrupt.Add(-1) >= 0 {
+				buf[nr-1] ^= 0xff
+			}
+			if _, err := dst.Write(buf[:nr]); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package detourtest
+
+import (
+	"io"
+	"testing"
+
+	"github.com/observerss/detour2/logger"
+)
+
+// SilenceLogs discards all log output for the duration of the test.
+func SilenceLogs(t testing.TB) {
+	t.Helper()
+
+	format, out := logger.Format(), logger.Writer()
+	logger.Setup(format, io.Discard)
+	t.Cleanup(func() {
+		logger.Setup(format, out)
+	})
+}
@@ -0,0 +1,96 @@
+package detourtest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/observerss/detour2/local"
+)
+
+// Socks5Connect performs a no-auth socks5 CONNECT handshake for address on conn.
+func Socks5Connect(conn net.Conn, address string) error {
+	return Socks5ConnectAuth(conn, address, "", "")
+}
+
+// Socks5ConnectAuth is Socks5Connect with RFC 1929 username/password auth,
+// an empty user means no auth.
+func Socks5ConnectAuth(conn net.Conn, address string, user string, password string) error {
+	method, accept := byte(local.METHOD_NOAUTH), local.ACCEPT_METHOD_AUTH
+	if user != "" {
+		method, accept = local.METHOD_USERPASS, local.ACCEPT_METHOD_USERPASS
+	}
+	if _, err := conn.Write([]byte{local.SOCKS5_VERSION, 1, method}); err != nil {
+		return err
+	}
+	authReply := make([]byte, len(accept))
+	if _, err := io.ReadFull(conn, authReply); err != nil {
+		return err
+	}
+	if !bytes.Equal(authReply, accept) {
+		return fmt.Errorf("unexpected auth reply: %v", authReply)
+	}
+	if user != "" {
+		request := []byte{local.USERPASS_VERSION, byte(len(user))}
+		request = append(request, user...)
+		request = append(request, byte(len(password)))
+		request = append(request, password...)
+		if _, err := conn.Write(request); err != nil {
+			return err
+		}
+		reply := make([]byte, len(local.USERPASS_OK))
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if !bytes.Equal(reply, local.USERPASS_OK) {
+			return errors.New("socks5 auth failed")
+		}
+	}
+
+	host, portValue, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portValue)
+	if err != nil {
+		return err
+	}
+	if len(host) > 255 {
+		return fmt.Errorf("host is too long for socks5 domain request: %q", host)
+	}
+	request := []byte{local.SOCKS5_VERSION, local.SOCKS5_CONNECT, 0, local.ADDR_DOMAIN, byte(len(host))}
+	request = append(request, host...)
+	request = binary.BigEndian.AppendUint16(request, uint16(port))
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	reply := make([]byte, len(local.CMD_OK))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if !bytes.Equal(reply, local.CMD_OK) {
+		return errors.New("socks5 connect failed")
+	}
+	return nil
+}
+
+// AssertEcho writes payload on conn and fails the test unless it reads it back.
+func AssertEcho(t testing.TB, conn net.Conn, payload []byte) {
+	t.Helper()
+	if _, err := conn.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("unexpected echo payload: %q", got)
+	}
+}
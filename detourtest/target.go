@@ -0,0 +1,85 @@
+package detourtest
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// EchoServer is a fake TCP target that writes back everything it reads.
+type EchoServer struct {
+	Listener net.Listener
+}
+
+func NewEchoServer() (*EchoServer, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}(conn)
+		}
+	}()
+	return &EchoServer{Listener: listener}, nil
+}
+
+func (e *EchoServer) Addr() string {
+	return e.Listener.Addr().String()
+}
+
+func (e *EchoServer) Close() error {
+	return e.Listener.Close()
+}
+
+// StartEchoServer starts an EchoServer closed at the end of the test and returns its address.
+func StartEchoServer(t testing.TB) string {
+	t.Helper()
+	echo, err := NewEchoServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { echo.Close() })
+	return echo.Addr()
+}
+
+// EchoHandler answers every request with its method, host and path.
+var EchoHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintf(w, "%s %s%s", r.Method, r.Host, r.URL.RequestURI())
+})
+
+// StartHTTPServer starts a fake HTTP target, handler defaults to EchoHandler.
+func StartHTTPServer(t testing.TB, handler http.Handler) *httptest.Server {
+	t.Helper()
+	if handler == nil {
+		handler = EchoHandler
+	}
+	target := httptest.NewServer(handler)
+	t.Cleanup(target.Close)
+	return target
+}
+
+// UnusedAddr returns a loopback address nothing is listening on.
+func UnusedAddr(t testing.TB) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	if err := listener.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return addr
+}
@@ -9,6 +9,8 @@ require (
 	github.com/docker/docker v20.10.21+incompatible
 	github.com/docker/go-connections v0.4.0
 	github.com/gorilla/websocket v1.5.3
+	github.com/klauspost/compress v1.18.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
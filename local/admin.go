@@ -0,0 +1,93 @@
+package local
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/observerss/detour2/common"
+	"github.com/observerss/detour2/logger"
+)
+
+func (l *Local) AdminConns() []common.AdminConn {
+	conns := []common.AdminConn{}
+	l.Conns.Range(func(key, value any) bool {
+		conn := value.(*Conn)
+		conn.AttrLock.RLock()
+		item := common.AdminConn{
+			Cid:       conn.Cid,
+			Wid:       conn.Wid,
+			Network:   conn.Network,
+			Address:   conn.Address,
+			User:      conn.User,
+			Listener:  conn.Listener,
+			BytesUp:   conn.BytesUp.Load(),
+			BytesDown: conn.BytesDown.Load(),
+		}
+		startedAt, lastActive := conn.StartedAt, conn.LastActTime
+		conn.AttrLock.RUnlock()
+		if startedAt.IsZero() {
+			// still waiting for the CONNECT ack
+			startedAt = lastActive
+		}
+		if conn.WSConn != nil {
+			item.Via = conn.WSConn.Url
+		}
+		conns = append(conns, common.NewAdminConn(item, startedAt, lastActive))
+		return true
+	})
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].AgeSeconds > conns[j].AgeSeconds
+	})
+	return conns
+}
+
+func (l *Local) Spans(cid string) []common.Span {
+	return l.Tracer.Spans(cid)
+}
+
+func (l *Local) RateLimits() common.RateLimitConfig {
+	return l.Throttle.Config()
+}
+
+func (l *Local) SetRateLimits(conf common.RateLimitConfig) error {
+	return l.Throttle.Update(conf)
+}
+
+// CloseConn sends CLOSE for cid through the chain and closes the client side.
+func (l *Local) CloseConn(cid string) bool {
+	value, ok := l.Conns.Load(cid)
+	if !ok {
+		return false
+	}
+	conn := value.(*Conn)
+	conn.Logger().Info("admin, close conn")
+	conn.CloseReason.Set("admin closed")
+	conn.CloseUpstream()
+	conn.CloseQuit()
+	if conn.NetConn != nil {
+		conn.NetConn.Close()
+	}
+	return true
+}
+
+func (l *Local) StartAdminServer() {
+	if l.AdminListen == "" {
+		return
+	}
+
+	server := &http.Server{Addr: l.AdminListen, Handler: common.NewAdminHandler(l.AdminToken, l)}
+	go func() {
+		<-l.DoneChan()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_ = server.Shutdown(ctx)
+	}()
+	go func() {
+		logger.Local.Info("Admin listening at http://" + l.AdminListen + "/admin/conns")
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Local.Error("admin, listen error", logger.ERR, err)
+		}
+	}()
+}
@@ -0,0 +1,162 @@
+package local_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/observerss/detour2/common"
+	"github.com/observerss/detour2/detourtest"
+	"github.com/observerss/detour2/local"
+	"github.com/observerss/detour2/logger"
+)
+
+func TestAdminListsAndClosesStreams(t *testing.T) {
+	detourtest.SilenceLogs(t)
+
+	targetAddr := detourtest.StartEchoServer(t)
+	chain := detourtest.StartChain(t, detourtest.ChainConfig{Relays: 1})
+
+	for _, backend := range []common.AdminBackend{chain.Local, chain.Servers[0], chain.Exit()} {
+		admin := httptest.NewServer(common.NewAdminHandler("token", backend))
+		defer admin.Close()
+
+		conn, err := chain.DialSOCKS5(targetAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(3 * time.Second))
+		detourtest.AssertEcho(t, conn, []byte("admin payload"))
+
+		if resp := adminRequest(t, admin.URL, http.MethodGet, "/admin/conns", "wrong"); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("expected unauthorized, got %s", resp.Status)
+		}
+		var conns []common.AdminConn
+		resp := adminRequest(t, admin.URL, http.MethodGet, "/admin/conns", "token")
+		if err := json.NewDecoder(resp.Body).Decode(&conns); err != nil {
+			t.Fatal(err)
+		}
+		if len(conns) != 1 || conns[0].Address != targetAddr || conns[0].BytesUp != 13 || conns[0].BytesDown != 13 || conns[0].Via == "" {
+			t.Fatalf("unexpected conns on %T: %+v", backend, conns)
+		}
+
+		if resp := adminRequest(t, admin.URL, http.MethodDelete, "/admin/conns/"+conns[0].Cid, "token"); resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("unexpected close status: %s", resp.Status)
+		}
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("expected the client stream to be closed, got %v", err)
+		}
+		if err := chain.WaitIdle(2 * time.Second); err != nil {
+			t.Fatal(err)
+		}
+		if resp := adminRequest(t, admin.URL, http.MethodDelete, "/admin/conns/"+conns[0].Cid, "token"); resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("expected not found for a closed stream, got %s", resp.Status)
+		}
+	}
+}
+
+func adminRequest(t *testing.T, url string, method string, path string, token string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestAdminChangesLogLevels(t *testing.T) {
+	detourtest.SilenceLogs(t)
+	defer logger.SetLevels(logger.LevelsSpec())
+
+	admin := httptest.NewServer(common.NewAdminHandler("token", &local.Local{}))
+	defer admin.Close()
+
+	if resp := adminRequest(t, admin.URL, http.MethodPut, "/admin/log?level=wsconn=loud", "token"); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected bad request, got %s", resp.Status)
+	}
+	var state common.AdminLog
+	resp := adminRequest(t, admin.URL, http.MethodPut, "/admin/log?level=wsconn=debug", "token")
+	if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+		t.Fatal(err)
+	}
+	if state.Levels["wsconn"] != "debug" || !logger.WSConn.Enabled(context.Background(), slog.LevelDebug) {
+		t.Fatalf("wsconn level not changed: %+v", state)
+	}
+}
+
+func TestAdminTracesStreamAcrossHops(t *testing.T) {
+	detourtest.SilenceLogs(t)
+
+	exported := make(chan []byte, 8)
+	collector := detourtest.StartHTTPServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		exported <- body
+	}))
+	targetAddr := detourtest.StartEchoServer(t)
+	chain := detourtest.StartChain(t, detourtest.ChainConfig{
+		Relays: 1,
+		ServerConfig: func(hop int, conf *common.ServerConfig) {
+			if hop == 1 {
+				conf.TraceEndpoint = collector.URL + "/v1/traces"
+			}
+		},
+	})
+
+	conn, err := chain.DialSOCKS5(targetAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	detourtest.AssertEcho(t, conn, []byte("trace payload"))
+	cid := chain.Local.AdminConns()[0].Cid
+
+	spans := []common.Span{}
+	for _, backend := range []common.AdminBackend{chain.Exit(), chain.Local, chain.Servers[0]} {
+		admin := httptest.NewServer(common.NewAdminHandler("token", backend))
+		defer admin.Close()
+		found, err := common.FetchSpans(context.Background(), admin.URL, "token", cid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		spans = append(spans, found...)
+	}
+	spans = common.OrderSpans(spans)
+	if len(spans) != 3 || spans[0].Hop != common.HOP_LOCAL || spans[1].Hop != common.HOP_RELAY || spans[2].Hop != common.HOP_EXIT {
+		t.Fatalf("unexpected spans: %+v", spans)
+	}
+	for i, span := range spans {
+		if span.TraceID != spans[0].TraceID || span.Error != "" || len(span.Phases) == 0 {
+			t.Fatalf("unexpected span %d: %+v", i, span)
+		}
+		if i > 0 && span.ParentID != spans[i-1].SpanID {
+			t.Fatalf("span %d is not a child of the previous hop: %+v", i, span)
+		}
+	}
+	if spans[2].Phases[0].Name != "dial" || spans[1].Next == "" {
+		t.Fatalf("unexpected exit phases or relay next hop: %+v %+v", spans[2].Phases, spans[1])
+	}
+
+	chain.Exit().Tracer.Close()
+	select {
+	case body := <-exported:
+		if !bytes.Contains(body, []byte(spans[0].TraceID)) || !bytes.Contains(body, []byte(`"name":"dial"`)) {
+			t.Fatalf("unexpected otlp export: %s", body)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no spans exported")
+	}
+}
@@ -0,0 +1,226 @@
+package local
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/observerss/detour2/common"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	DIAGNOSE_OK                = "ok"
+	DIAGNOSE_UNREACHABLE       = "unreachable"       // websocket dial failed
+	DIAGNOSE_HANDSHAKE_FAILED  = "handshake_failed"  // the hop answered, but not as a websocket
+	DIAGNOSE_PASSWORD_MISMATCH = "password_mismatch" // the hop hung up on our first message, or its decoy answered the upgrade
+	DIAGNOSE_TIMEOUT           = "timeout"
+	DIAGNOSE_REFUSED           = "refused"    // the chain answered the CONNECT with an error
+	DIAGNOSE_DNS_FAILED        = "dns_failed" // the exit could not resolve the target
+
+	DEFAULT_DIAGNOSE_TARGET = "www.google.com:443"
+)
+
+// DiagnoseConfig tells Diagnose which remotes to probe and how.
+type DiagnoseConfig struct {
+	Remotes       []string
+	Password      string
+	Compress      []common.Codec
+	Target        string
+	Timeout       time.Duration
+	RemoteOptions common.RemoteOptions
+}
+
+// DiagnoseReport is the outcome of a test CONNECT through one remote.
+type DiagnoseReport struct {
+	Remote      string        `json:"remote"`
+	Target      string        `json:"target"`
+	Status      string        `json:"status"`
+	Error       string        `json:"error,omitempty"`
+	Codec       string        `json:"codec,omitempty"`
+	Pin         string        `json:"pin,omitempty"` // of the certificate a wss remote presented
+	HandshakeMs float64       `json:"handshakeMs"`
+	ConnectMs   float64       `json:"connectMs,omitempty"`
+	Resolved    string        `json:"resolved,omitempty"` // address the exit dialed
+	Hops        []DiagnoseHop `json:"hops,omitempty"`
+}
+
+// DiagnoseHop is how long one hop took to ack the CONNECT, including the
+// hops after it.
+type DiagnoseHop struct {
+	Url       string  `json:"url"`
+	ElapsedMs float64 `json:"elapsedMs"`
+}
+
+// Diagnose probes every remote at once, reports keep the order of Remotes.
+func Diagnose(ctx context.Context, conf DiagnoseConfig) []DiagnoseReport {
+	if conf.Target == "" {
+		conf.Target = DEFAULT_DIAGNOSE_TARGET
+	}
+	if conf.Timeout <= 0 {
+		conf.Timeout = 10 * time.Second
+	}
+	reports := make([]DiagnoseReport, len(conf.Remotes))
+	wg := sync.WaitGroup{}
+	for i, remote := range conf.Remotes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reports[i] = diagnoseRemote(ctx, conf, remote)
+		}()
+	}
+	wg.Wait()
+	return reports
+}
+
+func diagnoseRemote(ctx context.Context, conf DiagnoseConfig, remote string) DiagnoseReport {
+	report := DiagnoseReport{Remote: remote, Target: conf.Target}
+	ctx, cancel := context.WithTimeout(ctx, conf.Timeout)
+	defer cancel()
+
+	header := http.Header{}
+	common.SetAuthHeader(header, conf.Password)
+	remoteConf := conf.RemoteOptions.For(remote)
+	remoteConf.SetHeaders(header)
+	dialer, err := common.NewWebsocketDialer(remoteConf, conf.Timeout)
+	if err != nil {
+		report.Status, report.Error = DIAGNOSE_UNREACHABLE, err.Error()
+		return report
+	}
+	start := time.Now()
+	conn, resp, err := dialer.DialContext(ctx, remote, header)
+	report.HandshakeMs = common.ElapsedMillis(time.Since(start))
+	if err != nil {
+		report.Error = err.Error()
+		report.Status = DIAGNOSE_UNREACHABLE
+		if resp != nil {
+			report.Status = DIAGNOSE_HANDSHAKE_FAILED
+			report.Error = fmt.Sprintf("%s: %s", err, resp.Status)
+			if resp.StatusCode >= 200 && resp.StatusCode < 400 {
+				// a websocket path serves no page, unless a decoy took an
+				// upgrade whose token did not verify
+				report.Status = DIAGNOSE_PASSWORD_MISMATCH
+				report.Error += ", answered by a decoy site"
+			}
+		}
+		return report
+	}
+	defer conn.Close()
+	if tlsConn, ok := conn.NetConn().(*tls.Conn); ok {
+		if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+			report.Pin = common.CertPin(certs[0])
+		}
+	}
+	packer := &common.Packer{Password: conf.Password}
+	cid, _ := common.GenerateRandomStringURLSafe(8)
+	wid, _ := common.GenerateRandomStringURLSafe(3)
+	msg := &common.Message{Cmd: common.CONNECT, Cid: cid, Wid: wid, Network: "tcp", Address: conf.Target,
+		Msg: common.ConnectRequest{Compress: common.FormatCodecs(conf.Compress)}.String()}
+	data, err := packer.Pack(msg)
+	if err != nil {
+		report.Status, report.Error = DIAGNOSE_UNREACHABLE, err.Error()
+		return report
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetWriteDeadline(deadline)
+	conn.SetReadDeadline(deadline)
+	start = time.Now()
+	if err := conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+		report.Status, report.Error = DIAGNOSE_UNREACHABLE, err.Error()
+		return report
+	}
+
+	for {
+		mt, data, err := conn.ReadMessage()
+		if err != nil {
+			report.Error = err.Error()
+			var nerr net.Error
+			switch {
+			case errors.As(err, &nerr) && nerr.Timeout():
+				report.Status = DIAGNOSE_TIMEOUT
+			case websocket.IsCloseError(err, websocket.CloseAbnormalClosure) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+				// servers hang up on websockets sending messages they cannot
+				// decrypt, without a close frame
+				report.Status = DIAGNOSE_PASSWORD_MISMATCH
+			default:
+				report.Status = DIAGNOSE_UNREACHABLE
+			}
+			return report
+		}
+		if mt != websocket.BinaryMessage {
+			continue
+		}
+		ack, err := packer.Unpack(data)
+		if err != nil {
+			report.Status, report.Error = DIAGNOSE_PASSWORD_MISMATCH, err.Error()
+			return report
+		}
+		if ack.Cid != cid || ack.Cmd != common.CONNECT {
+			continue
+		}
+		report.ConnectMs = common.ElapsedMillis(time.Since(start))
+		if !ack.Ok {
+			report.Status, report.Error = DIAGNOSE_REFUSED, ack.Msg
+			if strings.Contains(ack.Msg, "no such host") || strings.Contains(ack.Msg, "lookup ") {
+				report.Status = DIAGNOSE_DNS_FAILED
+			}
+			return report
+		}
+		info := common.ParseConnectInfo(ack.Msg)
+		report.Status = DIAGNOSE_OK
+		report.Resolved = info.Resolved
+		report.Codec = common.NegotiateCodec(info.Codec, conf.Compress).String()
+		for i, url := range append([]string{remote}, info.Path...) {
+			hop := DiagnoseHop{Url: url}
+			if i < len(info.Elapsed) {
+				hop.ElapsedMs = info.Elapsed[i]
+			}
+			report.Hops = append(report.Hops, hop)
+		}
+		closing := &common.Message{Cmd: common.CLOSE, Cid: cid, Wid: wid, Network: "tcp", Address: conf.Target}
+		if data, err := packer.Pack(closing); err == nil {
+			conn.WriteMessage(websocket.BinaryMessage, data)
+		}
+		return report
+	}
+}
+
+// WriteDiagnose prints reports for humans, one block per remote.
+func WriteDiagnose(w io.Writer, reports []DiagnoseReport) error {
+	for _, report := range reports {
+		summary := fmt.Sprintf("handshake %.1fms", report.HandshakeMs)
+		if report.ConnectMs > 0 {
+			summary += fmt.Sprintf(", connect %.1fms", report.ConnectMs)
+		}
+		if report.Codec != "" && report.Codec != common.CODEC_NONE.String() {
+			summary += ", codec " + report.Codec
+		}
+		fmt.Fprintf(w, "%s: %s (%s)\n", report.Remote, report.Status, summary)
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		for i, hop := range report.Hops {
+			fmt.Fprintf(tw, "  hop %d\t%s\tacked in %.1fms\n", i+1, hop.Url, hop.ElapsedMs)
+		}
+		if report.Resolved != "" {
+			fmt.Fprintf(tw, "  exit\t%s\tresolved to %s\n", report.Target, report.Resolved)
+		}
+		if report.Pin != "" {
+			fmt.Fprintf(tw, "  pin\t%s%s\n", common.PIN_PREFIX, report.Pin)
+		}
+		if report.Error != "" {
+			fmt.Fprintf(tw, "  error\t%s\n", report.Error)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
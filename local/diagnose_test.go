@@ -0,0 +1,86 @@
+package local_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/observerss/detour2/common"
+	"github.com/observerss/detour2/detourtest"
+	"github.com/observerss/detour2/local"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestDiagnoseReportsEachFailureKind(t *testing.T) {
+	detourtest.SilenceLogs(t)
+
+	targetAddr := detourtest.StartEchoServer(t)
+	chain := detourtest.StartChain(t, detourtest.ChainConfig{Relays: 1})
+	notWebsocket := detourtest.StartHTTPServer(t, http.NotFoundHandler())
+	unused := "ws://" + detourtest.UnusedAddr(t) + "/ws"
+
+	reports := local.Diagnose(context.Background(), local.DiagnoseConfig{
+		Remotes:  []string{chain.RemoteURL(), unused, "ws" + strings.TrimPrefix(notWebsocket.URL, "http") + "/ws"},
+		Password: detourtest.DefaultPassword,
+		Target:   targetAddr,
+		Timeout:  2 * time.Second,
+	})
+	ok := reports[0]
+	if ok.Status != local.DIAGNOSE_OK || ok.Resolved != targetAddr || len(ok.Hops) != 2 || ok.Hops[0].Url != chain.RemoteURL() || ok.Hops[1].ElapsedMs <= 0 || ok.Hops[0].ElapsedMs < ok.Hops[1].ElapsedMs {
+		t.Fatalf("unexpected report: %+v", ok)
+	}
+	if reports[1].Status != local.DIAGNOSE_UNREACHABLE || reports[2].Status != local.DIAGNOSE_HANDSHAKE_FAILED {
+		t.Fatalf("unexpected reports: %+v %+v", reports[1], reports[2])
+	}
+
+	reports = local.Diagnose(context.Background(), local.DiagnoseConfig{
+		Remotes:  []string{chain.RemoteURL()},
+		Password: "wrong",
+		Target:   targetAddr,
+		Timeout:  2 * time.Second,
+	})
+	if reports[0].Status != local.DIAGNOSE_PASSWORD_MISMATCH {
+		t.Fatalf("expected a password mismatch: %+v", reports[0])
+	}
+
+	site := detourtest.StartHTTPServer(t, nil)
+	decoyed := detourtest.StartChain(t, detourtest.ChainConfig{ServerConfig: func(hop int, conf *common.ServerConfig) {
+		conf.DecoyURL = site.URL
+	}})
+	// resets the connection on the first message instead of hanging up
+	resetting := detourtest.StartHTTPServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn.ReadMessage()
+		conn.NetConn().(*net.TCPConn).SetLinger(0)
+		conn.Close()
+	}))
+	reports = local.Diagnose(context.Background(), local.DiagnoseConfig{
+		Remotes:  []string{decoyed.RemoteURL(), "ws" + strings.TrimPrefix(resetting.URL, "http") + "/ws"},
+		Password: "wrong",
+		Target:   targetAddr,
+		Timeout:  2 * time.Second,
+	})
+	if reports[0].Status != local.DIAGNOSE_PASSWORD_MISMATCH || reports[1].Status != local.DIAGNOSE_UNREACHABLE {
+		t.Fatalf("expected the decoy to show a password mismatch and the reset to be unreachable: %+v %+v", reports[0], reports[1])
+	}
+
+	reports = local.Diagnose(context.Background(), local.DiagnoseConfig{
+		Remotes:  []string{chain.RemoteURL()},
+		Password: detourtest.DefaultPassword,
+		Target:   detourtest.UnusedAddr(t),
+		Timeout:  2 * time.Second,
+	})
+	if reports[0].Status != local.DIAGNOSE_REFUSED || reports[0].Error == "" {
+		t.Fatalf("expected the exit to refuse: %+v", reports[0])
+	}
+	if err := chain.WaitIdle(2 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,76 @@
+package local
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/observerss/detour2/common"
+	"github.com/observerss/detour2/logger"
+)
+
+// ErrNotStarted is returned by DialContext before Start, which binds the
+// websocket pool to a context of the caller.
+var ErrNotStarted = errors.New("local is not started")
+
+// DialContext opens a stream to address through the remote chain without an
+// inbound listener, so a Local can back http.Transport, gRPC or x/net/proxy
+// dialers. Start has to be called first.
+func (l *Local) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: streamAddr{network, address}, Err: net.UnknownNetworkError(network)}
+	}
+	l.WSConnsLock.RLock()
+	started := l.Started
+	l.WSConnsLock.RUnlock()
+	if !started {
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: streamAddr{network, address}, Err: ErrNotStarted}
+	}
+
+	if l.Metrics != nil {
+		l.Metrics.ClientConnectionsTotal.Inc()
+	}
+	cid, _ := common.GenerateRandomStringURLSafe(6)
+	logger.Local.Info("dial, get", logger.CID, cid, logger.TARGET, address)
+
+	client, netconn := net.Pipe()
+	conn, err := l.Open(ctx, cid, netconn, network, address)
+	if err != nil {
+		client.Close()
+		netconn.Close()
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: streamAddr{network, address}, Err: err}
+	}
+
+	go l.CopyFromWS(conn)
+	go l.CopyToWS(conn)
+	return &streamConn{Conn: client, remote: streamAddr{network, address}}, nil
+}
+
+// Dial is DialContext without a context, it satisfies golang.org/x/net/proxy.Dialer.
+func (l *Local) Dial(network string, address string) (net.Conn, error) {
+	return l.DialContext(context.Background(), network, address)
+}
+
+type streamAddr struct {
+	network string
+	address string
+}
+
+func (a streamAddr) Network() string {
+	return a.network
+}
+
+func (a streamAddr) String() string {
+	return a.address
+}
+
+type streamConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.remote
+}
@@ -0,0 +1,107 @@
+package local_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/observerss/detour2/common"
+	"github.com/observerss/detour2/detourtest"
+	"github.com/observerss/detour2/local"
+)
+
+func TestDialContextEcho(t *testing.T) {
+	detourtest.SilenceLogs(t)
+
+	targetAddr := detourtest.StartEchoServer(t)
+	chain := detourtest.StartChain(t, detourtest.ChainConfig{})
+
+	conn, err := chain.DialContext(context.Background(), "tcp", targetAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().String() != targetAddr {
+		t.Fatalf("unexpected remote addr: %s", conn.RemoteAddr())
+	}
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	detourtest.AssertEcho(t, conn, []byte("dial context payload"))
+}
+
+func TestDialContextHTTPTransport(t *testing.T) {
+	detourtest.SilenceLogs(t)
+
+	target := detourtest.StartHTTPServer(t, nil)
+	chain := detourtest.StartChain(t, detourtest.ChainConfig{})
+
+	client := &http.Client{Transport: &http.Transport{DialContext: chain.Local.DialContext}, Timeout: 3 * time.Second}
+	resp, err := client.Get(target.URL + "/embedded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "GET " + target.Listener.Addr().String() + "/embedded"; string(body) != want {
+		t.Fatalf("unexpected body: %q want %q", body, want)
+	}
+}
+
+func TestDialContextRefused(t *testing.T) {
+	detourtest.SilenceLogs(t)
+
+	chain := detourtest.StartChain(t, detourtest.ChainConfig{})
+
+	_, err := chain.DialContext(context.Background(), "tcp", detourtest.UnusedAddr(t))
+	var refused *local.ConnectError
+	if !errors.As(err, &refused) {
+		t.Fatalf("expected connect refusal, got %v", err)
+	}
+	snapshot := chain.Local.MetricsSnapshot()
+	if snapshot.Connections.Active != 0 || snapshot.WebSocketPool.ActiveTotal != 0 {
+		t.Fatalf("refused dial leaked state: %+v %+v", snapshot.Connections, snapshot.WebSocketPool)
+	}
+}
+
+func TestNewLocalReturnsConfigErrors(t *testing.T) {
+	_, err := local.NewLocal(&common.LocalConfig{
+		Remotes:  "ws://127.0.0.1:1/ws",
+		Password: detourtest.DefaultPassword,
+		Compress: "brotli",
+	})
+	if err == nil || !strings.Contains(err.Error(), "compress:") {
+		t.Fatalf("expected a compress error, got %v", err)
+	}
+}
+
+func TestStartStopsOnContextCancel(t *testing.T) {
+	proxy, err := local.NewLocal(&common.LocalConfig{
+		Remotes:  "ws://127.0.0.1:1/ws",
+		Password: detourtest.DefaultPassword,
+		Listen:   "tcp://127.0.0.1:0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := proxy.DialContext(context.Background(), "tcp", "127.0.0.1:1"); !errors.Is(err, local.ErrNotStarted) {
+		t.Fatalf("expected dial before Start to fail, got %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	proxy.Start(ctx)
+	cancel()
+
+	select {
+	case <-proxy.DoneChan():
+	case <-time.After(time.Second):
+		t.Fatal("local did not stop after context cancel")
+	}
+	if _, err := proxy.DialContext(context.Background(), "tcp", "127.0.0.1:1"); err == nil {
+		t.Fatal("expected dial on stopped local to fail")
+	}
+}
@@ -2,13 +2,19 @@ package local
 
 import (
 	"bufio"
+	"encoding/base64"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"strings"
 )
 
-type HTTPProto struct{}
+const PROXY_AUTH_REQUIRED = "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"detour\"\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"
+
+type HTTPProto struct {
+	Users map[string]string // username => password, Basic Proxy-Authorization is required when set
+}
 
 func (p *HTTPProto) Get(conn net.Conn) (*Request, error) {
 	reader := bufio.NewReader(conn)
@@ -16,6 +22,15 @@ func (p *HTTPProto) Get(conn net.Conn) (*Request, error) {
 	if err != nil {
 		return nil, err
 	}
+	user := ""
+	if len(p.Users) > 0 {
+		user, err = p.auth(r)
+		if err != nil {
+			conn.Write([]byte(PROXY_AUTH_REQUIRED))
+			return nil, err
+		}
+	}
+	r.Header.Del("Proxy-Authorization")
 	host := r.Host
 	if !strings.Contains(r.Host, ":") {
 		host += ":80"
@@ -23,6 +38,7 @@ func (p *HTTPProto) Get(conn net.Conn) (*Request, error) {
 	req := &Request{
 		Network: "tcp",
 		Address: host,
+		User:    user,
 	}
 	if r.Method == "CONNECT" {
 		return req, nil
@@ -38,6 +54,22 @@ func (p *HTTPProto) Get(conn net.Conn) (*Request, error) {
 	return req, nil
 }
 
+func (p *HTTPProto) auth(r *http.Request) (string, error) {
+	scheme, credentials, _ := strings.Cut(r.Header.Get("Proxy-Authorization"), " ")
+	if !strings.EqualFold(scheme, "basic") {
+		return "", fmt.Errorf("%w, no basic proxy authorization", ErrAuthFailed)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+	if err != nil {
+		return "", fmt.Errorf("%w, %v", ErrAuthFailed, err)
+	}
+	user, password, _ := strings.Cut(string(decoded), ":")
+	if !checkUser(p.Users, user, password) {
+		return "", fmt.Errorf("%w, user %q", ErrAuthFailed, user)
+	}
+	return user, nil
+}
+
 func (p *HTTPProto) Ack(conn net.Conn, ok bool, msg string, req *Request) error {
 	// http proxy does not need to ack
 	if !req.More {
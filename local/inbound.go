@@ -0,0 +1,83 @@
+package local
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/observerss/detour2/common"
+)
+
+// Inbound is one proxy listener, every inbound of a Local shares its
+// websocket pool.
+type Inbound struct {
+	Name     string
+	Network  string
+	Address  string
+	Proto    Proto
+	Users    map[string]string
+	Listener net.Listener // guarded by Local.ListenerLock
+	Metrics  InboundMetrics
+}
+
+type InboundMetrics struct {
+	ConnectionsTotal     common.Counter
+	ConnectionsActive    common.Counter
+	AuthFailuresTotal    common.Counter
+	ConnectFailuresTotal common.Counter
+	BytesUpTotal         common.Counter
+	BytesDownTotal       common.Counter
+}
+
+func NewInbound(lconf common.ListenerConfig) (*Inbound, error) {
+	network, address, _ := strings.Cut(lconf.Listen, "://")
+	inbound := &Inbound{
+		Name:    lconf.Name,
+		Network: network,
+		Address: address,
+		Users:   lconf.Users,
+	}
+	switch lconf.Proto {
+	case PROTO_SOCKS5:
+		inbound.Proto = &Socks5Proto{Users: lconf.Users}
+	case PROTO_HTTP:
+		inbound.Proto = &HTTPProto{Users: lconf.Users}
+	default:
+		return nil, fmt.Errorf("proto %s not supported", lconf.Proto)
+	}
+	return inbound, nil
+}
+
+// inboundConn counts the bytes of an accepted client and the inbound's active
+// connections until it is closed.
+type inboundConn struct {
+	net.Conn
+	inbound   *Inbound
+	closeOnce sync.Once
+}
+
+func newInboundConn(inbound *Inbound, conn net.Conn) *inboundConn {
+	inbound.Metrics.ConnectionsTotal.Inc()
+	inbound.Metrics.ConnectionsActive.Inc()
+	return &inboundConn{Conn: conn, inbound: inbound}
+}
+
+func (c *inboundConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.inbound.Metrics.BytesUpTotal.Add(int64(n))
+	return n, err
+}
+
+func (c *inboundConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.inbound.Metrics.BytesDownTotal.Add(int64(n))
+	return n, err
+}
+
+func (c *inboundConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.inbound.Metrics.ConnectionsActive.Dec()
+	})
+	return c.Conn.Close()
+}
@@ -1,7 +1,11 @@
 package local
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net"
 	"strings"
 	"sync"
@@ -17,17 +21,26 @@ const (
 )
 
 type Local struct {
-	Network       string
-	Address       string
+	Inbounds      []*Inbound
 	Packer        *common.Packer
-	Proto         Proto
 	WSConns       map[string]*WSConn // pool key => WSConn
-	Conns         sync.Map           // Cid => Conn
-	Listener      net.Listener
+	WSConnsLock   sync.RWMutex
+	Started       bool
+	Conns         sync.Map // Cid => Conn
+	ListenerLock  sync.Mutex
 	Done          chan struct{}
+	StartOnce     sync.Once
 	StopOnce      sync.Once
 	Metrics       *common.RuntimeMetrics
 	MetricsListen string
+	AdminListen   string
+	AdminToken    string
+	Compress      []common.Codec
+	RemoteOptions common.RemoteOptions // how each remote is dialed
+	Traffic       *common.TrafficTable
+	Access        *common.AccessLog
+	Tracer        *common.Tracer
+	Throttle      *common.Throttle // paces uploads only, see CopyToWS
 }
 type Conn struct {
 	Cid               string
@@ -40,12 +53,46 @@ type Conn struct {
 	WSConn            *WSConn
 	Metrics           *common.RuntimeMetrics
 	LastActTime       time.Time
+	OpenedAt          time.Time // when the CONNECT was sent
+	StartedAt         time.Time // set once the remote acked the CONNECT
+	Client            string
+	User              string
+	Listener          string
+	Info              common.ConnectInfo // from the ack, guarded by AttrLock
+	CloseReason       common.CloseReason
+	BytesUp           common.Counter
+	BytesDown         common.Counter
+	Traffic           *common.TrafficTable
+	TrafficCursor     common.TrafficCursor
+	Throttle          *common.StreamThrottle
+	Log               *slog.Logger // cid, wid, target, trace, hop and user fields
+	Access            *common.AccessLog
 	AttrLock          sync.RWMutex
 	QuitOnce          sync.Once
 	ReleaseOnce       sync.Once
 	CloseUpstreamOnce sync.Once
 }
 
+// ConnectError is returned when the remote end refuses a CONNECT.
+type ConnectError struct {
+	Msg string
+}
+
+func (e *ConnectError) Error() string {
+	if e.Msg == "" {
+		return "connect refused by remote"
+	}
+	return "connect refused by remote: " + e.Msg
+}
+
+// Logger returns the logger carrying the fields of the stream.
+func (c *Conn) Logger() *slog.Logger {
+	if c.Log == nil {
+		return logger.Local.With(logger.CID, c.Cid, logger.WID, c.Wid, logger.TARGET, c.Address)
+	}
+	return c.Log
+}
+
 func (c *Conn) CloseQuit() {
 	c.QuitOnce.Do(func() {
 		close(c.Quit)
@@ -59,10 +106,62 @@ func (c *Conn) ReleaseWSConn() {
 		}
 		if c.Metrics != nil {
 			c.Metrics.ClientConnectionsClosed.Inc()
+			c.AttrLock.RLock()
+			startedAt := c.StartedAt
+			c.AttrLock.RUnlock()
+			if !startedAt.IsZero() {
+				c.Metrics.StreamLifetime.Since(startedAt)
+			}
 		}
+		c.AccountTraffic(true)
+		c.WriteAccess()
 	})
 }
 
+// WriteAccess appends the access record of the stream, it is called once
+// the stream is released.
+func (c *Conn) WriteAccess() {
+	if c.Access == nil {
+		return
+	}
+	c.AttrLock.RLock()
+	info := c.Info
+	c.AttrLock.RUnlock()
+	record := common.AccessRecord{
+		Start:     c.OpenedAt,
+		End:       time.Now(),
+		Side:      "local",
+		Cid:       c.Cid,
+		Client:    c.Client,
+		User:      c.User,
+		Listener:  c.Listener,
+		Target:    c.Address,
+		Resolved:  info.Resolved,
+		BytesUp:   c.BytesUp.Load(),
+		BytesDown: c.BytesDown.Load(),
+		Result:    c.CloseReason.Get("closed"),
+	}
+	if c.WSConn != nil {
+		record.Path = append([]string{c.WSConn.Url}, info.Path...)
+	}
+	if err := c.Access.Write(record); err != nil {
+		c.Logger().Error("access, write error", logger.ERR, err)
+	}
+}
+
+// AccountTraffic adds the bytes moved since the last call to the traffic
+// table, streams that were never acked are left out.
+func (c *Conn) AccountTraffic(finished bool) {
+	c.AttrLock.RLock()
+	startedAt, user := c.StartedAt, c.User
+	c.AttrLock.RUnlock()
+	if startedAt.IsZero() {
+		return
+	}
+	up, down := c.TrafficCursor.Advance(c.BytesUp.Load(), c.BytesDown.Load())
+	c.Traffic.Add(c.Address, user, up, down, finished)
+}
+
 func (c *Conn) CloseUpstream() {
 	c.CloseUpstreamOnce.Do(func() {
 		if c.WSConn == nil {
@@ -76,100 +175,185 @@ func (c *Conn) CloseUpstream() {
 			Address: c.Address,
 		}
 		if err := c.WSConn.WriteMessage(msg); err != nil {
-			logger.Debug.Println(c.Cid, "close-upstream, write error", err)
+			c.Logger().Debug("close-upstream, write error", logger.ERR, err)
 		}
 	})
 }
 
-func NewLocal(lconf *common.LocalConfig) *Local {
-	vals := strings.Split(lconf.Listen, "://")
-	network := vals[0]
-	address := vals[1]
-	urls := strings.Split(lconf.Remotes, ",")
+// NewLocal builds a local from lconf, an invalid setting returns an error
+// naming every one that failed.
+func NewLocal(lconf *common.LocalConfig) (*Local, error) {
+	metrics := common.NewRuntimeMetrics()
 	local := &Local{
-		Network:       network,
-		Address:       address,
-		Packer:        &common.Packer{Password: lconf.Password},
+		Packer:        &common.Packer{Password: lconf.Password, CompressThreshold: lconf.CompressThreshold, Metrics: metrics},
 		WSConns:       make(map[string]*WSConn),
 		Done:          make(chan struct{}),
-		Metrics:       common.NewRuntimeMetrics(),
+		Metrics:       metrics,
 		MetricsListen: strings.TrimSpace(lconf.MetricsListen),
+		AdminListen:   strings.TrimSpace(lconf.AdminListen),
+		AdminToken:    lconf.AdminToken,
+		RemoteOptions: lconf.RemoteOptions,
+		Traffic:       common.NewTrafficTable(strings.TrimSpace(lconf.TrafficLog)),
+		Tracer:        common.NewTracer("detour2-local", lconf.TraceEndpoint, logger.Local),
 	}
-	switch lconf.Proto {
-	case PROTO_SOCKS5:
-		local.Proto = &Socks5Proto{}
-	case PROTO_HTTP:
-		local.Proto = &HTTPProto{}
-	default:
-		logger.Error.Fatalln("proto", lconf.Proto, "not supported")
+	errs := []error{}
+	var err error
+	if local.Compress, err = common.ParseCodecs(lconf.Compress); err != nil {
+		errs = append(errs, fmt.Errorf("compress: %w", err))
 	}
-	poolSize := lconf.PoolSize
-	if poolSize < 1 {
-		poolSize = 1
+	if local.Access, err = common.NewAccessLog(lconf.AccessLogConfig); err != nil {
+		errs = append(errs, fmt.Errorf("access log: %w", err))
 	}
-	for _, url := range urls {
-		url = strings.TrimSpace(url)
-		if url == "" {
+	if local.Throttle, err = common.NewThrottle(lconf.RateLimitConfig, metrics); err != nil {
+		errs = append(errs, fmt.Errorf("ratelimit: %w", err))
+	}
+	// without listeners the local is only used through DialContext
+	for _, listener := range lconf.InboundListeners() {
+		inbound, err := NewInbound(listener)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("listener %s: %w", listener.Name, err))
 			continue
 		}
-		for i := 0; i < poolSize; i++ {
-			wid, _ := common.GenerateRandomStringURLSafe(3)
-			local.WSConns[fmt.Sprintf("%s#%d", url, i)] = NewWSConn(url, wid, local)
-		}
+		local.Inbounds = append(local.Inbounds, inbound)
+	}
+	if err := errors.Join(errs...); err != nil {
+		local.Access.Close()
+		local.Tracer.Close()
+		return nil, err
 	}
-	return local
+	for key, url := range common.PoolKeys(lconf.Remotes, lconf.PoolSize) {
+		wid, _ := common.GenerateRandomStringURLSafe(3)
+		local.WSConns[key] = NewWSConn(url, wid, local)
+	}
+	return local, nil
 }
 
 func (l *Local) RunLocal() error {
-	defer func() {
-		logger.Info.Println("Local server stopped.")
-	}()
+	return l.RunLocalContext(context.Background())
+}
 
-	l.StartMetricsServer()
+// RunLocalContext listens on every configured inbound and serves until ctx
+// is done or the local is stopped. When one listener fails the others are
+// stopped as well.
+func (l *Local) RunLocalContext(ctx context.Context) error {
+	if len(l.Inbounds) == 0 {
+		return errors.New("local listener is not configured")
+	}
+	listeners := make([]net.Listener, 0, len(l.Inbounds))
+	for _, inbound := range l.Inbounds {
+		listener, err := net.Listen(inbound.Network, inbound.Address)
+		if err != nil {
+			for _, listener := range listeners {
+				listener.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, listener)
+	}
 
-	listen, err := net.Listen(l.Network, l.Address)
-	l.Listener = listen
-	if err != nil {
-		return err
+	errs := make(chan error, len(listeners))
+	for i, inbound := range l.Inbounds {
+		go func() {
+			errs <- l.ServeInbound(ctx, inbound, listeners[i])
+		}()
+	}
+	var err error
+	for range listeners {
+		err = errors.Join(err, <-errs)
+		l.StopLocal()
 	}
+	return err
+}
 
-	logger.Info.Println("Listening on " + l.Network + "://" + l.Address)
+// Serve accepts proxy clients of the first inbound on listener until ctx is
+// done or the local is stopped.
+func (l *Local) Serve(ctx context.Context, listener net.Listener) error {
+	if len(l.Inbounds) == 0 {
+		listener.Close()
+		return errors.New("local listener is not configured")
+	}
+	return l.ServeInbound(ctx, l.Inbounds[0], listener)
+}
 
-	// background wsconn puller & keeper
-	for _, wsconn := range l.WSConns {
-		go wsconn.WebsocketPuller()
+// ServeInbound accepts proxy clients of inbound on listener until ctx is done
+// or the local is stopped.
+func (l *Local) ServeInbound(ctx context.Context, inbound *Inbound, listener net.Listener) error {
+	defer func() {
+		logger.Local.Info("Local server stopped.", "listener", inbound.Name)
+	}()
+
+	l.ListenerLock.Lock()
+	inbound.Listener = listener
+	l.ListenerLock.Unlock()
+	l.Start(ctx)
+	if l.IsStopped() {
+		listener.Close()
+		return nil
 	}
 
+	logger.Local.Info("Listening on "+inbound.Network+"://"+listener.Addr().String(), "listener", inbound.Name)
+
 	for {
-		conn, err := listen.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
 			if l.IsStopped() {
 				break
 			}
-			logger.Error.Println("run, accept error", err)
+			logger.Local.Error("run, accept error", "listener", inbound.Name, logger.ERR, err)
 			break
 		}
 
-		go l.HandleConn(conn)
+		go l.HandleConn(inbound, conn)
 	}
 
 	return nil
 }
 
+// Start runs the metrics endpoint and the background websocket pullers, and
+// stops the local once ctx is done. It is safe to call more than once, only
+// the first call takes effect.
+func (l *Local) Start(ctx context.Context) {
+	l.StartOnce.Do(func() {
+		l.StartMetricsServer()
+		l.StartAdminServer()
+		go l.RunTraffic()
+
+		// background wsconn puller & keeper
+		l.WSConnsLock.Lock()
+		l.Started = true
+		for _, wsconn := range l.WSConns {
+			go wsconn.WebsocketPuller()
+		}
+		l.WSConnsLock.Unlock()
+
+		go func() {
+			select {
+			case <-ctx.Done():
+				l.StopLocal()
+			case <-l.DoneChan():
+			}
+		}()
+	})
+}
+
 func (l *Local) StopLocal() {
 	defer func() {
 		if r := recover(); r != nil {
-			logger.Error.Println(r)
+			logger.Local.Error("stop, panic", logger.ERR, r)
 		}
 	}()
 	l.StopOnce.Do(func() {
 		if l.Done != nil {
 			close(l.Done)
 		}
-		if l.Listener != nil {
-			l.Listener.Close()
+		l.ListenerLock.Lock()
+		for _, inbound := range l.Inbounds {
+			if inbound.Listener != nil {
+				inbound.Listener.Close()
+			}
 		}
-		for _, wsconn := range l.WSConns {
+		l.ListenerLock.Unlock()
+		for _, wsconn := range l.PoolWSConns() {
 			wsconn.SignalConnChan()
 			wsconn.WriteLock.Lock()
 			writer := wsconn.Writer
@@ -184,15 +368,28 @@ func (l *Local) StopLocal() {
 		}
 		l.Conns.Range(func(key, value any) bool {
 			conn := value.(*Conn)
+			conn.CloseReason.Set("local stopped")
 			conn.CloseQuit()
 			if conn.NetConn != nil {
 				conn.NetConn.Close()
 			}
 			return true
 		})
+		l.Tracer.Close()
 	})
 }
 
+// PoolWSConns returns the websockets currently used for new streams.
+func (l *Local) PoolWSConns() []*WSConn {
+	l.WSConnsLock.RLock()
+	defer l.WSConnsLock.RUnlock()
+	wsconns := make([]*WSConn, 0, len(l.WSConns))
+	for _, wsconn := range l.WSConns {
+		wsconns = append(wsconns, wsconn)
+	}
+	return wsconns
+}
+
 func (l *Local) DoneChan() <-chan struct{} {
 	if l == nil || l.Done == nil {
 		return nil
@@ -209,100 +406,69 @@ func (l *Local) IsStopped() bool {
 	}
 }
 
-func (l *Local) HandleConn(netconn net.Conn) {
+func (l *Local) HandleConn(inbound *Inbound, netconn net.Conn) {
 	if l.Metrics != nil {
 		l.Metrics.ClientConnectionsTotal.Inc()
 	}
+	netconn = newInboundConn(inbound, netconn)
 	cid, _ := common.GenerateRandomStringURLSafe(6)
+	log := logger.Local.With(logger.CID, cid)
 	handleOk := false
+	opened := false
 	var conn *Conn
-	var reservedWSConn *WSConn
 	defer func() {
 		if !handleOk {
-			logger.Error.Println(cid, "handle, close conn")
+			log.Error("handle, close conn")
 			netconn.Close()
-			l.Conns.Delete(cid)
 			if conn != nil {
+				l.Conns.Delete(cid)
 				conn.CloseUpstream()
 				conn.ReleaseWSConn()
 				conn.CloseQuit()
-			} else if reservedWSConn != nil {
-				reservedWSConn.AddActive(-1)
-				if l.Metrics != nil {
-					l.Metrics.ClientConnectionsClosed.Inc()
-				}
-			} else if l.Metrics != nil {
+			} else if !opened && l.Metrics != nil {
 				l.Metrics.ClientConnectionsClosed.Inc()
 			}
 		}
 	}()
 
-	logger.Debug.Println(cid, "handle, init")
-	req, err := l.Proto.Get(netconn)
-	if err != nil {
-		logger.Debug.Println(cid, "init error", err)
-		return
-	}
-	logger.Info.Println(cid, "handle, get", req.Address)
-
-	logger.Debug.Println(cid, "handle, get wsconn")
-	wsconn, err := l.GetWSConn()
+	log.Debug("handle, init", "listener", inbound.Name)
+	req, err := inbound.Proto.Get(netconn)
 	if err != nil {
-		if l.Metrics != nil {
-			l.Metrics.ConnectFailuresTotal.Inc()
+		if errors.Is(err, ErrAuthFailed) {
+			inbound.Metrics.AuthFailuresTotal.Inc()
+			log.Warn("handle, auth error", "listener", inbound.Name, "remote", netconn.RemoteAddr().String(), logger.ERR, err)
+			return
 		}
-		logger.Debug.Println(cid, "cannot connect to ws", err)
+		log.Debug("handle, init error", logger.ERR, err)
 		return
 	}
-	reservedWSConn = wsconn
-
-	logger.Debug.Println(cid, "handle, wsconn send 'connect'")
-	msg := &common.Message{
-		Cmd:     common.CONNECT,
-		Cid:     cid,
-		Wid:     wsconn.Wid,
-		Network: req.Network,
-		Address: req.Address,
-	}
-	err = wsconn.WriteMessage(msg)
-	if err != nil {
-		logger.Debug.Println(cid, "handle, wsconn send error", err)
-		return
+	log = log.With(logger.TARGET, req.Address)
+	if req.User != "" {
+		log = log.With(logger.USER, req.User)
 	}
+	log.Info("handle, get")
 
-	logger.Debug.Println(cid, "handle, wait on msg channel")
-	conn = &Conn{
-		Wid:         wsconn.Wid,
-		Cid:         cid,
-		MsgChan:     make(chan *common.Message, 32),
-		Quit:        make(chan interface{}),
-		Network:     msg.Network,
-		Address:     msg.Address,
-		NetConn:     netconn,
-		WSConn:      wsconn,
-		Metrics:     l.Metrics,
-		LastActTime: time.Now(),
-	}
-	reservedWSConn = nil
-	l.Conns.Store(cid, conn)
-	select {
-	case <-conn.Quit:
-		logger.Debug.Println(cid, "handle, quit before ack")
-		return
-	case <-l.DoneChan():
-		logger.Debug.Println(cid, "handle, local stopped before ack")
+	opened = true
+	conn, err = l.open(context.Background(), cid, netconn, req.Network, req.Address, req.User, inbound.Name)
+	if err != nil {
+		inbound.Metrics.ConnectFailuresTotal.Inc()
+		var refused *ConnectError
+		if errors.As(err, &refused) {
+			log.Debug("handle, send ack", "ok", false)
+			if err := inbound.Proto.Ack(netconn, false, refused.Msg, req); err != nil {
+				log.Debug("handle, ack error", logger.ERR, err)
+			}
+		}
+		log.Debug("handle, open connection failed", logger.ERR, err)
 		return
-	case msg = <-conn.MsgChan:
 	}
+	log = conn.Log
 
-	logger.Debug.Println(cid, "handle, send ack", msg.Ok, msg.Network, msg.Address)
-	err = l.Proto.Ack(netconn, msg.Ok, msg.Msg, req)
+	log.Debug("handle, send ack", "ok", true)
+	err = inbound.Proto.Ack(netconn, true, "", req)
 	if err != nil {
-		logger.Debug.Println(cid, "handle, ack error", err)
-		return
-	}
-	if !msg.Ok {
-		logger.Debug.Println(cid, "open connection failed", msg.Msg)
+		conn.CloseReason.Set("client ack error")
+		log.Debug("handle, ack error", logger.ERR, err)
 		return
 	}
 
@@ -312,7 +478,8 @@ func (l *Local) HandleConn(netconn net.Conn) {
 		for {
 			nr, err := req.Reader.Read(buf)
 			if err != nil {
-				logger.Debug.Println(cid, "handle, send more error", err)
+				conn.CloseReason.Set("client read error")
+				log.Debug("handle, send more error", logger.ERR, err)
 				return
 			}
 
@@ -325,14 +492,16 @@ func (l *Local) HandleConn(netconn net.Conn) {
 				Data:    append([]byte{}, buf[:nr]...),
 			}
 
-			logger.Debug.Println(conn.Cid, "copy-to-ws, read <=== local", msg.Cmd, len(msg.Data))
+			log.Debug("copy-to-ws, read <=== local", "cmd", msg.Cmd, "bytes", len(msg.Data))
 			err = conn.WSConn.WriteMessage(msg)
 			if err != nil {
-				logger.Debug.Println(conn.Cid, "copy-to-ws, write error", err)
+				conn.CloseReason.Set("websocket write error")
+				log.Debug("copy-to-ws, write error", logger.ERR, err)
 				return
 			}
+			conn.BytesUp.Add(int64(nr))
 
-			logger.Debug.Println(conn.Cid, "copy-to-ws, sent ===> ws", nr)
+			log.Debug("copy-to-ws, sent ===> ws", "bytes", nr)
 
 			if nr < BUFFER_SIZE {
 				break
@@ -341,21 +510,146 @@ func (l *Local) HandleConn(netconn net.Conn) {
 	}
 
 	handleOk = true
-	logger.Debug.Println(conn.Cid, "handle, ok")
+	log.Debug("handle, ok")
 
 	go l.CopyFromWS(conn)
 	go l.CopyToWS(conn)
 }
 
+// Open sends CONNECT for network/address over a pooled websocket and waits for
+// the remote ack. On success the returned Conn is registered and bound to
+// netconn; on failure everything but netconn is released, and a refusal by the
+// remote is reported as *ConnectError.
+func (l *Local) Open(ctx context.Context, cid string, netconn net.Conn, network string, address string) (*Conn, error) {
+	return l.open(ctx, cid, netconn, network, address, "", "")
+}
+
+func (l *Local) open(ctx context.Context, cid string, netconn net.Conn, network string, address string, user string, listener string) (*Conn, error) {
+	span := l.Tracer.Start(common.TraceContext{}, common.HOP_LOCAL, cid, address)
+	log := logger.Local.With(logger.CID, cid, logger.TARGET, address, logger.TRACE, span.Context().TraceID)
+	if user != "" {
+		log = log.With(logger.USER, user)
+	}
+	conn := &Conn{
+		Cid:         cid,
+		MsgChan:     make(chan *common.Message, 32),
+		Quit:        make(chan interface{}),
+		Network:     network,
+		Address:     address,
+		NetConn:     netconn,
+		Metrics:     l.Metrics,
+		LastActTime: time.Now(),
+		OpenedAt:    time.Now(),
+		User:        user,
+		Listener:    listener,
+		Traffic:     l.Traffic,
+		Access:      l.Access,
+		Throttle:    l.Throttle.Stream(user),
+		Log:         log,
+	}
+	if netconn != nil && netconn.RemoteAddr() != nil {
+		conn.Client = netconn.RemoteAddr().String()
+	}
+	// failures below set a close reason before returning
+	defer func() { span.Finish(conn.CloseReason.Get("")) }()
+
+	log.Debug("handle, get wsconn")
+	wsconn, err := l.GetWSConn()
+	span.Mark("wsconn")
+	if err != nil {
+		if l.Metrics != nil {
+			l.Metrics.ConnectFailuresTotal.Inc()
+			l.Metrics.ClientConnectionsClosed.Inc()
+		}
+		log.Debug("handle, cannot connect to ws", logger.ERR, err)
+		conn.CloseReason.Set("no websocket: " + err.Error())
+		conn.WriteAccess()
+		return nil, err
+	}
+
+	log = log.With(logger.WID, wsconn.Wid, logger.HOP, wsconn.Url)
+	log.Debug("handle, wsconn send 'connect'")
+	span.SetNext(wsconn.Url)
+	msg := &common.Message{
+		Cmd:     common.CONNECT,
+		Cid:     cid,
+		Wid:     wsconn.Wid,
+		Msg:     common.ConnectRequest{TraceParent: span.Context().TraceParent(), User: user, Compress: common.FormatCodecs(wsconn.Compress)}.String(),
+		Network: network,
+		Address: address,
+	}
+	start := time.Now()
+	err = wsconn.WriteMessage(msg)
+	span.Mark("queue")
+	if err != nil {
+		log.Debug("handle, wsconn send error", logger.ERR, err)
+		wsconn.AddActive(-1)
+		if l.Metrics != nil {
+			l.Metrics.ClientConnectionsClosed.Inc()
+		}
+		conn.CloseReason.Set("websocket write error")
+		conn.WriteAccess()
+		return nil, err
+	}
+
+	log.Debug("handle, wait on msg channel")
+	conn.Wid = wsconn.Wid
+	conn.WSConn = wsconn
+	conn.Log = log
+	l.Conns.Store(cid, conn)
+	// wake the puller again, it may have counted the conns before the store
+	wsconn.SignalConnChan()
+	release := func() {
+		l.Conns.Delete(cid)
+		conn.CloseUpstream()
+		conn.ReleaseWSConn()
+		conn.CloseQuit()
+	}
+	select {
+	case <-conn.Quit:
+		log.Debug("handle, quit before ack")
+		conn.CloseReason.Set("closed before ack")
+		release()
+		return nil, errors.New("connection closed before ack")
+	case <-l.DoneChan():
+		log.Debug("handle, local stopped before ack")
+		conn.CloseReason.Set("local stopped")
+		release()
+		return nil, errors.New("local server is stopped")
+	case <-ctx.Done():
+		log.Debug("handle, canceled before ack")
+		conn.CloseReason.Set("canceled")
+		release()
+		return nil, ctx.Err()
+	case msg = <-conn.MsgChan:
+	}
+	span.Mark("ack")
+	if l.Metrics != nil {
+		l.Metrics.ConnectRTT.Since(start)
+	}
+
+	if !msg.Ok {
+		conn.CloseReason.Set(strings.TrimSuffix("refused: "+msg.Msg, ": "))
+		release()
+		return nil, &ConnectError{Msg: msg.Msg}
+	}
+	conn.AttrLock.Lock()
+	conn.StartedAt = time.Now()
+	conn.Info = common.ParseConnectInfo(msg.Msg)
+	conn.AttrLock.Unlock()
+	return conn, nil
+}
+
 func (l *Local) CopyFromWS(conn *Conn) {
+	log := conn.Logger()
 	defer func() {
-		logger.Debug.Println(conn.Cid, "copy-from-ws, close conn")
+		log.Debug("copy-from-ws, close conn")
 		conn.NetConn.Close()
 		l.Conns.Delete(conn.Cid)
 		conn.ReleaseWSConn()
 	}()
 
-	logger.Debug.Println(conn.Cid, "copy-from-ws, start")
+	log.Debug("copy-from-ws, start")
 
 	// we need to timeout the conn if TTL is passed (i.e. recovery from hibernate)
 	// **Server** websocket is closed silently at that time
@@ -368,13 +662,15 @@ func (l *Local) CopyFromWS(conn *Conn) {
 		var msg *common.Message
 		select {
 		case <-conn.Quit:
-			logger.Debug.Println(conn.Cid, "copy-from-ws, 'quit'")
+			log.Debug("copy-from-ws, 'quit'")
 			return
 		case <-l.DoneChan():
-			logger.Debug.Println(conn.Cid, "copy-from-ws, local stopped")
+			conn.CloseReason.Set("local stopped")
+			log.Debug("copy-from-ws, local stopped")
 			return
 		case <-timer.C:
-			logger.Info.Println(conn.Cid, "copy-from-ws, timeout")
+			conn.CloseReason.Set("idle timeout")
+			log.Info("copy-from-ws, timeout")
 			return
 		case msg = <-conn.MsgChan:
 			if !timer.Stop() {
@@ -390,29 +686,34 @@ func (l *Local) CopyFromWS(conn *Conn) {
 		conn.LastActTime = time.Now()
 		conn.AttrLock.Unlock()
 
-		logger.Debug.Println(conn.Cid, "copy-from-ws, get <=== queue", msg.Cmd, len(msg.Data))
+		log.Debug("copy-from-ws, get <=== queue", "cmd", msg.Cmd, "bytes", len(msg.Data))
 		switch msg.Cmd {
 		case common.CLOSE:
-			logger.Debug.Println(conn.Cid, "copy-from-ws, 'close'")
+			conn.CloseReason.Set("remote closed")
+			log.Debug("copy-from-ws, 'close'")
 			return
 		case common.DATA:
 			nw, err := conn.NetConn.Write(msg.Data)
 			if err != nil {
-				logger.Debug.Println(conn.Cid, "copy-from-ws, write error", err)
+				conn.CloseReason.Set("client write error")
+				log.Debug("copy-from-ws, write error", logger.ERR, err)
 				return
 			}
 			if nw == 0 {
-				logger.Debug.Println(conn.Cid, "copy-from-ws, close by '0' data")
+				conn.CloseReason.Set("client closed")
+				log.Debug("copy-from-ws, close by '0' data")
 				return
 			}
-			logger.Debug.Println(conn.Cid, "copy-from-ws, written ===> local", nw)
+			conn.BytesDown.Add(int64(nw))
+			log.Debug("copy-from-ws, written ===> local", "bytes", nw)
 		}
 	}
 }
 
 func (l *Local) CopyToWS(conn *Conn) {
+	log := conn.Logger()
 	defer func() {
-		logger.Debug.Println(conn.Cid, "copy-to-ws, close conn")
+		log.Debug("copy-to-ws, close conn")
 		conn.CloseUpstream()
 		conn.NetConn.Close()
 		l.Conns.Delete(conn.Cid)
@@ -420,20 +721,28 @@ func (l *Local) CopyToWS(conn *Conn) {
 		conn.CloseQuit()
 	}()
 
-	logger.Debug.Println(conn.Cid, "copy-to-ws, start")
+	log.Debug("copy-to-ws, start")
 
 	buf := make([]byte, BUFFER_SIZE)
 	for {
 		// conn.NetConn.SetReadDeadline(time.Now().Add(time.Second * READ_TIMEOUT))
 		nr, err := conn.NetConn.Read(buf)
 		if err != nil {
-			logger.Debug.Println(conn.Cid, "copy-to-ws, read error", err)
+			if errors.Is(err, io.EOF) {
+				conn.CloseReason.Set("client closed")
+			} else {
+				conn.CloseReason.Set("client read error")
+			}
+			log.Debug("copy-to-ws, read error", logger.ERR, err)
 			return
 		}
 
 		conn.AttrLock.Lock()
 		conn.LastActTime = time.Now()
 		conn.AttrLock.Unlock()
+		// reading slower pushes back on the client, pacing downloads here
+		// would only fill MsgChan, so they are left to the exit
+		conn.Throttle.Wait(true, nr, l.DoneChan())
 
 		msg := &common.Message{
 			Cmd:     common.DATA,
@@ -447,17 +756,20 @@ func (l *Local) CopyToWS(conn *Conn) {
 			msg.Cmd = common.CLOSE
 		}
 
-		logger.Debug.Println(conn.Cid, "copy-to-ws, read <=== local", msg.Cmd, len(msg.Data))
+		log.Debug("copy-to-ws, read <=== local", "cmd", msg.Cmd, "bytes", len(msg.Data))
 		err = conn.WSConn.WriteMessage(msg)
 		if err != nil {
-			logger.Debug.Println(conn.Cid, "copy-to-ws, write error", err)
+			conn.CloseReason.Set("websocket write error")
+			log.Debug("copy-to-ws, write error", logger.ERR, err)
 			return
 		}
+		conn.BytesUp.Add(int64(nr))
 
-		logger.Debug.Println(conn.Cid, "copy-to-ws, sent ===> ws", nr)
+		log.Debug("copy-to-ws, sent ===> ws", "bytes", nr)
 
 		if nr == 0 {
-			logger.Debug.Println(conn.Cid, "copy-to-ws, close by '0' data")
+			conn.CloseReason.Set("client closed")
+			log.Debug("copy-to-ws, close by '0' data")
 			return
 		}
 	}
@@ -13,13 +13,27 @@ import (
 
 type LocalMetricsSnapshot struct {
 	Role          string                        `json:"role"`
-	Listen        string                        `json:"listen"`
-	Proto         string                        `json:"proto"`
+	Listen        string                        `json:"listen,omitempty"`
+	Proto         string                        `json:"proto,omitempty"`
 	Runtime       common.RuntimeMetricsSnapshot `json:"runtime"`
 	Connections   LocalConnectionSnapshot       `json:"connections"`
+	Listeners     []LocalListenerSnapshot       `json:"listeners"`
 	WebSocketPool LocalWebSocketPoolSnapshot    `json:"webSocketPool"`
 }
 
+type LocalListenerSnapshot struct {
+	Name                 string `json:"name"`
+	Listen               string `json:"listen"`
+	Proto                string `json:"proto"`
+	Auth                 bool   `json:"auth"`
+	ConnectionsTotal     int64  `json:"connectionsTotal"`
+	ConnectionsActive    int64  `json:"connectionsActive"`
+	AuthFailuresTotal    int64  `json:"authFailuresTotal"`
+	ConnectFailuresTotal int64  `json:"connectFailuresTotal"`
+	BytesUpTotal         int64  `json:"bytesUpTotal"`
+	BytesDownTotal       int64  `json:"bytesDownTotal"`
+}
+
 type LocalConnectionSnapshot struct {
 	Active int `json:"active"`
 }
@@ -40,6 +54,7 @@ type LocalWebSocketSnapshot struct {
 	Connected  bool                             `json:"connected"`
 	CanConnect bool                             `json:"canConnect"`
 	Active     int64                            `json:"active"`
+	Codec      string                           `json:"codec"`
 	Writer     common.FairMessageWriterSnapshot `json:"writer"`
 }
 
@@ -50,9 +65,16 @@ func (l *Local) MetricsSnapshot() LocalMetricsSnapshot {
 		return true
 	})
 
-	items := make([]LocalWebSocketSnapshot, 0, len(l.WSConns))
-	pool := LocalWebSocketPoolSnapshot{Total: len(l.WSConns)}
+	l.WSConnsLock.RLock()
+	wsconns := make(map[string]*WSConn, len(l.WSConns))
 	for key, wsconn := range l.WSConns {
+		wsconns[key] = wsconn
+	}
+	l.WSConnsLock.RUnlock()
+
+	items := make([]LocalWebSocketSnapshot, 0, len(wsconns))
+	pool := LocalWebSocketPoolSnapshot{Total: len(wsconns)}
+	for key, wsconn := range wsconns {
 		wsconn.RWLock.RLock()
 		connected := wsconn.Connected
 		canConnect := wsconn.CanConnect
@@ -60,6 +82,7 @@ func (l *Local) MetricsSnapshot() LocalMetricsSnapshot {
 
 		wsconn.WriteLock.Lock()
 		writerSnapshot := wsconn.Writer.Snapshot()
+		codec := wsconn.Codec.Load()
 		wsconn.WriteLock.Unlock()
 
 		item := LocalWebSocketSnapshot{
@@ -69,6 +92,7 @@ func (l *Local) MetricsSnapshot() LocalMetricsSnapshot {
 			Connected:  connected,
 			CanConnect: canConnect,
 			Active:     wsconn.ActiveCount(),
+			Codec:      codec.String(),
 			Writer:     writerSnapshot,
 		}
 
@@ -89,14 +113,69 @@ func (l *Local) MetricsSnapshot() LocalMetricsSnapshot {
 	})
 	pool.Items = items
 
-	return LocalMetricsSnapshot{
+	listeners := make([]LocalListenerSnapshot, 0, len(l.Inbounds))
+	for _, inbound := range l.Inbounds {
+		listeners = append(listeners, LocalListenerSnapshot{
+			Name:                 inbound.Name,
+			Listen:               inbound.Network + "://" + inbound.Address,
+			Proto:                protoName(inbound.Proto),
+			Auth:                 len(inbound.Users) > 0,
+			ConnectionsTotal:     inbound.Metrics.ConnectionsTotal.Load(),
+			ConnectionsActive:    inbound.Metrics.ConnectionsActive.Load(),
+			AuthFailuresTotal:    inbound.Metrics.AuthFailuresTotal.Load(),
+			ConnectFailuresTotal: inbound.Metrics.ConnectFailuresTotal.Load(),
+			BytesUpTotal:         inbound.Metrics.BytesUpTotal.Load(),
+			BytesDownTotal:       inbound.Metrics.BytesDownTotal.Load(),
+		})
+	}
+
+	snapshot := LocalMetricsSnapshot{
 		Role:          "local",
-		Listen:        l.Network + "://" + l.Address,
-		Proto:         protoName(l.Proto),
 		Runtime:       l.Metrics.Snapshot(),
 		Connections:   LocalConnectionSnapshot{Active: activeConnections},
+		Listeners:     listeners,
 		WebSocketPool: pool,
 	}
+	if len(listeners) > 0 {
+		// listen and proto describe the first listener, as before there were several
+		snapshot.Listen = listeners[0].Listen
+		snapshot.Proto = listeners[0].Proto
+	}
+	return snapshot
+}
+
+// PrometheusMetrics renders MetricsSnapshot in the Prometheus text format.
+func (l *Local) PrometheusMetrics() *common.PromWriter {
+	snapshot := l.MetricsSnapshot()
+	p := common.NewPromWriter()
+	p.Gauge("detour_info", "Role of the process.", 1, "role", snapshot.Role)
+	p.Runtime(snapshot.Runtime)
+	p.Gauge("detour_local_connections_active", "Streams open through the local.", float64(snapshot.Connections.Active))
+	for _, listener := range snapshot.Listeners {
+		labels := []string{"listener", listener.Name, "proto", listener.Proto}
+		p.Counter("detour_listener_connections_total", "Client connections accepted by the listener.", float64(listener.ConnectionsTotal), labels...)
+		p.Gauge("detour_listener_connections_active", "Client connections open on the listener.", float64(listener.ConnectionsActive), labels...)
+		p.Counter("detour_listener_auth_failures_total", "Client connections rejected by listener auth.", float64(listener.AuthFailuresTotal), labels...)
+		p.Counter("detour_listener_connect_failures_total", "Client requests whose CONNECT failed.", float64(listener.ConnectFailuresTotal), labels...)
+		p.Counter("detour_listener_up_bytes_total", "Bytes read from clients of the listener.", float64(listener.BytesUpTotal), labels...)
+		p.Counter("detour_listener_down_bytes_total", "Bytes written to clients of the listener.", float64(listener.BytesDownTotal), labels...)
+	}
+	pool := snapshot.WebSocketPool
+	p.Gauge("detour_pool_websockets", "Websockets in the pool.", float64(pool.Total), "pool", "websocket")
+	p.Gauge("detour_pool_connected", "Websockets in the pool that are connected.", float64(pool.Connected), "pool", "websocket")
+	p.Gauge("detour_pool_active_streams", "Streams carried by the pool.", float64(pool.ActiveTotal), "pool", "websocket")
+	p.Gauge("detour_pool_max_active_streams", "Most streams carried by one websocket of the pool.", float64(pool.MaxActive), "pool", "websocket")
+	for _, item := range pool.Items {
+		labels := []string{"pool", "websocket", "remote", item.URL, "key", item.Key}
+		connected := 0.0
+		if item.Connected {
+			connected = 1
+		}
+		p.Gauge("detour_websocket_connected", "Whether the websocket is connected.", connected, labels...)
+		p.Gauge("detour_websocket_active_streams", "Streams carried by the websocket.", float64(item.Active), labels...)
+		p.Writer(item.Writer, labels...)
+	}
+	return p
 }
 
 func (l *Local) StartMetricsServer() {
@@ -112,10 +191,23 @@ func (l *Local) StartMetricsServer() {
 		}
 		w.Header().Set("Content-Type", "application/json")
 		if err := json.NewEncoder(w).Encode(l.MetricsSnapshot()); err != nil {
-			logger.Error.Println("metrics, encode error", err)
+			logger.Local.Error("metrics, encode error", logger.ERR, err)
+		}
+	})
+
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", common.PROMETHEUS_CONTENT_TYPE)
+		if _, err := l.PrometheusMetrics().WriteTo(w); err != nil {
+			logger.Local.Error("metrics, write error", logger.ERR, err)
 		}
 	})
 
+	mux.HandleFunc("/debug/traffic", common.TrafficHandler(l.Traffic))
+
 	server := &http.Server{Addr: l.MetricsListen, Handler: mux}
 	go func() {
 		<-l.DoneChan()
@@ -124,9 +216,9 @@ func (l *Local) StartMetricsServer() {
 		_ = server.Shutdown(ctx)
 	}()
 	go func() {
-		logger.Info.Println("Metrics listening at http://" + l.MetricsListen + "/debug/metrics")
+		logger.Local.Info("Metrics listening at http://" + l.MetricsListen + "/debug/metrics, /debug/traffic and /metrics")
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			logger.Error.Println("metrics, listen error", err)
+			logger.Local.Error("metrics, listen error", logger.ERR, err)
 		}
 	}()
 }
@@ -8,12 +8,10 @@ import (
 
 func TestLocalMetricsSnapshot(t *testing.T) {
 	localServer := &Local{
-		Network: "tcp",
-		Address: "127.0.0.1:3810",
-		Proto:   &HTTPProto{},
-		Packer:  &common.Packer{Password: "pass123"},
-		WSConns: make(map[string]*WSConn),
-		Metrics: common.NewRuntimeMetrics(),
+		Inbounds: []*Inbound{{Name: "http", Network: "tcp", Address: "127.0.0.1:3810", Proto: &HTTPProto{}}},
+		Packer:   &common.Packer{Password: "pass123"},
+		WSConns:  make(map[string]*WSConn),
+		Metrics:  common.NewRuntimeMetrics(),
 	}
 	connected := newConnectedTestWSConn(localServer, "connected", 2)
 	disconnected := NewWSConn("ws://127.0.0.1:3811/ws", "disconnected", localServer)
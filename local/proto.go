@@ -1,13 +1,20 @@
 package local
 
 import (
+	"crypto/subtle"
+	"errors"
 	"io"
 	"net"
 )
 
+// ErrAuthFailed is returned by Proto.Get when the client credentials are
+// missing or wrong.
+var ErrAuthFailed = errors.New("authentication failed")
+
 type Request struct {
 	Network string
 	Address string
+	User    string // authenticated username, empty without auth
 	More    bool
 	Reader  io.Reader
 }
@@ -16,3 +23,12 @@ type Proto interface {
 	Get(conn net.Conn) (*Request, error)                        // Get Request from Client
 	Ack(conn net.Conn, ok bool, msg string, req *Request) error // Ack Request
 }
+
+func checkUser(users map[string]string, user string, password string) bool {
+	expected, ok := users[user]
+	if !ok {
+		// compare anyway so unknown users take as long as wrong passwords
+		expected = password + "x"
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1 && ok
+}
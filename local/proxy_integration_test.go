@@ -1,59 +1,73 @@
-package local
+package local_test
 
 import (
 	"bufio"
 	"bytes"
-	"encoding/binary"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
-	"net/http/httptest"
-	"strconv"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/observerss/detour2/common"
-	"github.com/observerss/detour2/logger"
+	"github.com/observerss/detour2/detourtest"
+	"github.com/observerss/detour2/local"
 	"github.com/observerss/detour2/server"
 )
 
-const integrationTestPassword = "pass123"
-
 func TestProxyStackSocks5ConnectEcho(t *testing.T) {
-	silenceLogs(t)
+	detourtest.SilenceLogs(t)
 
-	targetAddr := startTCPEchoServer(t)
-	proxyAddr := startProxyStack(t, PROTO_SOCKS5)
+	targetAddr := detourtest.StartEchoServer(t)
+	chain := detourtest.StartChain(t, detourtest.ChainConfig{})
 
-	conn := dialProxy(t, proxyAddr)
+	conn, err := chain.DialSOCKS5(targetAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
 	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	detourtest.AssertEcho(t, conn, []byte("socks5 integration payload"))
 
-	writeSocks5Connect(t, conn, targetAddr)
-	assertSocks5Reply(t, conn, true)
-
-	payload := []byte("socks5 integration payload")
-	if _, err := conn.Write(payload); err != nil {
-		t.Fatal(err)
+	if runtime := chain.Local.Metrics.Snapshot(); runtime.ConnectRTT.Count != 1 || runtime.HandshakeDuration.Count == 0 || runtime.QueueWait.Count == 0 {
+		t.Fatalf("local latency histograms not recorded: %+v %+v %+v", runtime.ConnectRTT, runtime.HandshakeDuration, runtime.QueueWait)
 	}
-	got := make([]byte, len(payload))
-	if _, err := io.ReadFull(conn, got); err != nil {
-		t.Fatal(err)
+	if runtime := chain.Exit().Metrics.Snapshot(); runtime.DialDuration.Count != 1 {
+		t.Fatalf("exit dial histogram not recorded: %+v", runtime.DialDuration)
 	}
-	if !bytes.Equal(got, payload) {
-		t.Fatalf("unexpected echo payload: %q", got)
+
+	payload := int64(len("socks5 integration payload"))
+	for name, flush := range map[string]func() *common.TrafficTable{
+		"local": func() *common.TrafficTable { chain.Local.FlushTraffic(); return chain.Local.Traffic },
+		"exit":  func() *common.TrafficTable { chain.Exit().FlushTraffic(); return chain.Exit().Traffic },
+	} {
+		top := flush().Top(time.Minute, 1)
+		if len(top.ByHost) != 1 || top.ByHost[0].Host != "127.0.0.1" || top.ByHost[0].BytesUp != payload || top.ByHost[0].BytesDown != payload {
+			t.Fatalf("%s traffic not recorded: %+v", name, top)
+		}
 	}
 }
 
 func TestProxyStackHTTPConnectEcho(t *testing.T) {
-	silenceLogs(t)
+	detourtest.SilenceLogs(t)
 
-	targetAddr := startTCPEchoServer(t)
-	proxyAddr := startProxyStack(t, PROTO_HTTP)
+	targetAddr := detourtest.StartEchoServer(t)
+	chain := detourtest.StartChain(t, detourtest.ChainConfig{Proto: local.PROTO_HTTP})
 
-	conn := dialProxy(t, proxyAddr)
+	conn, err := net.DialTimeout("tcp", chain.ProxyAddr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
 	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
 	reader := bufio.NewReader(conn)
 
 	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", targetAddr, targetAddr)
@@ -80,295 +94,327 @@ func TestProxyStackHTTPConnectEcho(t *testing.T) {
 }
 
 func TestProxyStackSocks5ConnectFailure(t *testing.T) {
-	silenceLogs(t)
-
-	proxyAddr := startProxyStack(t, PROTO_SOCKS5)
-	conn := dialProxy(t, proxyAddr)
-	defer conn.Close()
+	detourtest.SilenceLogs(t)
 
-	writeSocks5Connect(t, conn, unusedTCPAddress(t))
-	assertSocks5Reply(t, conn, false)
+	chain := detourtest.StartChain(t, detourtest.ChainConfig{})
+	if conn, err := chain.DialSOCKS5(detourtest.UnusedAddr(t)); err == nil {
+		conn.Close()
+		t.Fatal("expected socks5 connect failure")
+	}
 }
 
-func TestProxyStackSocks5MultiHopRelayEcho(t *testing.T) {
-	silenceLogs(t)
+func TestProxyStackExitDeniesPrivateDestinations(t *testing.T) {
+	detourtest.SilenceLogs(t)
+
+	targetAddr := detourtest.StartEchoServer(t)
+	_, port, _ := net.SplitHostPort(targetAddr)
+	chain := detourtest.StartChain(t, detourtest.ChainConfig{
+		Relays: 1,
+		ServerConfig: func(hop int, conf *common.ServerConfig) {
+			// the relay keeps the test default, only the exit enforces the ACL
+			if hop == 1 {
+				conf.ACLConfig = common.ACLConfig{DenyDestinations: "*:9"}
+			}
+		},
+	})
+	if conn, err := chain.DialSOCKS5(targetAddr); err == nil {
+		conn.Close()
+		t.Fatal("expected loopback to be denied")
+	}
 
-	targetAddr := startTCPEchoServer(t)
-	exitRelayURL := startRelayServer(t, "")
-	middleRelay, middleRelayURL := startRelayServerWithServer(t, exitRelayURL)
-	proxyAddr := startProxyToRemote(t, PROTO_SOCKS5, middleRelayURL)
+	// names are checked on what they resolve to
+	reports := local.Diagnose(context.Background(), local.DiagnoseConfig{
+		Remotes:  []string{chain.RemoteURL()},
+		Password: detourtest.DefaultPassword,
+		Target:   net.JoinHostPort("localhost", port),
+		Timeout:  2 * time.Second,
+	})
+	if reports[0].Status != local.DIAGNOSE_REFUSED || !strings.Contains(reports[0].Error, "denied: private address") {
+		t.Fatalf("unexpected report: %+v", reports[0])
+	}
+	if denied := chain.Exit().Metrics.ConnectDeniedTotal.Load(); denied != 2 {
+		t.Fatalf("unexpected denied count: %d", denied)
+	}
+}
 
-	conn := dialProxy(t, proxyAddr)
-	defer conn.Close()
+func TestProxyStackSocks5MultiHopRelayEcho(t *testing.T) {
+	detourtest.SilenceLogs(t)
 
-	writeSocks5Connect(t, conn, targetAddr)
-	assertSocks5Reply(t, conn, true)
+	targetAddr := detourtest.StartEchoServer(t)
+	chain := detourtest.StartChain(t, detourtest.ChainConfig{Relays: 1})
 
-	payload := []byte("multi hop relay payload")
-	if _, err := conn.Write(payload); err != nil {
+	conn, err := chain.DialSOCKS5(targetAddr)
+	if err != nil {
 		t.Fatal(err)
 	}
-	got := make([]byte, len(payload))
-	if _, err := io.ReadFull(conn, got); err != nil {
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	detourtest.AssertEcho(t, conn, []byte("multi hop relay payload"))
+	conn.Close()
+	if err := chain.WaitIdle(2 * time.Second); err != nil {
 		t.Fatal(err)
 	}
-	if !bytes.Equal(got, payload) {
-		t.Fatalf("unexpected echo payload: %q", got)
-	}
-	conn.Close()
-	waitForRelayIdle(t, middleRelay)
 }
 
 func TestProxyStackSocks5MultiHopRelayReconnects(t *testing.T) {
-	silenceLogs(t)
+	detourtest.SilenceLogs(t)
 
-	targetAddr := startTCPEchoServer(t)
-	_, exitRelayURL := startRelayServerWithServer(t, "")
-	middleRelay, middleRelayURL := startRelayServerWithServer(t, exitRelayURL)
-	proxyAddr := startProxyToRemote(t, PROTO_SOCKS5, middleRelayURL)
+	targetAddr := detourtest.StartEchoServer(t)
+	chain := detourtest.StartChain(t, detourtest.ChainConfig{Relays: 1})
 
-	assertSocks5Echo(t, proxyAddr, targetAddr, []byte("before relay reconnect"))
-	disconnectRelayClient(t, firstRelayClient(t, middleRelay))
-	assertSocks5Echo(t, proxyAddr, targetAddr, []byte("after relay reconnect"))
+	assertSocks5Echo(t, chain, targetAddr, []byte("before relay reconnect"))
+	chain.Links[1].DropAll()
+	assertSocks5Echo(t, chain, targetAddr, []byte("after relay reconnect"))
 }
 
-func startProxyStack(t *testing.T, proto string) string {
-	t.Helper()
-	return startProxyToRemote(t, proto, startRelayServer(t, ""))
-}
+func TestProxyStackSocks5CompressedEcho(t *testing.T) {
+	detourtest.SilenceLogs(t)
 
-func startRelayServer(t *testing.T, nextRemotes string) string {
-	t.Helper()
-	_, url := startRelayServerWithServer(t, nextRemotes)
-	return url
-}
+	targetAddr := detourtest.StartEchoServer(t)
+	chain := detourtest.StartChain(t, detourtest.ChainConfig{Relays: 1, Compress: "zstd"})
 
-func startRelayServerWithServer(t *testing.T, nextRemotes string) (*server.Server, string) {
-	t.Helper()
+	assertSocks5Echo(t, chain, targetAddr, bytes.Repeat([]byte("compressible payload "), 256))
 
-	remote := server.NewServer(&common.ServerConfig{
-		Listen:   "tcp://127.0.0.1:0",
-		Remotes:  nextRemotes,
-		Password: integrationTestPassword,
-	})
-	mux := http.NewServeMux()
-	mux.HandleFunc("/ws", remote.HandleWebsocket)
-	wsServer := httptest.NewServer(mux)
-	t.Cleanup(wsServer.Close)
-	return remote, "ws" + strings.TrimPrefix(wsServer.URL, "http") + "/ws"
+	if got := chain.Local.Metrics.Snapshot().CompressedMessagesTotal; got == 0 {
+		t.Fatal("local did not compress upstream payload")
+	}
+	for i, hop := range chain.Servers {
+		if got := hop.Metrics.Snapshot().CompressedMessagesTotal; got == 0 {
+			t.Fatalf("hop %d did not compress downstream payload", i)
+		}
+	}
+	// the pools have one websocket each, agreed on in the CONNECT
+	for _, item := range chain.Local.MetricsSnapshot().WebSocketPool.Items {
+		if item.Codec != "zstd" {
+			t.Fatalf("unexpected negotiated codec: %+v", item)
+		}
+	}
+	for _, item := range chain.Servers[0].MetricsSnapshot().RelayPool.Items {
+		if item.Codec != "zstd" {
+			t.Fatalf("unexpected codec to the next relay: %+v", item)
+		}
+	}
 }
 
-func startProxyToRemote(t *testing.T, proto string, remoteURL string) string {
-	t.Helper()
+func TestProxyStackListenersShareWebsocketPool(t *testing.T) {
+	detourtest.SilenceLogs(t)
 
-	proxy := NewLocal(&common.LocalConfig{
-		Listen:   "tcp://127.0.0.1:0",
-		Remotes:  remoteURL,
-		Password: integrationTestPassword,
-		Proto:    proto,
-	})
-	listener, err := net.Listen(proxy.Network, proxy.Address)
+	targetAddr := detourtest.StartEchoServer(t)
+	chain := detourtest.StartChain(t, detourtest.ChainConfig{PoolSize: 2, LocalConfig: func(conf *common.LocalConfig) {
+		conf.Listeners = []common.ListenerConfig{
+			{Name: "socks", Listen: "tcp://127.0.0.1:0", Proto: local.PROTO_SOCKS5, Users: map[string]string{"alice": "secret"}},
+			{Listen: "tcp://127.0.0.1:0", Proto: local.PROTO_HTTP, Users: map[string]string{"bob": "hunter2"}},
+		}
+	}})
+
+	conn, err := net.DialTimeout("tcp", chain.ProxyAddrs["socks"], time.Second)
 	if err != nil {
 		t.Fatal(err)
 	}
-	proxy.Listener = listener
-
-	for _, wsconn := range proxy.WSConns {
-		go wsconn.WebsocketPuller()
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	if err := detourtest.Socks5ConnectAuth(conn, targetAddr, "alice", "secret"); err != nil {
+		t.Fatal(err)
 	}
-	go func() {
-		for {
-			conn, err := listener.Accept()
-			if err != nil {
-				return
-			}
-			go proxy.HandleConn(conn)
-		}
-	}()
-	t.Cleanup(proxy.StopLocal)
-
-	return listener.Addr().String()
-}
-
-func startTCPEchoServer(t *testing.T) string {
-	t.Helper()
+	detourtest.AssertEcho(t, conn, []byte("authenticated socks5 payload"))
 
-	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	bad, err := net.DialTimeout("tcp", chain.ProxyAddrs["socks"], time.Second)
 	if err != nil {
 		t.Fatal(err)
 	}
-	go func() {
-		for {
-			conn, err := listener.Accept()
-			if err != nil {
-				return
-			}
-			go func(conn net.Conn) {
-				defer conn.Close()
-				io.Copy(conn, conn)
-			}(conn)
+	defer bad.Close()
+	bad.SetDeadline(time.Now().Add(3 * time.Second))
+	if err := detourtest.Socks5ConnectAuth(bad, targetAddr, "alice", "wrong"); err == nil {
+		t.Fatal("expected socks5 auth failure")
+	}
+
+	for _, attempt := range []struct {
+		header string
+		status int
+	}{
+		{"", http.StatusProxyAuthRequired},
+		{"Proxy-Authorization: Basic Ym9iOmh1bnRlcjI=\r\n", http.StatusOK},
+	} {
+		web, err := net.DialTimeout("tcp", chain.ProxyAddrs["http"], time.Second)
+		if err != nil {
+			t.Fatal(err)
 		}
-	}()
-	t.Cleanup(func() {
-		listener.Close()
-	})
+		defer web.Close()
+		web.SetDeadline(time.Now().Add(3 * time.Second))
+		fmt.Fprintf(web, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n%s\r\n", targetAddr, targetAddr, attempt.header)
+		resp, err := http.ReadResponse(bufio.NewReader(web), &http.Request{Method: http.MethodConnect})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != attempt.status {
+			t.Fatalf("unexpected CONNECT status with %q: %s", attempt.header, resp.Status)
+		}
+	}
 
-	return listener.Addr().String()
+	snapshot := chain.Local.MetricsSnapshot()
+	if snapshot.WebSocketPool.Total != 2 {
+		t.Fatalf("listeners should share one pool: %+v", snapshot.WebSocketPool)
+	}
+	if len(snapshot.Listeners) != 2 {
+		t.Fatalf("unexpected listeners: %+v", snapshot.Listeners)
+	}
+	socks, web := snapshot.Listeners[0], snapshot.Listeners[1]
+	if socks.Name != "socks" || !socks.Auth || socks.ConnectionsTotal != 2 || socks.AuthFailuresTotal != 1 || socks.BytesDownTotal == 0 {
+		t.Fatalf("unexpected socks listener metrics: %+v", socks)
+	}
+	if web.Name != "http" || web.ConnectionsTotal != 2 || web.AuthFailuresTotal != 1 {
+		t.Fatalf("unexpected http listener metrics: %+v", web)
+	}
 }
 
-func unusedTCPAddress(t *testing.T) string {
-	t.Helper()
-
-	listener, err := net.Listen("tcp", "127.0.0.1:0")
+func TestProxyStackRateLimitsUsersOnTheExit(t *testing.T) {
+	detourtest.SilenceLogs(t)
+
+	targetAddr := detourtest.StartEchoServer(t)
+	chain := detourtest.StartChain(t, detourtest.ChainConfig{
+		Relays: 1,
+		LocalConfig: func(conf *common.LocalConfig) {
+			conf.Listeners = []common.ListenerConfig{{Name: "socks", Listen: "tcp://127.0.0.1:0", Proto: local.PROTO_SOCKS5, Users: map[string]string{"alice": "secret"}}}
+		},
+		ServerConfig: func(hop int, conf *common.ServerConfig) {
+			conf.UserRateLimits = map[string]string{"alice": "64K"}
+		},
+	})
+	conn, err := net.DialTimeout("tcp", chain.ProxyAddr, time.Second)
 	if err != nil {
 		t.Fatal(err)
 	}
-	addr := listener.Addr().String()
-	if err := listener.Close(); err != nil {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := detourtest.Socks5ConnectAuth(conn, targetAddr, "alice", "secret"); err != nil {
 		t.Fatal(err)
 	}
-	return addr
-}
-
-func firstRelayClient(t *testing.T, remote *server.Server) *server.RelayClient {
-	t.Helper()
-
-	for _, relay := range remote.RelayClients {
-		return relay
-	}
-	t.Fatal("server has no relay clients")
-	return nil
-}
-
-func disconnectRelayClient(t *testing.T, relay *server.RelayClient) {
-	t.Helper()
-
-	relay.WriteLock.Lock()
-	if relay.WSConn != nil {
-		if err := relay.WSConn.Close(); err != nil {
-			relay.WriteLock.Unlock()
+	echo := func(size int) time.Duration {
+		start := time.Now()
+		payload := bytes.Repeat([]byte("x"), size)
+		go conn.Write(payload)
+		if _, err := io.ReadFull(conn, payload); err != nil {
 			t.Fatal(err)
 		}
-		relay.WSConn = nil
+		return time.Since(start)
 	}
-	relay.WriteLock.Unlock()
-	relay.SetConnected(false)
-}
 
-func waitForRelayIdle(t *testing.T, remote *server.Server) {
-	t.Helper()
-	deadline := time.Now().Add(2 * time.Second)
-	for time.Now().Before(deadline) {
-		snapshot := remote.MetricsSnapshot()
-		if snapshot.Connections.Active == 0 && snapshot.RelayPool.ActiveTotal == 0 {
-			return
-		}
-		time.Sleep(10 * time.Millisecond)
+	// a burst of 64K passes at once, the rest at 64K/s
+	if elapsed := echo(192 << 10); elapsed < 1500*time.Millisecond {
+		t.Fatalf("alice was not throttled: %v", elapsed)
 	}
-	snapshot := remote.MetricsSnapshot()
-	t.Fatalf("relay did not become idle: connections=%+v relayPool=%+v", snapshot.Connections, snapshot.RelayPool)
-}
-
-func dialProxy(t *testing.T, addr string) net.Conn {
-	t.Helper()
-
-	conn, err := net.DialTimeout("tcp", addr, time.Second)
-	if err != nil {
-		t.Fatal(err)
+	exit := chain.Exit()
+	if conns := exit.AdminConns(); len(conns) != 1 || conns[0].User != "alice" {
+		t.Fatalf("user did not reach the exit: %+v", conns)
 	}
-	if err := conn.SetDeadline(time.Now().Add(3 * time.Second)); err != nil {
-		conn.Close()
+	if exit.Metrics.ThrottledNanosTotal.Load() == 0 {
+		t.Fatal("throttled time was not counted")
+	}
+	if err := exit.SetRateLimits(common.RateLimitConfig{}); err != nil {
 		t.Fatal(err)
 	}
-	return conn
+	if elapsed := echo(192 << 10); elapsed > time.Second {
+		t.Fatalf("removed limits should apply to live streams: %v", elapsed)
+	}
 }
 
-func assertSocks5Echo(t *testing.T, proxyAddr string, targetAddr string, payload []byte) {
-	t.Helper()
-
-	conn := dialProxy(t, proxyAddr)
-	defer conn.Close()
+func TestProxyStackAccessLog(t *testing.T) {
+	detourtest.SilenceLogs(t)
+
+	dir := t.TempDir()
+	targetAddr := detourtest.StartEchoServer(t)
+	chain := detourtest.StartChain(t, detourtest.ChainConfig{
+		Relays:      1,
+		LocalConfig: func(conf *common.LocalConfig) { conf.AccessLog = filepath.Join(dir, "local.log") },
+		ServerConfig: func(hop int, conf *common.ServerConfig) {
+			conf.AccessLog = filepath.Join(dir, fmt.Sprintf("hop%d.log", hop))
+		},
+	})
 
-	writeSocks5Connect(t, conn, targetAddr)
-	assertSocks5Reply(t, conn, true)
+	assertSocks5Echo(t, chain, targetAddr, []byte("access log payload"))
+	payload := int64(len("access log payload"))
+	records := map[string]common.AccessRecord{}
+	deadline := time.Now().Add(2 * time.Second)
+	for _, name := range []string{"local.log", "hop0.log", "hop1.log"} {
+		for {
+			data, _ := os.ReadFile(filepath.Join(dir, name))
+			if len(data) > 0 {
+				var record common.AccessRecord
+				if err := json.Unmarshal(data, &record); err != nil {
+					t.Fatalf("%s: %v: %s", name, err, data)
+				}
+				records[name] = record
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: no access record", name)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
 
-	if _, err := conn.Write(payload); err != nil {
-		t.Fatal(err)
+	exit := records["hop1.log"]
+	if exit.Side != "exit" || exit.Target != targetAddr || exit.Resolved != targetAddr || exit.BytesUp != payload || exit.BytesDown != payload || exit.Result == "" {
+		t.Fatalf("exit record: %+v", exit)
 	}
-	got := make([]byte, len(payload))
-	if _, err := io.ReadFull(conn, got); err != nil {
-		t.Fatal(err)
+	relay := records["hop0.log"]
+	if relay.Side != "relay" || relay.Resolved != targetAddr || len(relay.Path) != 1 || relay.BytesUp != payload {
+		t.Fatalf("relay record: %+v", relay)
 	}
-	if !bytes.Equal(got, payload) {
-		t.Fatalf("unexpected echo payload: %q", got)
+	record := records["local.log"]
+	if record.Side != "local" || record.Target != targetAddr || record.Resolved != targetAddr || record.Client == "" || len(record.Path) != 2 || record.Path[1] != relay.Path[0] || record.BytesUp != payload || record.BytesDown != payload || record.Result != "client closed" {
+		t.Fatalf("local record: %+v", record)
 	}
 }
 
-func writeSocks5Connect(t *testing.T, conn net.Conn, targetAddr string) {
+func assertSocks5Echo(t *testing.T, chain *detourtest.Chain, targetAddr string, payload []byte) {
 	t.Helper()
 
-	if _, err := conn.Write([]byte{SOCKS5_VERSION, 1, METHOD_NOAUTH}); err != nil {
-		t.Fatal(err)
-	}
-	authReply := make([]byte, len(ACCEPT_METHOD_AUTH))
-	if _, err := io.ReadFull(conn, authReply); err != nil {
+	conn, err := chain.DialSOCKS5(targetAddr)
+	if err != nil {
 		t.Fatal(err)
 	}
-	if !bytes.Equal(authReply, ACCEPT_METHOD_AUTH) {
-		t.Fatalf("unexpected auth reply: %v", authReply)
-	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	detourtest.AssertEcho(t, conn, payload)
+}
 
-	host, portValue, err := net.SplitHostPort(targetAddr)
+func TestProxyStackMutualTLS(t *testing.T) {
+	detourtest.SilenceLogs(t)
+
+	dir := t.TempDir()
+	client, err := server.NewSelfSigned([]string{"client"})
 	if err != nil {
 		t.Fatal(err)
 	}
-	port, err := strconv.Atoi(portValue)
+	key, err := x509.MarshalPKCS8PrivateKey(client.PrivateKey)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(host) > 255 {
-		t.Fatalf("host is too long for socks5 domain request: %q", host)
-	}
-
-	request := []byte{SOCKS5_VERSION, SOCKS5_CONNECT, 0, ADDR_DOMAIN, byte(len(host))}
-	request = append(request, host...)
-	request = binary.BigEndian.AppendUint16(request, uint16(port))
-	if _, err := conn.Write(request); err != nil {
-		t.Fatal(err)
-	}
-}
-
-func assertSocks5Reply(t *testing.T, conn net.Conn, ok bool) {
-	t.Helper()
+	certFile, keyFile := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: client.Certificate[0]}), 0o644)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0o600)
+	remote := common.RemoteConfig{Insecure: true, ClientCert: certFile, ClientKey: keyFile}
+
+	targetAddr := detourtest.StartEchoServer(t)
+	chain := detourtest.StartChain(t, detourtest.ChainConfig{
+		Relays: 1,
+		ServerConfig: func(hop int, conf *common.ServerConfig) {
+			conf.TLSConfig = common.TLSConfig{TLSSelfSigned: true, TLSClientCA: certFile}
+			conf.Remotes = strings.ReplaceAll(conf.Remotes, "ws://", "wss://")
+			conf.RemoteOptions = common.RemoteOptions{"*": remote}
+		},
+		LocalConfig: func(conf *common.LocalConfig) {
+			conf.Remotes = strings.ReplaceAll(conf.Remotes, "ws://", "wss://")
+			conf.RemoteOptions = common.RemoteOptions{"*": remote}
+		},
+	})
 
-	reply := make([]byte, len(CMD_OK))
-	if _, err := io.ReadFull(conn, reply); err != nil {
+	conn, err := chain.DialSOCKS5(targetAddr)
+	if err != nil {
 		t.Fatal(err)
 	}
-	want := CMD_OK
-	if !ok {
-		want = CMD_FAILED
-	}
-	if !bytes.Equal(reply, want) {
-		t.Fatalf("unexpected socks5 reply: got %v want %v", reply, want)
-	}
-}
-
-func silenceLogs(t *testing.T) {
-	t.Helper()
-
-	debugOut := logger.Debug.Writer()
-	infoOut := logger.Info.Writer()
-	warnOut := logger.Warn.Writer()
-	errorOut := logger.Error.Writer()
-	logger.Debug.SetOutput(io.Discard)
-	logger.Info.SetOutput(io.Discard)
-	logger.Warn.SetOutput(io.Discard)
-	logger.Error.SetOutput(io.Discard)
-	t.Cleanup(func() {
-		logger.Debug.SetOutput(debugOut)
-		logger.Info.SetOutput(infoOut)
-		logger.Warn.SetOutput(warnOut)
-		logger.Error.SetOutput(errorOut)
-	})
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	detourtest.AssertEcho(t, conn, []byte("mutual tls payload"))
 }
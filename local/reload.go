@@ -0,0 +1,107 @@
+package local
+
+import (
+	"errors"
+	"maps"
+	"strings"
+
+	"github.com/observerss/detour2/common"
+	"github.com/observerss/detour2/logger"
+)
+
+// Reload applies remotes, pool size, rate limits, password, compression and
+// remote dial options from lconf without dropping live streams. Pool entries
+// that are gone, or all of them when the password or compression changes,
+// are retired: they take no new streams and are closed once their last
+// stream is done.
+// Listeners, their users and the metrics address need a restart.
+func (l *Local) Reload(lconf *common.LocalConfig) (err error) {
+	defer func() {
+		l.Metrics.RecordReload(err)
+		if err != nil {
+			logger.Local.Error("reload, failed", logger.ERR, err)
+		}
+	}()
+
+	codecs, err := common.ParseCodecs(lconf.Compress)
+	if err != nil {
+		return err
+	}
+	keys := common.PoolKeys(lconf.Remotes, lconf.PoolSize)
+	if len(keys) == 0 {
+		return errors.New("no remotes configured")
+	}
+	if err := lconf.RemoteOptions.Validate(); err != nil {
+		return err
+	}
+	if err := l.Throttle.Update(lconf.RateLimitConfig); err != nil {
+		return err
+	}
+	if l.Inbounds != nil && !sameInbounds(l.Inbounds, lconf.InboundListeners()) {
+		logger.Local.Warn("reload, listeners change needs a restart")
+	}
+	if strings.TrimSpace(lconf.MetricsListen) != l.MetricsListen {
+		logger.Local.Warn("reload, metrics listen change needs a restart", "metricsListen", lconf.MetricsListen)
+	}
+
+	if strings.TrimSpace(lconf.AdminListen) != l.AdminListen || lconf.AdminToken != l.AdminToken {
+		logger.Local.Warn("reload, admin change needs a restart", "adminListen", lconf.AdminListen)
+	}
+	if strings.TrimSpace(lconf.TrafficLog) != l.Traffic.Log {
+		logger.Local.Warn("reload, traffic log change needs a restart", "trafficLog", lconf.TrafficLog)
+	}
+	if strings.TrimSpace(lconf.TraceEndpoint) != l.Tracer.Endpoint {
+		logger.Local.Warn("reload, trace endpoint change needs a restart", "traceEndpoint", lconf.TraceEndpoint)
+	}
+	if strings.TrimSpace(lconf.AccessLog) != l.Access.Path() {
+		logger.Local.Warn("reload, access log change needs a restart", "accessLog", lconf.AccessLog)
+	}
+
+	l.WSConnsLock.Lock()
+	defer l.WSConnsLock.Unlock()
+	if l.Packer.Password != lconf.Password || l.Packer.CompressThreshold != lconf.CompressThreshold || common.FormatCodecs(l.Compress) != common.FormatCodecs(codecs) {
+		l.Packer = &common.Packer{Password: lconf.Password, CompressThreshold: lconf.CompressThreshold, Metrics: l.Metrics}
+		l.Compress = codecs
+	}
+	l.RemoteOptions = lconf.RemoteOptions
+
+	wsconns := make(map[string]*WSConn, len(keys))
+	added := 0
+	for key, url := range keys {
+		if wsconn, ok := l.WSConns[key]; ok && wsconn.Packer == l.Packer && wsconn.Remote.Equal(l.RemoteOptions.For(url)) {
+			wsconns[key] = wsconn
+			continue
+		}
+		wid, _ := common.GenerateRandomStringURLSafe(3)
+		wsconn := NewWSConn(url, wid, l)
+		wsconns[key] = wsconn
+		added++
+		if l.Started {
+			go wsconn.WebsocketPuller()
+		}
+	}
+	retired := 0
+	for key, wsconn := range l.WSConns {
+		if wsconns[key] != wsconn {
+			wsconn.Retire()
+			retired++
+		}
+	}
+	l.WSConns = wsconns
+	logger.Local.Info("reload, ok", "added", added, "retired", retired, "total", len(wsconns))
+	return nil
+}
+
+func sameInbounds(inbounds []*Inbound, listeners []common.ListenerConfig) bool {
+	if len(inbounds) != len(listeners) {
+		return false
+	}
+	for i, inbound := range inbounds {
+		listener := listeners[i]
+		if inbound.Name != listener.Name || inbound.Network+"://"+inbound.Address != listener.Listen ||
+			protoName(inbound.Proto) != listener.Proto || !maps.Equal(inbound.Users, listener.Users) {
+			return false
+		}
+	}
+	return true
+}
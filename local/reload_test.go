@@ -0,0 +1,100 @@
+package local_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/observerss/detour2/common"
+	"github.com/observerss/detour2/detourtest"
+)
+
+func TestReloadRetiresWebsocketsAfterLiveStreams(t *testing.T) {
+	detourtest.SilenceLogs(t)
+
+	targetAddr := detourtest.StartEchoServer(t)
+	chain := detourtest.StartChain(t, detourtest.ChainConfig{})
+
+	live, err := chain.DialSOCKS5(targetAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer live.Close()
+	live.SetDeadline(time.Now().Add(3 * time.Second))
+	detourtest.AssertEcho(t, live, []byte("before reload"))
+	oldWid := chain.Local.MetricsSnapshot().WebSocketPool.Items[0].WID
+
+	err = chain.Local.Reload(&common.LocalConfig{
+		Remotes:  chain.RemoteURL(),
+		Password: detourtest.DefaultPassword,
+		PoolSize: 2,
+		Compress: "zstd",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	detourtest.AssertEcho(t, live, []byte("live stream after reload"))
+	assertSocks5Echo(t, chain, targetAddr, []byte("new stream after reload"))
+
+	snapshot := chain.Local.MetricsSnapshot()
+	if snapshot.WebSocketPool.Total != 2 || snapshot.Runtime.ConfigReloadsTotal != 1 {
+		t.Fatalf("unexpected snapshot after reload: %+v %+v", snapshot.WebSocketPool, snapshot.Runtime)
+	}
+	for _, item := range snapshot.WebSocketPool.Items {
+		if item.WID == oldWid {
+			t.Fatalf("retired websocket still in pool: %+v", item)
+		}
+	}
+
+	live.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for chain.Exit().Metrics.WebSocketActive.Load() > 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("retired websocket was not closed, exit has %d", chain.Exit().Metrics.WebSocketActive.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReloadPasswordOnBothEnds(t *testing.T) {
+	detourtest.SilenceLogs(t)
+
+	targetAddr := detourtest.StartEchoServer(t)
+	chain := detourtest.StartChain(t, detourtest.ChainConfig{})
+
+	live, err := chain.DialSOCKS5(targetAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer live.Close()
+	live.SetDeadline(time.Now().Add(3 * time.Second))
+
+	exit := chain.Exit()
+	err = exit.Reload(&common.ServerConfig{
+		Listen:        "tcp://" + exit.Addr().String(),
+		Password:      "rotated",
+		DNSServers:    "127.0.0.1:53",
+		Pprof:         exit.Pprof,
+		RelayPoolSize: 1,
+		ACLConfig:     common.ACLConfig{AllowPrivateDestinations: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := exit.MetricsSnapshot().DNSServers; len(got) != 1 || got[0] != "127.0.0.1:53" {
+		t.Fatalf("dns servers were not swapped: %v", got)
+	}
+	// the websocket opened before the reload keeps the old password
+	detourtest.AssertEcho(t, live, []byte("old password stream"))
+
+	err = chain.Local.Reload(&common.LocalConfig{
+		Remotes:  chain.RemoteURL(),
+		Password: "rotated",
+		PoolSize: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	detourtest.AssertEcho(t, live, []byte("old password stream after local reload"))
+	assertSocks5Echo(t, chain, targetAddr, []byte("rotated password stream"))
+}
@@ -9,25 +9,32 @@ import (
 )
 
 const (
-	PROTO_SOCKS5   = "socks5"
-	PROTO_HTTP     = "http"
-	SOCKS5_VERSION = 5
-	METHOD_NOAUTH  = 0
-	SOCKS5_CONNECT = 1
-	ADDR_IPV4      = 1
-	ADDR_DOMAIN    = 3
-	ADDR_IPV6      = 4
+	PROTO_SOCKS5     = "socks5"
+	PROTO_HTTP       = "http"
+	SOCKS5_VERSION   = 5
+	METHOD_NOAUTH    = 0
+	METHOD_USERPASS  = 2
+	USERPASS_VERSION = 1
+	SOCKS5_CONNECT   = 1
+	ADDR_IPV4        = 1
+	ADDR_DOMAIN      = 3
+	ADDR_IPV6        = 4
 )
 
 var (
-	NO_ACCEPTABLE_METHODS = []byte{5, 255}
-	ACCEPT_METHOD_AUTH    = []byte{5, 0}
-	CMD_OK                = []byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}
-	CMD_FAILED            = []byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0}
-	CMD_NOT_SUPPORTED     = []byte{5, 7, 0, 1, 0, 0, 0, 0, 0, 0}
+	NO_ACCEPTABLE_METHODS  = []byte{5, 255}
+	ACCEPT_METHOD_AUTH     = []byte{5, 0}
+	ACCEPT_METHOD_USERPASS = []byte{5, 2}
+	USERPASS_OK            = []byte{1, 0}
+	USERPASS_FAILED        = []byte{1, 1}
+	CMD_OK                 = []byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	CMD_FAILED             = []byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0}
+	CMD_NOT_SUPPORTED      = []byte{5, 7, 0, 1, 0, 0, 0, 0, 0, 0}
 )
 
-type Socks5Proto struct{}
+type Socks5Proto struct {
+	Users map[string]string // username => password, RFC 1929 auth is required when set
+}
 
 func (s *Socks5Proto) Get(conn net.Conn) (req *Request, err error) {
 	defer func() {
@@ -57,18 +64,35 @@ func (s *Socks5Proto) Get(conn net.Conn) (req *Request, err error) {
 	if nr < 2+int(nmethods) {
 		return nil, errors.New("bad request, methods truncated")
 	}
+	wanted := byte(METHOD_NOAUTH)
+	if len(s.Users) > 0 {
+		wanted = METHOD_USERPASS
+	}
 	method := -1
 	for i := 0; i < int(nmethods); i++ {
-		if buf[2+i] == METHOD_NOAUTH {
-			method = METHOD_NOAUTH
+		if buf[2+i] == wanted {
+			method = int(wanted)
 			break
 		}
 	}
 	if method == -1 {
 		conn.Write(NO_ACCEPTABLE_METHODS)
+		if wanted == METHOD_USERPASS {
+			return nil, fmt.Errorf("%w, username/password method not offered", ErrAuthFailed)
+		}
 		return nil, errors.New("no acceptable method")
 	}
-	conn.Write(ACCEPT_METHOD_AUTH)
+
+	user := ""
+	if method == METHOD_USERPASS {
+		conn.Write(ACCEPT_METHOD_USERPASS)
+		user, err = s.auth(conn, buf)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		conn.Write(ACCEPT_METHOD_AUTH)
+	}
 
 	// now get the request
 	nr, err = conn.Read(buf)
@@ -117,7 +141,37 @@ func (s *Socks5Proto) Get(conn net.Conn) (req *Request, err error) {
 		return nil, errors.New("unknown addr type")
 	}
 
-	return &Request{Network: network, Address: address}, nil
+	return &Request{Network: network, Address: address, User: user}, nil
+}
+
+// auth reads the RFC 1929 username/password request and replies to it.
+func (s *Socks5Proto) auth(conn net.Conn, buf []byte) (string, error) {
+	nr, err := conn.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	if nr < 2 || buf[0] != USERPASS_VERSION {
+		conn.Write(USERPASS_FAILED)
+		return "", errors.New("bad auth request")
+	}
+	ulen := int(buf[1])
+	if nr < 3+ulen {
+		conn.Write(USERPASS_FAILED)
+		return "", errors.New("bad auth request, username truncated")
+	}
+	plen := int(buf[2+ulen])
+	if nr < 3+ulen+plen {
+		conn.Write(USERPASS_FAILED)
+		return "", errors.New("bad auth request, password truncated")
+	}
+	user := string(buf[2 : 2+ulen])
+	password := string(buf[3+ulen : 3+ulen+plen])
+	if !checkUser(s.Users, user, password) {
+		conn.Write(USERPASS_FAILED)
+		return "", fmt.Errorf("%w, user %q", ErrAuthFailed, user)
+	}
+	conn.Write(USERPASS_OK)
+	return user, nil
 }
 
 func (s *Socks5Proto) Ack(conn net.Conn, ok bool, msg string, req *Request) error {
@@ -0,0 +1,34 @@
+package local
+
+import (
+	"time"
+
+	"github.com/observerss/detour2/common"
+	"github.com/observerss/detour2/logger"
+)
+
+// RunTraffic samples live streams into the traffic table and flushes it to
+// the traffic log every TRAFFIC_FLUSH_INTERVAL until the local stops.
+func (l *Local) RunTraffic() {
+	ticker := time.NewTicker(common.TRAFFIC_FLUSH_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-l.DoneChan():
+			l.FlushTraffic()
+			return
+		}
+		l.FlushTraffic()
+	}
+}
+
+func (l *Local) FlushTraffic() {
+	l.Conns.Range(func(_, value any) bool {
+		value.(*Conn).AccountTraffic(false)
+		return true
+	})
+	if err := l.Traffic.Flush(); err != nil {
+		logger.Local.Error("traffic, flush error", logger.ERR, err)
+	}
+}
@@ -2,6 +2,8 @@ package local
 
 import (
 	"errors"
+	"log/slog"
+	"net/http"
 	"sort"
 	"strings"
 	"sync"
@@ -38,8 +40,13 @@ type WSConn struct {
 	RWLock      sync.RWMutex
 	ConnectLock sync.Mutex
 	Active      int64
+	Retired     atomic.Bool
+	Codec       *common.AtomicCodec // agreed on in the acks of the remote
+	Compress    []common.Codec      // codecs offered in every CONNECT
 	Packer      *common.Packer
+	Remote      common.RemoteConfig
 	Local       *Local
+	Log         *slog.Logger
 }
 
 func NewWSConn(url string, wid string, local *Local) *WSConn {
@@ -50,8 +57,27 @@ func NewWSConn(url string, wid string, local *Local) *WSConn {
 		Connected:  false,
 		CanConnect: true,
 		Packer:     local.Packer,
+		Compress:   local.Compress,
+		Remote:     local.RemoteOptions.For(url),
 		Local:      local,
 		ConnChan:   make(chan interface{}),
+		Log:        logger.WSConn.With(logger.WID, wid, logger.HOP, strings.TrimSpace(url)),
+	}
+}
+
+// sibling returns an unconnected wsconn with the same url, wid and packer as ws.
+func (ws *WSConn) sibling() *WSConn {
+	return &WSConn{
+		Url:        ws.Url,
+		Wid:        ws.Wid,
+		TimeToLive: ws.TimeToLive,
+		CanConnect: true,
+		Packer:     ws.Packer,
+		Compress:   ws.Compress,
+		Remote:     ws.Remote,
+		Local:      ws.Local,
+		ConnChan:   make(chan interface{}),
+		Log:        ws.Log,
 	}
 }
 
@@ -60,8 +86,8 @@ func (l *Local) GetWSConn() (*WSConn, error) {
 	if l.IsStopped() {
 		return nil, errors.New("local server is stopped")
 	}
-	wsconns := make([]*WSConn, 0, len(l.WSConns))
-	for _, w := range l.WSConns {
+	wsconns := []*WSConn{}
+	for _, w := range l.PoolWSConns() {
 		if w.CanConnectNow() {
 			wsconns = append(wsconns, w)
 		}
@@ -74,12 +100,17 @@ func (l *Local) GetWSConn() (*WSConn, error) {
 		if !wsconn.IsConnected() {
 			err := Connect(wsconn, false)
 			if err != nil {
-				logger.Error.Println("ws, connect error", err)
+				wsconn.Log.Error("ws, connect error", logger.ERR, err)
 				continue
 			}
 		}
 
 		wsconn.AddActive(1)
+		if wsconn.IsRetired() {
+			// removed by a reload meanwhile
+			wsconn.AddActive(-1)
+			continue
+		}
 		wsconn.SignalConnChan()
 		return wsconn, nil
 	}
@@ -92,7 +123,38 @@ func (ws *WSConn) ActiveCount() int64 {
 }
 
 func (ws *WSConn) AddActive(delta int64) {
-	atomic.AddInt64(&ws.Active, delta)
+	if atomic.AddInt64(&ws.Active, delta) <= 0 && delta < 0 && ws.IsRetired() {
+		ws.Close()
+	}
+}
+
+func (ws *WSConn) IsRetired() bool {
+	return ws.Retired.Load()
+}
+
+// Retire takes the wsconn out of service, it is closed once its last stream is done.
+func (ws *WSConn) Retire() {
+	ws.Retired.Store(true)
+	if ws.ActiveCount() <= 0 {
+		ws.Close()
+	}
+}
+
+func (ws *WSConn) Close() {
+	ws.SignalConnChan()
+	ws.WriteLock.Lock()
+	writer := ws.Writer
+	conn := ws.WSConn
+	ws.WriteLock.Unlock()
+	if writer != nil {
+		writer.Close()
+	}
+	if conn != nil {
+		conn.Close()
+	}
+	ws.RWLock.Lock()
+	ws.Connected = false
+	ws.RWLock.Unlock()
 }
 
 func (ws *WSConn) CanConnectNow() bool {
@@ -108,16 +170,16 @@ func (ws *WSConn) IsConnected() bool {
 }
 
 func Connect(wsconn *WSConn, force bool) error {
-	logger.Debug.Println(wsconn.Wid, "ws, try connect")
+	wsconn.Log.Debug("ws, try connect")
 
 	wsconn.ConnectLock.Lock()
 	defer func() {
 		wsconn.ConnectLock.Unlock()
-		logger.Debug.Println(wsconn.Wid, "ws, try connect done")
+		wsconn.Log.Debug("ws, try connect done")
 	}()
 
 	if wsconn.IsConnected() {
-		logger.Debug.Println(wsconn.Wid, "ws, connected by others")
+		wsconn.Log.Debug("ws, connected by others")
 		wsconn.SignalConnChan()
 		return nil
 	}
@@ -134,8 +196,19 @@ func Connect(wsconn *WSConn, force bool) error {
 		return errors.New("can not connect")
 	}
 
-	dialer := websocket.Dialer{HandshakeTimeout: time.Second * DIAL_TIMEOUT}
-	conn, _, err := dialer.Dial(wsconn.Url, nil)
+	header := http.Header{}
+	common.SetAuthHeader(header, wsconn.Packer.Password)
+	wsconn.Remote.SetHeaders(header)
+	// the dialer is built on every dial so a renewed CA bundle is picked up
+	var conn *websocket.Conn
+	start := time.Now()
+	dialer, err := common.NewWebsocketDialer(wsconn.Remote, time.Second*DIAL_TIMEOUT)
+	if err == nil {
+		conn, _, err = dialer.Dial(wsconn.Url, header)
+	}
+	if wsconn.Local != nil && wsconn.Local.Metrics != nil {
+		wsconn.Local.Metrics.HandshakeDuration.Since(start)
+	}
 
 	if err != nil {
 		if wsconn.Local != nil && wsconn.Local.Metrics != nil {
@@ -145,15 +218,17 @@ func Connect(wsconn *WSConn, force bool) error {
 		wsconn.CanConnect = false
 		wsconn.Connected = false
 		wsconn.RWLock.Unlock()
-		logger.Debug.Println(wsconn.Wid, "ws, dial error", err)
+		wsconn.Log.Debug("ws, dial error", logger.ERR, err)
 		return err
 	}
-	writer := wsconn.NewMessageWriter(conn)
+	codec := &common.AtomicCodec{}
+	writer := wsconn.NewMessageWriter(conn, codec)
 	wsconn.WriteLock.Lock()
 	oldWriter := wsconn.Writer
 	oldConn := wsconn.WSConn
 	wsconn.WSConn = conn
 	wsconn.Writer = writer
+	wsconn.Codec = codec
 	if oldWriter != nil {
 		oldWriter.Close()
 	}
@@ -163,7 +238,7 @@ func Connect(wsconn *WSConn, force bool) error {
 	wsconn.WriteLock.Unlock()
 
 	wsconn.RWLock.Lock()
-	logger.Debug.Println(wsconn.Wid, "ws, connected")
+	wsconn.Log.Debug("ws, connected")
 	wsconn.Connected = true
 	wsconn.CanConnect = true
 	wsconn.RWLock.Unlock()
@@ -175,9 +250,9 @@ func Connect(wsconn *WSConn, force bool) error {
 	return nil
 }
 
-func (ws *WSConn) NewMessageWriter(conn *websocket.Conn) *common.FairMessageWriter {
-	return common.NewFairMessageWriter(func(msg *common.Message) error {
-		data, err := ws.Packer.Pack(msg)
+func (ws *WSConn) NewMessageWriter(conn *websocket.Conn, codec *common.AtomicCodec) *common.FairMessageWriter {
+	writer := common.NewFairMessageWriter(func(msg *common.Message) error {
+		data, err := ws.Packer.PackWith(msg, codec.Load())
 		if err == nil {
 			err = conn.WriteMessage(websocket.BinaryMessage, data)
 		}
@@ -191,6 +266,10 @@ func (ws *WSConn) NewMessageWriter(conn *websocket.Conn) *common.FairMessageWrit
 		}
 		return err
 	}, common.DefaultMessageQueueLimit)
+	if ws.Local != nil && ws.Local.Metrics != nil {
+		writer.QueueWait = &ws.Local.Metrics.QueueWait
+	}
+	return writer
 }
 
 func (ws *WSConn) SignalConnChan() {
@@ -220,10 +299,15 @@ func (ws *WSConn) WebsocketPuller() error {
 		stopTimer(switchTimer)
 	}()
 
-	logger.Debug.Println(ws.Wid, "ws, start")
+	ws.Log.Debug("ws, start")
 	for {
 		if ws.Local.IsStopped() {
-			logger.Debug.Println(ws.Wid, "ws, local stopped")
+			ws.Log.Debug("ws, local stopped")
+			return nil
+		}
+		if ws.IsRetired() && (ws.ActiveCount() <= 0 || !ws.IsConnected()) {
+			ws.Log.Debug("ws, retired")
+			ws.Close()
 			return nil
 		}
 
@@ -241,15 +325,21 @@ func (ws *WSConn) WebsocketPuller() error {
 		if numOfConns == 0 {
 			ws.RWLock.Lock()
 			if isClosed(ws.ConnChan) {
+				// signaled since the last wait, recount instead of blocking
 				ws.ConnChan = make(chan interface{})
+				ws.RWLock.Unlock()
+				continue
 			}
 			connChan := ws.ConnChan
 			ws.RWLock.Unlock()
-			logger.Debug.Println(ws.Wid, "ws, num of conns == 0, block on ConnChan")
+			ws.Log.Debug("ws, num of conns == 0, block on ConnChan")
 			select {
 			case <-connChan:
+				if ws.IsRetired() {
+					continue
+				}
 			case <-ws.Local.DoneChan():
-				logger.Debug.Println(ws.Wid, "ws, stopped while idle")
+				ws.Log.Debug("ws, stopped while idle")
 				return nil
 			}
 			resetTimer(&switchTimer, time.Second*time.Duration(ws.TimeToLive))
@@ -257,11 +347,11 @@ func (ws *WSConn) WebsocketPuller() error {
 
 		// try connect if not connected
 		if !ws.IsConnected() {
-			logger.Debug.Println(ws.Wid, "ws, wait for reconnect", numOfConns)
+			ws.Log.Debug("ws, wait for reconnect", "conns", numOfConns)
 			select {
 			case <-time.After(time.Second * RECONNECT_INTERVAL):
 			case <-ws.Local.DoneChan():
-				logger.Debug.Println(ws.Wid, "ws, stopped before reconnect")
+				ws.Log.Debug("ws, stopped before reconnect")
 				return nil
 			}
 			err := Connect(ws, true)
@@ -277,8 +367,8 @@ func (ws *WSConn) WebsocketPuller() error {
 			case <-switchTimer.C:
 				switchTimer = nil
 				// create new connection
-				logger.Debug.Println(ws.Wid, "ws, switch start")
-				wsconn := NewWSConn(ws.Url, ws.Wid, ws.Local)
+				ws.Log.Debug("ws, switch start")
+				wsconn := ws.sibling()
 				err := Connect(wsconn, false)
 				if err != nil {
 					// use old
@@ -304,10 +394,10 @@ func (ws *WSConn) WebsocketPuller() error {
 					if err != nil {
 						break
 					}
-					logger.Debug.Println(ws.Wid, "ws, flush read", msg.Cmd, len(msg.Data))
+					ws.Log.Debug("ws, flush read", logger.CID, msg.Cid, "cmd", msg.Cmd, "bytes", len(msg.Data))
 					conn, ok := ws.Local.Conns.Load(msg.Cid)
 					if ok {
-						logger.Debug.Println(msg.Cid, "ws, put ===> queue", msg.Cmd, len(msg.Data))
+						ws.Log.Debug("ws, put ===> queue", logger.CID, msg.Cid, "cmd", msg.Cmd, "bytes", len(msg.Data))
 						ws.DeliverMessage(conn.(*Conn), msg)
 					}
 				}
@@ -318,6 +408,7 @@ func (ws *WSConn) WebsocketPuller() error {
 				oldWriter := ws.Writer
 				ws.WSConn = wsconn.WSConn
 				ws.Writer = wsconn.Writer
+				ws.Codec = wsconn.Codec
 				wsconn.Writer = nil
 				if oldWSConn != nil {
 					oldWSConn.Close()
@@ -337,25 +428,25 @@ func (ws *WSConn) WebsocketPuller() error {
 		}
 
 		// read & put queue
-		logger.Debug.Println(ws.Wid, "ws, wait read")
+		ws.Log.Debug("ws, wait read")
 		msg, err := ws.ReadMessage()
 		if err != nil {
 			if ws.Local.IsStopped() {
-				logger.Debug.Println(ws.Wid, "ws, stopped after read error")
+				ws.Log.Debug("ws, stopped after read error")
 				return nil
 			}
-			logger.Error.Println(ws.Wid, "ws, read error", err)
+			ws.Log.Error("ws, read error", logger.ERR, err)
 			continue
 		}
 
-		logger.Debug.Println(ws.Wid, "ws, read", msg.Cmd, len(msg.Data))
+		ws.Log.Debug("ws, read", logger.CID, msg.Cid, "cmd", msg.Cmd, "bytes", len(msg.Data))
 		conn, ok := ws.Local.Conns.Load(msg.Cid)
 		if ok {
-			logger.Debug.Println(msg.Cid, "ws, put ===> queue", msg.Cmd, len(msg.Data))
+			ws.Log.Debug("ws, put ===> queue", logger.CID, msg.Cid, "cmd", msg.Cmd, "bytes", len(msg.Data))
 			ws.DeliverMessage(conn.(*Conn), msg)
 		} else {
 			// no handler for this conn, should tell remote to stop
-			logger.Debug.Println(msg.Cid, "ws, handler has quit, tell ws to close")
+			ws.Log.Debug("ws, handler has quit, tell ws to close", logger.CID, msg.Cid)
 			msg.Cmd = common.CLOSE
 			msg.Data = []byte{}
 			ws.WriteMessage(msg)
@@ -370,7 +461,8 @@ func (ws *WSConn) DeliverMessage(conn *Conn, msg *common.Message) bool {
 	case conn.MsgChan <- msg:
 		return true
 	case <-timer.C:
-		logger.Warn.Println(conn.Cid, "ws, queue timeout, close slow conn")
+		ws.Log.Warn("ws, queue timeout, close slow conn", logger.CID, conn.Cid, logger.TARGET, conn.Address)
+		conn.CloseReason.Set("queue timeout")
 		if ws.Local != nil && ws.Local.Metrics != nil {
 			ws.Local.Metrics.QueueTimeoutsTotal.Inc()
 		}
@@ -384,7 +476,7 @@ func (ws *WSConn) DeliverMessage(conn *Conn, msg *common.Message) bool {
 		closeMsg.Cmd = common.CLOSE
 		closeMsg.Data = nil
 		if err := ws.WriteMessage(closeMsg); err != nil {
-			logger.Debug.Println(conn.Cid, "ws, queue timeout close write error", err)
+			ws.Log.Debug("ws, queue timeout close write error", logger.CID, conn.Cid, logger.ERR, err)
 		}
 		return false
 	case <-ws.Local.DoneChan():
@@ -469,6 +561,15 @@ func (ws *WSConn) ReadMessage() (*common.Message, error) {
 			ws.Local.Metrics.MessagesInTotal.Inc()
 			ws.Local.Metrics.PayloadBytesInTotal.Add(int64(len(msg.Data)))
 		}
+		if msg.Cmd == common.CONNECT && msg.Ok {
+			// the ack tells the codec the remote took from our offer
+			ws.WriteLock.Lock()
+			codec := ws.Codec
+			ws.WriteLock.Unlock()
+			if codec != nil {
+				codec.Store(common.NegotiateCodec(common.ParseConnectInfo(msg.Msg).Codec, ws.Compress))
+			}
+		}
 		return msg, nil
 	}
 }
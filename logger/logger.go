@@ -1,14 +1,228 @@
 package logger
 
 import (
-	"log"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
+// Field keys shared by every subsystem, so a stream can be followed across
+// the local, the relays and the exit.
+const (
+	CID    = "cid"
+	WID    = "wid"
+	TARGET = "target"
+	USER   = "user"
+	HOP    = "hop" // websocket url of the next hop
+	TRACE  = "trace"
+	ERR    = "err"
+)
+
+const (
+	FORMAT_TEXT = "text"
+	FORMAT_JSON = "json"
+)
+
+// SUBSYSTEMS lists the loggers whose level can be set on their own.
+var SUBSYSTEMS = []string{"main", "local", "wsconn", "server", "relay", "deploy"}
+
 var (
-	Flags = log.LstdFlags | log.Lmicroseconds | log.Lshortfile | log.Lmsgprefix
-	Debug = log.New(os.Stdout, "DEBUG ", Flags)
-	Info  = log.New(os.Stdout, "INFO  ", Flags)
-	Warn  = log.New(os.Stdout, "WARN  ", Flags)
-	Error = log.New(os.Stderr, "ERROR ", Flags)
+	levels = map[string]*slog.LevelVar{}
+	root   atomic.Pointer[slog.Handler]
+	output atomic.Pointer[outputConfig]
+
+	Main   = New("main")
+	Local  = New("local")
+	WSConn = New("wsconn")
+	Server = New("server")
+	Relay  = New("relay")
+	Deploy = New("deploy")
 )
+
+func init() {
+	if err := Setup(FORMAT_TEXT, os.Stdout); err != nil {
+		panic(err)
+	}
+}
+
+// New returns the logger of a subsystem, records carry a "subsystem" field
+// and are dropped below the subsystem level, info by default.
+func New(subsystem string) *slog.Logger {
+	level, ok := levels[subsystem]
+	if !ok {
+		level = &slog.LevelVar{}
+		levels[subsystem] = level
+	}
+	return slog.New(&handler{level: level}).With("subsystem", subsystem)
+}
+
+// Setup switches every logger to write text or json records to w.
+func Setup(name string, w io.Writer) error {
+	opts := &slog.HandlerOptions{AddSource: true, Level: slog.LevelDebug, ReplaceAttr: shortSource}
+	var h slog.Handler
+	switch name {
+	case FORMAT_TEXT, "":
+		name = FORMAT_TEXT
+		h = slog.NewTextHandler(w, opts)
+	case FORMAT_JSON:
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("unknown log format %q, should be text or json", name)
+	}
+	root.Store(&h)
+	output.Store(&outputConfig{format: name, writer: w})
+	return nil
+}
+
+type outputConfig struct {
+	format string
+	writer io.Writer
+}
+
+// Format returns the format given to Setup.
+func Format() string {
+	return output.Load().format
+}
+
+// Writer returns the writer given to Setup.
+func Writer() io.Writer {
+	return output.Load().writer
+}
+
+func shortSource(groups []string, a slog.Attr) slog.Attr {
+	if a.Key == slog.SourceKey && len(groups) == 0 {
+		if source, ok := a.Value.Any().(*slog.Source); ok {
+			return slog.String(slog.SourceKey, filepath.Base(source.File)+":"+strconv.Itoa(source.Line))
+		}
+	}
+	return a
+}
+
+// ParseLevels parses "info,wsconn=debug": a bare level applies to every
+// subsystem, name=level to one of them.
+func ParseLevels(spec string) (map[string]slog.Level, error) {
+	parsed := map[string]slog.Level{}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, value, named := strings.Cut(item, "=")
+		if !named {
+			name, value = "", item
+		}
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(strings.TrimSpace(value))); err != nil {
+			return nil, fmt.Errorf("log level %q: %w", item, err)
+		}
+		name = strings.TrimSpace(name)
+		if name == "" {
+			for _, subsystem := range SUBSYSTEMS {
+				parsed[subsystem] = level
+			}
+			continue
+		}
+		if _, ok := levels[name]; !ok {
+			return nil, fmt.Errorf("log level %q: unknown subsystem, should be one of %s", item, strings.Join(SUBSYSTEMS, ","))
+		}
+		parsed[name] = level
+	}
+	return parsed, nil
+}
+
+// SetLevels applies ParseLevels, subsystems left out keep their level.
+func SetLevels(spec string) error {
+	parsed, err := ParseLevels(spec)
+	if err != nil {
+		return err
+	}
+	for name, level := range parsed {
+		levels[name].Set(level)
+	}
+	return nil
+}
+
+// Levels returns the current level of every subsystem.
+func Levels() map[string]string {
+	current := make(map[string]string, len(levels))
+	for name, level := range levels {
+		current[name] = strings.ToLower(level.Level().String())
+	}
+	return current
+}
+
+// LevelsSpec formats Levels for ParseLevels, sorted by subsystem.
+func LevelsSpec() string {
+	current := Levels()
+	items := make([]string, 0, len(current))
+	for name, level := range current {
+		items = append(items, name+"="+level)
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
+
+// Fatal logs msg at error level and exits, like log.Fatal.
+func Fatal(l *slog.Logger, msg string, args ...any) {
+	var pcs [1]uintptr
+	runtime.Callers(2, pcs[:])
+	record := slog.NewRecord(time.Now(), slog.LevelError, msg, pcs[0])
+	record.Add(args...)
+	_ = l.Handler().Handle(context.Background(), record)
+	os.Exit(1)
+}
+
+// handler filters by the subsystem level and hands records to the handler
+// installed by Setup, replaying With calls on it.
+type handler struct {
+	level *slog.LevelVar
+	wraps []func(slog.Handler) slog.Handler
+	cache atomic.Pointer[cachedHandler]
+}
+
+type cachedHandler struct {
+	root    *slog.Handler
+	handler slog.Handler
+}
+
+func (h *handler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *handler) Handle(ctx context.Context, record slog.Record) error {
+	return h.current().Handle(ctx, record)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(next slog.Handler) slog.Handler { return next.WithAttrs(attrs) })
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return h.with(func(next slog.Handler) slog.Handler { return next.WithGroup(name) })
+}
+
+func (h *handler) with(wrap func(slog.Handler) slog.Handler) *handler {
+	return &handler{level: h.level, wraps: append(h.wraps[:len(h.wraps):len(h.wraps)], wrap)}
+}
+
+func (h *handler) current() slog.Handler {
+	base := root.Load()
+	if cached := h.cache.Load(); cached != nil && cached.root == base {
+		return cached.handler
+	}
+	built := *base
+	for _, wrap := range h.wraps {
+		built = wrap(built)
+	}
+	h.cache.Store(&cachedHandler{root: base, handler: built})
+	return built
+}
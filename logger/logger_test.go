@@ -0,0 +1,61 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestSubsystemLevelsAndFields(t *testing.T) {
+	var out bytes.Buffer
+	format, writer, levels := Format(), Writer(), LevelsSpec()
+	t.Cleanup(func() {
+		Setup(format, writer)
+		SetLevels(levels)
+	})
+	if err := Setup(FORMAT_JSON, &out); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetLevels("info,wsconn=debug"); err != nil {
+		t.Fatal(err)
+	}
+
+	conn := Local.With(CID, "c1", TARGET, "example.com:443")
+	conn.Debug("dropped")
+	conn.Info("kept", "bytes", 3)
+	WSConn.Debug("kept too", WID, "w1")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("unexpected records: %q", lines)
+	}
+	var record map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record["msg"] != "kept" || record["subsystem"] != "local" || record[CID] != "c1" || record[TARGET] != "example.com:443" || record["bytes"] != 3.0 {
+		t.Fatalf("unexpected record: %v", record)
+	}
+	if source, _ := record["source"].(string); !strings.HasPrefix(source, "logger_test.go:") {
+		t.Fatalf("source should point at the caller: %v", record["source"])
+	}
+	if !strings.Contains(lines[1], `"subsystem":"wsconn"`) {
+		t.Fatalf("unexpected record: %s", lines[1])
+	}
+}
+
+func TestParseLevels(t *testing.T) {
+	parsed, err := ParseLevels("warn, relay=debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed) != len(SUBSYSTEMS) || parsed["relay"].String() != "DEBUG" || parsed["local"].String() != "WARN" {
+		t.Fatalf("unexpected levels: %v", parsed)
+	}
+	for _, spec := range []string{"loud", "nope=debug", "local=loud"} {
+		if _, err := ParseLevels(spec); err == nil {
+			t.Fatalf("%q should be rejected", spec)
+		}
+	}
+}
@@ -1,11 +1,19 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
-	"io"
-	"log"
+	"fmt"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/observerss/detour2/bench"
 	"github.com/observerss/detour2/common"
 	"github.com/observerss/detour2/deploy"
 	"github.com/observerss/detour2/local"
@@ -13,144 +21,500 @@ import (
 	"github.com/observerss/detour2/server"
 )
 
-var (
-	password      string
-	listen        string
-	remotes       string
-	proto         string
-	debug         bool
-	mode          string
-	key           string
-	secret        string
-	accountId     string
-	region        string
-	serviceName   string
-	functionName  string
-	triggerName   string
-	image         string
-	publicPort    int
-	poolSize      int
-	dnsServers    string
-	metricsListen string
-	remove        bool
-)
+var debug bool
 
 func main() {
 	if len(os.Args) < 2 {
-		logger.Error.Fatal("run with 'server'/'relay'/'local'/'deploy' subcommand")
+		logger.Fatal(logger.Main, "run with 'server'/'relay'/'local'/'deploy'/'trace'/'diagnose'/'bench' subcommand")
 	}
-	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
 
 	switch os.Args[1] {
 	case "server", "relay":
-		ser := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
-		ser.StringVar(&password, "p", "password", "password for authentication")
-		ser.StringVar(&listen, "l", "tcp://0.0.0.0:3811", "address to listen on")
-		ser.StringVar(&remotes, "r", "", "next relay server(s) to connect, separated by comma")
-		ser.StringVar(&dnsServers, "dns", "", "comma-separated DNS servers for direct target dials")
-		ser.IntVar(&poolSize, "pool", 64, "websocket connections per next relay")
-		ser.StringVar(&metricsListen, "metrics", "", "optional metrics listen address, exposes /debug/metrics")
-		ser.BoolVar(&debug, "d", false, "print debug log")
-
-		ser.Parse(os.Args[2:])
-
-		if !debug {
-			logger.Debug.SetOutput(io.Discard)
-		}
-
-		s := server.NewServer(&common.ServerConfig{
-			Listen:        listen,
-			Remotes:       remotes,
-			Password:      password,
-			RelayPoolSize: poolSize,
-			DNSServers:    dnsServers,
-			MetricsListen: metricsListen,
+		conf := &common.ServerConfig{}
+		ser := serverFlags(os.Args[1], conf)
+		if err := parseConfig(ser, conf); err != nil {
+			ser.Usage()
+			logger.Fatal(logger.Main, "config, invalid", logger.ERR, err)
+		}
+		if err := setupLogging(conf.LogFormat, conf.LogLevel); err != nil {
+			logger.Fatal(logger.Main, "config, invalid", logger.ERR, err)
+		}
+
+		s, err := server.NewServer(conf)
+		if err != nil {
+			logger.Fatal(logger.Main, "server, invalid config", logger.ERR, err)
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+		reloadOnHangup(ctx, func() error {
+			next := &common.ServerConfig{}
+			if err := parseConfig(serverFlags(os.Args[1], next), next); err != nil {
+				s.Metrics.RecordReload(err)
+				return err
+			}
+			if err := s.Reload(next); err != nil {
+				return err
+			}
+			return setupLogging(next.LogFormat, next.LogLevel)
 		})
-		s.RunServer()
+		if err := s.RunServerContext(ctx); err != nil {
+			logger.Fatal(logger.Main, "server, stopped", logger.ERR, err)
+		}
 	case "local":
-		cli := flag.NewFlagSet("local", flag.ExitOnError)
-		cli.StringVar(&remotes, "r", "ws://localhost:3811/ws", "remote server(s) to connect, seperated by comma")
-		cli.StringVar(&password, "p", "password", "password for authentication")
-		cli.StringVar(&listen, "l", "tcp://0.0.0.0:3810", "address to listen on")
-		cli.StringVar(&proto, "t", "socks5", "target protocol to use")
-		cli.IntVar(&poolSize, "pool", 64, "websocket connections per remote server")
-		cli.StringVar(&metricsListen, "metrics", "", "optional metrics listen address, exposes /debug/metrics")
-		cli.BoolVar(&debug, "d", false, "print debug log")
-
-		cli.Parse(os.Args[2:])
-
-		if !debug {
-			logger.Debug.SetOutput(io.Discard)
-		}
-
-		c := local.NewLocal(&common.LocalConfig{
-			Listen:        listen,
-			Remotes:       remotes,
-			Password:      password,
-			Proto:         proto,
-			PoolSize:      poolSize,
-			MetricsListen: metricsListen,
-		})
-		err := c.RunLocal()
+		conf := &common.LocalConfig{}
+		cli := localFlags(conf)
+		if err := parseConfig(cli, conf); err != nil {
+			cli.Usage()
+			logger.Fatal(logger.Main, "config, invalid", logger.ERR, err)
+		}
+		if err := setupLogging(conf.LogFormat, conf.LogLevel); err != nil {
+			logger.Fatal(logger.Main, "config, invalid", logger.ERR, err)
+		}
+
+		c, err := local.NewLocal(conf)
 		if err != nil {
-			logger.Error.Fatal(err)
+			logger.Fatal(logger.Main, "local, invalid config", logger.ERR, err)
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+		reloadOnHangup(ctx, func() error {
+			next := &common.LocalConfig{}
+			if err := parseConfig(localFlags(next), next); err != nil {
+				c.Metrics.RecordReload(err)
+				return err
+			}
+			if err := c.Reload(next); err != nil {
+				return err
+			}
+			return setupLogging(next.LogFormat, next.LogLevel)
+		})
+		if err := c.RunLocalContext(ctx); err != nil {
+			logger.Fatal(logger.Main, "local, stopped", logger.ERR, err)
 		}
 	case "deploy":
+		conf := &common.DeployConfig{}
 		cli := flag.NewFlagSet("deploy", flag.ExitOnError)
-		cli.StringVar(&mode, "m", "", "deploy 'server' or 'local'")
-		cli.StringVar(&key, "k", "", "aliyun access key id")
-		cli.StringVar(&secret, "s", "", "aliyun access key secret")
-		cli.StringVar(&accountId, "a", "", "aliyun main account id")
-		cli.StringVar(&region, "r", "cn-hongkong", "aliyun region")
-		cli.StringVar(&serviceName, "sn", "api2", "aliyun fc service name")
-		cli.StringVar(&functionName, "fn", "dt2", "aliyun fc function name")
-		cli.StringVar(&triggerName, "tn", "ws2", "aliyun fc trigger name")
-		cli.StringVar(&password, "p", "password", "password for authentication")
-		cli.StringVar(&image, "i", "registry-vpc.cn-hongkong.aliyuncs.com/hjcrocks/detour2", "aliyun container registry uri")
-		cli.IntVar(&publicPort, "pp", 3810, "public port to use")
-		cli.BoolVar(&remove, "remove", false, "remove all fc trigger/function/service")
-
-		cli.Parse(os.Args[2:])
-
-		if mode == "" {
+		cli.StringVar(&conf.Mode, "m", "", "deploy 'server' or 'local'")
+		cli.StringVar(&conf.AccessKeyId, "k", "", "aliyun access key id")
+		cli.StringVar(&conf.AccessKeySecret, "s", "", "aliyun access key secret")
+		cli.StringVar(&conf.AccountId, "a", "", "aliyun main account id")
+		cli.StringVar(&conf.Region, "r", "cn-hongkong", "aliyun region")
+		cli.StringVar(&conf.ServiceName, "sn", "api2", "aliyun fc service name")
+		cli.StringVar(&conf.FunctionName, "fn", "dt2", "aliyun fc function name")
+		cli.StringVar(&conf.TriggerName, "tn", "ws2", "aliyun fc trigger name")
+		cli.StringVar(&conf.Password, "p", "password", "password for authentication, $"+common.PASSWORD_ENV+" is used when set")
+		cli.StringVar(&conf.Image, "i", "registry-vpc.cn-hongkong.aliyuncs.com/hjcrocks/detour2", "aliyun container registry uri")
+		cli.IntVar(&conf.PublicPort, "pp", 3810, "public port to use")
+		cli.BoolVar(&conf.Remove, "remove", false, "remove all fc trigger/function/service")
+
+		if err := parseConfig(cli, conf); err != nil {
 			cli.Usage()
-			logger.Error.Fatal("mode cannot be empty")
+			logger.Fatal(logger.Main, "config, invalid", logger.ERR, err)
 		}
 
-		if key == "" || secret == "" || accountId == "" {
-			cli.Usage()
-			logger.Error.Fatal("aliyun credentials cannot be empty")
-		}
-
-		conf := &common.DeployConfig{
-			AccessKeyId:     key,
-			AccessKeySecret: secret,
-			AccountId:       accountId,
-			Region:          region,
-			ServiceName:     serviceName,
-			FunctionName:    functionName,
-			TriggerName:     triggerName,
-			Password:        password,
-			Image:           image,
-			PublicPort:      publicPort,
-			Remove:          remove,
-		}
-		switch mode {
+		switch conf.Mode {
 		case "server":
 			err := deploy.DeployServer(conf)
 			if err != nil {
-				logger.Error.Fatal(err)
+				logger.Fatal(logger.Deploy, "deploy, failed", logger.ERR, err)
 			}
 		case "local":
 			err := deploy.DeployLocal(conf)
 			if err != nil {
-				logger.Error.Fatal(err)
+				logger.Fatal(logger.Deploy, "deploy, failed", logger.ERR, err)
 			}
 		default:
-			logger.Error.Fatal("method should be either 'server' or 'local'")
+			logger.Fatal(logger.Main, "method should be either 'server' or 'local'")
+		}
+
+	case "trace":
+		if err := runTrace(os.Args[2:]); err != nil {
+			logger.Fatal(logger.Main, "trace, failed", logger.ERR, err)
+		}
+	case "diagnose":
+		if err := runDiagnose(os.Args[2:]); err != nil {
+			logger.Fatal(logger.Main, "diagnose, failed", logger.ERR, err)
+		}
+	case "bench":
+		if err := runBench(os.Args[2:]); err != nil {
+			logger.Fatal(logger.Main, "bench, failed", logger.ERR, err)
 		}
 
 	default:
-		logger.Error.Fatal("only 'server'/'relay'/'local'/'deploy' subcommands are allowed")
+		logger.Fatal(logger.Main, "only 'server'/'relay'/'local'/'deploy'/'trace'/'diagnose'/'bench' subcommands are allowed")
+	}
+}
+
+func serverFlags(name string, conf *common.ServerConfig) *flag.FlagSet {
+	ser := flag.NewFlagSet(name, flag.ExitOnError)
+	ser.StringVar(&conf.Password, "p", "password", "password for authentication, $"+common.PASSWORD_ENV+" is used when set")
+	ser.StringVar(&conf.Listen, "l", "tcp://0.0.0.0:3811", "address to listen on")
+	ser.StringVar(&conf.Remotes, "r", "", "next relay server(s) to connect, separated by comma")
+	ser.StringVar(&conf.DNSServers, "dns", "", "comma-separated DNS servers for direct target dials")
+	ser.StringVar(&conf.AllowDestinations, "allow", "", "comma-separated destinations the exit may dial, e.g. '*.example.com:443,203.0.113.0/24' (default all public)")
+	ser.StringVar(&conf.DenyDestinations, "deny", "", "comma-separated destinations the exit refuses, e.g. '*:25,10.1.0.0/16'")
+	ser.BoolVar(&conf.AllowPrivateDestinations, "allow-private", false, "let the exit dial loopback, link-local and private addresses")
+	ser.StringVar(&conf.WSPath, "ws-path", "/ws", "websocket path, keep it secret when a decoy is set")
+	ser.StringVar(&conf.DecoyURL, "decoy-url", "", "optional site every other request is proxied to, e.g. https://www.example.com")
+	ser.StringVar(&conf.DecoyDir, "decoy-dir", "", "optional directory of static files served to every other request")
+	ser.IntVar(&conf.BanThreshold, "ban-threshold", 5, "authentication failures of a client IP within 10 minutes that ban it, 0 turns banning off")
+	ser.StringVar(&conf.BanDuration, "ban-duration", "10m", "first ban of a client IP, every next one lasts twice as long")
+	ser.StringVar(&conf.BanMaxDuration, "ban-max-duration", "24h", "longest ban of a client IP")
+	ser.StringVar(&conf.BanFile, "ban-file", "", "optional json file bans are kept in across restarts")
+	ser.StringVar(&conf.TLSCert, "tls-cert", "", "optional certificate file, serves wss:// and is loaded again when it changes")
+	ser.StringVar(&conf.TLSKey, "tls-key", "", "private key file of -tls-cert")
+	ser.StringVar(&conf.TLSClientCA, "tls-client-ca", "", "optional CA file, websockets then need a client certificate signed by it")
+	ser.BoolVar(&conf.TLSSelfSigned, "tls-self-signed", false, "serve wss:// with a throwaway self-signed certificate, for testing")
+	remoteFlags(ser, &conf.RemoteOptions)
+	ser.StringVar(&conf.TrustedProxies, "trusted-proxies", "", "comma-separated proxies whose X-Forwarded-For is trusted, e.g. '127.0.0.1,10.0.0.0/8'")
+	ser.IntVar(&conf.RelayPoolSize, "pool", 64, "websocket connections per next relay")
+	ser.StringVar(&conf.MetricsListen, "metrics", "", "optional metrics listen address, exposes /debug/metrics")
+	ser.StringVar(&conf.Compress, "compress", "", "compression codecs accepted from upstream and offered to next relays, e.g. 'zstd,snappy' or 'none' (default accepts all)")
+	ser.IntVar(&conf.CompressThreshold, "compress-min", common.DEFAULT_COMPRESS_THRESHOLD, "minimum payload size in bytes to compress")
+	ser.BoolVar(&conf.Pprof, "pprof", true, "expose /debug/pprof on the listen address")
+	ser.StringVar(&conf.AdminListen, "admin", "", "optional admin listen address, exposes /admin/conns")
+	ser.StringVar(&conf.AdminToken, "admin-token", "", "bearer token for the admin api, $"+common.ADMIN_TOKEN_ENV+" is used when set")
+	ser.StringVar(&conf.TrafficLog, "traffic-log", "", "optional json-lines file the per-destination traffic is appended to every minute")
+	ser.StringVar(&conf.AccessLog, "access-log", "", "optional file with one record per finished stream")
+	ser.StringVar(&conf.AccessLogFormat, "access-log-format", common.ACCESS_FORMAT_JSON, "access log format: json, common or a template like '{client} {target} {result}'")
+	ser.StringVar(&conf.RateLimit, "rate-limit", "", "bandwidth cap of the exit in bytes per second each way, e.g. '100M' (default off)")
+	ser.StringVar(&conf.UserRateLimit, "user-rate-limit", "", "bandwidth cap of every user, e.g. '10M' (default off)")
+	ser.StringVar(&conf.StreamRateLimit, "stream-rate-limit", "", "bandwidth cap of every stream, e.g. '2M' (default off)")
+	ser.IntVar(&conf.MaxStreams, "max-streams", 16384, "streams the server accepts at once, 0 is unlimited")
+	ser.IntVar(&conf.MaxStreamsPerWebsocket, "max-streams-per-ws", 4096, "streams one websocket may hold, 0 is unlimited")
+	ser.IntVar(&conf.MaxStreamsPerUser, "max-streams-per-user", 0, "streams one user may hold, 0 is unlimited")
+	ser.Float64Var(&conf.ConnectRate, "connect-rate", 0, "CONNECTs accepted per second, 0 is unlimited")
+	ser.StringVar(&conf.UserQuota, "user-quota", "", "traffic every user may move per billing cycle, e.g. '100G' (default off)")
+	ser.IntVar(&conf.QuotaResetDay, "quota-reset-day", 1, "day of the month the billing cycle starts, 1-28")
+	ser.BoolVar(&conf.QuotaCloseStreams, "quota-close", false, "close live streams of users over their traffic quota")
+	ser.StringVar(&conf.UsageFile, "usage-file", "", "optional json file user traffic is kept in across restarts")
+	ser.StringVar(&conf.TraceEndpoint, "trace-endpoint", "", "optional OTLP/HTTP endpoint spans are exported to, e.g. http://127.0.0.1:4318/v1/traces")
+	ser.StringVar(&conf.LogFormat, "log-format", logger.FORMAT_TEXT, "log format, text or json")
+	ser.StringVar(&conf.LogLevel, "log-level", "", "log levels, e.g. 'info' or 'info,relay=debug' (default info)")
+	ser.BoolVar(&debug, "d", false, "print debug log of every subsystem")
+
+	return ser
+}
+
+func localFlags(conf *common.LocalConfig) *flag.FlagSet {
+	cli := flag.NewFlagSet("local", flag.ExitOnError)
+	cli.StringVar(&conf.Remotes, "r", "ws://localhost:3811/ws", "remote server(s) to connect, seperated by comma")
+	cli.StringVar(&conf.Password, "p", "password", "password for authentication, $"+common.PASSWORD_ENV+" is used when set")
+	cli.StringVar(&conf.Listen, "l", "tcp://0.0.0.0:3810", "address to listen on")
+	cli.StringVar(&conf.Proto, "t", "socks5", "target protocol to use")
+	cli.IntVar(&conf.PoolSize, "pool", 64, "websocket connections per remote server")
+	cli.StringVar(&conf.MetricsListen, "metrics", "", "optional metrics listen address, exposes /debug/metrics")
+	cli.StringVar(&conf.Compress, "compress", "", "compression codecs to offer, e.g. 'zstd,snappy' (default off)")
+	cli.IntVar(&conf.CompressThreshold, "compress-min", common.DEFAULT_COMPRESS_THRESHOLD, "minimum payload size in bytes to compress")
+	cli.StringVar(&conf.AdminListen, "admin", "", "optional admin listen address, exposes /admin/conns")
+	cli.StringVar(&conf.AdminToken, "admin-token", "", "bearer token for the admin api, $"+common.ADMIN_TOKEN_ENV+" is used when set")
+	cli.StringVar(&conf.TrafficLog, "traffic-log", "", "optional json-lines file the per-destination traffic is appended to every minute")
+	cli.StringVar(&conf.AccessLog, "access-log", "", "optional file with one record per finished stream")
+	cli.StringVar(&conf.AccessLogFormat, "access-log-format", common.ACCESS_FORMAT_JSON, "access log format: json, common or a template like '{client} {target} {result}'")
+	cli.StringVar(&conf.RateLimit, "rate-limit", "", "upload cap of the local in bytes per second, e.g. '100M' (default off)")
+	cli.StringVar(&conf.UserRateLimit, "user-rate-limit", "", "upload cap of every user, e.g. '10M' (default off)")
+	cli.StringVar(&conf.StreamRateLimit, "stream-rate-limit", "", "upload cap of every stream, e.g. '2M' (default off)")
+	remoteFlags(cli, &conf.RemoteOptions)
+	cli.StringVar(&conf.TraceEndpoint, "trace-endpoint", "", "optional OTLP/HTTP endpoint spans are exported to, e.g. http://127.0.0.1:4318/v1/traces")
+	cli.StringVar(&conf.LogFormat, "log-format", logger.FORMAT_TEXT, "log format, text or json")
+	cli.StringVar(&conf.LogLevel, "log-level", "", "log levels, e.g. 'info' or 'info,wsconn=debug' (default info)")
+	cli.BoolVar(&debug, "d", false, "print debug log of every subsystem")
+
+	return cli
+}
+
+// remoteFlag sets one field of the "*" entry of RemoteOptions.
+type remoteFlag struct {
+	options *common.RemoteOptions
+	isBool  bool
+	set     func(conf *common.RemoteConfig, value string) error
+}
+
+func (f remoteFlag) String() string   { return "" }
+func (f remoteFlag) IsBoolFlag() bool { return f.isBool }
+
+func (f remoteFlag) Set(value string) error {
+	if *f.options == nil {
+		*f.options = common.RemoteOptions{}
+	}
+	conf := (*f.options)["*"]
+	if err := f.set(&conf, value); err != nil {
+		return err
+	}
+	(*f.options)["*"] = conf
+	return nil
+}
+
+// remoteFlags registers the options of dialing remotes, they apply to every
+// remote without its own entry in remoteOptions.
+func remoteFlags(fs *flag.FlagSet, options *common.RemoteOptions) {
+	fs.Var(remoteFlag{options: options, set: func(conf *common.RemoteConfig, value string) error {
+		conf.CA = value
+		return nil
+	}}, "remote-ca", "optional CA file trusted for wss:// remotes instead of the system roots")
+	fs.Var(remoteFlag{options: options, set: func(conf *common.RemoteConfig, value string) error {
+		conf.Pins = nil
+		for _, pin := range strings.Split(value, ",") {
+			if pin = strings.TrimSpace(pin); pin != "" {
+				conf.Pins = append(conf.Pins, pin)
+			}
+		}
+		return nil
+	}}, "remote-pin", "comma-separated base64 SHA-256 of the SPKI one certificate of a wss:// remote must have")
+	fs.Var(remoteFlag{options: options, set: func(conf *common.RemoteConfig, value string) error {
+		conf.SNI = value
+		return nil
+	}}, "remote-sni", "server name sent to wss:// remotes and verified, instead of the host of the url")
+	fs.Var(remoteFlag{options: options, isBool: true, set: func(conf *common.RemoteConfig, value string) (err error) {
+		conf.Insecure, err = strconv.ParseBool(value)
+		return err
+	}}, "remote-insecure", "skip verifying the certificate of wss:// remotes, for labs, pins still apply")
+	fs.Var(remoteFlag{options: options, set: func(conf *common.RemoteConfig, value string) error {
+		conf.ClientCert = value
+		return nil
+	}}, "remote-cert", "optional client certificate file presented to wss:// remotes with -tls-client-ca")
+	fs.Var(remoteFlag{options: options, set: func(conf *common.RemoteConfig, value string) error {
+		conf.ClientKey = value
+		return nil
+	}}, "remote-key", "private key file of -remote-cert")
+	fs.Var(remoteFlag{options: options, set: func(conf *common.RemoteConfig, value string) error {
+		conf.Address = value
+		return nil
+	}}, "remote-address", "host:port to connect to instead of the host of the remote url, e.g. a CDN edge")
+	fs.Var(remoteFlag{options: options, set: func(conf *common.RemoteConfig, value string) error {
+		conf.Host = value
+		return nil
+	}}, "remote-host", "Host header sent to remotes instead of the host of the url")
+	fs.Var(remoteFlag{options: options, set: func(conf *common.RemoteConfig, value string) error {
+		name, value, ok := strings.Cut(value, ":")
+		if !ok {
+			return errors.New("should look like 'Name: value'")
+		}
+		if conf.Headers == nil {
+			conf.Headers = map[string]string{}
+		}
+		conf.Headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+		return nil
+	}}, "remote-header", "extra header of the websocket handshake as 'Name: value', may be repeated")
+	fs.Var(remoteFlag{options: options, set: func(conf *common.RemoteConfig, value string) error {
+		conf.Subprotocol = value
+		return nil
+	}}, "remote-subprotocol", "websocket subprotocol asked of remotes")
+}
+
+// parseConfig parses the flags, then loads -c if given and parses the flags
+// again so that the ones set explicitly win over the file.
+func parseConfig(fs *flag.FlagSet, conf interface{ Validate() error }) error {
+	var path string
+	fs.StringVar(&path, "c", "", "config file (.json or .yaml), explicitly set flags override it")
+	for name, env := range map[string]string{"p": common.PASSWORD_ENV, "admin-token": common.ADMIN_TOKEN_ENV} {
+		// set the value only, so usage does not print the secret as default
+		if value := os.Getenv(env); value != "" && fs.Lookup(name) != nil {
+			fs.Lookup(name).Value.Set(value)
+		}
+	}
+	fs.Parse(os.Args[2:])
+	if path != "" {
+		if err := common.LoadConfig(path, conf); err != nil {
+			return err
+		}
+		fs.Parse(os.Args[2:])
+	}
+	if err := conf.Validate(); err != nil {
+		return fmt.Errorf("invalid config:\n%w", err)
+	}
+	return nil
+}
+
+// setupLogging switches the log format and sets the levels on top of info,
+// or of debug with -d, so a reload drops levels changed in the meantime.
+func setupLogging(format string, level string) error {
+	if err := logger.Setup(format, os.Stdout); err != nil {
+		return err
+	}
+	base := "info"
+	if debug {
+		base = "debug"
+	}
+	return logger.SetLevels(base + "," + level)
+}
+
+// runTrace collects the spans of a cid from the admin api of every hop and
+// prints them as one timeline.
+func runTrace(args []string) error {
+	cli := flag.NewFlagSet("trace", flag.ExitOnError)
+	token := cli.String("admin-token", os.Getenv(common.ADMIN_TOKEN_ENV), "bearer token for the admin apis, $"+common.ADMIN_TOKEN_ENV+" by default")
+	asJSON := cli.Bool("json", false, "print the spans as json")
+	timeout := cli.Duration("timeout", 5*time.Second, "timeout of every admin request")
+	cli.Usage = func() {
+		fmt.Fprintln(cli.Output(), "usage: detour trace [flags] <cid> <admin address>...")
+		cli.PrintDefaults()
+	}
+	cli.Parse(args)
+	if cli.NArg() < 2 {
+		cli.Usage()
+		return errors.New("need a cid and at least one admin address")
+	}
+
+	cid := cli.Arg(0)
+	spans := []common.Span{}
+	for _, admin := range cli.Args()[1:] {
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		found, err := common.FetchSpans(ctx, admin, *token, cid)
+		cancel()
+		if err != nil {
+			logger.Main.Warn("trace, admin unreachable", "admin", admin, logger.ERR, err)
+			continue
+		}
+		spans = append(spans, found...)
+	}
+	spans = common.OrderSpans(spans)
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(spans)
+	}
+	return common.WriteTimeline(os.Stdout, spans)
+}
+
+// runDiagnose sends a test CONNECT through every remote of a local, or every
+// next hop of a relay, and reports where the chain breaks.
+func runDiagnose(args []string) error {
+	cli := flag.NewFlagSet("diagnose", flag.ExitOnError)
+	path := cli.String("c", "", "local or relay config file to take remotes, password and compress from")
+	remotes := cli.String("r", "", "remote server(s) to probe, separated by comma")
+	password := cli.String("p", "password", "password for authentication, $"+common.PASSWORD_ENV+" is used when set")
+	compress := cli.String("compress", "", "compression codecs to offer, e.g. 'zstd,snappy' (default off)")
+	target := cli.String("target", local.DEFAULT_DIAGNOSE_TARGET, "address the exit is asked to connect to")
+	timeout := cli.Duration("timeout", 10*time.Second, "timeout of every probe")
+	asJSON := cli.Bool("json", false, "print the reports as json")
+	options := common.RemoteOptions{}
+	remoteFlags(cli, &options)
+	if value := os.Getenv(common.PASSWORD_ENV); value != "" {
+		cli.Lookup("p").Value.Set(value)
+	}
+	cli.Parse(args)
+
+	if *path != "" {
+		explicit := map[string]bool{}
+		cli.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+		lconf := &common.LocalConfig{}
+		if err := common.LoadConfig(*path, lconf); err != nil {
+			sconf := &common.ServerConfig{}
+			if err := common.LoadConfig(*path, sconf); err != nil {
+				return err
+			}
+			lconf.Remotes, lconf.Password, lconf.Compress = sconf.Remotes, sconf.Password, sconf.Compress
+			lconf.RemoteOptions = sconf.RemoteOptions
+		}
+		for url, remote := range lconf.RemoteOptions {
+			// a "*" set by flags wins over the one of the file
+			if _, ok := options[url]; !ok {
+				options[url] = remote
+			}
+		}
+		for name, value := range map[string]string{"r": lconf.Remotes, "p": lconf.Password, "compress": lconf.Compress} {
+			if !explicit[name] && value != "" {
+				cli.Lookup(name).Value.Set(value)
+			}
+		}
+	}
+
+	if err := options.Validate(); err != nil {
+		return err
+	}
+	conf := local.DiagnoseConfig{Password: *password, Target: *target, Timeout: *timeout, RemoteOptions: options}
+	for _, remote := range strings.Split(*remotes, ",") {
+		if remote = strings.TrimSpace(remote); remote != "" {
+			conf.Remotes = append(conf.Remotes, remote)
+		}
+	}
+	if len(conf.Remotes) == 0 {
+		cli.Usage()
+		return errors.New("no remotes to diagnose, give -r or -c")
+	}
+	codecs, err := common.ParseCodecs(*compress)
+	if err != nil {
+		return err
+	}
+	conf.Compress = codecs
+
+	reports := local.Diagnose(context.Background(), conf)
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(reports)
+	} else {
+		err = local.WriteDiagnose(os.Stdout, reports)
+	}
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, report := range reports {
+		if report.Status != local.DIAGNOSE_OK {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d remotes failed", failed, len(reports))
+	}
+	return nil
+}
+
+// runBench drives streams through a running local, or an in-process chain,
+// to a sink it starts and reports throughput and latency.
+func runBench(args []string) error {
+	cli := flag.NewFlagSet("bench", flag.ExitOnError)
+	conf := bench.Config{}
+	cli.StringVar(&conf.Proxy, "proxy", "", "socks5 address of a running local (default an in-process chain)")
+	cli.StringVar(&conf.MetricsURL, "metrics", "", "metrics url of the local given by -proxy, e.g. http://127.0.0.1:3910")
+	cli.IntVar(&conf.Relays, "relays", 0, "relays in the in-process chain")
+	cli.StringVar(&conf.Compress, "compress", "", "compression codecs of the in-process chain, e.g. 'zstd,snappy'")
+	cli.IntVar(&conf.Streams, "streams", 16, "concurrent streams")
+	cli.IntVar(&conf.Upload, "upload", 1024, "bytes sent per round trip")
+	cli.IntVar(&conf.Download, "download", 65536, "bytes answered per round trip")
+	cli.IntVar(&conf.RoundTrips, "round-trips", 0, "round trips before a stream is reopened, 0 keeps it open")
+	cli.DurationVar(&conf.Duration, "duration", 10*time.Second, "how long to run")
+	cli.StringVar(&conf.SinkListen, "sink-listen", "127.0.0.1:0", "address the sink listens on")
+	cli.StringVar(&conf.SinkAddr, "sink-addr", "", "address the exit dials to reach the sink (default the sink address)")
+	asJSON := cli.Bool("json", false, "print the report as json")
+	cli.BoolVar(&debug, "d", false, "print debug log of every subsystem")
+	cli.Parse(args)
+	if !debug {
+		logger.SetLevels("warn")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	report, err := bench.Run(ctx, conf)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
 	}
+	return bench.WriteReport(os.Stdout, report)
+}
+
+// reloadOnHangup calls reload on every SIGHUP until ctx is done.
+func reloadOnHangup(ctx context.Context, reload func() error) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hangup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hangup:
+				logger.Main.Info("reload, SIGHUP received")
+				if err := reload(); err != nil {
+					logger.Main.Error("reload, failed", logger.ERR, err)
+				}
+			}
+		}
+	}()
 }
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/observerss/detour2/common"
+	"github.com/observerss/detour2/logger"
+)
+
+func (s *Server) AdminConns() []common.AdminConn {
+	conns := []common.AdminConn{}
+	s.Conns.Range(func(key, value any) bool {
+		conn := value.(*Conn)
+		item := common.AdminConn{
+			Cid:       conn.Cid,
+			Wid:       conn.Wid,
+			Network:   conn.Network,
+			Address:   conn.Address,
+			User:      conn.User,
+			Via:       "direct",
+			BytesUp:   conn.BytesUp.Load(),
+			BytesDown: conn.BytesDown.Load(),
+		}
+		if conn.Relay != nil {
+			item.Via = conn.Relay.Url
+		}
+		conns = append(conns, common.NewAdminConn(item, conn.StartedAt, time.Unix(0, conn.LastActive.Load())))
+		return true
+	})
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].AgeSeconds > conns[j].AgeSeconds
+	})
+	return conns
+}
+
+func (s *Server) Spans(cid string) []common.Span {
+	return s.Tracer.Spans(cid)
+}
+
+func (s *Server) RateLimits() common.RateLimitConfig {
+	return s.Throttle.Config()
+}
+
+func (s *Server) SetRateLimits(conf common.RateLimitConfig) error {
+	return s.Throttle.Update(conf)
+}
+
+func (s *Server) UsageSnapshot() common.UsageSnapshot {
+	return s.Usage.Snapshot()
+}
+
+func (s *Server) ResetUsage(user string) {
+	s.Usage.Reset(user)
+}
+
+func (s *Server) Bans() []common.Ban {
+	return s.BanList.Bans()
+}
+
+func (s *Server) Unban(ip string) bool {
+	if !s.BanList.Unban(ip) {
+		return false
+	}
+	if err := s.BanList.Save(); err != nil {
+		logger.Server.Error("ban, save error", logger.ERR, err)
+	}
+	return true
+}
+
+// CloseConn closes cid towards the target or the next relay and sends CLOSE
+// back upstream.
+func (s *Server) CloseConn(cid string) bool {
+	value, ok := s.Conns.Load(cid)
+	if !ok {
+		return false
+	}
+	value.(*Conn).Logger().Info("admin, close conn")
+	return s.closeConn(value.(*Conn), "admin closed")
+}
+
+// closeConn is CloseConn with the reason recorded for the stream, it reports
+// false when the stream is already gone.
+func (s *Server) closeConn(conn *Conn, reason string) bool {
+	if _, ok := s.Conns.LoadAndDelete(conn.Cid); !ok {
+		return false
+	}
+	conn.CloseReason.Set(reason)
+	msg := &common.Message{
+		Cmd:     common.CLOSE,
+		Cid:     conn.Cid,
+		Network: conn.Network,
+		Address: conn.Address,
+	}
+	if conn.Relay != nil {
+		forwarded := *msg
+		forwarded.Wid = conn.Relay.Wid
+		conn.Relay.WriteMessage(&forwarded)
+		conn.ReleaseRelay()
+	} else if conn.NetConn != nil {
+		conn.NetConn.Close()
+	}
+	msg.Wid = conn.Wid
+	s.SendWebosket(conn, msg)
+	return true
+}
+
+func (s *Server) StartAdminServer() error {
+	if s.AdminListen == "" {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", s.AdminListen)
+	if err != nil {
+		return err
+	}
+	s.AdminServer = &http.Server{Handler: common.NewAdminHandler(s.AdminToken, s)}
+	adminServer := s.AdminServer
+	go func() {
+		logger.Server.Info("Admin listening at http://" + listener.Addr().String() + "/admin/conns")
+		if err := adminServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.Server.Error("admin, listen error", logger.ERR, err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/observerss/detour2/common"
+	"github.com/observerss/detour2/logger"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	DEFAULT_WS_PATH = "/ws"
+	// GARBAGE_DRAIN_TIMEOUT is how long a websocket sending frames that do
+	// not unpack is read and ignored before it is dropped.
+	GARBAGE_DRAIN_TIMEOUT = time.Minute
+)
+
+// NewDecoy returns the handler of conf.DecoyURL or conf.DecoyDir, nil when
+// neither is set.
+func NewDecoy(conf common.DecoyConfig) (http.Handler, error) {
+	if value := strings.TrimSpace(conf.DecoyURL); value != "" {
+		target, err := url.Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("decoyURL: %w", err)
+		}
+		return &httputil.ReverseProxy{
+			// the decoy sees its own host and no forwarding headers
+			Rewrite: func(r *httputil.ProxyRequest) {
+				r.SetURL(target)
+				r.Out.Header.Del(common.AUTH_HEADER)
+			},
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				logger.Server.Debug("decoy, proxy error", "url", r.URL.String(), logger.ERR, err)
+				w.WriteHeader(http.StatusBadGateway)
+			},
+		}, nil
+	}
+	if dir := strings.TrimSpace(conf.DecoyDir); dir != "" {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return nil, fmt.Errorf("decoyDir: %w", err)
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("decoyDir: %s is not a directory", dir)
+		}
+		return http.FileServer(http.Dir(dir)), nil
+	}
+	return nil, nil
+}
+
+func wsPath(conf common.DecoyConfig) string {
+	if path := strings.TrimSpace(conf.WSPath); path != "" {
+		return path
+	}
+	return DEFAULT_WS_PATH
+}
+
+// decoy returns the decoy in effect, nil when there is none.
+func (s *Server) decoy() http.Handler {
+	s.ConfigLock.RLock()
+	defer s.ConfigLock.RUnlock()
+	return s.Decoy
+}
+
+// HandleHTTP routes WSPath to HandleWebsocket and everything else to
+// HandleIndex.
+func (s *Server) HandleHTTP(w http.ResponseWriter, r *http.Request) {
+	s.ConfigLock.RLock()
+	path := s.WSPath
+	s.ConfigLock.RUnlock()
+	if r.URL.Path == path {
+		s.HandleWebsocket(w, r)
+		return
+	}
+	s.HandleIndex(w, r)
+}
+
+// unlessDecoy hands requests to the decoy while one is set, so debug pages
+// do not give the server away.
+func (s *Server) unlessDecoy(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if decoy := s.decoy(); decoy != nil {
+			decoy.ServeHTTP(w, r)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// drainWebsocket reads and ignores conn until the peer gives up or
+// GARBAGE_DRAIN_TIMEOUT passes.
+func drainWebsocket(conn *websocket.Conn) {
+	conn.SetReadDeadline(time.Now().Add(GARBAGE_DRAIN_TIMEOUT))
+	for {
+		if _, _, err := conn.NextReader(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/observerss/detour2/common"
+
+	"github.com/gorilla/websocket"
+)
+
+func fetch(t *testing.T, url string, header http.Header) (int, string) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestDecoyDirHidesWebsocket(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte("<h1>hello</h1>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	server := newServer(t, &common.ServerConfig{
+		Listen:      "tcp://127.0.0.1:0",
+		Password:    "pass123",
+		Pprof:       true,
+		DecoyConfig: common.DecoyConfig{WSPath: "/secret", DecoyDir: dir},
+	})
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+
+	if status, body := fetch(t, ts.URL+"/", nil); status != http.StatusOK || body != "<h1>hello</h1>" {
+		t.Fatalf("decoy index not served: %d %q", status, body)
+	}
+	missingStatus, missingBody := fetch(t, ts.URL+"/missing", nil)
+	upgrade := http.Header{"Connection": {"Upgrade"}, "Upgrade": {"websocket"}, "Sec-Websocket-Version": {"13"}, "Sec-Websocket-Key": {"dGhlIHNhbXBsZSBub25jZQ=="}}
+	for _, probe := range []struct {
+		path   string
+		header http.Header
+	}{
+		{"/ws", upgrade},
+		{"/secret", nil},
+		{"/secret", upgrade},
+		{"/debug/pprof/", nil},
+	} {
+		if status, body := fetch(t, ts.URL+probe.path, probe.header); status != missingStatus || body != missingBody {
+			t.Fatalf("%s answered %d %q, the decoy answers %d %q", probe.path, status, body, missingStatus, missingBody)
+		}
+	}
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/secret"
+	header := http.Header{}
+	common.SetAuthHeader(header, "wrong")
+	if conn, _, err := websocket.DefaultDialer.Dial(url, header); err == nil {
+		conn.Close()
+		t.Fatal("upgrade with a wrong password accepted")
+	}
+	common.SetAuthHeader(header, "pass123")
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestDecoyURLProxiesRequests(t *testing.T) {
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Host+" "+r.URL.Path+" "+r.Header.Get(common.AUTH_HEADER)+r.Header.Get("X-Forwarded-For"))
+	}))
+	defer site.Close()
+	server := newServer(t, &common.ServerConfig{
+		Listen:      "tcp://127.0.0.1:0",
+		Password:    "pass123",
+		DecoyConfig: common.DecoyConfig{DecoyURL: site.URL},
+	})
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+
+	header := http.Header{common.AUTH_HEADER: {"forged"}}
+	want := strings.TrimPrefix(site.URL, "http://") + " /ws "
+	if status, body := fetch(t, ts.URL+"/ws", header); status != http.StatusOK || body != want {
+		t.Fatalf("unexpected decoy answer: %d %q, want %q", status, body, want)
+	}
+}
+
+func TestUnpackFailuresBanClient(t *testing.T) {
+	server := newServer(t, &common.ServerConfig{
+		Listen:    "tcp://127.0.0.1:0",
+		Password:  "pass123",
+		BanConfig: common.BanConfig{BanThreshold: 2},
+	})
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws"
+	for range 2 {
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.WriteMessage(websocket.BinaryMessage, []byte("garbage"))
+		// the server hangs up after the frame fails to unpack
+		conn.ReadMessage()
+		conn.Close()
+	}
+	if _, resp, err := websocket.DefaultDialer.Dial(url, nil); err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("banned client was not refused: %v %+v", err, resp)
+	}
+	if bans := server.Bans(); len(bans) != 1 || bans[0].IP != "127.0.0.1" {
+		t.Fatalf("unexpected bans: %+v", bans)
+	}
+	runtime := server.Metrics.Snapshot()
+	if runtime.AuthFailuresTotal != 2 || runtime.BannedRequestsTotal != 1 {
+		t.Fatalf("unexpected counters: %+v", runtime)
+	}
+}
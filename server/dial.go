@@ -23,19 +23,37 @@ func ParseDNSServers(value string) []string {
 	return servers
 }
 
-func (s *Server) Dialer() net.Dialer {
-	dialer := net.Dialer{Timeout: time.Second * DIAL_TIMEOUT}
-	if len(s.DNSServers) == 0 {
+// Dialer returns a dialer for host, the name a client asked for. Every
+// address host resolves to is checked against the ACL right before the dial.
+func (s *Server) Dialer(host string) net.Dialer {
+	s.ConfigLock.RLock()
+	servers := s.DNSServers
+	acl := s.ACL
+	s.ConfigLock.RUnlock()
+	dialer := net.Dialer{Timeout: time.Second * DIAL_TIMEOUT, Control: acl.Control(host)}
+	if len(servers) == 0 {
 		return dialer
 	}
 	dialer.Resolver = &net.Resolver{
 		PreferGo: true,
 		Dial: func(ctx context.Context, network string, address string) (net.Conn, error) {
 			idx := atomic.AddUint64(&s.DNSCounter, 1)
-			server := s.DNSServers[int(idx-1)%len(s.DNSServers)]
+			server := servers[int(idx-1)%len(servers)]
 			resolverDialer := net.Dialer{Timeout: time.Second * DIAL_TIMEOUT}
 			return resolverDialer.DialContext(ctx, network, server)
 		},
 	}
 	return dialer
 }
+
+// DialTarget dials a target of the exit server and records the dial time.
+func (s *Server) DialTarget(network string, address string) (net.Conn, error) {
+	host, _, _ := net.SplitHostPort(address)
+	dialer := s.Dialer(host)
+	start := time.Now()
+	conn, err := dialer.Dial(network, address)
+	if s.Metrics != nil {
+		s.Metrics.DialDuration.Since(start)
+	}
+	return conn, err
+}
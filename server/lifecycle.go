@@ -0,0 +1,230 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+
+	"github.com/observerss/detour2/logger"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	SHUTDOWN_TIMEOUT    = 10 * time.Second
+	DRAIN_POLL_INTERVAL = 50 * time.Millisecond
+)
+
+// Handler serves the websocket endpoint at WSPath and the index page or the
+// decoy, so the server can be mounted inside another http.Server.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.HandleHTTP)
+	if s.Pprof {
+		mux.HandleFunc("/debug/pprof/", s.unlessDecoy(pprof.Index))
+		mux.HandleFunc("/debug/pprof/cmdline", s.unlessDecoy(pprof.Cmdline))
+		mux.HandleFunc("/debug/pprof/profile", s.unlessDecoy(pprof.Profile))
+		mux.HandleFunc("/debug/pprof/symbol", s.unlessDecoy(pprof.Symbol))
+		mux.HandleFunc("/debug/pprof/trace", s.unlessDecoy(pprof.Trace))
+	}
+	return mux
+}
+
+func (s *Server) RunServer() error {
+	return s.RunServerContext(context.Background())
+}
+
+// RunServerContext starts the server and blocks until ctx is done or serving
+// fails, then shuts down gracefully within SHUTDOWN_TIMEOUT.
+func (s *Server) RunServerContext(ctx context.Context) error {
+	if err := s.Start(); err != nil {
+		return err
+	}
+
+	var serveErr error
+	select {
+	case <-ctx.Done():
+	case <-s.DoneChan():
+	case serveErr = <-s.ServeErr:
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+	err := errors.Join(serveErr, s.Shutdown(shutdownCtx))
+	logger.Server.Debug("Bye bye")
+	return err
+}
+
+// Start listens on the configured address and serves in the background.
+func (s *Server) Start() error {
+	if s.IsStopped() {
+		return errors.New("server is stopped")
+	}
+	listener, err := net.Listen("tcp", s.Address)
+	if err != nil {
+		return err
+	}
+	if err := s.StartMetricsServer(); err != nil {
+		listener.Close()
+		return err
+	}
+	if err := s.StartAdminServer(); err != nil {
+		listener.Close()
+		if s.MetricsServer != nil {
+			s.MetricsServer.Close()
+		}
+		return err
+	}
+	s.StartRelayClients()
+	go s.RunTraffic()
+	go s.RunUsage()
+
+	scheme := "http://"
+	if s.TLS != nil {
+		listener = tls.NewListener(listener, s.TLS)
+		scheme = "https://"
+	}
+	s.Listener = listener
+	s.HTTPServer = &http.Server{Handler: s.Handler()}
+	httpServer := s.HTTPServer
+	logger.Server.Info("Listening at " + scheme + listener.Addr().String())
+	go func() {
+		if err := httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.Server.Error("HTTP server Serve Error", logger.ERR, err)
+			select {
+			case s.ServeErr <- err:
+			default:
+			}
+		}
+	}()
+	return nil
+}
+
+// Addr returns the listening address once Start succeeded.
+func (s *Server) Addr() net.Addr {
+	if s.Listener == nil {
+		return nil
+	}
+	return s.Listener.Addr()
+}
+
+// Shutdown stops accepting websockets, waits for active streams to drain until
+// ctx is done, then closes the remaining websockets and relay clients.
+func (s *Server) Shutdown(ctx context.Context) error {
+	var errs []error
+	s.HandlerLock.Lock()
+	s.StopOnce.Do(func() {
+		if s.Done != nil {
+			close(s.Done)
+		}
+	})
+	s.HandlerLock.Unlock()
+
+	if s.HTTPServer != nil {
+		if err := s.HTTPServer.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("http shutdown: %w", err))
+		}
+	}
+
+	if n := s.waitIdle(ctx); n > 0 {
+		errs = append(errs, fmt.Errorf("drain: %d streams still active: %w", n, ctx.Err()))
+	}
+
+	s.Conns.Range(func(_, value any) bool {
+		conn := value.(*Conn)
+		conn.CloseReason.Set("server stopped")
+		if conn.Relay == nil && conn.NetConn != nil {
+			// ends handlers waiting on a full upload queue
+			conn.NetConn.Close()
+		}
+		return true
+	})
+	s.Websockets.Range(func(key, value any) bool {
+		key.(*websocket.Conn).Close()
+		return true
+	})
+	for _, relay := range s.Relays() {
+		relay.Close()
+	}
+
+	handlersDone := make(chan struct{})
+	go func() {
+		s.HandlerWG.Wait()
+		close(handlersDone)
+	}()
+	select {
+	case <-handlersDone:
+	case <-ctx.Done():
+		errs = append(errs, fmt.Errorf("websocket handlers: %w", ctx.Err()))
+	}
+
+	if s.MetricsServer != nil {
+		if err := s.MetricsServer.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("metrics shutdown: %w", err))
+		}
+	}
+	if s.AdminServer != nil {
+		if err := s.AdminServer.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("admin shutdown: %w", err))
+		}
+	}
+	if err := s.Usage.Save(); err != nil {
+		errs = append(errs, fmt.Errorf("usage save: %w", err))
+	}
+	s.Tracer.Close()
+	return errors.Join(errs...)
+}
+
+func (s *Server) waitIdle(ctx context.Context) int {
+	ticker := time.NewTicker(DRAIN_POLL_INTERVAL)
+	defer ticker.Stop()
+	for {
+		active := 0
+		s.Conns.Range(func(key, value any) bool {
+			active++
+			return true
+		})
+		if active == 0 {
+			return 0
+		}
+		select {
+		case <-ctx.Done():
+			return active
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) DoneChan() <-chan struct{} {
+	if s == nil || s.Done == nil {
+		return nil
+	}
+	return s.Done
+}
+
+// enterHandler counts a websocket handler in HandlerWG unless the server is
+// stopped. Shutdown closes Done under the same lock, so no Add follows its
+// Wait.
+func (s *Server) enterHandler() bool {
+	s.HandlerLock.Lock()
+	defer s.HandlerLock.Unlock()
+	if s.IsStopped() {
+		return false
+	}
+	s.HandlerWG.Add(1)
+	return true
+}
+
+func (s *Server) IsStopped() bool {
+	select {
+	case <-s.DoneChan():
+		return true
+	default:
+		return false
+	}
+}
@@ -1,7 +1,13 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -10,7 +16,7 @@ import (
 )
 
 func TestCloseRelayConnsReleasesActiveAndClosesUpstream(t *testing.T) {
-	server := NewServer(&common.ServerConfig{
+	server := newServer(t, &common.ServerConfig{
 		Listen:   "tcp://127.0.0.1:3811",
 		Password: "pass123",
 	})
@@ -52,7 +58,7 @@ func TestCloseRelayConnsReleasesActiveAndClosesUpstream(t *testing.T) {
 }
 
 func TestCloseWebsocketConnsClosesAssociatedConnections(t *testing.T) {
-	server := NewServer(&common.ServerConfig{
+	server := newServer(t, &common.ServerConfig{
 		Listen:   "tcp://127.0.0.1:3811",
 		Password: "pass123",
 	})
@@ -82,7 +88,7 @@ func TestCloseWebsocketConnsClosesAssociatedConnections(t *testing.T) {
 }
 
 func TestRunLoopSendsCloseOnTargetReadError(t *testing.T) {
-	server := NewServer(&common.ServerConfig{
+	server := newServer(t, &common.ServerConfig{
 		Listen:   "tcp://127.0.0.1:3811",
 		Password: "pass123",
 	})
@@ -139,3 +145,164 @@ func TestTargetIdleTimeoutAllowsHLSConnectionReuse(t *testing.T) {
 		t.Fatalf("target idle timeout is too short for browser video tunnel reuse: %s", TARGET_IDLE_TIMEOUT)
 	}
 }
+
+func TestServerStartShutdownClosesWebsockets(t *testing.T) {
+	server := newServer(t, &common.ServerConfig{
+		Listen:   "tcp://127.0.0.1:0",
+		Password: "pass123",
+	})
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+server.Addr().String()+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	deadline := time.Now().Add(time.Second)
+	for server.Metrics.WebSocketActive.Load() != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := ws.ReadMessage(); err == nil {
+		t.Fatal("expected websocket to be closed by shutdown")
+	}
+	if got := server.Metrics.WebSocketActive.Load(); got != 0 {
+		t.Fatalf("unexpected active websockets after shutdown: %d", got)
+	}
+	if _, err := net.DialTimeout("tcp", server.Addr().String(), 100*time.Millisecond); err == nil {
+		t.Fatal("listener still accepting after shutdown")
+	}
+}
+
+func TestServerShutdownReportsUndrainedStreams(t *testing.T) {
+	server := newServer(t, &common.ServerConfig{
+		Listen:   "tcp://127.0.0.1:0",
+		Password: "pass123",
+	})
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	server.Conns.Store("cid", &Conn{Cid: "cid", Wid: "wid", NetConn: serverConn})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected drain deadline error, got %v", err)
+	}
+	if !server.IsStopped() {
+		t.Fatal("server should be stopped")
+	}
+}
+
+func TestHandleConnectRejectsAfterShutdown(t *testing.T) {
+	server := newServer(t, &common.ServerConfig{
+		Listen:   "tcp://127.0.0.1:0",
+		Password: "pass123",
+	})
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	written := make(chan *common.Message, 1)
+	writer := common.NewFairMessageWriter(func(msg *common.Message) error {
+		written <- common.CloneMessage(msg)
+		return nil
+	}, common.DefaultMessageQueueLimit)
+	defer writer.Close()
+
+	server.HandleConnect(&Handle{
+		WSWriter: writer,
+		Msg:      &common.Message{Cmd: common.CONNECT, Cid: "cid", Wid: "wid", Network: "tcp", Address: "127.0.0.1:1"},
+	})
+	select {
+	case msg := <-written:
+		if msg.Ok || msg.Msg == "" {
+			t.Fatalf("expected rejection, got %+v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("connect was not answered")
+	}
+}
+
+func TestShutdownWaitsForUpgradesRacingIt(t *testing.T) {
+	server := newServer(t, &common.ServerConfig{
+		Listen:   "tcp://127.0.0.1:0",
+		Password: "pass123",
+	})
+	// served outside HTTPServer, so upgrades keep coming during Shutdown
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws"
+
+	stop := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if conn, _, err := websocket.DefaultDialer.Dial(url, nil); err == nil {
+					conn.Close()
+				}
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	close(stop)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, resp, err := websocket.DefaultDialer.Dial(url, nil); err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("upgrade after shutdown was not refused: %v", err)
+	}
+}
+
+func TestShutdownClosesWebsocketStoredAfterIt(t *testing.T) {
+	server := newServer(t, &common.ServerConfig{
+		Listen:   "tcp://127.0.0.1:0",
+		Password: "pass123",
+	})
+	// holds the upgrade until Shutdown went past the websockets it closes
+	upgrading := make(chan struct{})
+	upgrader.CheckOrigin = func(*http.Request) bool {
+		close(upgrading)
+		<-server.DoneChan()
+		time.Sleep(100 * time.Millisecond)
+		return true
+	}
+	defer func() { upgrader.CheckOrigin = nil }()
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+
+	dialed := make(chan *websocket.Conn, 1)
+	go func() {
+		conn, _, _ := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", nil)
+		dialed <- conn
+	}()
+	<-upgrading
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if conn := <-dialed; conn != nil {
+		conn.Close()
+	}
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"encoding/json"
+	"net"
 	"net/http"
 	"sort"
 
@@ -15,6 +16,7 @@ type ServerMetricsSnapshot struct {
 	DNSServers  []string                      `json:"dnsServers,omitempty"`
 	Runtime     common.RuntimeMetricsSnapshot `json:"runtime"`
 	Connections ServerConnectionSnapshot      `json:"connections"`
+	Quota       ServerQuotaSnapshot           `json:"quota"`
 	RelayPool   ServerRelayPoolSnapshot       `json:"relayPool,omitempty"`
 }
 
@@ -45,6 +47,7 @@ type ServerRelaySnapshot struct {
 	WID       string                           `json:"wid"`
 	Connected bool                             `json:"connected"`
 	Active    int64                            `json:"active"`
+	Codec     string                           `json:"codec"`
 	Writer    common.FairMessageWriterSnapshot `json:"writer"`
 }
 
@@ -69,16 +72,24 @@ func (s *Server) MetricsSnapshot() ServerMetricsSnapshot {
 		return true
 	})
 
-	relayPool := ServerRelayPoolSnapshot{Total: len(s.RelayClients)}
-	if len(s.RelayClients) > 0 {
-		items := make([]ServerRelaySnapshot, 0, len(s.RelayClients))
-		for key, relay := range s.RelayClients {
+	s.RelayLock.RLock()
+	relays := make(map[string]*RelayClient, len(s.RelayClients))
+	for key, relay := range s.RelayClients {
+		relays[key] = relay
+	}
+	s.RelayLock.RUnlock()
+
+	relayPool := ServerRelayPoolSnapshot{Total: len(relays)}
+	if len(relays) > 0 {
+		items := make([]ServerRelaySnapshot, 0, len(relays))
+		for key, relay := range relays {
 			relay.RWLock.RLock()
 			connected := relay.Connected
 			relay.RWLock.RUnlock()
 
 			relay.WriteLock.Lock()
 			writerSnapshot := relay.Writer.Snapshot()
+			codec := relay.Codec.Load()
 			relay.WriteLock.Unlock()
 
 			item := ServerRelaySnapshot{
@@ -87,6 +98,7 @@ func (s *Server) MetricsSnapshot() ServerMetricsSnapshot {
 				WID:       relay.Wid,
 				Connected: connected,
 				Active:    relay.ActiveCount(),
+				Codec:     codec.String(),
 				Writer:    writerSnapshot,
 			}
 
@@ -106,23 +118,70 @@ func (s *Server) MetricsSnapshot() ServerMetricsSnapshot {
 	}
 
 	role := "server"
-	if s.HasNextRelay() {
+	if len(relays) > 0 {
 		role = "relay"
 	}
+	s.ConfigLock.RLock()
+	dnsServers := append([]string{}, s.DNSServers...)
+	s.ConfigLock.RUnlock()
 
 	return ServerMetricsSnapshot{
 		Role:        role,
 		Listen:      s.Address,
-		DNSServers:  append([]string{}, s.DNSServers...),
+		DNSServers:  dnsServers,
 		Runtime:     s.Metrics.Snapshot(),
 		Connections: connections,
+		Quota:       s.Quota.Snapshot(),
 		RelayPool:   relayPool,
 	}
 }
 
-func (s *Server) StartMetricsServer() {
+// PrometheusMetrics renders MetricsSnapshot in the Prometheus text format.
+func (s *Server) PrometheusMetrics() *common.PromWriter {
+	snapshot := s.MetricsSnapshot()
+	p := common.NewPromWriter()
+	p.Gauge("detour_info", "Role of the process.", 1, "role", snapshot.Role)
+	p.Runtime(snapshot.Runtime)
+	p.Gauge("detour_server_connections_active", "Streams open through the server.", float64(snapshot.Connections.Active))
+	quota := snapshot.Quota
+	p.Gauge("detour_quota_streams", "Streams counted against the stream quotas.", float64(quota.Streams))
+	p.Gauge("detour_quota_max_streams", "Stream limit of the server, 0 is unlimited.", float64(quota.MaxStreams))
+	p.Gauge("detour_quota_busiest_websocket_streams", "Streams of the fullest websocket.", float64(quota.BusiestWebsocket))
+	p.Gauge("detour_quota_max_streams_per_websocket", "Stream limit of every websocket, 0 is unlimited.", float64(quota.MaxStreamsPerWebsocket))
+	p.Gauge("detour_quota_max_streams_per_user", "Stream limit of every user, 0 is unlimited.", float64(quota.MaxStreamsPerUser))
+	p.Gauge("detour_quota_connect_rate", "CONNECTs allowed per second, 0 is unlimited.", quota.ConnectRate)
+	for _, limit := range []string{QUOTA_STREAMS, QUOTA_WEBSOCKET, QUOTA_USER, QUOTA_RATE} {
+		p.Counter("detour_quota_rejected_total", "CONNECTs refused by a quota.", float64(quota.Rejected[limit]), "limit", limit)
+	}
+	writers := snapshot.Connections.Writers
+	p.Gauge("detour_server_writers", "Websocket writers of upstream connections.", float64(writers.Total))
+	p.Gauge("detour_server_writers_closed", "Websocket writers of upstream connections that are closed.", float64(writers.Closed))
+	p.Gauge("detour_server_writer_queue_streams", "Streams with messages queued in the websocket writers of upstream connections.", float64(writers.QueueKeys))
+	p.Gauge("detour_server_writer_queue_messages", "Messages queued in the websocket writers of upstream connections.", float64(writers.QueueMessages))
+
+	relays := snapshot.RelayPool
+	if relays.Total > 0 {
+		p.Gauge("detour_pool_websockets", "Websockets in the pool.", float64(relays.Total), "pool", "relay")
+		p.Gauge("detour_pool_connected", "Websockets in the pool that are connected.", float64(relays.Connected), "pool", "relay")
+		p.Gauge("detour_pool_active_streams", "Streams carried by the pool.", float64(relays.ActiveTotal), "pool", "relay")
+		p.Gauge("detour_pool_max_active_streams", "Most streams carried by one websocket of the pool.", float64(relays.MaxActive), "pool", "relay")
+	}
+	for _, item := range relays.Items {
+		labels := []string{"pool", "relay", "remote", item.URL, "key", item.Key}
+		connected := 0.0
+		if item.Connected {
+			connected = 1
+		}
+		p.Gauge("detour_websocket_connected", "Whether the websocket is connected.", connected, labels...)
+		p.Gauge("detour_websocket_active_streams", "Streams carried by the websocket.", float64(item.Active), labels...)
+		p.Writer(item.Writer, labels...)
+	}
+	return p
+}
+
+func (s *Server) StartMetricsServer() error {
 	if s.MetricsListen == "" {
-		return
+		return nil
 	}
 
 	mux := http.NewServeMux()
@@ -133,14 +192,34 @@ func (s *Server) StartMetricsServer() {
 		}
 		w.Header().Set("Content-Type", "application/json")
 		if err := json.NewEncoder(w).Encode(s.MetricsSnapshot()); err != nil {
-			logger.Error.Println("metrics, encode error", err)
+			logger.Server.Error("metrics, encode error", logger.ERR, err)
 		}
 	})
 
+	mux.HandleFunc("/debug/traffic", common.TrafficHandler(s.Traffic))
+
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", common.PROMETHEUS_CONTENT_TYPE)
+		if _, err := s.PrometheusMetrics().WriteTo(w); err != nil {
+			logger.Server.Error("metrics, write error", logger.ERR, err)
+		}
+	})
+
+	listener, err := net.Listen("tcp", s.MetricsListen)
+	if err != nil {
+		return err
+	}
+	s.MetricsServer = &http.Server{Handler: mux}
+	metricsServer := s.MetricsServer
 	go func() {
-		logger.Info.Println("Metrics listening at http://" + s.MetricsListen + "/debug/metrics")
-		if err := http.ListenAndServe(s.MetricsListen, mux); err != nil && err != http.ErrServerClosed {
-			logger.Error.Println("metrics, listen error", err)
+		logger.Server.Info("Metrics listening at http://" + listener.Addr().String() + "/debug/metrics, /debug/traffic and /metrics")
+		if err := metricsServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.Server.Error("metrics, listen error", logger.ERR, err)
 		}
 	}()
+	return nil
 }
@@ -1,13 +1,15 @@
 package server
 
 import (
+	"regexp"
+	"strings"
 	"testing"
 
 	"github.com/observerss/detour2/common"
 )
 
 func TestServerMetricsSnapshot(t *testing.T) {
-	server := NewServer(&common.ServerConfig{
+	server := newServer(t, &common.ServerConfig{
 		Listen:        "tcp://127.0.0.1:3811",
 		Remotes:       "ws://127.0.0.1:3812/ws,ws://127.0.0.1:3813/ws",
 		Password:      "pass123",
@@ -46,3 +48,48 @@ func TestServerMetricsSnapshot(t *testing.T) {
 		t.Fatalf("unexpected DNS servers: %+v", snapshot.DNSServers)
 	}
 }
+
+func TestServerPrometheusMetrics(t *testing.T) {
+	server := newServer(t, &common.ServerConfig{
+		Listen:        "tcp://127.0.0.1:3811",
+		Remotes:       "ws://127.0.0.1:3812/ws",
+		Password:      "pass123",
+		RelayPoolSize: 1,
+	})
+	server.Metrics.MessagesInTotal.Add(7)
+
+	var out strings.Builder
+	if _, err := server.PrometheusMetrics().WriteTo(&out); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`detour_info{role="relay"} 1`,
+		"detour_messages_in_total 7",
+		`detour_pool_websockets{pool="relay"} 1`,
+		`detour_websocket_connected{pool="relay",remote="ws://127.0.0.1:3812/ws",key="ws://127.0.0.1:3812/ws#0"} 0`,
+		"detour_server_writer_queue_messages 0",
+		`detour_writer_queue_messages{pool="relay",remote="ws://127.0.0.1:3812/ws",key="ws://127.0.0.1:3812/ws#0"} 0`,
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, out.String())
+		}
+	}
+	// a family keeps one set of label names, as Prometheus expects
+	labelNames := map[string]string{}
+	for _, line := range strings.Split(out.String(), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		sample, _, _ := strings.Cut(line, " ")
+		name, labels, _ := strings.Cut(sample, "{")
+		names := regexp.MustCompile(`(\w+)="`).FindAllStringSubmatch(labels, -1)
+		keys := []string{}
+		for _, match := range names {
+			keys = append(keys, match[1])
+		}
+		if seen, ok := labelNames[name]; ok && seen != strings.Join(keys, ",") {
+			t.Errorf("%s has labels %q and %q", name, seen, strings.Join(keys, ","))
+		}
+		labelNames[name] = strings.Join(keys, ",")
+	}
+}
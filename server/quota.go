@@ -0,0 +1,216 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/observerss/detour2/common"
+)
+
+const (
+	QUOTA_STREAMS   = "streams"
+	QUOTA_WEBSOCKET = "websocket"
+	QUOTA_USER      = "user"
+	QUOTA_RATE      = "connect_rate"
+)
+
+// Quota counts the open streams of a server globally, per websocket and per
+// user, and the rate of CONNECTs. A nil Quota admits everything.
+type Quota struct {
+	lock     sync.Mutex
+	conf     common.QuotaConfig
+	streams  int
+	byWS     map[*common.FairMessageWriter]int // writer of a websocket => streams, not the wid a client picks
+	byUser   map[string]int
+	tokens   float64 // CONNECTs that may still pass this second
+	last     time.Time
+	rejected map[string]int64 // limit => CONNECTs refused
+}
+
+func NewQuota(conf common.QuotaConfig) *Quota {
+	return &Quota{conf: conf, byWS: map[*common.FairMessageWriter]int{}, byUser: map[string]int{}, rejected: map[string]int64{}}
+}
+
+// SetConfig swaps the limits, streams over a lowered limit are kept.
+func (q *Quota) SetConfig(conf common.QuotaConfig) {
+	q.lock.Lock()
+	q.conf = conf
+	q.lock.Unlock()
+}
+
+// Acquire admits a new stream of user arriving on the websocket of ws, or
+// returns the reason it is refused. The slot must be released when the
+// stream ends.
+func (q *Quota) Acquire(ws *common.FairMessageWriter, user string) (*QuotaSlot, string) {
+	if q == nil {
+		return nil, ""
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	limit, reason := "", ""
+	switch {
+	case q.conf.MaxStreams > 0 && q.streams >= q.conf.MaxStreams:
+		limit, reason = QUOTA_STREAMS, "too many streams on the server"
+	case q.conf.MaxStreamsPerWebsocket > 0 && q.byWS[ws] >= q.conf.MaxStreamsPerWebsocket:
+		limit, reason = QUOTA_WEBSOCKET, "too many streams on this websocket"
+	case user != "" && q.conf.MaxStreamsPerUser > 0 && q.byUser[user] >= q.conf.MaxStreamsPerUser:
+		limit, reason = QUOTA_USER, "too many streams of user "+user
+	case !q.takeConnect(time.Now()):
+		limit, reason = QUOTA_RATE, "connect rate exceeded"
+	}
+	if limit != "" {
+		q.rejected[limit]++
+		return nil, reason
+	}
+	q.streams++
+	q.byWS[ws]++
+	if user != "" {
+		q.byUser[user]++
+	}
+	return &QuotaSlot{quota: q, ws: ws, user: user}, ""
+}
+
+// takeConnect is a token bucket holding one second of ConnectRate.
+func (q *Quota) takeConnect(now time.Time) bool {
+	rate := q.conf.ConnectRate
+	if rate <= 0 {
+		q.last = time.Time{}
+		return true
+	}
+	burst := max(rate, 1)
+	if q.last.IsZero() {
+		q.tokens = burst
+	} else {
+		q.tokens = min(burst, q.tokens+now.Sub(q.last).Seconds()*rate)
+	}
+	q.last = now
+	if q.tokens < 1 {
+		return false
+	}
+	q.tokens--
+	return true
+}
+
+func (q *Quota) release(slot *QuotaSlot) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.streams--
+	if q.byWS[slot.ws]--; q.byWS[slot.ws] <= 0 {
+		delete(q.byWS, slot.ws)
+	}
+	if slot.user != "" {
+		if q.byUser[slot.user]--; q.byUser[slot.user] <= 0 {
+			delete(q.byUser, slot.user)
+		}
+	}
+}
+
+// QuotaSlot is one admitted stream, a nil slot releases nothing.
+type QuotaSlot struct {
+	quota *Quota
+	ws    *common.FairMessageWriter
+	user  string
+	once  sync.Once
+}
+
+// Release frees the slot, only the first call counts.
+func (s *QuotaSlot) Release() {
+	if s == nil {
+		return
+	}
+	s.once.Do(func() { s.quota.release(s) })
+}
+
+type ServerQuotaSnapshot struct {
+	Streams                int              `json:"streams"`
+	MaxStreams             int              `json:"maxStreams"`
+	MaxStreamsPerWebsocket int              `json:"maxStreamsPerWebsocket"`
+	BusiestWebsocket       int              `json:"busiestWebsocket"` // streams of the fullest websocket
+	MaxStreamsPerUser      int              `json:"maxStreamsPerUser"`
+	ByUser                 map[string]int   `json:"byUser,omitempty"`
+	ConnectRate            float64          `json:"connectRate"`
+	Rejected               map[string]int64 `json:"rejected"` // limit => CONNECTs refused
+}
+
+func (q *Quota) Snapshot() ServerQuotaSnapshot {
+	if q == nil {
+		return ServerQuotaSnapshot{}
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	snapshot := ServerQuotaSnapshot{
+		Streams:                q.streams,
+		MaxStreams:             q.conf.MaxStreams,
+		MaxStreamsPerWebsocket: q.conf.MaxStreamsPerWebsocket,
+		MaxStreamsPerUser:      q.conf.MaxStreamsPerUser,
+		ByUser:                 map[string]int{},
+		ConnectRate:            q.conf.ConnectRate,
+		Rejected:               map[string]int64{},
+	}
+	for _, n := range q.byWS {
+		snapshot.BusiestWebsocket = max(snapshot.BusiestWebsocket, n)
+	}
+	for user, n := range q.byUser {
+		snapshot.ByUser[user] = n
+	}
+	for _, limit := range []string{QUOTA_STREAMS, QUOTA_WEBSOCKET, QUOTA_USER, QUOTA_RATE} {
+		snapshot.Rejected[limit] = q.rejected[limit]
+	}
+	return snapshot
+}
+
+// STREAM_USER_TTL is how long the user of a stream is remembered after it
+// was last seen open.
+const STREAM_USER_TTL = 10 * time.Minute
+
+type streamUser struct {
+	user string
+	seen time.Time
+}
+
+// StreamUsers remembers the user of every stream by cid, so a stream that a
+// local reopens with DATA after its websocket dropped keeps its user.
+type StreamUsers struct {
+	lock  sync.Mutex
+	users map[string]streamUser
+}
+
+func NewStreamUsers() *StreamUsers {
+	return &StreamUsers{users: map[string]streamUser{}}
+}
+
+func (u *StreamUsers) Remember(cid string, user string) {
+	if user == "" {
+		return
+	}
+	u.lock.Lock()
+	u.users[cid] = streamUser{user: user, seen: time.Now()}
+	u.lock.Unlock()
+}
+
+func (u *StreamUsers) Forget(cid string) {
+	u.lock.Lock()
+	delete(u.users, cid)
+	u.lock.Unlock()
+}
+
+// Lookup returns the user of cid, "" for streams without one.
+func (u *StreamUsers) Lookup(cid string) string {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.users[cid].user
+}
+
+// Prune forgets the streams not open for STREAM_USER_TTL.
+func (u *StreamUsers) Prune(now time.Time, open func(cid string) bool) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	for cid, entry := range u.users {
+		if open(cid) {
+			entry.seen = now
+			u.users[cid] = entry
+		} else if now.Sub(entry.seen) > STREAM_USER_TTL {
+			delete(u.users, cid)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/observerss/detour2/common"
+)
+
+func TestQuotaLimitsStreams(t *testing.T) {
+	quota := NewQuota(common.QuotaConfig{MaxStreams: 3, MaxStreamsPerWebsocket: 2, MaxStreamsPerUser: 1})
+	w1, w2, w3 := &common.FairMessageWriter{}, &common.FairMessageWriter{}, &common.FairMessageWriter{}
+
+	a, reason := quota.Acquire(w1, "alice")
+	if reason != "" {
+		t.Fatalf("first stream refused: %s", reason)
+	}
+	if _, reason := quota.Acquire(w2, "alice"); reason != "too many streams of user alice" {
+		t.Fatalf("user limit not applied: %q", reason)
+	}
+	if _, reason := quota.Acquire(w1, ""); reason != "" {
+		t.Fatalf("second stream refused: %s", reason)
+	}
+	if _, reason := quota.Acquire(w1, "bob"); reason != "too many streams on this websocket" {
+		t.Fatalf("websocket limit not applied: %q", reason)
+	}
+	if _, reason := quota.Acquire(w2, "bob"); reason != "" {
+		t.Fatalf("third stream refused: %s", reason)
+	}
+	if _, reason := quota.Acquire(w3, ""); reason != "too many streams on the server" {
+		t.Fatalf("server limit not applied: %q", reason)
+	}
+
+	snapshot := quota.Snapshot()
+	if snapshot.Streams != 3 || snapshot.BusiestWebsocket != 2 || snapshot.ByUser["alice"] != 1 || snapshot.ByUser["bob"] != 1 {
+		t.Fatalf("unexpected usage: %+v", snapshot)
+	}
+	if snapshot.Rejected[QUOTA_STREAMS] != 1 || snapshot.Rejected[QUOTA_WEBSOCKET] != 1 || snapshot.Rejected[QUOTA_USER] != 1 {
+		t.Fatalf("unexpected rejections: %+v", snapshot.Rejected)
+	}
+
+	a.Release()
+	a.Release()
+	if _, reason := quota.Acquire(w3, "alice"); reason != "" {
+		t.Fatalf("released slot not reused: %s", reason)
+	}
+	if snapshot := quota.Snapshot(); snapshot.Streams != 3 || snapshot.ByUser["alice"] != 1 {
+		t.Fatalf("unexpected usage after release: %+v", snapshot)
+	}
+}
+
+func TestQuotaConnectRate(t *testing.T) {
+	quota := NewQuota(common.QuotaConfig{ConnectRate: 2})
+	now := time.Now()
+	if !quota.takeConnect(now) || !quota.takeConnect(now) {
+		t.Fatal("burst of one second refused")
+	}
+	if quota.takeConnect(now) {
+		t.Fatal("connect over the rate admitted")
+	}
+	if !quota.takeConnect(now.Add(500 * time.Millisecond)) {
+		t.Fatal("rate did not refill")
+	}
+
+	quota.SetConfig(common.QuotaConfig{})
+	for range 10 {
+		if !quota.takeConnect(now) {
+			t.Fatal("unlimited rate refused a connect")
+		}
+	}
+}
+
+func TestHandleConnectRejectsOverQuota(t *testing.T) {
+	server := newServer(t, &common.ServerConfig{
+		Listen:      "tcp://127.0.0.1:0",
+		Password:    "pass123",
+		QuotaConfig: common.QuotaConfig{MaxStreamsPerWebsocket: 1},
+	})
+	written := make(chan *common.Message, 1)
+	writer := common.NewFairMessageWriter(func(msg *common.Message) error {
+		written <- common.CloneMessage(msg)
+		return nil
+	}, common.DefaultMessageQueueLimit)
+	defer writer.Close()
+	slot, _ := server.Quota.Acquire(writer, "")
+	defer slot.Release()
+
+	// a fresh wid is still the same websocket
+	server.HandleConnect(&Handle{
+		WSWriter: writer,
+		Msg:      &common.Message{Cmd: common.CONNECT, Cid: "cid", Wid: "other", Network: "tcp", Address: "127.0.0.1:1"},
+	})
+	select {
+	case msg := <-written:
+		if msg.Ok || msg.Msg != "too many streams on this websocket" {
+			t.Fatalf("expected quota rejection, got %+v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("connect was not answered")
+	}
+	if quota := server.MetricsSnapshot().Quota; quota.Streams != 1 || quota.Rejected[QUOTA_WEBSOCKET] != 1 {
+		t.Fatalf("unexpected quota snapshot: %+v", quota)
+	}
+}
+
+func TestHandleConnectRejectsUserOverTrafficQuota(t *testing.T) {
+	server := newServer(t, &common.ServerConfig{
+		Listen:      "tcp://127.0.0.1:0",
+		Password:    "pass123",
+		UsageConfig: common.UsageConfig{UserQuota: "1K"},
+	})
+	server.Usage.Add("alice", 1024, 0)
+
+	written := make(chan *common.Message, 1)
+	writer := common.NewFairMessageWriter(func(msg *common.Message) error {
+		written <- common.CloneMessage(msg)
+		return nil
+	}, common.DefaultMessageQueueLimit)
+	defer writer.Close()
+
+	server.HandleConnect(&Handle{
+		WSWriter: writer,
+		Msg: &common.Message{
+			Cmd: common.CONNECT, Cid: "cid", Wid: "wid", Network: "tcp", Address: "127.0.0.1:1",
+			Msg: common.ConnectRequest{User: "alice"}.String(),
+		},
+	})
+	select {
+	case msg := <-written:
+		if msg.Ok || msg.Msg != "traffic quota of user alice exceeded" {
+			t.Fatalf("expected traffic quota rejection, got %+v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("connect was not answered")
+	}
+}
+
+func TestReconnectKeepsUser(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+	server := newServer(t, &common.ServerConfig{
+		Listen:      "tcp://127.0.0.1:0",
+		Password:    "pass123",
+		ACLConfig:   common.ACLConfig{AllowPrivateDestinations: true},
+		UsageConfig: common.UsageConfig{UserQuota: "1K"},
+	})
+	written := make(chan *common.Message, 4)
+	writer := common.NewFairMessageWriter(func(msg *common.Message) error {
+		written <- common.CloneMessage(msg)
+		return nil
+	}, common.DefaultMessageQueueLimit)
+	defer writer.Close()
+	address := target.Addr().String()
+	handle := func(msg string) *Handle {
+		return &Handle{WSWriter: writer, Msg: &common.Message{Cid: "cid", Wid: "wid", Network: "tcp", Address: address, Msg: msg, Data: []byte("x")}}
+	}
+
+	server.HandleConnect(handle(common.ConnectRequest{User: "alice"}.String()))
+	if msg := <-written; !msg.Ok {
+		t.Fatalf("connect refused: %+v", msg)
+	}
+	server.CloseWebsocketConns(nil, writer)
+	server.HandleData(handle(""))
+	value, ok := server.Conns.Load("cid")
+	if !ok {
+		t.Fatal("stream was not reopened")
+	}
+	if conn := value.(*Conn); conn.User != "alice" {
+		t.Fatalf("reopened stream lost its user: %q", conn.User)
+	}
+
+	server.CloseWebsocketConns(nil, writer)
+	server.Usage.Add("alice", 1024, 0)
+	server.HandleData(handle(""))
+	if msg := <-written; msg.Cmd != common.CLOSE {
+		t.Fatalf("stream over the traffic quota reopened: %+v", msg)
+	}
+	if _, ok := server.Conns.Load("cid"); ok {
+		t.Fatal("stream over the traffic quota reopened")
+	}
+}
@@ -2,6 +2,8 @@ package server
 
 import (
 	"errors"
+	"log/slog"
+	"net/http"
 	"sort"
 	"strings"
 	"sync"
@@ -26,46 +28,78 @@ type RelayClient struct {
 	RWLock      sync.RWMutex
 	ConnectLock sync.Mutex
 	Active      int64
+	Retired     atomic.Bool
+	Codec       *common.AtomicCodec // agreed on in the acks of the next relay
+	Offer       []common.Codec      // codecs offered to the next relay
 	Packer      *common.Packer
+	Remote      common.RemoteConfig
 	Server      *Server
+	Log         *slog.Logger
 }
 
 func NewRelayClient(url string, wid string, server *Server) *RelayClient {
+	server.ConfigLock.RLock()
+	defer server.ConfigLock.RUnlock()
 	return &RelayClient{
 		Url:    strings.TrimSpace(url),
 		Wid:    wid,
+		Offer:  server.OfferCodecs,
 		Packer: server.Packer,
+		Remote: server.RemoteOptions.For(url),
 		Server: server,
+		Log:    logger.Relay.With(logger.WID, wid, logger.HOP, strings.TrimSpace(url)),
 	}
 }
 
 func (s *Server) HasNextRelay() bool {
+	s.RelayLock.RLock()
+	defer s.RelayLock.RUnlock()
 	return len(s.RelayClients) > 0
 }
 
+// Relays returns the relay clients currently used for new streams.
+func (s *Server) Relays() []*RelayClient {
+	s.RelayLock.RLock()
+	defer s.RelayLock.RUnlock()
+	relays := make([]*RelayClient, 0, len(s.RelayClients))
+	for _, relay := range s.RelayClients {
+		relays = append(relays, relay)
+	}
+	return relays
+}
+
 func (s *Server) StartRelayClients() {
-	s.RelayStartOnce.Do(func() {
-		for _, relay := range s.RelayClients {
-			go relay.WebsocketPuller()
-		}
-	})
+	s.RelayLock.Lock()
+	defer s.RelayLock.Unlock()
+	if s.RelayStarted {
+		return
+	}
+	s.RelayStarted = true
+	for _, relay := range s.RelayClients {
+		go relay.WebsocketPuller()
+	}
 }
 
 func (s *Server) GetRelayClient() (*RelayClient, error) {
-	s.StartRelayClients()
-	relays := make([]*RelayClient, 0, len(s.RelayClients))
-	for _, relay := range s.RelayClients {
-		relays = append(relays, relay)
+	if s.IsStopped() {
+		return nil, errors.New("server is stopped")
 	}
+	s.StartRelayClients()
+	relays := s.Relays()
 	sort.SliceStable(relays, func(i, j int) bool {
 		return relays[i].ActiveCount() < relays[j].ActiveCount()
 	})
 	for _, relay := range relays {
 		if err := relay.Connect(); err != nil {
-			logger.Error.Println(relay.Wid, "relay, connect error", err)
+			relay.Log.Error("relay, connect error", logger.ERR, err)
 			continue
 		}
 		relay.AddActive(1)
+		if relay.IsRetired() {
+			// removed by a reload meanwhile
+			relay.AddActive(-1)
+			continue
+		}
 		return relay, nil
 	}
 	return nil, errors.New("all relay remotes are not reachable")
@@ -76,7 +110,21 @@ func (relay *RelayClient) ActiveCount() int64 {
 }
 
 func (relay *RelayClient) AddActive(delta int64) {
-	atomic.AddInt64(&relay.Active, delta)
+	if atomic.AddInt64(&relay.Active, delta) <= 0 && delta < 0 && relay.IsRetired() {
+		relay.Close()
+	}
+}
+
+func (relay *RelayClient) IsRetired() bool {
+	return relay.Retired.Load()
+}
+
+// Retire takes the relay out of service, it is closed once its last stream is done.
+func (relay *RelayClient) Retire() {
+	relay.Retired.Store(true)
+	if relay.ActiveCount() <= 0 {
+		relay.Close()
+	}
 }
 
 func (relay *RelayClient) IsConnected() bool {
@@ -98,9 +146,26 @@ func (relay *RelayClient) Connect() error {
 	if relay.IsConnected() {
 		return nil
 	}
+	if relay.Server.IsStopped() {
+		return errors.New("server is stopped")
+	}
+	if relay.IsRetired() && relay.ActiveCount() <= 0 {
+		return errors.New("relay is retired")
+	}
 
-	dialer := websocket.Dialer{HandshakeTimeout: time.Second * DIAL_TIMEOUT}
-	conn, _, err := dialer.Dial(relay.Url, nil)
+	header := http.Header{}
+	common.SetAuthHeader(header, relay.Packer.Password)
+	relay.Remote.SetHeaders(header)
+	// the dialer is built on every dial so a renewed CA bundle is picked up
+	var conn *websocket.Conn
+	start := time.Now()
+	dialer, err := common.NewWebsocketDialer(relay.Remote, time.Second*DIAL_TIMEOUT)
+	if err == nil {
+		conn, _, err = dialer.Dial(relay.Url, header)
+	}
+	if relay.Server != nil && relay.Server.Metrics != nil {
+		relay.Server.Metrics.HandshakeDuration.Since(start)
+	}
 	if err != nil {
 		if relay.Server != nil && relay.Server.Metrics != nil {
 			relay.Server.Metrics.RelayConnectFailures.Inc()
@@ -109,13 +174,15 @@ func (relay *RelayClient) Connect() error {
 		return err
 	}
 
+	codec := &common.AtomicCodec{}
 	relay.WriteLock.Lock()
 	oldWriter := relay.Writer
 	if relay.WSConn != nil {
 		relay.WSConn.Close()
 	}
 	relay.WSConn = conn
-	relay.Writer = relay.NewMessageWriter(conn)
+	relay.Codec = codec
+	relay.Writer = relay.NewMessageWriter(conn, codec)
 	if oldWriter != nil {
 		oldWriter.Close()
 	}
@@ -124,13 +191,24 @@ func (relay *RelayClient) Connect() error {
 	if relay.Server != nil && relay.Server.Metrics != nil {
 		relay.Server.Metrics.WebSocketConnectsTotal.Inc()
 	}
-	logger.Info.Println(relay.Wid, "relay, connected", relay.Url)
+	relay.Log.Info("relay, connected")
 	return nil
 }
 
-func (relay *RelayClient) NewMessageWriter(conn *websocket.Conn) *common.FairMessageWriter {
-	return common.NewFairMessageWriter(func(msg *common.Message) error {
-		data, err := relay.Packer.Pack(msg)
+// AcceptCodec takes the codec the next relay told in an ack, one not offered
+// is none.
+func (relay *RelayClient) AcceptCodec(name string) {
+	relay.WriteLock.Lock()
+	codec := relay.Codec
+	relay.WriteLock.Unlock()
+	if codec != nil {
+		codec.Store(common.NegotiateCodec(name, relay.Offer))
+	}
+}
+
+func (relay *RelayClient) NewMessageWriter(conn *websocket.Conn, codec *common.AtomicCodec) *common.FairMessageWriter {
+	writer := common.NewFairMessageWriter(func(msg *common.Message) error {
+		data, err := relay.Packer.PackWith(msg, codec.Load())
 		if err == nil {
 			err = conn.WriteMessage(websocket.BinaryMessage, data)
 		}
@@ -144,6 +222,10 @@ func (relay *RelayClient) NewMessageWriter(conn *websocket.Conn) *common.FairMes
 		}
 		return err
 	}, common.DefaultMessageQueueLimit)
+	if relay.Server != nil && relay.Server.Metrics != nil {
+		writer.QueueWait = &relay.Server.Metrics.QueueWait
+	}
+	return writer
 }
 
 func (relay *RelayClient) WriteMessage(msg *common.Message) error {
@@ -215,18 +297,50 @@ func (relay *RelayClient) ReadMessage() (*common.Message, error) {
 	}
 }
 
+// Close disconnects the relay websocket, the puller exits once the server is stopped.
+func (relay *RelayClient) Close() {
+	relay.ConnectLock.Lock()
+	defer relay.ConnectLock.Unlock()
+	relay.WriteLock.Lock()
+	writer := relay.Writer
+	conn := relay.WSConn
+	relay.WriteLock.Unlock()
+	if writer != nil {
+		writer.Close()
+	}
+	if conn != nil {
+		conn.Close()
+	}
+	relay.SetConnected(false)
+}
+
 func (relay *RelayClient) WebsocketPuller() {
 	for {
+		if relay.Server.IsStopped() {
+			relay.Log.Debug("relay, server stopped")
+			return
+		}
+		if relay.IsRetired() && (relay.ActiveCount() <= 0 || !relay.IsConnected()) {
+			relay.Log.Debug("relay, retired")
+			relay.Close()
+			return
+		}
 		if !relay.IsConnected() {
 			if err := relay.Connect(); err != nil {
-				time.Sleep(time.Second * RELAY_RECONNECT_INTERVAL)
+				select {
+				case <-time.After(time.Second * RELAY_RECONNECT_INTERVAL):
+				case <-relay.Server.DoneChan():
+				}
 				continue
 			}
 		}
 
 		msg, err := relay.ReadMessage()
 		if err != nil {
-			logger.Error.Println(relay.Wid, "relay, read error", err)
+			if relay.Server.IsStopped() {
+				continue
+			}
+			relay.Log.Error("relay, read error", logger.ERR, err)
 			continue
 		}
 		relay.Server.HandleRelayResponse(relay, msg)
@@ -236,7 +350,7 @@ func (relay *RelayClient) WebsocketPuller() {
 func (s *Server) HandleRelayResponse(relay *RelayClient, msg *common.Message) {
 	value, ok := s.Conns.Load(msg.Cid)
 	if !ok {
-		logger.Debug.Println(msg.Cid, "relay, handler has quit, tell next relay to close")
+		logger.Relay.Debug("relay, handler has quit, tell next relay to close", logger.CID, msg.Cid, logger.WID, relay.Wid)
 		msg.Cmd = common.CLOSE
 		msg.Data = []byte{}
 		msg.Wid = relay.Wid
@@ -246,8 +360,30 @@ func (s *Server) HandleRelayResponse(relay *RelayClient, msg *common.Message) {
 
 	conn := value.(*Conn)
 	msg.Wid = conn.Wid
+	switch {
+	case msg.Cmd == common.DATA:
+		conn.Touch(false, len(msg.Data))
+	case msg.Cmd == common.CONNECT && msg.Ok:
+		// the exit told where it dialed, add this hop to the path; the
+		// codec is the one of the next hop, upstream gets ours instead
+		info := common.ParseConnectInfo(msg.Msg)
+		relay.AcceptCodec(info.Codec)
+		info.Codec = conn.Codec.String()
+		info.Path = append([]string{relay.Url}, info.Path...)
+		info.Elapsed = append([]float64{common.ElapsedMillis(time.Since(conn.OpenedAt))}, info.Elapsed...)
+		conn.Info.Store(&info)
+		msg.Msg = info.String()
+	case msg.Cmd == common.CONNECT:
+		conn.CloseReason.Set(strings.TrimSuffix("refused: "+msg.Msg, ": "))
+	case msg.Cmd == common.CLOSE:
+		conn.CloseReason.Set("remote closed")
+	}
 	if err := s.SendWebosket(conn, msg); err != nil {
-		logger.Debug.Println(msg.Cid, "relay, send upstream error", err)
+		conn.Logger().Debug("relay, send upstream error", logger.ERR, err)
+	}
+	if msg.Cmd == common.CONNECT {
+		conn.Span.Mark("ack")
+		conn.Span.Finish(conn.CloseReason.Get(""))
 	}
 	if msg.Cmd == common.CLOSE || (msg.Cmd == common.CONNECT && !msg.Ok) {
 		conn.ReleaseRelay()
@@ -255,9 +391,12 @@ func (s *Server) HandleRelayResponse(relay *RelayClient, msg *common.Message) {
 	}
 }
 
-func (s *Server) HandleRelayConnect(handle *Handle) {
+func (s *Server) HandleRelayConnect(handle *Handle, slot *QuotaSlot) {
 	msg := handle.Msg
 	cid := msg.Cid
+	req := common.ParseConnectRequest(msg.Msg)
+	parent, _ := common.ParseTraceParent(req.TraceParent)
+	span := s.Tracer.Start(parent, common.HOP_RELAY, cid, msg.Address)
 	conn := Conn{
 		Cid:      cid,
 		Wid:      msg.Wid,
@@ -266,30 +405,50 @@ func (s *Server) HandleRelayConnect(handle *Handle) {
 		WSConn:   handle.WSConn,
 		WSLock:   handle.WSLock,
 		WSWriter: handle.WSWriter,
+		Client:   handle.Remote,
+		User:     req.User,
+		OpenedAt: time.Now(),
+		Codec:    s.AgreeCodec(handle, req.Compress),
+		Span:     span,
+		Slot:     slot,
+		Log:      userLogger(connLogger(logger.Relay, msg), req.User).With(logger.TRACE, span.Context().TraceID),
 	}
 
-	logger.Debug.Println(cid, "relay, open next connection", msg.Network, msg.Address)
+	conn.Log.Debug("relay, open next connection", "network", msg.Network)
 	relay, err := s.GetRelayClient()
+	span.Mark("relay")
 	if err != nil {
 		msg.Ok = false
 		msg.Msg = err.Error()
 		s.SendWebosket(&conn, msg)
+		slot.Release()
+		conn.CloseReason.Set("no relay: " + err.Error())
+		span.Finish(conn.CloseReason.Get(""))
+		s.WriteAccess(&conn, "relay")
 		return
 	}
 
 	conn.Relay = relay
+	conn.Log = conn.Log.With(logger.HOP, relay.Url)
+	span.SetNext(relay.Url)
+	conn.StartedAt = time.Now()
+	conn.LastActive.Store(conn.StartedAt.UnixNano())
 	s.Conns.Store(cid, &conn)
 	forwarded := *msg
 	forwarded.Wid = relay.Wid
-	if err := relay.WriteMessage(&forwarded); err != nil {
+	forwarded.Msg = common.ConnectRequest{TraceParent: span.Context().TraceParent(), User: req.User, Compress: common.FormatCodecs(relay.Offer)}.String()
+	err = relay.WriteMessage(&forwarded)
+	span.Mark("forward")
+	if err != nil {
 		s.Conns.Delete(cid)
+		conn.CloseReason.Set("relay write error")
 		conn.ReleaseRelay()
 		msg.Ok = false
 		msg.Msg = err.Error()
 		s.SendWebosket(&conn, msg)
 		return
 	}
-	logger.Debug.Println(cid, "relay, connect forwarded")
+	conn.Log.Debug("relay, connect forwarded")
 }
 
 func (s *Server) HandleRelayData(handle *Handle) {
@@ -305,14 +464,14 @@ func (s *Server) HandleRelayData(handle *Handle) {
 
 	value, ok := s.Conns.Load(cid)
 	if !ok {
-		logger.Debug.Println("relay data,", cid, "not found")
+		connLogger(logger.Relay, msg).Debug("relay data, not found")
 		s.SendWebosket(&Conn{Cid: cid, Wid: msg.Wid, Network: msg.Network, Address: msg.Address, WSConn: handle.WSConn, WSLock: handle.WSLock, WSWriter: handle.WSWriter}, cmsg)
 		return
 	}
 
 	conn := value.(*Conn)
 	if conn.Relay == nil {
-		logger.Debug.Println(cid, "relay data, next relay missing")
+		conn.Logger().Debug("relay data, next relay missing")
 		s.Conns.Delete(cid)
 		s.SendWebosket(conn, cmsg)
 		return
@@ -320,8 +479,10 @@ func (s *Server) HandleRelayData(handle *Handle) {
 
 	forwarded := *msg
 	forwarded.Wid = conn.Relay.Wid
+	conn.Touch(true, len(msg.Data))
 	if err := conn.Relay.WriteMessage(&forwarded); err != nil {
-		logger.Debug.Println(cid, "relay data, write error", err)
+		conn.Logger().Debug("relay data, write error", logger.ERR, err)
+		conn.CloseReason.Set("relay write error")
 		conn.ReleaseRelay()
 		s.Conns.Delete(cid)
 		s.SendWebosket(conn, cmsg)
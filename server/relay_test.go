@@ -1,6 +1,8 @@
 package server
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"sync"
 	"testing"
 
@@ -45,3 +47,37 @@ func TestHandleSwitchUpdatesRelayConnUpstream(t *testing.T) {
 		t.Fatal("relay client should be preserved")
 	}
 }
+
+func TestRelayClientFrontsNextRelay(t *testing.T) {
+	next := newServer(t, &common.ServerConfig{Listen: "tcp://127.0.0.1:0", Password: "pass123"})
+	seen := make(chan *http.Request, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen <- r
+		next.Handler().ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	url := "ws://relay.invalid/ws"
+	server := newServer(t, &common.ServerConfig{
+		Listen:   "tcp://127.0.0.1:0",
+		Password: "pass123",
+		RemoteOptions: common.RemoteOptions{url: {
+			Address:     ts.Listener.Addr().String(),
+			Host:        "relay.example.com",
+			Headers:     map[string]string{"User-Agent": "Mozilla/5.0", "Cookie": "gw=token"},
+			Subprotocol: "chat",
+		}},
+	})
+	relay := NewRelayClient(url, "relay-wid", server)
+	if err := relay.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer relay.WSConn.Close()
+	r := <-seen
+	if r.Host != "relay.example.com" || r.UserAgent() != "Mozilla/5.0" || r.Header.Get("Cookie") != "gw=token" {
+		t.Fatalf("unexpected handshake: host %q header %v", r.Host, r.Header)
+	}
+	if protocol := relay.WSConn.Subprotocol(); protocol != "chat" {
+		t.Fatalf("subprotocol %q not accepted", protocol)
+	}
+}
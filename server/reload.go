@@ -0,0 +1,144 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/observerss/detour2/common"
+	"github.com/observerss/detour2/logger"
+)
+
+// Reload applies next relays, pool size, DNS servers, destination ACL, rate
+// limits, stream and traffic quotas, websocket path, decoy, ban rules, TLS
+// cert and key files, password, compression and next relay dial options from
+// sconf without dropping live streams. New websockets and dials use the new settings while
+// existing ones finish on the old, rate limits apply to live streams at once.
+// Relay clients that are gone are retired and closed after their last stream.
+// Listen, metrics and pprof need a restart.
+func (s *Server) Reload(sconf *common.ServerConfig) (err error) {
+	defer func() {
+		s.Metrics.RecordReload(err)
+		if err != nil {
+			logger.Server.Error("reload, failed", logger.ERR, err)
+		}
+	}()
+
+	// everything is checked and loaded before the first change, so a failed
+	// reload leaves the running config whole
+	if err := sconf.Validate(); err != nil {
+		return err
+	}
+	accept, offer := common.SupportedCodecs, []common.Codec(nil)
+	if strings.TrimSpace(sconf.Compress) != "" {
+		codecs, err := common.ParseCodecs(sconf.Compress)
+		if err != nil {
+			return err
+		}
+		accept, offer = codecs, codecs
+	}
+	acl, err := common.NewACL(sconf.ACLConfig)
+	if err != nil {
+		return err
+	}
+	decoy, err := NewDecoy(sconf.DecoyConfig)
+	if err != nil {
+		return err
+	}
+	tlsConf := sconf.TLSConfig
+	var certs *certPair
+	if s.Certs != nil && tlsConf.Enabled() && !tlsConf.TLSSelfSigned {
+		certFile, keyFile := s.Certs.Files()
+		if strings.TrimSpace(tlsConf.TLSCert) != certFile || strings.TrimSpace(tlsConf.TLSKey) != keyFile {
+			if certs, err = loadCertPair(tlsConf.TLSCert, tlsConf.TLSKey); err != nil {
+				return fmt.Errorf("tlsCert: %w", err)
+			}
+		}
+		tlsConf.TLSCert, tlsConf.TLSKey = s.TLSConf.TLSCert, s.TLSConf.TLSKey
+	}
+
+	// validated above, so neither can fail halfway
+	if err := s.BanList.Update(sconf.BanConfig); err != nil {
+		return err
+	}
+	if err := s.Throttle.Update(sconf.RateLimitConfig); err != nil {
+		return err
+	}
+	if certs != nil {
+		s.Certs.use(certs)
+	}
+	s.Usage.Update(sconf.UsageConfig)
+	if strings.TrimSpace(sconf.BanFile) != s.BanList.Path {
+		logger.Server.Warn("reload, ban file change needs a restart", "banFile", sconf.BanFile)
+	}
+	if tlsConf != s.TLSConf {
+		logger.Server.Warn("reload, tls change needs a restart", "tlsSelfSigned", sconf.TLSSelfSigned, "tlsClientCA", sconf.TLSClientCA)
+	}
+	if strings.TrimSpace(sconf.UsageFile) != s.Usage.Path {
+		logger.Server.Warn("reload, usage file change needs a restart", "usageFile", sconf.UsageFile)
+	}
+	if address, ok := strings.CutPrefix(sconf.Listen, "tcp://"); ok && address != s.Address {
+		logger.Server.Warn("reload, listen change needs a restart", "listen", sconf.Listen)
+	}
+	if strings.TrimSpace(sconf.MetricsListen) != s.MetricsListen {
+		logger.Server.Warn("reload, metrics listen change needs a restart", "metricsListen", sconf.MetricsListen)
+	}
+	if strings.TrimSpace(sconf.AdminListen) != s.AdminListen || sconf.AdminToken != s.AdminToken {
+		logger.Server.Warn("reload, admin change needs a restart", "adminListen", sconf.AdminListen)
+	}
+	if strings.TrimSpace(sconf.TrafficLog) != s.Traffic.Log {
+		logger.Server.Warn("reload, traffic log change needs a restart", "trafficLog", sconf.TrafficLog)
+	}
+	if strings.TrimSpace(sconf.TraceEndpoint) != s.Tracer.Endpoint {
+		logger.Server.Warn("reload, trace endpoint change needs a restart", "traceEndpoint", sconf.TraceEndpoint)
+	}
+	if strings.TrimSpace(sconf.AccessLog) != s.Access.Path() {
+		logger.Server.Warn("reload, access log change needs a restart", "accessLog", sconf.AccessLog)
+	}
+	if sconf.Pprof != s.Pprof {
+		logger.Server.Warn("reload, pprof change needs a restart")
+	}
+
+	s.ConfigLock.Lock()
+	if s.Packer.Password != sconf.Password || s.Packer.CompressThreshold != sconf.CompressThreshold {
+		s.Packer = &common.Packer{Password: sconf.Password, CompressThreshold: sconf.CompressThreshold, Metrics: s.Metrics}
+	}
+	s.DNSServers = ParseDNSServers(sconf.DNSServers)
+	s.ACL = acl
+	s.Quota.SetConfig(sconf.QuotaConfig)
+	s.WSPath = wsPath(sconf.DecoyConfig)
+	s.Decoy = decoy
+	s.AcceptCodecs = accept
+	s.OfferCodecs = offer
+	s.RemoteOptions = sconf.RemoteOptions
+	packer := s.Packer
+	s.ConfigLock.Unlock()
+
+	s.RelayLock.Lock()
+	defer s.RelayLock.Unlock()
+	relays := map[string]*RelayClient{}
+	added := 0
+	for key, url := range common.PoolKeys(sconf.Remotes, sconf.RelayPoolSize) {
+		if relay, ok := s.RelayClients[key]; ok && relay.Packer == packer && common.FormatCodecs(relay.Offer) == common.FormatCodecs(offer) &&
+			relay.Remote.Equal(sconf.RemoteOptions.For(url)) {
+			relays[key] = relay
+			continue
+		}
+		wid, _ := common.GenerateRandomStringURLSafe(3)
+		relay := NewRelayClient(url, wid, s)
+		relays[key] = relay
+		added++
+		if s.RelayStarted {
+			go relay.WebsocketPuller()
+		}
+	}
+	retired := 0
+	for key, relay := range s.RelayClients {
+		if relays[key] != relay {
+			relay.Retire()
+			retired++
+		}
+	}
+	s.RelayClients = relays
+	logger.Server.Info("reload, ok", "added", added, "retired", retired, "total", len(relays))
+	return nil
+}
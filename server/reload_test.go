@@ -0,0 +1,68 @@
+package server
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/observerss/detour2/common"
+)
+
+func TestReloadDiffsRelayClients(t *testing.T) {
+	server := newServer(t, &common.ServerConfig{
+		Listen:        "tcp://127.0.0.1:3811",
+		Remotes:       "ws://127.0.0.1:3812/ws,ws://127.0.0.1:3813/ws",
+		Password:      "pass123",
+		RelayPoolSize: 2,
+	})
+	kept := server.RelayClients["ws://127.0.0.1:3812/ws#0"]
+	removed := server.RelayClients["ws://127.0.0.1:3813/ws#0"]
+	busy := server.RelayClients["ws://127.0.0.1:3812/ws#1"]
+	busy.AddActive(1)
+
+	err := server.Reload(&common.ServerConfig{
+		Listen:        "tcp://127.0.0.1:3811",
+		Remotes:       "ws://127.0.0.1:3812/ws,ws://127.0.0.1:3814/ws",
+		Password:      "pass123",
+		RelayPoolSize: 1,
+		DNSServers:    "8.8.8.8",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(server.RelayClients) != 2 || server.RelayClients["ws://127.0.0.1:3812/ws#0"] != kept || server.RelayClients["ws://127.0.0.1:3814/ws#0"] == nil {
+		t.Fatalf("unexpected relay clients after reload: %v", server.RelayClients)
+	}
+	if kept.IsRetired() || !removed.IsRetired() || !busy.IsRetired() {
+		t.Fatal("relay clients were not retired as expected")
+	}
+	if len(server.DNSServers) != 1 || server.DNSServers[0] != "8.8.8.8:53" {
+		t.Fatalf("unexpected dns servers: %v", server.DNSServers)
+	}
+
+	if err := server.Reload(&common.ServerConfig{Password: "pass123", Compress: "lz4"}); err == nil {
+		t.Fatal("expected invalid compression to fail the reload")
+	}
+	snapshot := server.Metrics.Snapshot()
+	if snapshot.ConfigReloadsTotal != 2 || snapshot.ConfigReloadFailures != 1 || snapshot.LastReloadError == "" {
+		t.Fatalf("unexpected reload metrics: %+v", snapshot)
+	}
+	if len(server.RelayClients) != 2 {
+		t.Fatal("failed reload changed the relay clients")
+	}
+}
+
+func TestFailedReloadChangesNothing(t *testing.T) {
+	conf := common.ServerConfig{Listen: "tcp://127.0.0.1:3811", Password: "pass123"}
+	server := newServer(t, &conf)
+
+	next := conf
+	next.BanThreshold = 1
+	next.StreamRateLimit = "fast"
+	if err := server.Reload(&next); err == nil {
+		t.Fatal("expected an invalid rate limit to fail the reload")
+	}
+	if duration := server.BanList.Fail(netip.MustParseAddr("192.0.2.1")); duration != 0 {
+		t.Fatalf("ban rules of the failed reload are live: banned for %v", duration)
+	}
+}
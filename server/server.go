@@ -1,22 +1,23 @@
 package server
 
 import (
-	"context"
+	"cmp"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net"
 	"net/http"
-	"os"
-	"os/signal"
+	"net/netip"
 	"strings"
 	"sync"
-	"syscall"
+	"sync/atomic"
 	"time"
 
 	"github.com/observerss/detour2/common"
 	"github.com/observerss/detour2/logger"
 
-	_ "net/http/pprof"
-
 	"github.com/gorilla/websocket"
 )
 
@@ -24,36 +25,118 @@ const (
 	BUFFER_SIZE         = 64 * 1024
 	TARGET_IDLE_TIMEOUT = 10 * time.Minute
 	DIAL_TIMEOUT        = 3
+	// UPLOAD_QUEUE_LIMIT is how many DATA of a stream may wait for its
+	// target, reading the websocket waits while one stream is over it.
+	UPLOAD_QUEUE_LIMIT = common.DefaultMessageQueueLimit
 )
 
 var upgrader = websocket.Upgrader{}
 
 type Server struct {
-	Address        string
-	Packer         *common.Packer
-	Conns          sync.Map       // Cid => Conn
-	WSCounter      map[string]int // Wid => num of NetConns
-	WSCounterLock  sync.Mutex
-	RelayClients   map[string]*RelayClient
-	RelayStartOnce sync.Once
-	DNSServers     []string
-	DNSCounter     uint64
-	Metrics        *common.RuntimeMetrics
-	MetricsListen  string
+	Address       string
+	Packer        *common.Packer
+	Conns         sync.Map       // Cid => Conn
+	WSCounter     map[string]int // Wid => num of NetConns
+	WSCounterLock sync.Mutex
+	ConfigLock    sync.RWMutex // guards Packer, DNSServers, ACL, codecs and RemoteOptions on reload
+	RelayClients  map[string]*RelayClient
+	RelayLock     sync.RWMutex
+	RelayStarted  bool
+	DNSServers    []string
+	DNSCounter    uint64
+	ACL           *common.ACL // destinations the exit may dial
+	Throttle      *common.Throttle
+	Quota         *Quota
+	StreamUsers   *StreamUsers        // user of every stream, kept for reconnects
+	Usage         *common.UsageLedger // traffic of users in the billing cycle
+	WSPath        string
+	Decoy         http.Handler        // answers everyone but authenticated upgrades, nil serves the index
+	Auth          common.AuthVerifier // checks the AUTH_HEADER of upgrades when there is a decoy
+	BanList       *common.BanList     // client IPs failing authentication
+	TLS           *tls.Config         // of the listener, nil serves plain http
+	TLSConf       common.TLSConfig
+	Certs         *CertReloader // loads tlsCert and tlsKey again when they change
+	Metrics       *common.RuntimeMetrics
+	MetricsListen string
+	AcceptCodecs  []common.Codec       // codecs accepted from upstream peers
+	OfferCodecs   []common.Codec       // codecs offered to next relays
+	RemoteOptions common.RemoteOptions // how next relays are dialed
+	Pprof         bool
+	Listener      net.Listener
+	HTTPServer    *http.Server
+	MetricsServer *http.Server
+	AdminListen   string
+	AdminToken    string
+	AdminServer   *http.Server
+	Traffic       *common.TrafficTable
+	Access        *common.AccessLog
+	Tracer        *common.Tracer
+	ServeErr      chan error
+	Websockets    sync.Map // *websocket.Conn => struct{}
+	HandlerWG     sync.WaitGroup
+	HandlerLock   sync.Mutex // orders HandlerWG.Add against closing Done
+	Done          chan struct{}
+	StopOnce      sync.Once
 }
 
 type Conn struct {
-	Wid         string // wsid
-	Cid         string // connid
-	Network     string
-	Address     string
-	WSConn      *websocket.Conn
-	NetConn     net.Conn
-	WSLock      *sync.Mutex
-	WSWriter    *common.FairMessageWriter
-	TransportMu sync.RWMutex
-	Relay       *RelayClient
-	ReleaseOnce sync.Once
+	Wid           string // wsid
+	Cid           string // connid
+	Network       string
+	Address       string
+	WSConn        *websocket.Conn
+	NetConn       net.Conn
+	WSLock        *sync.Mutex
+	WSWriter      *common.FairMessageWriter
+	TransportMu   sync.RWMutex
+	Relay         *RelayClient
+	ReleaseOnce   sync.Once
+	Client        string    // address of the upstream peer
+	User          string    // user the local authenticated, if any
+	OpenedAt      time.Time // when the CONNECT arrived
+	StartedAt     time.Time
+	LastActive    atomic.Int64 // unix nanos of the last data either way
+	BytesUp       common.Counter
+	BytesDown     common.Counter
+	TrafficCursor common.TrafficCursor
+	Info          atomic.Pointer[common.ConnectInfo] // sent back with the CONNECT ack
+	Codec         common.Codec                       // agreed on in the CONNECT, sent back in the ack
+	Throttle      *common.StreamThrottle             // paces the target side of the exit
+	Uploads       chan []byte                        // DATA for the target of an exit stream, nil closes it
+	Done          chan struct{}                      // closed when RunLoop ends
+	Slot          *QuotaSlot                         // released when the stream ends
+	CloseReason   common.CloseReason
+	Span          *common.ActiveSpan // the CONNECT of a relayed stream until its ack
+	Log           *slog.Logger       // cid, wid, target, trace and hop fields
+}
+
+// Logger returns the logger carrying the fields of the stream.
+func (c *Conn) Logger() *slog.Logger {
+	if c.Log == nil {
+		return connLogger(logger.Server, &common.Message{Cid: c.Cid, Wid: c.Wid, Address: c.Address})
+	}
+	return c.Log
+}
+
+func connLogger(log *slog.Logger, msg *common.Message) *slog.Logger {
+	return log.With(logger.CID, msg.Cid, logger.WID, msg.Wid, logger.TARGET, msg.Address)
+}
+
+func userLogger(log *slog.Logger, user string) *slog.Logger {
+	if user == "" {
+		return log
+	}
+	return log.With(logger.USER, user)
+}
+
+// Touch records n bytes of data, up is towards the target.
+func (c *Conn) Touch(up bool, n int) {
+	if up {
+		c.BytesUp.Add(int64(n))
+	} else {
+		c.BytesDown.Add(int64(n))
+	}
+	c.LastActive.Store(time.Now().UnixNano())
 }
 
 func (c *Conn) Transport() (*websocket.Conn, *common.FairMessageWriter) {
@@ -74,83 +157,101 @@ func (c *Conn) SetTransport(wsconn *websocket.Conn, wslock *sync.Mutex, writer *
 
 func (c *Conn) ReleaseRelay() {
 	c.ReleaseOnce.Do(func() {
+		c.Slot.Release()
+		c.Span.Finish(c.CloseReason.Get("released before ack"))
 		if c.Relay != nil {
 			c.Relay.AddActive(-1)
+			c.Relay.Server.AccountTraffic(c, true)
+			c.Relay.Server.WriteAccess(c, "relay")
 		}
 	})
 }
 
 type Handle struct {
+	Remote   string // address of the upstream peer
 	WSLock   *sync.Mutex
 	WSConn   *websocket.Conn
 	Msg      *common.Message
 	WSWriter *common.FairMessageWriter
+	Codec    *common.AtomicCodec // of the websocket, agreed on in CONNECTs
 }
 
-func NewServer(sconf *common.ServerConfig) *Server {
+// NewServer builds a server from sconf, an invalid setting returns an error
+// naming every one that failed.
+func NewServer(sconf *common.ServerConfig) (*Server, error) {
 	vals := strings.Split(sconf.Listen, "://")
+	metrics := common.NewRuntimeMetrics()
 	server := &Server{
 		Address:       vals[1],
-		Packer:        &common.Packer{Password: sconf.Password},
+		Packer:        &common.Packer{Password: sconf.Password, CompressThreshold: sconf.CompressThreshold, Metrics: metrics},
 		WSCounter:     make(map[string]int),
 		RelayClients:  make(map[string]*RelayClient),
 		DNSServers:    ParseDNSServers(sconf.DNSServers),
-		Metrics:       common.NewRuntimeMetrics(),
+		Metrics:       metrics,
 		MetricsListen: strings.TrimSpace(sconf.MetricsListen),
+		AdminListen:   strings.TrimSpace(sconf.AdminListen),
+		AdminToken:    sconf.AdminToken,
+		Traffic:       common.NewTrafficTable(strings.TrimSpace(sconf.TrafficLog)),
+		Tracer:        common.NewTracer("detour2-server", sconf.TraceEndpoint, logger.Server),
+		AcceptCodecs:  common.SupportedCodecs,
+		RemoteOptions: sconf.RemoteOptions,
+		Pprof:         sconf.Pprof,
+		ServeErr:      make(chan error, 1),
+		Done:          make(chan struct{}),
 	}
-	relayPoolSize := sconf.RelayPoolSize
-	if relayPoolSize < 1 {
-		relayPoolSize = 1
-	}
-	for _, url := range strings.Split(sconf.Remotes, ",") {
-		url = strings.TrimSpace(url)
-		if url == "" {
-			continue
-		}
-		for i := 0; i < relayPoolSize; i++ {
-			wid, _ := common.GenerateRandomStringURLSafe(3)
-			server.RelayClients[fmt.Sprintf("%s#%d", url, i)] = NewRelayClient(url, wid, server)
+	errs := []error{}
+	var err error
+	if strings.TrimSpace(sconf.Compress) != "" {
+		codecs, err := common.ParseCodecs(sconf.Compress)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("compress: %w", err))
 		}
+		server.AcceptCodecs = codecs
+		server.OfferCodecs = codecs
 	}
-	return server
-}
-
-func (s *Server) RunServer() {
-	s.StartRelayClients()
-	s.StartMetricsServer()
-	http.HandleFunc("/ws", s.HandleWebsocket)
-	http.HandleFunc("/", s.HandleIndex)
-
-	logger.Info.Printf("Listening at http://%s", s.Address)
-
-	httpServer := &http.Server{
-		Addr: s.Address,
+	if server.Access, err = common.NewAccessLog(sconf.AccessLogConfig); err != nil {
+		errs = append(errs, fmt.Errorf("access log: %w", err))
 	}
-
-	// graceful shutdown
-	quit := make(chan struct{})
-	go func() {
-		sigch := make(chan os.Signal, 1)
-		signal.Notify(sigch, syscall.SIGINT, syscall.SIGTERM)
-		<-sigch
-		if err := httpServer.Shutdown(context.Background()); err != nil {
-			logger.Info.Printf("HTTP Server Shutdown Error: %v", err)
-		}
-		close(quit)
-	}()
-
-	// listen and block
-	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
-		logger.Error.Fatalf("HTTP server ListenAndServe Error: %v", err)
+	if server.ACL, err = common.NewACL(sconf.ACLConfig); err != nil {
+		errs = append(errs, fmt.Errorf("acl: %w", err))
 	}
-
-	<-quit
-
-	logger.Debug.Printf("Bye bye")
+	if server.Throttle, err = common.NewThrottle(sconf.RateLimitConfig, metrics); err != nil {
+		errs = append(errs, fmt.Errorf("ratelimit: %w", err))
+	}
+	server.Quota = NewQuota(sconf.QuotaConfig)
+	server.StreamUsers = NewStreamUsers()
+	if server.Usage, err = common.NewUsageLedger(sconf.UsageConfig); err != nil {
+		errs = append(errs, fmt.Errorf("usage: %w", err))
+	}
+	if server.Decoy, err = NewDecoy(sconf.DecoyConfig); err != nil {
+		errs = append(errs, fmt.Errorf("decoy: %w", err))
+	}
+	server.WSPath = wsPath(sconf.DecoyConfig)
+	if server.BanList, err = common.NewBanList(sconf.BanConfig); err != nil {
+		errs = append(errs, fmt.Errorf("ban: %w", err))
+	}
+	if server.TLS, server.Certs, err = NewTLSConfig(sconf.TLSConfig, server.Address); err != nil {
+		errs = append(errs, fmt.Errorf("tls: %w", err))
+	}
+	server.TLSConf = sconf.TLSConfig
+	if err := errors.Join(errs...); err != nil {
+		server.Access.Close()
+		server.Tracer.Close()
+		return nil, err
+	}
+	for key, url := range common.PoolKeys(sconf.Remotes, sconf.RelayPoolSize) {
+		wid, _ := common.GenerateRandomStringURLSafe(3)
+		server.RelayClients[key] = NewRelayClient(url, wid, server)
+	}
+	return server, nil
 }
 
 func (s *Server) HandleIndex(w http.ResponseWriter, r *http.Request) {
-	logger.Debug.Printf("HTTP %s %s%s\n", r.Method, r.Host, r.URL)
+	logger.Server.Debug("http, index", "method", r.Method, "host", r.Host, "url", r.URL.String())
+	if decoy := s.decoy(); decoy != nil {
+		decoy.ServeHTTP(w, r)
+		return
+	}
 
 	if r.URL.Path != "/" {
 		http.Error(w, "Not Found", http.StatusNotFound)
@@ -161,13 +262,62 @@ func (s *Server) HandleIndex(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(time.Now().Local().Format(time.RFC3339)))
 }
 
+// HandleWebsocket upgrades r, with a decoy only when it carries a valid
+// AUTH_HEADER and with tlsClientCA only when it brings a client certificate.
+// Otherwise the decoy answers it, or a 403 without one.
 func (s *Server) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	// settings are bound per websocket, so a reload leaves live ones alone
+	s.ConfigLock.RLock()
+	packer, decoy := s.Packer, s.Decoy
+	s.ConfigLock.RUnlock()
+	client := s.BanList.ClientIP(r)
+	if s.BanList.Banned(client) {
+		logger.Server.Debug("ws, client banned", "remote", r.RemoteAddr, "client", client)
+		if s.Metrics != nil {
+			s.Metrics.BannedRequestsTotal.Inc()
+		}
+		if decoy != nil {
+			decoy.ServeHTTP(w, r)
+		} else {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+		}
+		return
+	}
+	authorized := s.hasClientCert(r)
+	if authorized && decoy != nil {
+		authorized = s.Auth.Verify(packer.Password, r.Header.Get(common.AUTH_HEADER), time.Now())
+	}
+	if !authorized {
+		logger.Server.Debug("ws, not authenticated", "remote", r.RemoteAddr)
+		// plain page loads of the path are not probes
+		if r.Header.Get(common.AUTH_HEADER) != "" || websocket.IsWebSocketUpgrade(r) {
+			s.AuthFailed(client)
+		}
+		if decoy != nil {
+			decoy.ServeHTTP(w, r)
+		} else {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+		}
+		return
+	}
+	if !s.enterHandler() {
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.HandlerWG.Done()
+
+	header := http.Header{}
+	if protocols := websocket.Subprotocols(r); len(protocols) > 0 {
+		// gateways in front may insist on a subprotocol, any one will do
+		header.Set("Sec-Websocket-Protocol", protocols[0])
+	}
+	conn, err := upgrader.Upgrade(w, r, header)
 	if err != nil {
-		logger.Debug.Println("ws, upgrade error", err)
+		logger.Server.Debug("ws, upgrade error", "remote", r.RemoteAddr, logger.ERR, err)
 		return
 	}
-	logger.Info.Println("ws, connected")
+	log := logger.Server.With("remote", r.RemoteAddr)
+	log.Info("ws, connected")
 	if s.Metrics != nil {
 		s.Metrics.WebSocketConnectsTotal.Inc()
 		s.Metrics.WebSocketActive.Inc()
@@ -176,9 +326,12 @@ func (s *Server) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
 	// wid, _ := common.GenerateRandomStringURLSafe(8)
 	// s.Locks.Store(wid, &Lock{})
 	lock := sync.Mutex{}
-	writer := s.NewWebsocketWriter(conn)
+	codec := &common.AtomicCodec{}
+	writer := s.NewWebsocketWriter(conn, packer, codec)
+	s.Websockets.Store(conn, struct{}{})
 
 	defer func() {
+		s.Websockets.Delete(conn)
 		s.CloseWebsocketConns(conn, writer)
 		if s.Metrics != nil {
 			s.Metrics.WebSocketActive.Dec()
@@ -186,16 +339,21 @@ func (s *Server) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
 		writer.Close()
 		conn.Close()
 	}()
+	if s.IsStopped() {
+		// Shutdown may have closed the websockets before this one was stored
+		log.Debug("ws, server is stopping")
+		return
+	}
 
 	for {
-		logger.Debug.Println("ws, wait read")
+		log.Debug("ws, wait read")
 		// conn.SetReadDeadline(time.Now().Add(time.Second * READ_TIMEOUT))
 		mt, data, err := conn.ReadMessage()
 		if err != nil {
 			if s.Metrics != nil {
 				s.Metrics.WebSocketReadErrors.Inc()
 			}
-			logger.Debug.Println("ws, read error", err)
+			log.Debug("ws, read error", logger.ERR, err)
 			return
 		}
 
@@ -203,9 +361,14 @@ func (s *Server) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 
-		msg, err := s.Packer.Unpack(data)
+		msg, err := packer.Unpack(data)
 		if err != nil {
-			logger.Debug.Println("ws, unpack error", err)
+			log.Debug("ws, unpack error", logger.ERR, err)
+			s.AuthFailed(client)
+			if decoy != nil {
+				// dropping at once would tell a probe its frame was looked at
+				drainWebsocket(conn)
+			}
 			return
 		}
 		if s.Metrics != nil {
@@ -213,12 +376,14 @@ func (s *Server) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
 			s.Metrics.PayloadBytesInTotal.Add(int64(len(msg.Data)))
 		}
 
-		logger.Debug.Println(msg.Cid, "ws, read", msg.Cmd, len(msg.Data))
+		log.Debug("ws, read", logger.CID, msg.Cid, logger.WID, msg.Wid, "cmd", msg.Cmd, "bytes", len(msg.Data))
 		handle := &Handle{
+			Remote:   r.RemoteAddr,
 			WSConn:   conn,
 			Msg:      msg,
 			WSLock:   &lock,
 			WSWriter: writer,
+			Codec:    codec,
 		}
 
 		switch msg.Cmd {
@@ -231,12 +396,40 @@ func (s *Server) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
 		case common.SWITCH:
 			s.HandleSwitch(handle)
 		default:
-			logger.Warn.Println("ws, ", msg.Cmd, "not implemented")
+			log.Warn("ws, not implemented", "cmd", msg.Cmd)
 		}
 
 	}
 }
 
+// AgreeCodec picks the codec of the websocket of handle from the offer in a
+// CONNECT, the ack tells it back. Older locals offer nothing and get none.
+func (s *Server) AgreeCodec(handle *Handle, offer string) common.Codec {
+	s.ConfigLock.RLock()
+	codec := common.NegotiateCodec(offer, s.AcceptCodecs)
+	s.ConfigLock.RUnlock()
+	if handle.Codec != nil {
+		handle.Codec.Store(codec)
+	}
+	return codec
+}
+
+// AuthFailed counts a failed authentication of client and bans it once it
+// failed too often.
+func (s *Server) AuthFailed(client netip.Addr) {
+	if s.Metrics != nil {
+		s.Metrics.AuthFailuresTotal.Inc()
+	}
+	duration := s.BanList.Fail(client)
+	if duration <= 0 {
+		return
+	}
+	logger.Server.Warn("ban, client banned", "client", client, "duration", duration)
+	if err := s.BanList.Save(); err != nil {
+		logger.Server.Error("ban, save error", logger.ERR, err)
+	}
+}
+
 func (s *Server) CloseWebsocketConns(wsconn *websocket.Conn, writer *common.FairMessageWriter) {
 	s.Conns.Range(func(key, value any) bool {
 		conn := value.(*Conn)
@@ -245,6 +438,8 @@ func (s *Server) CloseWebsocketConns(wsconn *websocket.Conn, writer *common.Fair
 			return true
 		}
 
+		// set before anything closes, the access log is written on release
+		conn.CloseReason.Set("websocket closed")
 		if conn.Relay != nil {
 			msg := &common.Message{
 				Cmd:     common.CLOSE,
@@ -254,12 +449,13 @@ func (s *Server) CloseWebsocketConns(wsconn *websocket.Conn, writer *common.Fair
 				Address: conn.Address,
 			}
 			if err := conn.Relay.WriteMessage(msg); err != nil {
-				logger.Debug.Println(conn.Cid, "ws close, relay close write error", err)
+				conn.Logger().Debug("ws close, relay close write error", logger.ERR, err)
 			}
 			conn.ReleaseRelay()
 		} else if conn.NetConn != nil {
 			conn.NetConn.Close()
 		}
+		conn.Slot.Release()
 		s.Conns.Delete(key)
 		return true
 	})
@@ -280,8 +476,9 @@ func (s *Server) CloseRelayConns(relay *RelayClient) {
 			Address: conn.Address,
 		}
 		if err := s.SendWebosket(conn, msg); err != nil {
-			logger.Debug.Println(conn.Cid, "relay close, upstream close write error", err)
+			conn.Logger().Debug("relay close, upstream close write error", logger.ERR, err)
 		}
+		conn.CloseReason.Set("relay closed")
 		conn.ReleaseRelay()
 		s.Conns.Delete(key)
 		return true
@@ -289,13 +486,30 @@ func (s *Server) CloseRelayConns(relay *RelayClient) {
 }
 
 func (s *Server) HandleConnect(handle *Handle) {
+	if s.IsStopped() {
+		s.RejectConnect(handle, "server is shutting down")
+		return
+	}
+	user := common.ParseConnectRequest(handle.Msg.Msg).User
+	if s.Usage.Exceeded(user) {
+		s.RejectConnect(handle, "traffic quota of user "+cmp.Or(user, common.ANONYMOUS_USER)+" exceeded")
+		return
+	}
+	slot, reason := s.Quota.Acquire(handle.WSWriter, user)
+	if reason != "" {
+		s.RejectConnect(handle, reason)
+		return
+	}
 	if s.HasNextRelay() {
-		s.HandleRelayConnect(handle)
+		s.HandleRelayConnect(handle, slot)
 		return
 	}
 
 	msg := handle.Msg
 	cid := msg.Cid
+	req := common.ParseConnectRequest(msg.Msg)
+	parent, _ := common.ParseTraceParent(req.TraceParent)
+	span := s.Tracer.Start(parent, common.HOP_EXIT, cid, msg.Address)
 	conn := Conn{
 		Cid:      cid,
 		Wid:      msg.Wid,
@@ -304,38 +518,85 @@ func (s *Server) HandleConnect(handle *Handle) {
 		WSConn:   handle.WSConn,
 		WSLock:   handle.WSLock,
 		WSWriter: handle.WSWriter,
+		Client:   handle.Remote,
+		User:     req.User,
+		OpenedAt: time.Now(),
+		Codec:    s.AgreeCodec(handle, req.Compress),
+		Throttle: s.Throttle.Stream(req.User),
+		Slot:     slot,
+		Log:      userLogger(connLogger(logger.Server, msg), req.User).With(logger.TRACE, span.Context().TraceID),
 	}
 
-	logger.Debug.Println(cid, "connect, open connection", msg.Network, msg.Address)
+	conn.Log.Debug("connect, open connection", "network", msg.Network)
 	if s.Metrics != nil {
 		s.Metrics.ConnectAttemptsTotal.Inc()
 	}
 
-	dialer := s.Dialer()
-
-	remote, err := dialer.Dial(msg.Network, msg.Address)
+	remote, err := s.DialTarget(msg.Network, msg.Address)
+	span.Mark("dial")
 	if err != nil {
 		if s.Metrics != nil {
 			s.Metrics.ConnectFailuresTotal.Inc()
 		}
 		msg.Ok = false
 		msg.Msg = err.Error()
-		logger.Error.Println(cid, "connect, failed", err)
+		if denied := (*common.DeniedError)(nil); errors.As(err, &denied) {
+			if s.Metrics != nil {
+				s.Metrics.ConnectDeniedTotal.Inc()
+			}
+			msg.Msg = denied.Error()
+			conn.Log.Warn("connect, destination denied", "reason", denied.Reason, "resolved", denied.Address)
+		} else {
+			conn.Log.Error("connect, failed", logger.ERR, err)
+		}
 		s.SendWebosket(&conn, msg)
+		slot.Release()
+		conn.CloseReason.Set("dial failed: " + err.Error())
+		span.Finish(conn.CloseReason.Get(""))
+		s.WriteAccess(&conn, "exit")
 		return
 	}
 
-	logger.Debug.Println(cid, "connect, send ok")
+	conn.Log.Debug("connect, send ok")
 	conn.NetConn = remote
+	conn.StartedAt = time.Now()
+	conn.LastActive.Store(conn.StartedAt.UnixNano())
+	info := &common.ConnectInfo{
+		Resolved: remote.RemoteAddr().String(),
+		Elapsed:  []float64{common.ElapsedMillis(time.Since(conn.OpenedAt))},
+		Codec:    conn.Codec.String(),
+	}
+	conn.Info.Store(info)
 	s.Conns.Store(cid, &conn)
 	msg.Ok = true
+	msg.Msg = info.String()
 	err = s.SendWebosket(&conn, msg)
+	span.Mark("ack")
 	if err != nil {
+		span.Finish("ack write error: " + err.Error())
 		return
 	}
+	span.Finish("")
 
+	s.StreamUsers.Remember(cid, req.User)
+	s.startUploads(&conn)
 	go s.RunLoop(&conn)
-	logger.Debug.Println(cid, "connect, done")
+	conn.Log.Debug("connect, done")
+}
+
+// RejectConnect answers a CONNECT with Ok=false and reason without opening anything.
+func (s *Server) RejectConnect(handle *Handle, reason string) {
+	msg := handle.Msg
+	connLogger(logger.Server, msg).Debug("connect, rejected", "reason", reason)
+	hop := common.HOP_EXIT
+	if s.HasNextRelay() {
+		hop = common.HOP_RELAY
+	}
+	parent, _ := common.ParseTraceParent(common.ParseConnectRequest(msg.Msg).TraceParent)
+	s.Tracer.Start(parent, hop, msg.Cid, msg.Address).Finish("rejected: " + reason)
+	msg.Ok = false
+	msg.Msg = reason
+	s.SendWebosket(&Conn{Cid: msg.Cid, Wid: msg.Wid, Network: msg.Network, Address: msg.Address, WSConn: handle.WSConn, WSLock: handle.WSLock, WSWriter: handle.WSWriter}, msg)
 }
 
 func (s *Server) incrementWSCounter(wid string) int {
@@ -367,15 +628,25 @@ func (s *Server) decrementWSCounter(wid string) int {
 
 func (s *Server) RunLoop(conn *Conn) {
 	// TODO: debug this, the loop is broken
-	logger.Debug.Println(conn.Cid, "loop, start")
+	log := conn.Logger()
+	log.Debug("loop, start")
 	defer func() {
-		logger.Debug.Println(conn.Cid, "loop, quit")
+		log.Debug("loop, quit")
 		conn.NetConn.Close()
+		if conn.Done != nil {
+			close(conn.Done)
+		}
 		s.Conns.Delete(conn.Cid)
+		conn.Slot.Release()
+		if s.Metrics != nil {
+			s.Metrics.StreamLifetime.Since(conn.StartedAt)
+		}
+		s.AccountTraffic(conn, true)
+		s.WriteAccess(conn, "exit")
 
 		// recalculate wscounter
 		n := s.decrementWSCounter(conn.Wid)
-		logger.Debug.Println(conn.Wid, "current num of NetConns", n)
+		log.Debug("loop, current num of NetConns", "conns", n)
 	}()
 
 	// calculate wscounter
@@ -383,12 +654,21 @@ func (s *Server) RunLoop(conn *Conn) {
 
 	buf := make([]byte, BUFFER_SIZE)
 	for {
-		logger.Debug.Println(conn.Cid, "loop, wait read")
+		log.Debug("loop, wait read")
 
 		conn.NetConn.SetReadDeadline(time.Now().Add(TARGET_IDLE_TIMEOUT))
 		nr, err := conn.NetConn.Read(buf)
 		if err != nil {
-			logger.Debug.Println(conn.Cid, "loop, read error", err)
+			log.Debug("loop, read error", logger.ERR, err)
+			var nerr net.Error
+			switch {
+			case errors.Is(err, io.EOF):
+				conn.CloseReason.Set("target closed")
+			case errors.As(err, &nerr) && nerr.Timeout():
+				conn.CloseReason.Set("idle timeout")
+			default:
+				conn.CloseReason.Set("target read error")
+			}
 			if _, ok := s.Conns.Load(conn.Cid); ok {
 				s.SendWebosket(conn, &common.Message{
 					Cmd:     common.CLOSE,
@@ -414,17 +694,21 @@ func (s *Server) RunLoop(conn *Conn) {
 			Network: conn.Network,
 			Address: conn.Address,
 		}
+		conn.Throttle.Wait(false, nr, s.DoneChan())
 		// DO NOT return on error here, the wsconn will be switched to recover
+		conn.Touch(false, nr)
 		s.SendWebosket(conn, msg)
 
 		if cmd == common.CLOSE {
+			conn.CloseReason.Set("target closed")
 			return
 		}
 	}
 }
 
 func (s *Server) HandleData(handle *Handle) {
-	if s.HasNextRelay() {
+	// streams stay on the path they were opened on, even if a reload changed it
+	if value, ok := s.Conns.Load(handle.Msg.Cid); ok && value.(*Conn).Relay != nil || !ok && s.HasNextRelay() {
 		s.HandleRelayData(handle)
 		return
 	}
@@ -442,51 +726,138 @@ func (s *Server) HandleData(handle *Handle) {
 	var conn *Conn
 	value, ok := s.Conns.Load(cid)
 	if !ok {
-		logger.Debug.Println("data,", cid, "not found")
-		logger.Debug.Println(cid, "reconnect, open connection", msg.Network, msg.Address)
+		// the stream keeps its user, so its quotas and limits still apply
+		user := s.StreamUsers.Lookup(cid)
+		log := userLogger(connLogger(logger.Server, msg), user)
+		log.Debug("data, not found")
+		log.Debug("reconnect, open connection", "network", msg.Network)
+		slot, reason := s.Quota.Acquire(handle.WSWriter, user)
+		if reason == "" && s.Usage.Exceeded(user) {
+			slot.Release()
+			reason = "traffic quota exceeded"
+		}
+		if reason != "" {
+			log.Debug("reconnect, rejected", "reason", reason)
+			s.SendWebosket(&Conn{Cid: cid, Wid: msg.Wid, Network: msg.Network, Address: msg.Address, WSConn: handle.WSConn, WSLock: handle.WSLock, WSWriter: handle.WSWriter}, cmsg)
+			return
+		}
 		if s.Metrics != nil {
 			s.Metrics.ConnectAttemptsTotal.Inc()
 		}
-		dialer := s.Dialer()
-		remote, err := dialer.Dial(msg.Network, msg.Address)
+		remote, err := s.DialTarget(msg.Network, msg.Address)
 		conn = &Conn{
-			Cid:      cid,
-			Wid:      msg.Wid,
-			WSLock:   handle.WSLock,
-			WSConn:   handle.WSConn,
-			WSWriter: handle.WSWriter,
-			NetConn:  remote,
-			Network:  msg.Network,
-			Address:  msg.Address,
+			Cid:       cid,
+			Wid:       msg.Wid,
+			WSLock:    handle.WSLock,
+			WSConn:    handle.WSConn,
+			WSWriter:  handle.WSWriter,
+			NetConn:   remote,
+			Network:   msg.Network,
+			Address:   msg.Address,
+			Client:    handle.Remote,
+			User:      user,
+			OpenedAt:  time.Now(),
+			StartedAt: time.Now(),
+			Throttle:  s.Throttle.Stream(user),
+			Slot:      slot,
+			Log:       log,
 		}
+		conn.LastActive.Store(conn.StartedAt.UnixNano())
 		if err != nil {
 			if s.Metrics != nil {
 				s.Metrics.ConnectFailuresTotal.Inc()
+				if errors.As(err, new(*common.DeniedError)) {
+					s.Metrics.ConnectDeniedTotal.Inc()
+				}
 			}
-			logger.Error.Println(cid, "reconnect, failed", err)
+			log.Error("reconnect, failed", logger.ERR, err)
 			s.SendWebosket(conn, cmsg)
+			slot.Release()
+			conn.CloseReason.Set("dial failed: " + err.Error())
+			s.WriteAccess(conn, "exit")
 			return
 		}
+		info := &common.ConnectInfo{Resolved: remote.RemoteAddr().String()}
+		conn.Info.Store(info)
 		s.Conns.Store(cid, conn)
+		s.StreamUsers.Remember(cid, user)
+		s.startUploads(conn)
 		go s.RunLoop(conn)
 	} else {
 		conn = value.(*Conn)
 	}
 
-	logger.Debug.Println(cid, "data, send ===> website", len(msg.Data))
-	_, err := conn.NetConn.Write(msg.Data)
-	if err != nil {
-		logger.Debug.Println(cid, "data, write error", err)
-		conn.NetConn.Close()
-		s.Conns.Delete(cid)
-		s.SendWebosket(conn, cmsg)
+	if len(msg.Data) == 0 {
+		return
+	}
+	conn.Logger().Debug("data, queue ===> website", "bytes", len(msg.Data))
+	conn.queueUpload(msg.Data)
+}
+
+// queueUpload hands data to the uploads of an exit stream, a full queue holds
+// the caller until the target takes more or the stream ends.
+func (c *Conn) queueUpload(data []byte) {
+	select {
+	case c.Uploads <- data:
+		return
+	default:
+	}
+	c.Logger().Debug("data, upload queue full")
+	select {
+	case c.Uploads <- data:
+	case <-c.Done:
+	}
+}
+
+// startUploads makes the upload queue of an exit stream and writes it to the
+// target from a goroutine of its own, so pacing or a slow target only holds
+// that stream.
+func (s *Server) startUploads(conn *Conn) {
+	conn.Uploads = make(chan []byte, UPLOAD_QUEUE_LIMIT)
+	conn.Done = make(chan struct{})
+	go s.RunUploads(conn)
+}
+
+// RunUploads writes the queued uploads of conn to the target until the
+// stream ends, a nil upload closes the target after the ones before it.
+func (s *Server) RunUploads(conn *Conn) {
+	for {
+		var data []byte
+		select {
+		case data = <-conn.Uploads:
+		case <-conn.Done:
+			return
+		}
+		if data == nil {
+			conn.NetConn.Close()
+			return
+		}
+		conn.Throttle.Wait(true, len(data), conn.Done)
+		conn.Touch(true, len(data))
+		if _, err := conn.NetConn.Write(data); err != nil {
+			conn.Logger().Debug("data, write error", logger.ERR, err)
+			conn.CloseReason.Set("target write error")
+			conn.NetConn.Close()
+			if s.Conns.CompareAndDelete(conn.Cid, conn) {
+				s.SendWebosket(conn, &common.Message{Cmd: common.CLOSE, Cid: conn.Cid, Wid: conn.Wid, Network: conn.Network, Address: conn.Address})
+			}
+			return
+		}
 	}
 }
 
+// closeTarget closes the target of an exit stream once its queued uploads
+// are written.
+func (c *Conn) closeTarget() {
+	c.queueUpload(nil)
+}
+
 func (s *Server) HandleClose(handle *Handle) {
+	s.StreamUsers.Forget(handle.Msg.Cid)
 	value, ok := s.Conns.Load(handle.Msg.Cid)
 	if ok {
 		conn := value.(*Conn)
+		conn.CloseReason.Set("client closed")
 		if conn.Relay != nil {
 			msg := *handle.Msg
 			msg.Wid = conn.Relay.Wid
@@ -495,7 +866,7 @@ func (s *Server) HandleClose(handle *Handle) {
 			s.Conns.Delete(handle.Msg.Cid)
 			return
 		}
-		conn.NetConn.Close()
+		conn.closeTarget()
 		s.Conns.Delete(handle.Msg.Cid)
 	}
 }
@@ -526,11 +897,11 @@ func (s *Server) HandleSwitch(handle *Handle) {
 	for writer := range oldWriters {
 		writer.Close()
 	}
-	logger.Info.Println(wid, "switched", count, "of", total)
+	logger.Server.Info("switch, done", logger.WID, wid, "switched", count, "total", total)
 }
 
 func (s *Server) SendWebosket(conn *Conn, msg *common.Message) error {
 	_, writer := conn.Transport()
-	logger.Debug.Println(msg.Cid, "send ===> websocket", msg.Cmd, len(msg.Data))
+	conn.Logger().Debug("send ===> websocket", "cmd", msg.Cmd, "bytes", len(msg.Data))
 	return s.writeWebsocket(writer, msg)
 }
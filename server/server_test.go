@@ -1,10 +1,41 @@
 package server
 
 import (
+	"bytes"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
 	"sync"
 	"testing"
+	"time"
+
+	"github.com/observerss/detour2/common"
+
+	"github.com/gorilla/websocket"
 )
 
+func newServer(t testing.TB, sconf *common.ServerConfig) *Server {
+	t.Helper()
+	server, err := NewServer(sconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func TestNewServerReturnsEveryConfigError(t *testing.T) {
+	_, err := NewServer(&common.ServerConfig{
+		Listen:          "tcp://127.0.0.1:0",
+		Password:        "pass123",
+		Compress:        "brotli",
+		RateLimitConfig: common.RateLimitConfig{RateLimit: "fast"},
+	})
+	if err == nil || !strings.Contains(err.Error(), "compress:") || !strings.Contains(err.Error(), "ratelimit:") {
+		t.Fatalf("expected compress and ratelimit errors, got %v", err)
+	}
+}
+
 func TestWSCounterConcurrentAccess(t *testing.T) {
 	server := &Server{WSCounter: make(map[string]int)}
 	var wg sync.WaitGroup
@@ -25,3 +56,176 @@ func TestWSCounterConcurrentAccess(t *testing.T) {
 		t.Fatalf("unexpected websocket counter: %d", got)
 	}
 }
+
+func TestThrottledUploadDoesNotHoldWebsocket(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	received := make(chan int, 16)
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				buf := make([]byte, 4096)
+				for {
+					n, err := conn.Read(buf)
+					if err != nil {
+						return
+					}
+					received <- n
+				}
+			}()
+		}
+	}()
+	server := newServer(t, &common.ServerConfig{
+		Listen:          "tcp://127.0.0.1:0",
+		Password:        "pass123",
+		ACLConfig:       common.ACLConfig{AllowPrivateDestinations: true},
+		RateLimitConfig: common.RateLimitConfig{StreamRateLimit: "2K"},
+	})
+	writer := common.NewFairMessageWriter(func(*common.Message) error { return nil }, common.DefaultMessageQueueLimit)
+	defer writer.Close()
+	message := func(cid string, data []byte) *Handle {
+		return &Handle{WSWriter: writer, Msg: &common.Message{Cid: cid, Wid: "wid", Network: "tcp", Address: target.Addr().String(), Data: data}}
+	}
+	server.HandleConnect(message("slow", nil))
+	server.HandleConnect(message("other", nil))
+	defer server.CloseWebsocketConns(nil, writer)
+
+	start := time.Now()
+	for range 4 {
+		server.HandleData(message("slow", make([]byte, 1024)))
+	}
+	server.HandleData(message("other", []byte("x")))
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Fatalf("reading the websocket was held for %v", elapsed)
+	}
+	total := 0
+	deadline := time.After(5 * time.Second)
+	for total < 4*1024+1 {
+		select {
+		case n := <-received:
+			total += n
+		case <-deadline:
+			t.Fatalf("only %d bytes reached the targets", total)
+		}
+	}
+}
+
+func TestPacedUploadOverTheQueueArrivesWhole(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	received := make(chan int64, 1)
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		n, _ := io.Copy(io.Discard, conn)
+		received <- n
+	}()
+	server := newServer(t, &common.ServerConfig{
+		Listen:          "tcp://127.0.0.1:0",
+		Password:        "pass123",
+		ACLConfig:       common.ACLConfig{AllowPrivateDestinations: true},
+		RateLimitConfig: common.RateLimitConfig{StreamRateLimit: "32K"},
+	})
+	writer := common.NewFairMessageWriter(func(*common.Message) error { return nil }, common.DefaultMessageQueueLimit)
+	defer writer.Close()
+	message := func(cmd common.CMD, data []byte) *Handle {
+		return &Handle{WSWriter: writer, Msg: &common.Message{Cmd: cmd, Cid: "cid", Wid: "wid", Network: "tcp", Address: target.Addr().String(), Data: data}}
+	}
+	server.HandleConnect(message(common.CONNECT, nil))
+	defer server.CloseWebsocketConns(nil, writer)
+
+	const messages = 2 * UPLOAD_QUEUE_LIMIT
+	for range messages {
+		server.HandleData(message(common.DATA, make([]byte, 512)))
+	}
+	if _, ok := server.Conns.Load("cid"); !ok {
+		t.Fatal("the stream was closed while its uploads queued")
+	}
+	server.HandleClose(message(common.CLOSE, nil))
+	select {
+	case n := <-received:
+		if n != messages*512 {
+			t.Fatalf("%d of %d bytes reached the target", n, messages*512)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the uploads did not reach the target")
+	}
+}
+
+func TestCodecIsAgreedInConnect(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	payload := bytes.Repeat([]byte("compressible payload "), 256)
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write(payload)
+		io.Copy(io.Discard, conn)
+	}()
+	server := newServer(t, &common.ServerConfig{
+		Listen:    "tcp://127.0.0.1:0",
+		Password:  "pass123",
+		ACLConfig: common.ACLConfig{AllowPrivateDestinations: true},
+	})
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for name := range resp.Header {
+		if strings.HasPrefix(name, "X-Detour") {
+			t.Fatalf("the handshake answered %s", name)
+		}
+	}
+	packer := &common.Packer{Password: "pass123"}
+	data, _ := packer.Pack(&common.Message{Cmd: common.CONNECT, Cid: "cid", Wid: "wid", Network: "tcp", Address: target.Addr().String(),
+		Msg: common.ConnectRequest{Compress: "lz4,snappy"}.String()})
+	if err := conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	received := []byte{}
+	for len(received) < len(payload) {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := packer.Unpack(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch msg.Cmd {
+		case common.CONNECT:
+			if info := common.ParseConnectInfo(msg.Msg); !msg.Ok || info.Codec != "snappy" {
+				t.Fatalf("unexpected ack: %+v", msg)
+			}
+		case common.DATA:
+			received = append(received, msg.Data...)
+		}
+	}
+	if !bytes.Equal(received, payload) || server.Metrics.Snapshot().CompressedMessagesTotal == 0 {
+		t.Fatalf("the download was not compressed with the agreed codec: %d bytes, %+v", len(received), server.Metrics.Snapshot())
+	}
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/observerss/detour2/common"
+	"github.com/observerss/detour2/logger"
+)
+
+const (
+	// TLS_RELOAD_CHECK is how often handshakes look at the cert and key files.
+	TLS_RELOAD_CHECK     = 5 * time.Second
+	SELF_SIGNED_VALIDITY = 365 * 24 * time.Hour
+)
+
+// CertReloader serves a certificate pair from files and loads it again once
+// either file changes, a pair that fails to load keeps the old one in use.
+type CertReloader struct {
+	lock     sync.Mutex
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	modTime  time.Time // of the newer file when loaded
+	checked  time.Time
+}
+
+func NewCertReloader(certFile string, keyFile string) (*CertReloader, error) {
+	c := &CertReloader{}
+	return c, c.SetFiles(certFile, keyFile)
+}
+
+func filesModTime(paths ...string) (time.Time, error) {
+	latest := time.Time{}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// certPair is a cert and key loaded from their files but not served yet.
+type certPair struct {
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	modTime  time.Time
+}
+
+func loadCertPair(certFile string, keyFile string) (*certPair, error) {
+	certFile, keyFile = strings.TrimSpace(certFile), strings.TrimSpace(keyFile)
+	modTime, err := filesModTime(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &certPair{certFile: certFile, keyFile: keyFile, cert: &cert, modTime: modTime}, nil
+}
+
+// SetFiles loads a new pair and serves it from then on.
+func (c *CertReloader) SetFiles(certFile string, keyFile string) error {
+	pair, err := loadCertPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	c.use(pair)
+	return nil
+}
+
+func (c *CertReloader) use(pair *certPair) {
+	c.lock.Lock()
+	c.certFile, c.keyFile, c.cert = pair.certFile, pair.keyFile, pair.cert
+	c.modTime, c.checked = pair.modTime, time.Now()
+	c.lock.Unlock()
+}
+
+// Files returns the cert and key files being served.
+func (c *CertReloader) Files() (string, string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.certFile, c.keyFile
+}
+
+// GetCertificate is a tls.Config.GetCertificate.
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if now := time.Now(); now.Sub(c.checked) >= TLS_RELOAD_CHECK {
+		c.checked = now
+		modTime, err := filesModTime(c.certFile, c.keyFile)
+		if err == nil && !modTime.Equal(c.modTime) {
+			err = c.load(modTime)
+		}
+		if err != nil {
+			logger.Server.Error("tls, reload failed", "cert", c.certFile, logger.ERR, err)
+		}
+	}
+	return c.cert, nil
+}
+
+func (c *CertReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert, c.modTime = &cert, modTime
+	logger.Server.Info("tls, certificate reloaded", "cert", c.certFile)
+	return nil
+}
+
+// NewSelfSigned makes an ECDSA certificate for hosts, also usable as its own
+// CA so a test client can present it too.
+func NewSelfSigned(hosts []string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "detour2 self-signed"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(SELF_SIGNED_VALIDITY),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if host != "" {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// CertFingerprint is the hex SHA-256 of the DER of cert.
+func CertFingerprint(cert tls.Certificate) string {
+	sum := sha256.Sum256(cert.Certificate[0])
+	return hex.EncodeToString(sum[:])
+}
+
+// NewTLSConfig returns the tls.Config of the listener at address, nil when
+// conf does not enable TLS. Client certificates are verified when given and
+// required by HandleWebsocket, so a decoy can still answer those without.
+func NewTLSConfig(conf common.TLSConfig, address string) (*tls.Config, *CertReloader, error) {
+	if !conf.Enabled() {
+		return nil, nil, nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12, NextProtos: []string{"http/1.1"}}
+	var certs *CertReloader
+	if conf.TLSSelfSigned {
+		hosts := []string{"localhost", "127.0.0.1", "::1"}
+		if host, _, err := net.SplitHostPort(address); err == nil && host != "" && !net.ParseIP(host).IsUnspecified() {
+			hosts = append(hosts, host)
+		}
+		cert, err := NewSelfSigned(hosts)
+		if err != nil {
+			return nil, nil, fmt.Errorf("tlsSelfSigned: %w", err)
+		}
+		logger.Server.Warn("tls, using a self-signed certificate", "sha256", CertFingerprint(cert), "pin", common.PIN_PREFIX+common.CertPin(cert.Leaf))
+		config.Certificates = []tls.Certificate{cert}
+	} else {
+		reloader, err := NewCertReloader(conf.TLSCert, conf.TLSKey)
+		if err != nil {
+			return nil, nil, fmt.Errorf("tlsCert: %w", err)
+		}
+		certs = reloader
+		config.GetCertificate = reloader.GetCertificate
+	}
+	if path := strings.TrimSpace(conf.TLSClientCA); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("tlsClientCA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, nil, fmt.Errorf("tlsClientCA: no certificates in %s", path)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, certs, nil
+}
+
+// hasClientCert reports whether r brings the client certificate the
+// listener asks for, always true without tlsClientCA.
+func (s *Server) hasClientCert(r *http.Request) bool {
+	if s.TLS == nil || s.TLS.ClientCAs == nil {
+		return true
+	}
+	return r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+}
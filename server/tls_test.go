@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/observerss/detour2/common"
+
+	"github.com/gorilla/websocket"
+)
+
+func writePair(t *testing.T, dir string, cert tls.Certificate) (string, string) {
+	t.Helper()
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func startTLSServer(t *testing.T, conf common.TLSConfig) *Server {
+	t.Helper()
+	server := newServer(t, &common.ServerConfig{Listen: "tcp://127.0.0.1:0", Password: "pass123", TLSConfig: conf})
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	})
+	return server
+}
+
+func dialTLS(server *Server, config *tls.Config) (*http.Response, error) {
+	dialer := websocket.Dialer{TLSClientConfig: config, HandshakeTimeout: time.Second}
+	conn, resp, err := dialer.Dial("wss://"+server.Addr().String()+"/ws", nil)
+	if err == nil {
+		conn.Close()
+	}
+	return resp, err
+}
+
+func trusting(cert tls.Certificate) *tls.Config {
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+	return &tls.Config{RootCAs: pool}
+}
+
+func TestServerServesTLSAndReloadsCert(t *testing.T) {
+	dir := t.TempDir()
+	first, err := NewSelfSigned([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := writePair(t, dir, first)
+	server := startTLSServer(t, common.TLSConfig{TLSCert: certFile, TLSKey: keyFile})
+
+	if _, err := dialTLS(server, trusting(first)); err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := NewSelfSigned([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePair(t, dir, second)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	server.Certs.lock.Lock()
+	server.Certs.checked = time.Time{}
+	server.Certs.lock.Unlock()
+	if _, err := dialTLS(server, trusting(second)); err != nil {
+		t.Fatalf("new certificate not served: %v", err)
+	}
+}
+
+func TestServerRequiresClientCert(t *testing.T) {
+	client, err := NewSelfSigned([]string{"client"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile, _ := writePair(t, t.TempDir(), client)
+	server := startTLSServer(t, common.TLSConfig{TLSSelfSigned: true, TLSClientCA: caFile})
+
+	resp, err := dialTLS(server, &tls.Config{InsecureSkipVerify: true})
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("websocket without a client certificate accepted: %v %+v", err, resp)
+	}
+	if _, err := dialTLS(server, &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{client}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRelayClientPinsNextRelay(t *testing.T) {
+	next := startTLSServer(t, common.TLSConfig{TLSSelfSigned: true})
+	url := "wss://" + next.Addr().String() + "/ws"
+	pin := common.CertPin(next.TLS.Certificates[0].Leaf)
+
+	for _, tc := range []struct {
+		remote common.RemoteConfig
+		ok     bool
+	}{
+		{common.RemoteConfig{}, false},
+		{common.RemoteConfig{Insecure: true, Pins: []string{"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="}}, false},
+		{common.RemoteConfig{Insecure: true, Pins: []string{pin}}, true},
+	} {
+		server := newServer(t, &common.ServerConfig{
+			Listen:        "tcp://127.0.0.1:0",
+			Password:      "pass123",
+			RemoteOptions: common.RemoteOptions{url: tc.remote},
+		})
+		relay := NewRelayClient(url, "relay-wid", server)
+		err := relay.Connect()
+		if (err == nil) != tc.ok {
+			t.Fatalf("%+v: connect error %v, want ok %v", tc.remote, err, tc.ok)
+		}
+		if err == nil {
+			relay.WSConn.Close()
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"time"
+
+	"github.com/observerss/detour2/common"
+	"github.com/observerss/detour2/logger"
+)
+
+// AccountTraffic adds the bytes moved by conn since the last call to the
+// traffic table, streams are counted when finished.
+func (s *Server) AccountTraffic(conn *Conn, finished bool) {
+	if s == nil || conn.StartedAt.IsZero() {
+		return
+	}
+	up, down := conn.TrafficCursor.Advance(conn.BytesUp.Load(), conn.BytesDown.Load())
+	s.Traffic.Add(conn.Address, conn.User, up, down, finished)
+	s.Usage.Add(conn.User, up, down)
+}
+
+// RunTraffic samples live streams into the traffic table and flushes it to
+// the traffic log every TRAFFIC_FLUSH_INTERVAL until the server stops.
+func (s *Server) RunTraffic() {
+	ticker := time.NewTicker(common.TRAFFIC_FLUSH_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.DoneChan():
+			s.FlushTraffic()
+			return
+		}
+		s.FlushTraffic()
+	}
+}
+
+// RunUsage samples live streams into the usage ledger, closes the streams of
+// users over quota when configured, saves the ledger and prunes StreamUsers
+// every USAGE_SAVE_INTERVAL until the server stops, Shutdown saves it last.
+func (s *Server) RunUsage() {
+	ticker := time.NewTicker(common.USAGE_SAVE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.DoneChan():
+			return
+		}
+		s.CheckUsage()
+		s.StreamUsers.Prune(time.Now(), func(cid string) bool {
+			_, ok := s.Conns.Load(cid)
+			return ok
+		})
+	}
+}
+
+func (s *Server) CheckUsage() {
+	closeStreams := s.Usage.CloseStreams()
+	s.Conns.Range(func(_, value any) bool {
+		conn := value.(*Conn)
+		s.AccountTraffic(conn, false)
+		if closeStreams && s.Usage.Exceeded(conn.User) {
+			s.closeConn(conn, "traffic quota exceeded")
+		}
+		return true
+	})
+	if err := s.Usage.Save(); err != nil {
+		logger.Server.Error("usage, save error", logger.ERR, err)
+	}
+}
+
+func (s *Server) FlushTraffic() {
+	s.Conns.Range(func(_, value any) bool {
+		s.AccountTraffic(value.(*Conn), false)
+		return true
+	})
+	if err := s.Traffic.Flush(); err != nil {
+		logger.Server.Error("traffic, flush error", logger.ERR, err)
+	}
+}
+
+// WriteAccess appends the access record of a finished stream, side is exit
+// or relay.
+func (s *Server) WriteAccess(conn *Conn, side string) {
+	if s == nil || s.Access == nil {
+		return
+	}
+	record := common.AccessRecord{
+		Start:     conn.OpenedAt,
+		End:       time.Now(),
+		Side:      side,
+		Cid:       conn.Cid,
+		Client:    conn.Client,
+		User:      conn.User,
+		Target:    conn.Address,
+		BytesUp:   conn.BytesUp.Load(),
+		BytesDown: conn.BytesDown.Load(),
+		Result:    conn.CloseReason.Get("closed"),
+	}
+	if info := conn.Info.Load(); info != nil {
+		record.Resolved = info.Resolved
+		record.Path = info.Path
+	}
+	if err := s.Access.Write(record); err != nil {
+		conn.Logger().Error("access, write error", logger.ERR, err)
+	}
+}
@@ -7,9 +7,9 @@ import (
 	"github.com/observerss/detour2/common"
 )
 
-func (s *Server) NewWebsocketWriter(conn *websocket.Conn) *common.FairMessageWriter {
-	return common.NewFairMessageWriter(func(msg *common.Message) error {
-		data, err := s.Packer.Pack(msg)
+func (s *Server) NewWebsocketWriter(conn *websocket.Conn, packer *common.Packer, codec *common.AtomicCodec) *common.FairMessageWriter {
+	writer := common.NewFairMessageWriter(func(msg *common.Message) error {
+		data, err := packer.PackWith(msg, codec.Load())
 		if err == nil {
 			err = conn.WriteMessage(websocket.BinaryMessage, data)
 		}
@@ -23,6 +23,10 @@ func (s *Server) NewWebsocketWriter(conn *websocket.Conn) *common.FairMessageWri
 		}
 		return err
 	}, common.DefaultMessageQueueLimit)
+	if s.Metrics != nil {
+		writer.QueueWait = &s.Metrics.QueueWait
+	}
+	return writer
 }
 
 func (s *Server) writeWebsocket(writer *common.FairMessageWriter, msg *common.Message) error {